@@ -0,0 +1,49 @@
+package abstract_definition
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock provides the current time to SessionManager and storage media, stamping last access times
+// and deciding expiration, so a fake clock can be advanced by hand to make sessions expire without waiting.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock returning the current time of the system, used by default.
+type SystemClock struct{}
+
+// Now is a method for SystemClock that returns the current time of the system.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ClockSetter is implemented by storage media reading the current time from a Clock,
+// SessionManager sets its own clock on its creation.
+type ClockSetter interface {
+	SetClock(clock Clock)
+}
+
+// ClockHolder holds the clock of a storage media, safe for concurrent use, it's the SystemClock until one is set.
+// Its zero value is ready to use.
+type ClockHolder struct {
+	clock atomic.Pointer[Clock]
+}
+
+// SetClock is a method for ClockHolder that replaces the held clock, a nil clock restores the SystemClock.
+func (holder *ClockHolder) SetClock(clock Clock) {
+	if clock == nil {
+		holder.clock.Store(nil)
+		return
+	}
+	holder.clock.Store(&clock)
+}
+
+// Now is a method for ClockHolder that returns the current time of the held clock.
+func (holder *ClockHolder) Now() time.Time {
+	if clock := holder.clock.Load(); clock != nil {
+		return (*clock).Now()
+	}
+	return time.Now()
+}
@@ -1,10 +1,56 @@
 package abstract_definition
 
-// Session provides the only four operations of sessions, implementing them guarantees the implementation
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidKey is an error used when a session value key is not a string.
+// Keys are restricted to strings so every storage media can serialize sessions consistently.
+var ErrInvalidKey = errors.New("wsm: session value keys must be strings")
+
+// ValidateKey is a function used by storage media to check that a session value key is supported,
+// it returns an ErrInvalidKey error if it's not a string.
+func ValidateKey(key interface{}) error {
+	if _, isString := key.(string); !isString {
+		return fmt.Errorf("%w, got %T", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+// Session provides the operations of sessions, implementing them guarantees the implementation
 // of a correct session.
+// SetExpiry overrides the maximum lifetime for a single session (e.g. "remember me" logins),
+// a zero expiry restores the maximum lifetime.
+// GetAndDelete reads and removes a value in a single atomic step (e.g. for one-time tokens), so concurrent
+// calls for the same key never both observe it.
+// GetValueOr returns the fallback instead of nil when the key has no value, sparing callers a nil check.
+// GetValueOk returns the value along with whether the key has one, telling a value set to nil from a missing key,
+// which GetValue both returns as nil.
+// Values returns a copy of all the values of the session by key, e.g. to copy them into another session.
+// DeleteValueIfExists deletes a value like DeleteValue, and reports whether the key had a value to delete.
+// CreatedAt and LastAccessedAt return when the session was created and last accessed, e.g. to show
+// "last active 5 minutes ago" or to enforce an absolute timeout.
+// Version returns the version of the session as last read or written, incremented by each of its changes,
+// so reading the same version twice means nothing changed in between.
+// CompareAndSwapValue sets the value of a key only if it still holds the old value, a missing key holding nil,
+// and reports whether it was swapped, so read-modify-write cycles of concurrent requests (e.g. incrementing
+// a counter) detect each other instead of losing one of their updates. Values are compared with
+// reflect.DeepEqual, so the old value should be the one read from the session, as decoded by its storage media.
 type Session interface {
 	SetValue(key, value interface{}) error
 	GetValue(key interface{}) interface{}
 	DeleteValue(key interface{}) error
 	GetSessionId() string
+	SetExpiry(expiry time.Duration) error
+	GetAndDelete(key interface{}) (interface{}, bool)
+	GetValueOr(key, fallback interface{}) interface{}
+	GetValueOk(key interface{}) (interface{}, bool)
+	Values() map[interface{}]interface{}
+	DeleteValueIfExists(key interface{}) (bool, error)
+	CreatedAt() time.Time
+	LastAccessedAt() time.Time
+	Version() int64
+	CompareAndSwapValue(key, old, new interface{}) (bool, error)
 }
@@ -1,18 +1,136 @@
 package abstract_definition
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"time"
 )
 
 // SessionNotExist is an error used when a session does not exist in the storage media.
 var SessionNotExist = errors.New("wsm: session does not exist")
 
+// ErrNotSupported is an error used by storage media for operations they can't perform,
+// such as listing the sessions of a store that can't be enumerated.
+var ErrNotSupported = errors.New("wsm: operation not supported by the storage media")
+
+// ErrSessionTooLarge is an error used when setting a value would make a session exceed the maximum size
+// of its storage media.
+var ErrSessionTooLarge = errors.New("wsm: session would exceed the maximum session size")
+
+// ErrInvalidScanLimit is an error used when sessions are scanned with a limit not greater than zero.
+var ErrInvalidScanLimit = errors.New("wsm: scan limit must be greater than zero")
+
+// SessionData is the full content of a session independent of any storage media,
+// used to move sessions from one storage media to another.
+// Pinned sessions are exempt from termination on expiration, and a non-zero Expiry overrides the maximum lifetime.
+// UserID is the user the session is associated with, if any.
+// CreatedAt is when the session was created, zero if unknown, e.g. for sessions stored before it was recorded.
+// Version is incremented by each change of the session, zero for sessions never changed.
+type SessionData struct {
+	Id             string
+	CreatedAt      time.Time
+	LastAccessTime time.Time
+	Values         map[interface{}]interface{}
+	Pinned         bool
+	Expiry         time.Duration
+	UserID         string
+	Version        int64
+}
+
 // StorageMedia provides a way to correctly handle a session in a provided storage media.
 // Implementing these functions guarantees correct session handling in a specified storage media type.
+// InitializeSession returns an error if the new session could not be durably stored, in which case
+// nothing of it must remain in the storage media.
+// Session IDs are always passed decoded, as generated, and storage media must store and look them up as is:
+// storage keys are never URL-escaped, escaping only happens in the cookie carrying a session ID.
+// RetrieveSessionAndTouch retrieves a session and updates its last access time in a single operation,
+// so concurrent requests of the same session can't lose the update.
+// ScanSessions returns a page of at most limit session IDs in ascending order, following the cursor,
+// and the cursor of the next page, empty once there's none: the cursor of the first page is empty.
+// It returns an ErrInvalidScanLimit error if the limit is not greater than zero.
+// Ping returns an error if the storage media can't be reached, e.g. to check it's ready before serving traffic,
+// nil for storage media having nothing to reach.
+// TerminateSessionOnExpiration returns the number of sessions it terminated, zero for storage media
+// expiring sessions by themselves, and an error if the expired sessions could not be terminated.
 type StorageMedia interface {
-	InitializeSession(sessionId string) Session
+	InitializeSession(sessionId string) (Session, error)
 	RetrieveSession(sessionId string) (Session, error)
+	RetrieveSessionAndTouch(sessionId string) (Session, error)
 	UpdateSessionLastAccess(sessionId string) error
 	DestroySession(sessionId string) error
-	TerminateSessionOnExpiration(maxLifetime int64)
+	DestroyAllSessions() error
+	TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error)
+	ListSessions() ([]string, error)
+	ScanSessions(cursor string, limit int) (ids []string, next string, err error)
+	ExportSession(sessionId string) (SessionData, error)
+	ImportSession(data SessionData) error
+	Pin(sessionId string) error
+	Unpin(sessionId string) error
+	Ping(ctx context.Context) error
+}
+
+// LifetimeSetter is implemented by storage media needing the maximum lifetime of sessions
+// when they're stored, such as those expiring sessions by themselves. SessionManager sets it on its creation.
+type LifetimeSetter interface {
+	SetMaxLifetime(maxLifetime time.Duration)
+}
+
+// UserIndex is implemented by storage media able to associate sessions with users,
+// so a user can have several sessions, e.g. one per device, listed or destroyed together.
+// UserSessionIDs returns the IDs of the sessions associated with a user.
+type UserIndex interface {
+	SetSessionUserID(sessionId, userID string) error
+	UserSessionIDs(userID string) ([]string, error)
+}
+
+// ValueIndex is implemented by storage media able to query sessions by their values, e.g. an admin page
+// listing the sessions of a role. SessionIDsByValue returns the IDs of the sessions holding the value under the key,
+// compared as encoded by encoding/json.
+type ValueIndex interface {
+	SessionIDsByValue(ctx context.Context, key string, value interface{}) ([]string, error)
+}
+
+// SizeLimiter is implemented by storage media able to limit the size of sessions, as serialized by their codec.
+// SessionManager sets it on its creation, zero meaning no limit. Setting a value that would make a session
+// exceed it fails with an ErrSessionTooLarge error, leaving the session unchanged.
+type SizeLimiter interface {
+	SetMaxSessionBytes(maxBytes int)
+}
+
+// ExpiryBatcher is implemented by storage media able to terminate expired sessions in bounded chunks,
+// so sweeping a large store doesn't lock it for long. SessionManager sets it on its creation,
+// zero meaning every expired session is terminated at once.
+type ExpiryBatcher interface {
+	SetExpiryBatchSize(batchSize int)
+}
+
+// ExpiryReporter is implemented by storage media able to report which sessions they terminate on expiration,
+// so SessionManager emits an expiry event for each of them. TerminateExpiredSessions terminates expired sessions
+// like TerminateSessionOnExpiration, and returns the IDs of the terminated sessions, along with an error
+// and the IDs of the sessions terminated before it if the expired sessions could not all be terminated.
+// Storage media wrapping another one return an ErrNotSupported error if the wrapped one can't report them.
+type ExpiryReporter interface {
+	TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error)
+}
+
+// PageSessionIds is a function used by storage media scanning sessions from all their IDs, such as those held
+// in memory, that returns the page of at most limit session IDs following the cursor among the given IDs,
+// sorted in ascending order, and the cursor of the next page, empty once there's none.
+// The cursor being the last ID of the previous page, pages never overlap, even if sessions are added or removed
+// in between. It returns an ErrInvalidScanLimit error if the limit is not greater than zero.
+func PageSessionIds(sortedIds []string, cursor string, limit int) (ids []string, next string, err error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidScanLimit
+	}
+	start := sort.SearchStrings(sortedIds, cursor)
+	if start < len(sortedIds) && sortedIds[start] == cursor {
+		start++
+	}
+	end := start + limit
+	if end >= len(sortedIds) {
+		return append([]string(nil), sortedIds[start:]...), "", nil
+	}
+	ids = append([]string(nil), sortedIds[start:end]...)
+	return ids, ids[len(ids)-1], nil
 }
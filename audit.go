@@ -0,0 +1,121 @@
+package wsm_backup
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// AuditAction is the lifecycle action of a session recorded in an audit event.
+type AuditAction string
+
+const (
+	// AuditActionCreate is recorded when a new session is initialized.
+	AuditActionCreate AuditAction = "create"
+	// AuditActionAccess is recorded when an existing session is retrieved.
+	AuditActionAccess AuditAction = "access"
+	// AuditActionDestroy is recorded when a session is destroyed, on logout or by the application.
+	AuditActionDestroy AuditAction = "destroy"
+	// AuditActionExpire is recorded when a session is terminated by the expiration.
+	AuditActionExpire AuditAction = "expire"
+)
+
+const (
+	// AuditActorApplication is the actor of the actions performed by the application outside of any request,
+	// such as CreateSession, Destroy, DestroyAllSessions and DestroySessionsForUser.
+	AuditActorApplication = "application"
+	// AuditActorExpiration is the actor of the sessions terminated by the expiration.
+	AuditActorExpiration = "expiration"
+)
+
+// AuditEvent is a single entry of the audit trail of sessions, holding who performed the action,
+// the remote address of the request it was performed by if any, the SHA-256 hash of the session ID
+// so the trail never exposes valid session IDs, the action, and when it happened.
+type AuditEvent struct {
+	Actor           string
+	RemoteAddr      string
+	HashedSessionId string
+	Action          AuditAction
+	Time            time.Time
+}
+
+// AuditSink receives the audit events of a SessionManager, it's used to keep an immutable audit trail
+// of sessions lifecycle in regulated environments. Record is called concurrently by concurrent requests.
+type AuditSink interface {
+	Record(event AuditEvent)
+}
+
+// WithAuditSink is an option that sets the sink receiving an audit event on each session creation, access,
+// destruction and expiration. By default, no audit events are recorded.
+func WithAuditSink(sink AuditSink) Option {
+	return func(manager *SessionManager) error {
+		manager.auditSink = sink
+		return nil
+	}
+}
+
+// WithAuditActor is an option that sets the function naming the actor of the audit events of requests,
+// e.g. the authenticated user or the client address forwarded by a trusted proxy, the remote address
+// of the request being used if it returns an empty actor. By default, the actor is the remote address.
+func WithAuditActor(actor func(request *http.Request) string) Option {
+	return func(manager *SessionManager) error {
+		manager.auditActor = actor
+		return nil
+	}
+}
+
+// recordAudit is a method for SessionManager used to send an audit event of an action performed by a request
+// to the audit sink if one is set. The actor is the one named by the WithAuditActor option, or the remote address.
+func (manager *SessionManager) recordAudit(request *http.Request, action AuditAction, sessionId string) {
+	if manager.auditSink == nil {
+		return
+	}
+	actor := ""
+	if manager.auditActor != nil {
+		actor = manager.auditActor(request)
+	}
+	if actor == "" {
+		actor = request.RemoteAddr
+	}
+	hashedSessionId := sha256.Sum256([]byte(sessionId))
+	manager.recordAuditEvent(actor, request.RemoteAddr, action, hashedSessionId[:])
+}
+
+// recordActorAudit is a method for SessionManager used to send an audit event of an action performed
+// without a request to the audit sink if one is set, e.g. AuditActorApplication or AuditActorExpiration.
+func (manager *SessionManager) recordActorAudit(actor string, action AuditAction, sessionId string) {
+	if manager.auditSink == nil {
+		return
+	}
+	hashedSessionId := sha256.Sum256([]byte(sessionId))
+	manager.recordAuditEvent(actor, "", action, hashedSessionId[:])
+}
+
+// recordStorageKeyAudit is a method for SessionManager used like recordActorAudit for a session known by its
+// storage key, e.g. listed or expired, which is the hash of its ID with the WithHashedStorageKeys option,
+// so its audit events carry the same hash as the ones of the requests of the session.
+func (manager *SessionManager) recordStorageKeyAudit(actor string, action AuditAction, key string) {
+	if manager.auditSink == nil {
+		return
+	}
+	if _, isHashed := manager.storageMedia.(*hashedStorage); isHashed {
+		if hashedSessionId, err := base64.RawURLEncoding.DecodeString(key); err == nil {
+			manager.recordAuditEvent(actor, "", action, hashedSessionId)
+			return
+		}
+	}
+	manager.recordActorAudit(actor, action, key)
+}
+
+// recordAuditEvent is a method for SessionManager used to send an audit event to the audit sink.
+func (manager *SessionManager) recordAuditEvent(actor, remoteAddr string, action AuditAction, hashedSessionId []byte) {
+	manager.auditSink.Record(AuditEvent{
+		Actor:           actor,
+		RemoteAddr:      remoteAddr,
+		HashedSessionId: hex.EncodeToString(hashedSessionId),
+		Action:          action,
+		Time:            manager.clock.Now(),
+	})
+}
@@ -0,0 +1,139 @@
+package wsm_backup_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/wsmtest"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink is an audit sink keeping the events it records.
+type recordingSink struct {
+	sync.Mutex
+	events []wsm.AuditEvent
+}
+
+func (sink *recordingSink) Record(event wsm.AuditEvent) {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.events = append(sink.events, event)
+}
+
+// recorded returns the events recorded so far, and forgets them.
+func (sink *recordingSink) recorded() []wsm.AuditEvent {
+	sink.Lock()
+	defer sink.Unlock()
+	events := sink.events
+	sink.events = nil
+	return events
+}
+
+// auditHash returns the hashed session ID audit events carry for a session ID.
+func auditHash(sessionId string) string {
+	hash := sha256.Sum256([]byte(sessionId))
+	return hex.EncodeToString(hash[:])
+}
+
+// assertAudited fails the test unless the events are the actions of the actor on the sessions, in any order.
+func assertAudited(t *testing.T, events []wsm.AuditEvent, actor string, action wsm.AuditAction, sessionIds ...string) {
+	t.Helper()
+	want := make(map[string]bool, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		want[auditHash(sessionId)] = true
+	}
+	if len(events) != len(sessionIds) {
+		t.Fatalf("recorded %v, want %s by %s of %d sessions", events, action, actor, len(sessionIds))
+	}
+	for _, event := range events {
+		if event.Actor != actor || event.Action != action || !want[event.HashedSessionId] {
+			t.Errorf("recorded %s by %s of %s, want %s by %s of one of %v", event.Action, event.Actor, event.HashedSessionId, action, actor, sessionIds)
+		}
+	}
+}
+
+func TestAuditEventsOfRequestsNameTheirActor(t *testing.T) {
+	sink := &recordingSink{}
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithAuditSink(sink), wsm.WithAuditActor(func(request *http.Request) string {
+		return request.Header.Get("X-User")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	started := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("X-User", "zyrx")
+	session, _, err := manager.StartSession(started, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := session.GetSessionId()
+	events := sink.recorded()
+	assertAudited(t, events, "zyrx", wsm.AuditActionCreate, sessionId)
+	if events[0].RemoteAddr != request.RemoteAddr || !events[0].Time.Equal(wsmtest.DefaultStartTime) {
+		t.Errorf("recorded the remote address %q at %v, want %q at the time of the clock", events[0].RemoteAddr, events[0].Time, request.RemoteAddr)
+	}
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), requestWithCookies(started)); err != nil {
+		t.Fatal(err)
+	}
+	assertAudited(t, sink.recorded(), request.RemoteAddr, wsm.AuditActionAccess, sessionId)
+	if _, err = manager.EndSession(httptest.NewRecorder(), requestWithCookies(started)); err != nil {
+		t.Fatal(err)
+	}
+	assertAudited(t, sink.recorded(), request.RemoteAddr, wsm.AuditActionDestroy, sessionId)
+}
+
+func TestAuditEventsOfTheApplicationAndTheExpiration(t *testing.T) {
+	for _, hashed := range []bool{false, true} {
+		sink := &recordingSink{}
+		manager, storage, err := wsmtest.NewSessionManager(wsm.WithAuditSink(sink), wsm.WithHashedStorageKeys(hashed),
+			wsm.WithMaxLifetime(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sessionIds []string
+		for i := 0; i < 5; i++ {
+			session, err := manager.CreateSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessionIds = append(sessionIds, session.GetSessionId())
+		}
+		assertAudited(t, sink.recorded(), wsm.AuditActorApplication, wsm.AuditActionCreate, sessionIds...)
+		destroyed, err := manager.LookupSession(sessionIds[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = manager.Destroy(destroyed); err != nil {
+			t.Fatal(err)
+		}
+		assertAudited(t, sink.recorded(), wsm.AuditActorApplication, wsm.AuditActionDestroy, sessionIds[0])
+		loggedOut, err := manager.LookupSession(sessionIds[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = manager.SetUserID(loggedOut, "user"); err != nil {
+			t.Fatal(err)
+		}
+		if err = manager.DestroySessionsForUser("user"); err != nil {
+			t.Fatal(err)
+		}
+		assertAudited(t, sink.recorded(), wsm.AuditActorApplication, wsm.AuditActionDestroy, sessionIds[1])
+		if err = manager.Pin(sessionIds[4]); err != nil {
+			t.Fatal(err)
+		}
+		storage.Advance(2 * time.Minute)
+		manager.SessionsExpirationRoutine()
+		assertAudited(t, sink.recorded(), wsm.AuditActorExpiration, wsm.AuditActionExpire, sessionIds[2], sessionIds[3])
+		if err = manager.DestroyAllSessions(); err != nil {
+			t.Fatal(err)
+		}
+		assertAudited(t, sink.recorded(), wsm.AuditActorApplication, wsm.AuditActionDestroy, sessionIds[4])
+		manager.Stop()
+	}
+}
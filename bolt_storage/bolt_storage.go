@@ -0,0 +1,443 @@
+// Package bolt_storage provides a storage media keeping sessions in an embedded bbolt database file,
+// persisting them across restarts without a database server, e.g. for single-binary deployments.
+package bolt_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBucketName is the bucket sessions are stored in when BoltConfig has no BucketName set.
+const DefaultBucketName = "sessions"
+
+// DefaultTimeout is how long opening waits for the lock of a database file held by another process
+// when BoltConfig has no Timeout set.
+const DefaultTimeout = time.Second
+
+// ErrNotConfigured is an error used when a BoltStorage is used before being opened with a configuration.
+var ErrNotConfigured = errors.New("wsm: bolt storage is not configured")
+
+// ErrAlreadyOpen is an error used when a BoltStorage already opened is opened again,
+// which would close the database its sessions are being used through.
+var ErrAlreadyOpen = errors.New("wsm: bolt storage is already open")
+
+// BoltConfig is the configuration of a BoltStorage.
+// Path is the database file, created if it doesn't exist, BucketName the bucket holding the sessions,
+// and Timeout how long opening waits for the lock of the file, which a single process can hold at once.
+type BoltConfig struct {
+	Path       string
+	BucketName string
+	Timeout    time.Duration
+}
+
+// BoltStorage represents a bbolt storage media type to store sessions in, a key per session ID in its bucket,
+// each session being stored as json, so values are retrieved as decoded by encoding/json.
+// Every change of a session is a read-write transaction, so concurrent requests of a session never overwrite
+// each other, and sessions are listed in ascending order of their ID, as bbolt keeps its keys sorted.
+// It must be created by NewBoltStorage, or opened by Open before being used, and closed by Close.
+type BoltStorage struct {
+	opening         sync.Mutex
+	database        *bolt.DB
+	bucketName      []byte
+	clock           abstract_definition.ClockHolder
+	maxSessionBytes atomic.Int64
+}
+
+// SetClock is a method for BoltStorage that sets the clock stamping the last access time of sessions
+// and deciding their expiration.
+func (storage *BoltStorage) SetClock(clock abstract_definition.Clock) {
+	storage.clock.SetClock(clock)
+}
+
+// Now is a method for BoltStorage that returns the current time of its clock.
+func (storage *BoltStorage) Now() time.Time {
+	return storage.clock.Now()
+}
+
+// NewBoltStorage is a function that opens the bbolt database of the configuration, creating its sessions bucket.
+// It returns an error if the configuration is invalid, or the database could not be opened.
+func NewBoltStorage(config BoltConfig) (*BoltStorage, error) {
+	storage := &BoltStorage{}
+	if err := storage.Open(config); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// Open is a method for BoltStorage that opens the bbolt database of the configuration, creating the file
+// and its sessions bucket if they don't exist.
+// It returns an ErrAlreadyOpen error if the storage is already open, and an error if the path is empty,
+// or the database could not be opened, e.g. while another process holds it.
+func (storage *BoltStorage) Open(config BoltConfig) error {
+	storage.opening.Lock()
+	defer storage.opening.Unlock()
+	if storage.database != nil {
+		return ErrAlreadyOpen
+	}
+	if config.Path == "" {
+		return errors.New("wsm: bolt database path must not be empty")
+	}
+	bucketName := config.BucketName
+	if bucketName == "" {
+		bucketName = DefaultBucketName
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	database, err := bolt.Open(config.Path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return fmt.Errorf("wsm: could not open the bolt database: %w", err)
+	}
+	err = database.Update(func(transaction *bolt.Tx) error {
+		_, err := transaction.CreateBucketIfNotExists([]byte(bucketName))
+		return err
+	})
+	if err != nil {
+		database.Close()
+		return fmt.Errorf("wsm: could not create the bolt sessions bucket: %w", err)
+	}
+	storage.database, storage.bucketName = database, []byte(bucketName)
+	return nil
+}
+
+// Close is a method for BoltStorage that closes its database, releasing the lock of its file.
+func (storage *BoltStorage) Close() error {
+	if storage.database == nil {
+		return nil
+	}
+	return storage.database.Close()
+}
+
+// view is a method for BoltStorage that runs a read-only transaction on its sessions bucket.
+// It returns an ErrNotConfigured error if the storage was not opened.
+func (storage *BoltStorage) view(function func(bucket *bolt.Bucket) error) error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	return storage.database.View(func(transaction *bolt.Tx) error {
+		return function(transaction.Bucket(storage.bucketName))
+	})
+}
+
+// update is a method for BoltStorage that runs a read-write transaction on its sessions bucket,
+// committed unless the function returns an error.
+// It returns an ErrNotConfigured error if the storage was not opened.
+func (storage *BoltStorage) update(function func(bucket *bolt.Bucket) error) error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	return storage.database.Update(func(transaction *bolt.Tx) error {
+		return function(transaction.Bucket(storage.bucketName))
+	})
+}
+
+// readSession is a function that decodes the session belonging to the given ID from the bucket,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func readSession(bucket *bolt.Bucket, sessionId string) (abstract_definition.SessionData, error) {
+	encodedData := bucket.Get([]byte(sessionId))
+	if encodedData == nil {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	data, err := stored_session.UnmarshalSessionData(encodedData)
+	if err != nil {
+		return abstract_definition.SessionData{}, fmt.Errorf("wsm: could not decode the session: %w", err)
+	}
+	return data, nil
+}
+
+// writeSession is a function that encodes a session into the bucket under its ID.
+// It returns an error if a key is not a string, or the session could not be written.
+func writeSession(bucket *bolt.Bucket, data abstract_definition.SessionData) error {
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return bucket.Put([]byte(data.Id), encodedData)
+}
+
+// SetMaxSessionBytes is a method for BoltStorage that sets the maximum size of sessions as encoded in their value,
+// zero meaning no limit.
+func (storage *BoltStorage) SetMaxSessionBytes(maxBytes int) {
+	storage.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// CheckSessionSize is a method for BoltStorage that returns an abstract_definition.ErrSessionTooLarge error
+// if the content of a session would exceed the maximum size once encoded in its value.
+func (storage *BoltStorage) CheckSessionSize(data abstract_definition.SessionData) error {
+	maxBytes := storage.maxSessionBytes.Load()
+	if maxBytes == 0 {
+		return nil
+	}
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return stored_session.CheckSize(len(encodedData), maxBytes)
+}
+
+// UpdateSession is a method for BoltStorage that reads the session belonging to the given ID,
+// applies the update to it, and writes it back in the same read-write transaction, and returns its new content.
+// It returns the error of the update without writing anything if the update fails.
+func (storage *BoltStorage) UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	var data abstract_definition.SessionData
+	err := storage.update(func(bucket *bolt.Bucket) error {
+		var err error
+		if data, err = readSession(bucket, sessionId); err != nil {
+			return err
+		}
+		if err = update(&data); err != nil {
+			return err
+		}
+		return writeSession(bucket, data)
+	})
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	return stored_session.CopySessionData(data), nil
+}
+
+// InitializeSession is a method for BoltStorage that takes a session ID argument of type string
+// creates a new session, writes it in the sessions bucket, and then return that session.
+// It returns an error if the session could not be written.
+func (storage *BoltStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	now := storage.Now()
+	data := abstract_definition.SessionData{
+		Id:             sessionId,
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values:         make(map[interface{}]interface{}),
+	}
+	err := storage.update(func(bucket *bolt.Bucket) error {
+		return writeSession(bucket, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSession is a method for BoltStorage that takes session ID of type string as an argument
+// and returns the session stored in the sessions bucket that belongs to the given ID, if it doesn't exist
+// it returns a wsm.SessionNotExists error.
+func (storage *BoltStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	var data abstract_definition.SessionData
+	err := storage.view(func(bucket *bolt.Bucket) error {
+		var err error
+		data, err = readSession(bucket, sessionId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSessionAndTouch is a method for BoltStorage that takes session ID of type string as an argument
+// and returns the session stored in the sessions bucket that belongs to the given ID, updating its last access time
+// in the same transaction, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *BoltStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	data, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// UpdateSessionLastAccess is a method for BoltStorage that updates the session's
+// last access time when it's used.
+func (storage *BoltStorage) UpdateSessionLastAccess(sessionId string) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	return err
+}
+
+// DestroySession is a method for BoltStorage that deletes a session from the sessions bucket if found,
+// otherwise it returns a wsm.SessionNotExists error.
+func (storage *BoltStorage) DestroySession(sessionId string) error {
+	return storage.update(func(bucket *bolt.Bucket) error {
+		if bucket.Get([]byte(sessionId)) == nil {
+			return abstract_definition.SessionNotExist
+		}
+		return bucket.Delete([]byte(sessionId))
+	})
+}
+
+// Ping is a method for BoltStorage that checks its database is open, in a read-only transaction.
+// It returns an ErrNotConfigured error if the storage was not opened, or an error once it's closed.
+func (storage *BoltStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.view(func(*bolt.Bucket) error {
+		return nil
+	})
+}
+
+// DestroyAllSessions is a method for BoltStorage that deletes all the sessions from the sessions bucket,
+// replacing it with an empty one in a single transaction.
+func (storage *BoltStorage) DestroyAllSessions() error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	return storage.database.Update(func(transaction *bolt.Tx) error {
+		if err := transaction.DeleteBucket(storage.bucketName); err != nil {
+			return err
+		}
+		_, err := transaction.CreateBucket(storage.bucketName)
+		return err
+	})
+}
+
+// TerminateSessionOnExpiration is a method for BoltStorage that deletes the sessions of the sessions bucket
+// that has exceeded a passed maximum lifetime parameter of type time.Duration, iterating the bucket
+// in a single read-write transaction, so a request touching a session can't be lost in between.
+// Pinned sessions are never deleted, and sessions with their own expiry use it instead of the maximum lifetime.
+// Corrupt sessions are left untouched.
+// It returns the number of deleted sessions, and an error if the sessions could not be deleted.
+func (storage *BoltStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	terminated, err := storage.TerminateExpiredSessions(maxLifetime)
+	return len(terminated), err
+}
+
+// TerminateExpiredSessions is a method for BoltStorage that deletes expired sessions of the sessions bucket
+// like TerminateSessionOnExpiration, and returns the IDs of the deleted sessions, none if the transaction failed.
+func (storage *BoltStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	now := storage.Now()
+	var expiredIds [][]byte
+	err := storage.update(func(bucket *bolt.Bucket) error {
+		err := bucket.ForEach(func(sessionId, encodedData []byte) error {
+			data, err := stored_session.UnmarshalSessionData(encodedData)
+			if err != nil || data.Pinned {
+				return nil
+			}
+			lifetime := maxLifetime
+			if data.Expiry > 0 {
+				lifetime = data.Expiry
+			}
+			if data.LastAccessTime.Add(lifetime).Before(now) {
+				expiredIds = append(expiredIds, append([]byte(nil), sessionId...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// keys are deleted once iterated, bbolt cursors skipping keys deleted under them
+		for _, sessionId := range expiredIds {
+			if err = bucket.Delete(sessionId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	terminated := make([]string, len(expiredIds))
+	for index, sessionId := range expiredIds {
+		terminated[index] = string(sessionId)
+	}
+	return terminated, nil
+}
+
+// ListSessions is a method for BoltStorage that returns the IDs of all the sessions, in ascending order.
+func (storage *BoltStorage) ListSessions() ([]string, error) {
+	var sessionIds []string
+	err := storage.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(sessionId, _ []byte) error {
+			sessionIds = append(sessionIds, string(sessionId))
+			return nil
+		})
+	})
+	return sessionIds, err
+}
+
+// ScanSessions is a method for BoltStorage that returns a page of at most limit session IDs in ascending order,
+// following the cursor, and the cursor of the next page, empty once there's none, seeking the cursor
+// in the sorted keys of the bucket rather than listing every session.
+// It returns an abstract_definition.ErrInvalidScanLimit error if the limit is not greater than zero.
+func (storage *BoltStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", abstract_definition.ErrInvalidScanLimit
+	}
+	var sessionIds []string
+	next := ""
+	err := storage.view(func(bucket *bolt.Bucket) error {
+		keys := bucket.Cursor()
+		sessionId, _ := keys.Seek([]byte(cursor))
+		if sessionId != nil && string(sessionId) == cursor {
+			sessionId, _ = keys.Next()
+		}
+		for ; sessionId != nil; sessionId, _ = keys.Next() {
+			if len(sessionIds) == limit {
+				next = sessionIds[limit-1]
+				break
+			}
+			sessionIds = append(sessionIds, string(sessionId))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return sessionIds, next, nil
+}
+
+// ExportSession is a method for BoltStorage that returns the full content of the session
+// belonging to the given ID, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *BoltStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	var data abstract_definition.SessionData
+	err := storage.view(func(bucket *bolt.Bucket) error {
+		var err error
+		data, err = readSession(bucket, sessionId)
+		return err
+	})
+	return data, err
+}
+
+// ImportSession is a method for BoltStorage that stores a session from its full content,
+// replacing any session with the same ID.
+// It returns an error if a key is not a string, the session is larger than the maximum session size,
+// with an abstract_definition.ErrSessionTooLarge error, or the session could not be written.
+func (storage *BoltStorage) ImportSession(data abstract_definition.SessionData) error {
+	if err := storage.CheckSessionSize(data); err != nil {
+		return err
+	}
+	return storage.update(func(bucket *bolt.Bucket) error {
+		return writeSession(bucket, data)
+	})
+}
+
+// Pin is a method for BoltStorage that exempts the session belonging to the given ID from expiration,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *BoltStorage) Pin(sessionId string) error {
+	return storage.setPinned(sessionId, true)
+}
+
+// Unpin is a method for BoltStorage that makes a pinned session belonging to the given ID expire again,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *BoltStorage) Unpin(sessionId string) error {
+	return storage.setPinned(sessionId, false)
+}
+
+// setPinned is a method for BoltStorage that sets the pin state of the session belonging to the given ID.
+func (storage *BoltStorage) setPinned(sessionId string, pinned bool) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.Pinned = pinned
+		return nil
+	})
+	return err
+}
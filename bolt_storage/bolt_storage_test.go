@@ -0,0 +1,191 @@
+package bolt_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixedClock is a clock only moving when it's advanced.
+type fixedClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (clock *fixedClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *fixedClock) advance(duration time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// openStorage opens a storage on the database file, closed once the test ends.
+func openStorage(t *testing.T, path string) *BoltStorage {
+	t.Helper()
+	storage, err := NewBoltStorage(BoltConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	storage := openStorage(t, filepath.Join(t.TempDir(), "sessions.db"))
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	touched, err := storage.RetrieveSessionAndTouch("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := touched.GetValue("username"); value != "zyrx" {
+		t.Fatalf("got %v, want the stored value", value)
+	}
+	if err = touched.DeleteValue("username"); err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := retrieved.GetValue("username"); value != nil {
+		t.Fatalf("deleted value kept: %v", value)
+	}
+	if err = storage.DestroySession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v after the deletion, want SessionNotExist", err)
+	}
+	if err = storage.DestroySession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v deleting a missing session, want SessionNotExist", err)
+	}
+}
+
+func TestSessionsPersistAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	storage, err := NewBoltStorage(BoltConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Pin("id"); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openStorage(t, path)
+	data, err := reopened.ExportSession("id")
+	if err != nil {
+		t.Fatalf("session lost on reopening: %v", err)
+	}
+	if data.Values["username"] != "zyrx" || !data.Pinned {
+		t.Fatalf("got %+v, want the session as it was stored", data)
+	}
+}
+
+func TestFileHeldByAnotherStorageTimesOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	openStorage(t, path)
+	if _, err := NewBoltStorage(BoltConfig{Path: path, Timeout: 50 * time.Millisecond}); err == nil {
+		t.Fatal("database file opened twice")
+	}
+}
+
+func TestTerminateSessionOnExpirationDeletesStaleEntries(t *testing.T) {
+	storage := openStorage(t, filepath.Join(t.TempDir(), "sessions.db"))
+	clock := &fixedClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	storage.SetClock(clock)
+	for index := 0; index < 5; index++ {
+		if _, err := storage.InitializeSession(fmt.Sprint("stale", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Pin("stale0"); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(2 * time.Minute)
+	if _, err := storage.InitializeSession("fresh"); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := storage.TerminateSessionOnExpiration(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 4 {
+		t.Fatalf("terminated %d sessions, want 4", expired)
+	}
+	if ids, err := storage.ListSessions(); err != nil || fmt.Sprint(ids) != "[fresh stale0]" {
+		t.Fatalf("listed %v, error %v, want the fresh and pinned sessions", ids, err)
+	}
+}
+
+func TestScanSessionsPagesInOrder(t *testing.T) {
+	storage := openStorage(t, filepath.Join(t.TempDir(), "sessions.db"))
+	for index := 4; index >= 0; index-- {
+		if _, err := storage.InitializeSession(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var scanned []string
+	cursor := ""
+	for {
+		ids, next, err := storage.ScanSessions(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned = append(scanned, ids...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprint(scanned) != "[id0 id1 id2 id3 id4]" {
+		t.Fatalf("scanned %v", scanned)
+	}
+	if err := storage.DestroyAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := storage.ListSessions(); err != nil || len(ids) != 0 {
+		t.Fatalf("listed %v after destroying all the sessions, error %v", ids, err)
+	}
+}
+
+func TestPingAndUnopenedStorage(t *testing.T) {
+	storage, err := NewBoltStorage(BoltConfig{Path: filepath.Join(t.TempDir(), "sessions.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+	if err = storage.Ping(context.Background()); err == nil {
+		t.Fatal("closed database reported as reachable")
+	}
+	if _, err = (&BoltStorage{}).InitializeSession("id"); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("got %v, want ErrNotConfigured", err)
+	}
+}
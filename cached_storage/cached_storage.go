@@ -0,0 +1,362 @@
+// Package cached_storage provides a storage media decorator serving sessions retrieval from an in-memory
+// least-recently-used cache, in front of a slower storage media such as postgres.
+package cached_storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"sync"
+	"time"
+)
+
+// cachedSession is an entry of the cache, holding a retrieved session until it expires.
+type cachedSession struct {
+	sessionId string
+	session   abstract_definition.Session
+	expiresAt time.Time
+}
+
+// retrieval is a retrieval of a session from the wrapped storage media in progress, on a cache miss,
+// whose session must not be cached if the session was invalidated meanwhile, e.g. destroyed,
+// counting the concurrent retrievals of the same session so it's forgotten once none are left.
+type retrieval struct {
+	invalidated bool
+	references  int
+}
+
+// CachedStorage represents a storage media wrapping another one, keeping up to its capacity of the most recently
+// retrieved sessions in memory for the cache TTL, so hot sessions are retrieved without a call to the wrapped storage.
+// Changes made through cached sessions are written by them to the wrapped storage media, and changes made
+// through the storage media are written through, invalidating the cached session.
+// Touching a cached session doesn't reach the wrapped storage media, its last access time being written
+// by the retrieval caching it, so the last access time kept by the wrapped storage media lags by up to the TTL.
+// Sessions changed elsewhere, e.g. by another process, are seen once their cache entry expires,
+// so the TTL should be kept short.
+type CachedStorage struct {
+	sync.Mutex
+	storage    abstract_definition.StorageMedia
+	capacity   int
+	ttl        time.Duration
+	recency    *list.List
+	entries    map[string]*list.Element
+	retrievals map[string]*retrieval
+	clock      abstract_definition.ClockHolder
+}
+
+// NewCachedStorage is a function that initializes a CachedStorage in front of the given storage media,
+// caching up to capacity sessions for the given TTL.
+// It returns an error if the storage media is nil, or the capacity or the TTL is not greater than zero.
+func NewCachedStorage(storage abstract_definition.StorageMedia, capacity int, ttl time.Duration) (*CachedStorage, error) {
+	if storage == nil {
+		return nil, errors.New("wsm: cached storage media must not be nil")
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("wsm: cache capacity must be greater than zero, got %d", capacity)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("wsm: cache TTL must be greater than zero, got %v", ttl)
+	}
+	return &CachedStorage{
+		storage:    storage,
+		capacity:   capacity,
+		ttl:        ttl,
+		recency:    list.New(),
+		entries:    make(map[string]*list.Element),
+		retrievals: make(map[string]*retrieval),
+	}, nil
+}
+
+// cached is a method for CachedStorage that returns the cached session belonging to the given ID
+// if it hasn't expired, marking it as the most recently used.
+func (cache *CachedStorage) cached(sessionId string) (abstract_definition.Session, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	element, isCached := cache.entries[sessionId]
+	if !isCached {
+		return nil, false
+	}
+	entry := element.Value.(*cachedSession)
+	if cache.clock.Now().After(entry.expiresAt) {
+		cache.recency.Remove(element)
+		delete(cache.entries, sessionId)
+		return nil, false
+	}
+	cache.recency.MoveToFront(element)
+	return entry.session, true
+}
+
+// beginRetrieval is a method for CachedStorage that records a retrieval of the session belonging to the given ID
+// from the wrapped storage media, to be ended by storeRetrieved.
+func (cache *CachedStorage) beginRetrieval(sessionId string) *retrieval {
+	cache.Lock()
+	defer cache.Unlock()
+	pending, found := cache.retrievals[sessionId]
+	if !found {
+		pending = &retrieval{}
+		cache.retrievals[sessionId] = pending
+	}
+	pending.references++
+	return pending
+}
+
+// storeRetrieved is a method for CachedStorage that ends a retrieval begun by beginRetrieval, caching
+// the retrieved session unless it's nil or was invalidated during the retrieval, so a session destroyed
+// while being retrieved is never cached again.
+func (cache *CachedStorage) storeRetrieved(sessionId string, pending *retrieval, session abstract_definition.Session) {
+	cache.Lock()
+	defer cache.Unlock()
+	pending.references--
+	if pending.references == 0 {
+		delete(cache.retrievals, sessionId)
+	}
+	if session != nil && !pending.invalidated {
+		cache.storeLocked(sessionId, session)
+	}
+}
+
+// store is a method for CachedStorage that caches a session, evicting the least recently used one
+// when the cache is full.
+func (cache *CachedStorage) store(sessionId string, session abstract_definition.Session) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.storeLocked(sessionId, session)
+}
+
+// storeLocked is a method for CachedStorage that caches a session like store, while holding the cache lock.
+func (cache *CachedStorage) storeLocked(sessionId string, session abstract_definition.Session) {
+	entry := &cachedSession{sessionId: sessionId, session: session, expiresAt: cache.clock.Now().Add(cache.ttl)}
+	if element, isCached := cache.entries[sessionId]; isCached {
+		element.Value = entry
+		cache.recency.MoveToFront(element)
+		return
+	}
+	cache.entries[sessionId] = cache.recency.PushFront(entry)
+	for cache.recency.Len() > cache.capacity {
+		leastRecentlyUsed := cache.recency.Back()
+		cache.recency.Remove(leastRecentlyUsed)
+		delete(cache.entries, leastRecentlyUsed.Value.(*cachedSession).sessionId)
+	}
+}
+
+// invalidate is a method for CachedStorage that removes the session belonging to the given ID from the cache,
+// and keeps its retrievals in progress from caching it.
+func (cache *CachedStorage) invalidate(sessionId string) {
+	cache.Lock()
+	defer cache.Unlock()
+	if pending, found := cache.retrievals[sessionId]; found {
+		pending.invalidated = true
+	}
+	if element, isCached := cache.entries[sessionId]; isCached {
+		cache.recency.Remove(element)
+		delete(cache.entries, sessionId)
+	}
+}
+
+// invalidateAll is a method for CachedStorage that empties the cache, and keeps all the retrievals in progress
+// from caching their session.
+func (cache *CachedStorage) invalidateAll() {
+	cache.Lock()
+	defer cache.Unlock()
+	for _, pending := range cache.retrievals {
+		pending.invalidated = true
+	}
+	cache.recency.Init()
+	cache.entries = make(map[string]*list.Element)
+}
+
+// InitializeSession is a method for CachedStorage that creates a new session in the wrapped storage media,
+// and caches it.
+func (cache *CachedStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	session, err := cache.storage.InitializeSession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	cache.store(sessionId, session)
+	return session, nil
+}
+
+// RetrieveSession is a method for CachedStorage that returns the cached session belonging to the given ID,
+// retrieving it from the wrapped storage media and caching it on a miss.
+func (cache *CachedStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	if session, isCached := cache.cached(sessionId); isCached {
+		return session, nil
+	}
+	pending := cache.beginRetrieval(sessionId)
+	session, err := cache.storage.RetrieveSession(sessionId)
+	cache.storeRetrieved(sessionId, pending, session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// RetrieveSessionAndTouch is a method for CachedStorage that returns the cached session belonging to the given ID,
+// without a call to the wrapped storage media. On a miss, it retrieves the session from the wrapped storage media,
+// which writes its last access time, and caches it, so the last access time is written at most once per TTL.
+func (cache *CachedStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	if session, isCached := cache.cached(sessionId); isCached {
+		return session, nil
+	}
+	pending := cache.beginRetrieval(sessionId)
+	session, err := cache.storage.RetrieveSessionAndTouch(sessionId)
+	if err != nil {
+		cache.storeRetrieved(sessionId, pending, nil)
+		cache.invalidate(sessionId)
+		return nil, err
+	}
+	cache.storeRetrieved(sessionId, pending, session)
+	return session, nil
+}
+
+// UpdateSessionLastAccess is a method for CachedStorage that writes the session's last access time
+// to the wrapped storage media, invalidating its cached session.
+func (cache *CachedStorage) UpdateSessionLastAccess(sessionId string) error {
+	defer cache.invalidate(sessionId)
+	return cache.storage.UpdateSessionLastAccess(sessionId)
+}
+
+// DestroySession is a method for CachedStorage that deletes a session from the wrapped storage media,
+// invalidating its cached session.
+func (cache *CachedStorage) DestroySession(sessionId string) error {
+	defer cache.invalidate(sessionId)
+	return cache.storage.DestroySession(sessionId)
+}
+
+// Ping is a method for CachedStorage that checks the wrapped storage media can be reached.
+func (cache *CachedStorage) Ping(ctx context.Context) error {
+	return cache.storage.Ping(ctx)
+}
+
+// DestroyAllSessions is a method for CachedStorage that deletes all the sessions from the wrapped storage media,
+// emptying the cache.
+func (cache *CachedStorage) DestroyAllSessions() error {
+	defer cache.invalidateAll()
+	return cache.storage.DestroyAllSessions()
+}
+
+// TerminateSessionOnExpiration is a method for CachedStorage that terminates expired sessions
+// in the wrapped storage media, emptying the cache so none of them is served from it,
+// and returns the number of terminated sessions.
+func (cache *CachedStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	defer cache.invalidateAll()
+	return cache.storage.TerminateSessionOnExpiration(maxLifetime)
+}
+
+// TerminateExpiredSessions is a method for CachedStorage that terminates expired sessions in the wrapped
+// storage media, emptying the cache, and returns the IDs of the terminated sessions.
+// It returns an abstract_definition.ErrNotSupported error if the wrapped storage media can't report them.
+func (cache *CachedStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	expiryReporter, reportsExpiry := cache.storage.(abstract_definition.ExpiryReporter)
+	if !reportsExpiry {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	defer cache.invalidateAll()
+	return expiryReporter.TerminateExpiredSessions(maxLifetime)
+}
+
+// ListSessions is a method for CachedStorage that returns the IDs of all the sessions of the wrapped storage media.
+func (cache *CachedStorage) ListSessions() ([]string, error) {
+	return cache.storage.ListSessions()
+}
+
+// ScanSessions is a method for CachedStorage that returns a page of the session IDs of the wrapped storage media.
+func (cache *CachedStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	return cache.storage.ScanSessions(cursor, limit)
+}
+
+// ExportSession is a method for CachedStorage that returns the full content of the session
+// belonging to the given ID from the wrapped storage media.
+func (cache *CachedStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	return cache.storage.ExportSession(sessionId)
+}
+
+// ImportSession is a method for CachedStorage that stores a session in the wrapped storage media
+// from its full content, invalidating the cached session it replaces.
+func (cache *CachedStorage) ImportSession(data abstract_definition.SessionData) error {
+	defer cache.invalidate(data.Id)
+	return cache.storage.ImportSession(data)
+}
+
+// Pin is a method for CachedStorage that pins a session in the wrapped storage media,
+// invalidating its cached session.
+func (cache *CachedStorage) Pin(sessionId string) error {
+	defer cache.invalidate(sessionId)
+	return cache.storage.Pin(sessionId)
+}
+
+// Unpin is a method for CachedStorage that unpins a session in the wrapped storage media,
+// invalidating its cached session.
+func (cache *CachedStorage) Unpin(sessionId string) error {
+	defer cache.invalidate(sessionId)
+	return cache.storage.Unpin(sessionId)
+}
+
+// SetMaxLifetime is a method for CachedStorage that passes the maximum lifetime to the wrapped storage media
+// if it needs it.
+func (cache *CachedStorage) SetMaxLifetime(maxLifetime time.Duration) {
+	if lifetimeSetter, isLifetimeSetter := cache.storage.(abstract_definition.LifetimeSetter); isLifetimeSetter {
+		lifetimeSetter.SetMaxLifetime(maxLifetime)
+	}
+}
+
+// SetMaxSessionBytes is a method for CachedStorage that passes the maximum size of sessions to the wrapped storage media
+// if it can limit it.
+func (cache *CachedStorage) SetMaxSessionBytes(maxBytes int) {
+	if sizeLimiter, isSizeLimiter := cache.storage.(abstract_definition.SizeLimiter); isSizeLimiter {
+		sizeLimiter.SetMaxSessionBytes(maxBytes)
+	}
+}
+
+// SetExpiryBatchSize is a method for CachedStorage that passes the expiry batch size to the wrapped storage media
+// if it can terminate sessions in chunks.
+func (cache *CachedStorage) SetExpiryBatchSize(batchSize int) {
+	if expiryBatcher, isExpiryBatcher := cache.storage.(abstract_definition.ExpiryBatcher); isExpiryBatcher {
+		expiryBatcher.SetExpiryBatchSize(batchSize)
+	}
+}
+
+// SetClock is a method for CachedStorage that sets the clock expiring cached sessions after their TTL,
+// and passes it to the wrapped storage media if it reads the current time from a clock.
+func (cache *CachedStorage) SetClock(clock abstract_definition.Clock) {
+	cache.clock.SetClock(clock)
+	if clockSetter, isClockSetter := cache.storage.(abstract_definition.ClockSetter); isClockSetter {
+		clockSetter.SetClock(clock)
+	}
+}
+
+// SetSessionUserID is a method for CachedStorage that associates a session with a user in the wrapped storage media,
+// invalidating its cached session. It returns an abstract_definition.ErrNotSupported error
+// if the wrapped storage media can't associate sessions with users.
+func (cache *CachedStorage) SetSessionUserID(sessionId, userID string) error {
+	userIndex, indexesUsers := cache.storage.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return abstract_definition.ErrNotSupported
+	}
+	defer cache.invalidate(sessionId)
+	return userIndex.SetSessionUserID(sessionId, userID)
+}
+
+// UserSessionIDs is a method for CachedStorage that returns the IDs of the sessions associated with a user
+// in the wrapped storage media. It returns an abstract_definition.ErrNotSupported error
+// if the wrapped storage media can't associate sessions with users.
+func (cache *CachedStorage) UserSessionIDs(userID string) ([]string, error) {
+	userIndex, indexesUsers := cache.storage.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return userIndex.UserSessionIDs(userID)
+}
+
+// SessionIDsByValue is a method for CachedStorage that returns the IDs of the sessions holding the value under the key
+// in the wrapped storage media. It returns an abstract_definition.ErrNotSupported error
+// if the wrapped storage media can't query sessions by their values.
+func (cache *CachedStorage) SessionIDsByValue(ctx context.Context, key string, value interface{}) ([]string, error) {
+	valueIndex, indexesValues := cache.storage.(abstract_definition.ValueIndex)
+	if !indexesValues {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return valueIndex.SessionIDsByValue(ctx, key, value)
+}
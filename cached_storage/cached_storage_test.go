@@ -0,0 +1,133 @@
+package cached_storage_test
+
+import (
+	"context"
+	"errors"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/cached_storage"
+	"local/zyrx/backup/memory_storage"
+	"local/zyrx/backup/wsmtest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStorage is a memory storage media counting the retrievals reaching it through the cache,
+// and running a hook, if set, on each retrieval.
+type countingStorage struct {
+	*memory_storage.MemoryStorage
+	calls      sync.Mutex
+	retrievals int
+	touches    int
+	onRetrieve func()
+}
+
+func (storage *countingStorage) counts() (retrievals, touches int) {
+	storage.calls.Lock()
+	defer storage.calls.Unlock()
+	return storage.retrievals, storage.touches
+}
+
+func (storage *countingStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	storage.calls.Lock()
+	storage.retrievals++
+	onRetrieve := storage.onRetrieve
+	storage.calls.Unlock()
+	session, err := storage.MemoryStorage.RetrieveSession(sessionId)
+	if onRetrieve != nil {
+		onRetrieve()
+	}
+	return session, err
+}
+
+func (storage *countingStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	storage.calls.Lock()
+	storage.touches++
+	storage.calls.Unlock()
+	return storage.MemoryStorage.RetrieveSessionAndTouch(sessionId)
+}
+
+// newCache returns a cache of a second TTL in front of a new countingStorage, both on a new ManualClock.
+func newCache(t *testing.T) (*cached_storage.CachedStorage, *countingStorage, *wsmtest.ManualClock) {
+	t.Helper()
+	storage := &countingStorage{MemoryStorage: &memory_storage.MemoryStorage{}}
+	cache, err := cached_storage.NewCachedStorage(storage, 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := wsmtest.NewManualClock(wsmtest.DefaultStartTime)
+	cache.SetClock(clock)
+	return cache, storage, clock
+}
+
+func TestRetrieveSessionAndTouchIsServedFromTheCache(t *testing.T) {
+	cache, storage, clock := newCache(t)
+	if _, err := cache.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	for request := 0; request < 5; request++ {
+		if _, err := cache.RetrieveSessionAndTouch("id"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, touches := storage.counts(); touches != 0 {
+		t.Fatalf("cached touches reached the wrapped storage %d times", touches)
+	}
+	clock.Advance(2 * time.Second)
+	for request := 0; request < 5; request++ {
+		if _, err := cache.RetrieveSessionAndTouch("id"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, touches := storage.counts(); touches != 1 {
+		t.Fatalf("got %d touches of the wrapped storage after the TTL, want 1", touches)
+	}
+}
+
+func TestSessionDestroyedDuringRetrievalIsNotCached(t *testing.T) {
+	cache, storage, _ := newCache(t)
+	if _, err := storage.MemoryStorage.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	storage.onRetrieve = func() {
+		storage.onRetrieve = nil
+		if err := cache.DestroySession("id"); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := cache.RetrieveSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("destroyed session served from the cache, got error %v", err)
+	}
+	if retrievals, _ := storage.counts(); retrievals != 2 {
+		t.Fatalf("got %d retrievals from the wrapped storage, want 2", retrievals)
+	}
+}
+
+func TestDestroyedSessionIsNotServed(t *testing.T) {
+	cache, _, _ := newCache(t)
+	if _, err := cache.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.DestroySession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.RetrieveSessionAndTouch("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v, want SessionNotExist", err)
+	}
+}
+
+func TestPingReachesTheWrappedStorage(t *testing.T) {
+	storage := wsmtest.NewFakeStorage()
+	cache, err := cached_storage.NewCachedStorage(storage, 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outage := errors.New("storage outage")
+	storage.FailPingWith(outage)
+	if err = cache.Ping(context.Background()); !errors.Is(err, outage) {
+		t.Fatalf("got %v, want the error of the wrapped storage", err)
+	}
+}
@@ -0,0 +1,316 @@
+package wsm_backup
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardedProtoHeader is the header TLS terminating proxies report the scheme of the original request in.
+const forwardedProtoHeader = "X-Forwarded-Proto"
+
+// cookiePaddingCharacter pads cookie values to the padding block size, it's always escaped by url.QueryEscape
+// so it never appears in an encoded session ID.
+const cookiePaddingCharacter = "*"
+
+// cookieSignatureSeparator separates the session ID from its signature in signed cookie values,
+// it never appears in a base64 URL encoded signature.
+const cookieSignatureSeparator = "."
+
+// ErrInvalidCookieSignature is an error used when a signed cookie value is missing its signature,
+// or its signature doesn't match the session ID it carries.
+var ErrInvalidCookieSignature = errors.New("wsm: invalid session cookie signature")
+
+// cookieNameSeparators are the separators RFC 6265 (through RFC 2616) excludes from cookie name tokens.
+const cookieNameSeparators = "()<>@,;:\\\"/[]?={} \t"
+
+// validateCookieName is a function that checks a cookie name is a token as defined by RFC 6265,
+// made of visible ASCII characters other than separators, so the Set-Cookie header is well-formed.
+// It returns an error if the name is empty or has an invalid character.
+func validateCookieName(cookieName string) error {
+	if cookieName == "" {
+		return errors.New("wsm: cookie name must not be empty")
+	}
+	for _, character := range cookieName {
+		if character <= ' ' || character >= 0x7f || strings.ContainsRune(cookieNameSeparators, character) {
+			return fmt.Errorf("wsm: invalid cookie name %q, character %q is not allowed", cookieName, character)
+		}
+	}
+	return nil
+}
+
+// hostCookiePrefix is the cookie name prefix browsers only accept on Secure cookies with Path=/ and no Domain,
+// locking the cookie to the host that set it so subdomains can't inject their own.
+const hostCookiePrefix = "__Host-"
+
+// ErrInsecureSameSiteNone is an error used when session cookies are set to SameSite=None without Secure,
+// which browsers reject.
+var ErrInsecureSameSiteNone = errors.New("wsm: SameSite=None session cookies must be Secure")
+
+// ErrInsecureHostCookie is an error used when a cookie name has the __Host- prefix without Secure,
+// which browsers reject.
+var ErrInsecureHostCookie = errors.New("wsm: __Host- prefixed session cookies must be Secure")
+
+// ErrHostCookiePath is an error used when a cookie name has the __Host- prefix with another Path than "/",
+// which browsers reject.
+var ErrHostCookiePath = errors.New("wsm: __Host- prefixed session cookies must have the path \"/\"")
+
+// ErrHostCookieDomain is an error used when a cookie name has the __Host- prefix with a Domain,
+// which browsers reject.
+var ErrHostCookieDomain = errors.New("wsm: __Host- prefixed session cookies must not have a domain")
+
+// checkHostCookieScope is a method for SessionManager used on its creation to check __Host- prefixed
+// session cookies have the Path "/" and no Domain, as browsers require.
+// It returns an ErrHostCookiePath or ErrHostCookieDomain error otherwise.
+func (manager *SessionManager) checkHostCookieScope() error {
+	if !strings.HasPrefix(manager.cookieName, hostCookiePrefix) {
+		return nil
+	}
+	if manager.cookiePath != "/" {
+		return ErrHostCookiePath
+	}
+	if manager.cookieDomain != "" {
+		return ErrHostCookieDomain
+	}
+	return nil
+}
+
+// ErrCookieNameInUse is an error used when a SessionManager with the WithUniqueCookieName option is created
+// with the cookie name of another session manager of the process.
+var ErrCookieNameInUse = errors.New("wsm: session cookie name already used by another session manager")
+
+// cookieNames is the registry of the session cookie names of the process, counting the session managers
+// using each, so a manager created with a cookie name already in use is noticed.
+var cookieNames = struct {
+	sync.Mutex
+	managers map[string]int
+}{managers: make(map[string]int)}
+
+// registerCookieName is a method for SessionManager used on its creation to register its cookie name,
+// suffixed with its namespace if any, in the registry of the process. Managers sharing a cookie name read
+// each other's cookies, so a name already in use is logged as a warning, or rejected with the WithUniqueCookieName
+// option, returning an ErrCookieNameInUse error.
+func (manager *SessionManager) registerCookieName() error {
+	cookieNames.Lock()
+	defer cookieNames.Unlock()
+	if cookieNames.managers[manager.cookieName] > 0 {
+		if manager.uniqueCookieName {
+			return fmt.Errorf("%w: %q", ErrCookieNameInUse, manager.cookieName)
+		}
+		manager.logger.Printf("wsm: session cookie name %q is already used by another session manager, "+
+			"their requests may resolve each other's sessions unless they have distinct namespaces", manager.cookieName)
+	}
+	cookieNames.managers[manager.cookieName]++
+	manager.cookieNameRegistered = true
+	return nil
+}
+
+// releaseCookieName is a method for SessionManager used by Stop to remove its cookie name from the registry
+// of the process, so a new manager can use it. It does nothing if the cookie name was already released.
+func (manager *SessionManager) releaseCookieName() {
+	if !manager.cookieNameRegistered {
+		return
+	}
+	manager.cookieNameRegistered = false
+	cookieNames.Lock()
+	defer cookieNames.Unlock()
+	cookieNames.managers[manager.cookieName]--
+	if cookieNames.managers[manager.cookieName] == 0 {
+		delete(cookieNames.managers, manager.cookieName)
+	}
+}
+
+// enforceCookieSecure is a method for SessionManager used on its creation to make session cookies Secure
+// when browsers require it: for SameSite=None, and for __Host- prefixed cookie names, which session cookies
+// already satisfy otherwise, their Path and Domain being checked by checkHostCookieScope.
+// It returns an ErrInsecureSameSiteNone or ErrInsecureHostCookie error if Secure was explicitly disabled.
+func (manager *SessionManager) enforceCookieSecure() error {
+	var err error
+	switch {
+	case strings.HasPrefix(manager.cookieName, hostCookiePrefix):
+		err = ErrInsecureHostCookie
+	case manager.cookieSameSite == http.SameSiteNoneMode:
+		err = ErrInsecureSameSiteNone
+	default:
+		return nil
+	}
+	if manager.cookieSecureSet && !manager.cookieSecure {
+		return err
+	}
+	manager.cookieSecure = true
+	return nil
+}
+
+// signSessionId is a method for SessionManager used to compute the base64 URL encoded HMAC-SHA256
+// signature of a session ID with the cookie signing key.
+func (manager *SessionManager) signSessionId(sessionId string) string {
+	mac := hmac.New(sha256.New, manager.cookieSigningKey)
+	mac.Write([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeCookieValue is a method for SessionManager used to turn a session ID into the value of its cookie,
+// escaping it, signing it if a cookie signing key is set, and padding it to the configured block size.
+// It's the only place a session ID gets escaped, storage media always receive decoded session IDs.
+func (manager *SessionManager) encodeCookieValue(sessionId string) string {
+	value := url.QueryEscape(sessionId)
+	if manager.cookieSigningKey != nil {
+		value += cookieSignatureSeparator + manager.signSessionId(sessionId)
+	}
+	if manager.cookiePaddingBlockSize > 0 && len(value)%manager.cookiePaddingBlockSize != 0 {
+		value += strings.Repeat(cookiePaddingCharacter, manager.cookiePaddingBlockSize-len(value)%manager.cookiePaddingBlockSize)
+	}
+	return value
+}
+
+// decodeCookieValue is a method for SessionManager used to retrieve the session ID carried by the value
+// of its cookie, removing its padding, verifying its signature if a cookie signing key is set, and unescaping it.
+// It returns an ErrInvalidCookieSignature error if the signature is missing or doesn't match,
+// or an error if the value could not be unescaped.
+func (manager *SessionManager) decodeCookieValue(value string) (string, error) {
+	value = strings.TrimRight(value, cookiePaddingCharacter)
+	if manager.cookieSigningKey == nil {
+		return url.QueryUnescape(value)
+	}
+	separatorIndex := strings.LastIndex(value, cookieSignatureSeparator)
+	if separatorIndex < 0 {
+		return "", ErrInvalidCookieSignature
+	}
+	sessionId, err := url.QueryUnescape(value[:separatorIndex])
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(value[separatorIndex+1:]), []byte(manager.signSessionId(sessionId))) {
+		return "", ErrInvalidCookieSignature
+	}
+	return sessionId, nil
+}
+
+// bearerScheme is the authentication scheme a session token sent in a header may be prefixed with,
+// as in "Authorization: Bearer <token>".
+const bearerScheme = "Bearer "
+
+// requestSessionValue is a method for SessionManager used to read the encoded session ID carried by a request,
+// from its session cookie, or from the header set by the WithHeaderTokenFallback option when the cookie is absent,
+// without its "Bearer " scheme if any. It returns an empty string if the request carries none.
+func (manager *SessionManager) requestSessionValue(request *http.Request) string {
+	if cookie, err := request.Cookie(manager.cookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	if manager.tokenHeaderName == "" {
+		return ""
+	}
+	value := strings.TrimSpace(request.Header.Get(manager.tokenHeaderName))
+	if len(value) >= len(bearerScheme) && strings.EqualFold(value[:len(bearerScheme)], bearerScheme) {
+		value = strings.TrimSpace(value[len(bearerScheme):])
+	}
+	return value
+}
+
+// SessionToken is a method for SessionManager that returns the token of a session to send in the header
+// set by the WithHeaderTokenFallback option, by clients that can't use cookies. It's the value of the session's
+// cookie, so it's signed when a cookie signing key is set, and carries a new opaque token with the WithOpaqueTokens
+// option, in which case it returns an empty string, logging why, if the token could not be stored.
+func (manager *SessionManager) SessionToken(session abstract_definition.Session) string {
+	manager.RLock()
+	defer manager.RUnlock()
+	cookieId, err := manager.newCookieId(session.GetSessionId(), 0)
+	if err != nil {
+		manager.logger.Printf("wsm: could not issue the token of a session: %v", err)
+		return ""
+	}
+	return manager.encodeCookieValue(cookieId)
+}
+
+// isSecureRequest reports whether a request was received over HTTPS, directly or, according
+// to the first value of its X-Forwarded-Proto header, by a TLS terminating proxy.
+func isSecureRequest(request *http.Request) bool {
+	if request.TLS != nil {
+		return true
+	}
+	proto, _, _ := strings.Cut(request.Header.Get(forwardedProtoHeader), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// cookieSecureFor is a method for SessionManager that returns the Secure attribute of the session cookies set
+// in response to a request. With the WithInsecureCookieForLocalDev option, it's derived from the scheme
+// of the request unless Secure is required, and kept for a nil request whose scheme is unknown.
+func (manager *SessionManager) cookieSecureFor(request *http.Request) bool {
+	if manager.cookieSecure || !manager.insecureCookieForLocalDev {
+		return manager.cookieSecure
+	}
+	return request == nil || isSecureRequest(request)
+}
+
+// newCookie is a method for SessionManager used to build a cookie of the session cookie name with the given value,
+// and the configured Path, Domain, Secure and SameSite attributes, the same for the cookie setting a session
+// and the one expiring it, since browsers only replace a cookie of the same name, Path and Domain.
+// The Secure attribute is the one of cookieSecureFor for the request the cookie responds to, or nil if unknown.
+func (manager *SessionManager) newCookie(value string, request *http.Request) *http.Cookie {
+	return &http.Cookie{Name: manager.cookieName, Value: value, Path: manager.cookiePath, Domain: manager.cookieDomain,
+		HttpOnly: true, Secure: manager.cookieSecureFor(request), SameSite: manager.cookieSameSite}
+}
+
+// newSessionCookie is a method for SessionManager used to build the cookie carrying a session ID,
+// or its opaque token with the WithOpaqueTokens option, with the given MaxAge in seconds and the configured attributes,
+// in response to the given request, or nil if unknown.
+func (manager *SessionManager) newSessionCookie(cookieId string, maxAge int, request *http.Request) *http.Cookie {
+	cookie := manager.newCookie(manager.encodeCookieValue(cookieId), request)
+	cookie.MaxAge = maxAge
+	return cookie
+}
+
+// sessionCookieMaxAge is a method for SessionManager that returns the MaxAge in seconds of session cookies,
+// zero with the WithSessionCookie option, the one set by the WithCookieMaxAge option, or the maximum lifetime
+// of the manager in whole seconds otherwise.
+// Zero means a session cookie, without MaxAge nor Expires, discarded when the browser closes.
+func (manager *SessionManager) sessionCookieMaxAge() int {
+	if manager.sessionCookie {
+		return 0
+	}
+	if manager.cookieMaxAgeSet {
+		return manager.cookieMaxAge
+	}
+	return int(manager.maxLifetime / time.Second)
+}
+
+// newExpiredSessionCookie is a method for SessionManager used to build a cookie with expired values,
+// replacing the cookie carrying a session ID in order to end it. It has the same attributes
+// as the session cookie set in response to the request, so browsers replace it instead of keeping both.
+func (manager *SessionManager) newExpiredSessionCookie(request *http.Request) *http.Cookie {
+	cookie := manager.newCookie("", request)
+	cookie.Expires = time.Now()
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// WriteCookie is a method for SessionManager used to set the cookie of a session with its own MaxAge in seconds,
+// e.g. a longer one for a "remember me" session than for an anonymous cart session, overriding the cookie
+// set by StartSession. A MaxAge of zero or less falls back to the cookie MaxAge of the manager.
+// With the WithOpaqueTokens option, the cookie carries a new opaque token, expiring along with a MaxAge of its own,
+// and no cookie is set, logging why, if the token could not be stored.
+// Not given the request, it keeps session cookies Secure with the WithInsecureCookieForLocalDev option.
+func (manager *SessionManager) WriteCookie(response http.ResponseWriter, session abstract_definition.Session, maxAge int) {
+	manager.RLock()
+	defer manager.RUnlock()
+	var expiry time.Duration
+	if maxAge > 0 {
+		expiry = time.Duration(maxAge) * time.Second
+	} else {
+		maxAge = manager.sessionCookieMaxAge()
+	}
+	cookieId, err := manager.newCookieId(session.GetSessionId(), expiry)
+	if err != nil {
+		manager.logger.Printf("wsm: could not issue the token of a session cookie: %v", err)
+		return
+	}
+	http.SetCookie(response, manager.newSessionCookie(cookieId, maxAge, nil))
+}
@@ -0,0 +1,92 @@
+package wsm_backup_test
+
+import (
+	"errors"
+	"fmt"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/memory_storage"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingLogger is a Logger keeping the diagnostics it receives.
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (logger *recordingLogger) Printf(format string, v ...interface{}) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.lines = append(logger.lines, fmt.Sprintf(format, v...))
+}
+
+// warned reports whether a diagnostic about the cookie name was logged.
+func (logger *recordingLogger) warned(cookieName string) bool {
+	logger.Lock()
+	defer logger.Unlock()
+	for _, line := range logger.lines {
+		if strings.Contains(line, fmt.Sprintf("%q", cookieName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newStoppedManager returns a manager on its own memory storage, stopped once the test ends.
+func newStoppedManager(t *testing.T, cookieName string, options ...wsm.Option) (*wsm.SessionManager, error) {
+	t.Helper()
+	manager, err := wsm.NewSessionManagerWithStorage(&memory_storage.MemoryStorage{}, cookieName, options...)
+	if err == nil {
+		t.Cleanup(manager.Stop)
+	}
+	return manager, err
+}
+
+func TestSharedCookieNameIsLogged(t *testing.T) {
+	if _, err := newStoppedManager(t, "shared_warned"); err != nil {
+		t.Fatal(err)
+	}
+	logger := &recordingLogger{}
+	if _, err := newStoppedManager(t, "shared_warned", wsm.WithLogger(logger)); err != nil {
+		t.Fatalf("shared cookie name rejected without WithUniqueCookieName: %v", err)
+	}
+	if !logger.warned("shared_warned") {
+		t.Fatal("shared cookie name not logged")
+	}
+}
+
+func TestSharedCookieNameFailsWithUniqueCookieName(t *testing.T) {
+	if _, err := newStoppedManager(t, "shared_rejected"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := newStoppedManager(t, "shared_rejected", wsm.WithUniqueCookieName(true))
+	if !errors.Is(err, wsm.ErrCookieNameInUse) {
+		t.Fatalf("got %v, want ErrCookieNameInUse", err)
+	}
+}
+
+func TestDistinctNamespacesDontShareTheirCookieName(t *testing.T) {
+	if _, err := newStoppedManager(t, "namespaced", wsm.WithNamespace("tenant-a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStoppedManager(t, "namespaced", wsm.WithNamespace("tenant-b"), wsm.WithUniqueCookieName(true)); err != nil {
+		t.Fatalf("distinct namespaces rejected: %v", err)
+	}
+	if _, err := newStoppedManager(t, "namespaced", wsm.WithNamespace("tenant-a"), wsm.WithUniqueCookieName(true)); !errors.Is(err, wsm.ErrCookieNameInUse) {
+		t.Fatalf("got %v for the same namespace, want ErrCookieNameInUse", err)
+	}
+}
+
+func TestStoppedManagerReleasesItsCookieName(t *testing.T) {
+	manager, err := newStoppedManager(t, "released")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Stop()
+	manager.Stop()
+	if _, err = newStoppedManager(t, "released", wsm.WithUniqueCookieName(true)); err != nil {
+		t.Fatalf("cookie name of a stopped manager still in use: %v", err)
+	}
+}
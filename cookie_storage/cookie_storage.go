@@ -0,0 +1,298 @@
+// Package cookie_storage provides a storage media keeping sessions entirely in their cookies,
+// for stateless deployments with no server-side store.
+package cookie_storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxCookieValueBytes is the maximum length of a session cookie value, leaving room for the cookie name
+// and attributes under the 4096 bytes browsers are required to accept per cookie.
+const MaxCookieValueBytes = 3800
+
+// ErrInvalidEncryptionKey is an error used when the encryption key of the cookie storage is not 32 bytes long.
+var ErrInvalidEncryptionKey = errors.New("wsm: cookie storage encryption key must be 32 bytes long")
+
+// ErrCookieTooLarge is an error used when a change would make the session cookie exceed MaxCookieValueBytes.
+var ErrCookieTooLarge = errors.New("wsm: session cookie would exceed the maximum cookie size")
+
+// CookieStorage represents a cookie storage media type keeping sessions in their cookies,
+// their content encoded as json, then encrypted and authenticated with AES-256-GCM using its EncryptionKey.
+// The ID of a session is its sealed content, so the cookie must be written again with
+// SessionManager.WriteCookie after the session changes.
+// The sealed content carries the last access time, so cookies past their expiry are rejected on retrieval.
+type CookieStorage struct {
+	EncryptionKey   []byte
+	maxLifetime     atomic.Int64
+	clock           abstract_definition.ClockHolder
+	maxSessionBytes atomic.Int64
+}
+
+// SetClock is a method for CookieStorage that sets the clock stamping the last access time of sessions
+// and rejecting expired cookies on retrieval.
+func (storage *CookieStorage) SetClock(clock abstract_definition.Clock) {
+	storage.clock.SetClock(clock)
+}
+
+// Now is a method for CookieStorage that returns the current time of its clock.
+func (storage *CookieStorage) Now() time.Time {
+	return storage.clock.Now()
+}
+
+// CookieSession is a session kept in its cookie, its ID being its sealed content.
+type CookieSession struct {
+	*stored_session.StoredSession
+	sealer *cookieSealer
+}
+
+// cookieSealer is the persister of a CookieSession, sealing its content on every change.
+type cookieSealer struct {
+	sync.Mutex
+	storage *CookieStorage
+	data    abstract_definition.SessionData
+	sealed  string
+}
+
+// Now is a method for cookieSealer that returns the current time of the clock of its storage.
+func (sealer *cookieSealer) Now() time.Time {
+	return sealer.storage.Now()
+}
+
+// UpdateSession is a method for cookieSealer that applies the update to the session content, and seals it.
+// It returns an ErrCookieTooLarge error without applying the update if the sealed content is too large.
+func (sealer *cookieSealer) UpdateSession(_ string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	sealer.Lock()
+	defer sealer.Unlock()
+	data := stored_session.CopySessionData(sealer.data)
+	if err := update(&data); err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	sealed, err := sealer.storage.seal(data)
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	sealer.data, sealer.sealed = data, sealed
+	return stored_session.CopySessionData(data), nil
+}
+
+// CheckSessionSize is a method for cookieSealer that returns an abstract_definition.ErrSessionTooLarge error
+// if the content of the session would exceed the maximum size of its storage once encoded, before being sealed.
+func (sealer *cookieSealer) CheckSessionSize(data abstract_definition.SessionData) error {
+	maxBytes := sealer.storage.maxSessionBytes.Load()
+	if maxBytes == 0 {
+		return nil
+	}
+	plaintext, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return stored_session.CheckSize(len(plaintext), maxBytes)
+}
+
+// GetSessionId is a method for CookieSession that returns the sealed content of the session,
+// to be sent as the value of its cookie.
+func (session *CookieSession) GetSessionId() string {
+	session.sealer.Lock()
+	defer session.sealer.Unlock()
+	return session.sealer.sealed
+}
+
+// newCookieSession is a method for CookieStorage that seals the content of a session,
+// and returns the session holding it.
+func (storage *CookieStorage) newCookieSession(data abstract_definition.SessionData) (*CookieSession, error) {
+	sealed, err := storage.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	sealer := &cookieSealer{storage: storage, data: stored_session.CopySessionData(data), sealed: sealed}
+	return &CookieSession{StoredSession: stored_session.NewStoredSession(data, sealer), sealer: sealer}, nil
+}
+
+// newCipher is a method for CookieStorage that returns the AES-GCM cipher of its encryption key,
+// or an ErrInvalidEncryptionKey error if the key is not 32 bytes long.
+func (storage *CookieStorage) newCipher() (cipher.AEAD, error) {
+	if len(storage.EncryptionKey) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(storage.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal is a method for CookieStorage that encodes the content of a session, encrypts it,
+// and returns the base64 URL encoded nonce and ciphertext.
+// It returns an ErrCookieTooLarge error if the result exceeds MaxCookieValueBytes.
+func (storage *CookieStorage) seal(data abstract_definition.SessionData) (string, error) {
+	aead, err := storage.newCipher()
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return "", fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil))
+	if len(sealed) > MaxCookieValueBytes {
+		return "", fmt.Errorf("%w: %d bytes, at most %d", ErrCookieTooLarge, len(sealed), MaxCookieValueBytes)
+	}
+	return sealed, nil
+}
+
+// open is a method for CookieStorage that decrypts and decodes the session content sealed in a cookie,
+// it returns a wsm.SessionNotExists error if it was tampered with, sealed with another key, or is expired.
+func (storage *CookieStorage) open(sealed string) (abstract_definition.SessionData, error) {
+	aead, err := storage.newCipher()
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	data, err := stored_session.UnmarshalSessionData(plaintext)
+	if err != nil {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	lifetime := time.Duration(storage.maxLifetime.Load())
+	if data.Expiry > 0 {
+		lifetime = data.Expiry
+	}
+	if !data.Pinned && lifetime > 0 && data.LastAccessTime.Add(lifetime).Before(storage.Now()) {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	return data, nil
+}
+
+// InitializeSession is a method for CookieStorage that takes a session ID argument of type string
+// creates a new session holding it, and then return that session.
+// It returns an error if the encryption key is invalid.
+func (storage *CookieStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	now := storage.Now()
+	return storage.newCookieSession(abstract_definition.SessionData{
+		Id:             sessionId,
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values:         make(map[interface{}]interface{}),
+	})
+}
+
+// RetrieveSession is a method for CookieStorage that takes the value of a session cookie as an argument
+// and returns the session sealed in it, if it was tampered with or is expired
+// it returns a wsm.SessionNotExists error.
+func (storage *CookieStorage) RetrieveSession(sealed string) (abstract_definition.Session, error) {
+	data, err := storage.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return storage.newCookieSession(data)
+}
+
+// RetrieveSessionAndTouch is a method for CookieStorage that takes the value of a session cookie as an argument
+// and returns the session sealed in it with its last access time updated, taking effect once its cookie
+// is written again, if it was tampered with or is expired it returns a wsm.SessionNotExists error.
+func (storage *CookieStorage) RetrieveSessionAndTouch(sealed string) (abstract_definition.Session, error) {
+	data, err := storage.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	data.LastAccessTime = storage.Now()
+	return storage.newCookieSession(data)
+}
+
+// UpdateSessionLastAccess is a method for CookieStorage that does nothing, since the last access time
+// is only updated in a cookie by changing its session.
+func (storage *CookieStorage) UpdateSessionLastAccess(string) error {
+	return nil
+}
+
+// DestroySession is a method for CookieStorage that does nothing, since a session is destroyed
+// by expiring its cookie.
+func (storage *CookieStorage) DestroySession(string) error {
+	return nil
+}
+
+// Ping is a method for CookieStorage that returns nil, since sessions are carried by their cookie.
+func (storage *CookieStorage) Ping(context.Context) error {
+	return nil
+}
+
+// DestroyAllSessions is a method for CookieStorage that returns an abstract_definition.ErrNotSupported error,
+// since there's no store of sessions. Changing the encryption key invalidates all the sessions instead.
+func (storage *CookieStorage) DestroyAllSessions() error {
+	return abstract_definition.ErrNotSupported
+}
+
+// SetMaxLifetime is a method for CookieStorage that sets the maximum lifetime
+// used to reject expired cookies on retrieval.
+func (storage *CookieStorage) SetMaxLifetime(maxLifetime time.Duration) {
+	storage.maxLifetime.Store(int64(maxLifetime))
+}
+
+// SetMaxSessionBytes is a method for CookieStorage that sets the maximum size of sessions as encoded
+// before being sealed in their cookie, zero meaning no limit. Sealed sessions are always limited to MaxCookieValueBytes.
+func (storage *CookieStorage) SetMaxSessionBytes(maxBytes int) {
+	storage.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// TerminateSessionOnExpiration is a method for CookieStorage that records the maximum lifetime
+// used to reject expired cookies on retrieval, since there's no store of sessions to terminate.
+func (storage *CookieStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	storage.SetMaxLifetime(maxLifetime)
+	return 0, nil
+}
+
+// ListSessions is a method for CookieStorage that returns no session IDs, since there's no store of sessions.
+func (storage *CookieStorage) ListSessions() ([]string, error) {
+	return nil, nil
+}
+
+// ScanSessions is a method for CookieStorage that returns no session IDs, since there's no store of sessions.
+func (storage *CookieStorage) ScanSessions(string, int) ([]string, string, error) {
+	return nil, "", nil
+}
+
+// ExportSession is a method for CookieStorage that returns the full content of the session
+// sealed in the given cookie value, if it was tampered with or is expired it returns a wsm.SessionNotExists error.
+func (storage *CookieStorage) ExportSession(sealed string) (abstract_definition.SessionData, error) {
+	return storage.open(sealed)
+}
+
+// ImportSession is a method for CookieStorage that returns an abstract_definition.ErrNotSupported error,
+// since there's no store to import sessions into.
+func (storage *CookieStorage) ImportSession(abstract_definition.SessionData) error {
+	return abstract_definition.ErrNotSupported
+}
+
+// Pin is a method for CookieStorage that returns an abstract_definition.ErrNotSupported error,
+// since a cookie can't be changed without a response to write it in.
+func (storage *CookieStorage) Pin(string) error {
+	return abstract_definition.ErrNotSupported
+}
+
+// Unpin is a method for CookieStorage that returns an abstract_definition.ErrNotSupported error,
+// since a cookie can't be changed without a response to write it in.
+func (storage *CookieStorage) Unpin(string) error {
+	return abstract_definition.ErrNotSupported
+}
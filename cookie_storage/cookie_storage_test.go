@@ -0,0 +1,104 @@
+package cookie_storage
+
+import (
+	"bytes"
+	"errors"
+	"local/zyrx/backup/abstract_definition"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedClock is a clock stopped at its time.
+type fixedClock struct {
+	now time.Time
+}
+
+func (clock *fixedClock) Now() time.Time {
+	return clock.now
+}
+
+// sealedSession creates a session holding a value with the storage and returns its sealed content.
+func sealedSession(t *testing.T, storage *CookieStorage) string {
+	t.Helper()
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+	return session.GetSessionId()
+}
+
+func TestSessionsRoundTripThroughTheirCookie(t *testing.T) {
+	storage := &CookieStorage{EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	sealed := sealedSession(t, storage)
+	if strings.Contains(sealed, "value") {
+		t.Fatal("session value readable in the cookie")
+	}
+	session, err := storage.RetrieveSession(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := session.GetValue("name"); name != "value" {
+		t.Fatalf("got %v, want value", name)
+	}
+}
+
+func TestTamperedCookiesAreRejected(t *testing.T) {
+	storage := &CookieStorage{EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	sealed := sealedSession(t, storage)
+	replacement := "A"
+	if sealed[10:11] == replacement {
+		replacement = "B"
+	}
+	tampered := sealed[:10] + replacement + sealed[11:]
+	if _, err := storage.RetrieveSession(tampered); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for a tampered cookie, want SessionNotExist", err)
+	}
+	otherKey := &CookieStorage{EncryptionKey: bytes.Repeat([]byte{2}, 32)}
+	if _, err := otherKey.RetrieveSession(sealed); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v with another key, want SessionNotExist", err)
+	}
+}
+
+func TestExpiredCookiesAreRejected(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	storage := &CookieStorage{EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	storage.SetClock(clock)
+	storage.SetMaxLifetime(time.Minute)
+	sealed := sealedSession(t, storage)
+	clock.now = clock.now.Add(30 * time.Second)
+	if _, err := storage.RetrieveSession(sealed); err != nil {
+		t.Fatalf("cookie rejected before its maximum lifetime: %v", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := storage.RetrieveSession(sealed); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for an expired cookie, want SessionNotExist", err)
+	}
+}
+
+func TestChangesOverflowingTheCookieAreRejected(t *testing.T) {
+	storage := &CookieStorage{EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("big", strings.Repeat("x", MaxCookieValueBytes)); !errors.Is(err, ErrCookieTooLarge) {
+		t.Fatalf("got %v, want ErrCookieTooLarge", err)
+	}
+	if session.GetValue("big") != nil {
+		t.Fatal("rejected value kept")
+	}
+	if len(session.GetSessionId()) > MaxCookieValueBytes {
+		t.Fatal("sealed session exceeds the maximum cookie size")
+	}
+}
+
+func TestInvalidEncryptionKeyIsRejected(t *testing.T) {
+	storage := &CookieStorage{EncryptionKey: []byte("short")}
+	if _, err := storage.InitializeSession("id"); !errors.Is(err, ErrInvalidEncryptionKey) {
+		t.Fatalf("got %v, want ErrInvalidEncryptionKey", err)
+	}
+}
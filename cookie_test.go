@@ -0,0 +1,377 @@
+package wsm_backup_test
+
+import (
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/wsmtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionCookie starts a session with the manager and returns the session cookie it sets.
+func sessionCookie(t *testing.T, manager *wsm.SessionManager) *http.Cookie {
+	t.Helper()
+	response := httptest.NewRecorder()
+	if _, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got cookies %v, want the session cookie", cookies)
+	}
+	return cookies[0]
+}
+
+func TestSignedCookiesAreVerified(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithCookieSigningKey([]byte("signing key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId, request := requestWithSession(t, manager)
+	session, isNew, err := manager.StartSession(httptest.NewRecorder(), request)
+	if err != nil || isNew || session.GetSessionId() != sessionId {
+		t.Fatalf("signed session not resumed: new %v, error %v", isNew, err)
+	}
+	cookie, err := request.Cookie(wsmtest.CookieName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement := "A"
+	if strings.HasPrefix(cookie.Value, replacement) {
+		replacement = "B"
+	}
+	for _, value := range []string{sessionId, replacement + cookie.Value[1:]} {
+		tampered := httptest.NewRequest("GET", "/", nil)
+		tampered.AddCookie(&http.Cookie{Name: wsmtest.CookieName, Value: value})
+		if _, _, err = manager.StartSession(httptest.NewRecorder(), tampered); !errors.Is(err, wsm.ErrInvalidCookieSignature) {
+			t.Errorf("got %v for the cookie value %q, want ErrInvalidCookieSignature", err, value)
+		}
+	}
+	otherKey, _, err := wsmtest.NewSessionManager(wsm.WithCookieSigningKey([]byte("other key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = otherKey.StartSession(httptest.NewRecorder(), request); !errors.Is(err, wsm.ErrInvalidCookieSignature) {
+		t.Fatalf("got %v with another signing key, want ErrInvalidCookieSignature", err)
+	}
+}
+
+func TestInvalidCookieNamesAreRejected(t *testing.T) {
+	for _, cookieName := range []string{"", "session id", "a;b", "a\"b", "a\\b", "a=b", "sé"} {
+		if _, err := wsm.NewSessionManagerWithStorage(wsmtest.NewFakeStorage(), cookieName); err == nil {
+			t.Errorf("cookie name %q accepted", cookieName)
+		}
+	}
+	for _, cookieName := range []string{"session", "__Host-session", "app.sid_1"} {
+		if _, err := wsm.NewSessionManagerWithStorage(wsmtest.NewFakeStorage(), cookieName); err != nil {
+			t.Errorf("cookie name %q rejected: %v", cookieName, err)
+		}
+	}
+}
+
+func TestSameSiteNoneCookiesAreSecure(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithCookieSameSite(http.SameSiteNoneMode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := sessionCookie(t, manager); !cookie.Secure || cookie.SameSite != http.SameSiteNoneMode {
+		t.Fatalf("got Secure %v and SameSite %v, want a Secure SameSite=None cookie", cookie.Secure, cookie.SameSite)
+	}
+	_, _, err = wsmtest.NewSessionManager(wsm.WithCookieSameSite(http.SameSiteNoneMode), wsm.WithCookieSecure(false))
+	if !errors.Is(err, wsm.ErrInsecureSameSiteNone) {
+		t.Fatalf("got %v, want ErrInsecureSameSiteNone", err)
+	}
+}
+
+func TestHostPrefixedCookiesAreSecure(t *testing.T) {
+	manager, err := wsm.NewSessionManagerWithStorage(wsmtest.NewFakeStorage(), "__Host-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := sessionCookie(t, manager); !cookie.Secure || cookie.Path != "/" || cookie.Domain != "" {
+		t.Fatalf("got Secure %v, Path %q and Domain %q, want a Secure cookie of Path / without Domain",
+			cookie.Secure, cookie.Path, cookie.Domain)
+	}
+	_, err = wsm.NewSessionManagerWithStorage(wsmtest.NewFakeStorage(), "__Host-session", wsm.WithCookieSecure(false))
+	if !errors.Is(err, wsm.ErrInsecureHostCookie) {
+		t.Fatalf("got %v, want ErrInsecureHostCookie", err)
+	}
+}
+
+func TestRollingCookiesAreSetOnEveryRequest(t *testing.T) {
+	for _, rolling := range []bool{false, true} {
+		manager, _, err := wsmtest.NewSessionManager(wsm.WithRollingCookie(rolling), wsm.WithMaxLifetime(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, request := requestWithSession(t, manager)
+		response := httptest.NewRecorder()
+		if _, _, err = manager.StartSession(response, request); err != nil {
+			t.Fatal(err)
+		}
+		cookies := response.Result().Cookies()
+		if !rolling {
+			if len(cookies) != 0 {
+				t.Errorf("cookie set again for a resumed session without rolling cookies: %v", cookies)
+			}
+			continue
+		}
+		if len(cookies) != 1 || cookies[0].MaxAge != 3600 {
+			t.Errorf("got cookies %v for a resumed session, want the session cookie of MaxAge 3600", cookies)
+		}
+	}
+}
+
+func TestHeaderTokenFallback(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithHeaderTokenFallback("Authorization"),
+		wsm.WithCookieSigningKey([]byte("signing key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSession, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieSession, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer "+manager.SessionToken(headerSession))
+	session, isNew, err := manager.StartSession(httptest.NewRecorder(), request)
+	if err != nil || isNew || session.GetSessionId() != headerSession.GetSessionId() {
+		t.Fatalf("session of the header not resumed: new %v, error %v", isNew, err)
+	}
+	request.AddCookie(&http.Cookie{Name: wsmtest.CookieName, Value: manager.SessionToken(cookieSession)})
+	if session, _, err = manager.StartSession(httptest.NewRecorder(), request); err != nil || session.GetSessionId() != cookieSession.GetSessionId() {
+		t.Fatalf("cookie doesn't take precedence over the header, error %v", err)
+	}
+	unsigned := httptest.NewRequest("GET", "/", nil)
+	unsigned.Header.Set("Authorization", "Bearer "+headerSession.GetSessionId())
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), unsigned); !errors.Is(err, wsm.ErrInvalidCookieSignature) {
+		t.Fatalf("got %v for an unsigned header token, want ErrInvalidCookieSignature", err)
+	}
+}
+
+func TestWithPathScopesTheSetAndExpiredCookies(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithPath("/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := httptest.NewRecorder()
+	if _, _, err = manager.StartSession(started, httptest.NewRequest("GET", "/app", nil)); err != nil {
+		t.Fatal(err)
+	}
+	set := started.Result().Cookies()[0]
+	response := httptest.NewRecorder()
+	if existed, err := manager.EndSession(response, requestWithCookies(started)); err != nil || !existed {
+		t.Fatalf("session not ended: existed %v, error %v", existed, err)
+	}
+	expired := response.Result().Cookies()[0]
+	if set.Path != "/app" || expired.Path != set.Path {
+		t.Fatalf("got the Path %q for the set cookie and %q for the expired one, want /app for both", set.Path, expired.Path)
+	}
+	defaultManager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := sessionCookie(t, defaultManager); cookie.Path != "/" {
+		t.Fatalf("got the default Path %q, want /", cookie.Path)
+	}
+}
+
+func TestWithPathRejectsInvalidPaths(t *testing.T) {
+	for _, path := range []string{"", "app", "/app;Domain=evil.example", "/app\n"} {
+		if _, _, err := wsmtest.NewSessionManager(wsm.WithPath(path)); err == nil {
+			t.Errorf("cookie path %q accepted", path)
+		}
+	}
+	_, err := wsm.NewSessionManagerWithStorage(wsmtest.NewFakeStorage(), "__Host-session", wsm.WithPath("/app"))
+	if !errors.Is(err, wsm.ErrHostCookiePath) {
+		t.Fatalf("got %v for a __Host- prefixed cookie of Path /app, want ErrHostCookiePath", err)
+	}
+}
+
+func TestExpiredCookieMatchesTheSessionCookie(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithPath("/app"), wsm.WithCookieDomain("example.com"),
+		wsm.WithCookieSecure(true), wsm.WithCookieSameSite(http.SameSiteStrictMode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := httptest.NewRecorder()
+	if _, _, err = manager.StartSession(started, httptest.NewRequest("GET", "/app", nil)); err != nil {
+		t.Fatal(err)
+	}
+	set := started.Result().Cookies()[0]
+	response := httptest.NewRecorder()
+	if _, err = manager.EndSession(response, requestWithCookies(started)); err != nil {
+		t.Fatal(err)
+	}
+	expired := response.Result().Cookies()[0]
+	if set.Domain != "example.com" || set.Path != "/app" {
+		t.Fatalf("got Domain %q and Path %q, want the configured ones", set.Domain, set.Path)
+	}
+	if expired.Name != set.Name || expired.Path != set.Path || expired.Domain != set.Domain ||
+		expired.Secure != set.Secure || expired.SameSite != set.SameSite || expired.HttpOnly != set.HttpOnly {
+		t.Fatalf("expired cookie %+v doesn't match the session cookie %+v", expired, set)
+	}
+	if expired.MaxAge >= 0 || expired.Value != "" {
+		t.Fatalf("got MaxAge %d and value %q, want an expired empty cookie", expired.MaxAge, expired.Value)
+	}
+}
+
+func TestWithCookieDomainRejectsInvalidDomains(t *testing.T) {
+	for _, domain := range []string{"", "example.com; Secure", "exa mple.com", "example.com/app"} {
+		if _, _, err := wsmtest.NewSessionManager(wsm.WithCookieDomain(domain)); err == nil {
+			t.Errorf("cookie domain %q accepted", domain)
+		}
+	}
+	_, err := wsm.NewSessionManagerWithStorage(wsmtest.NewFakeStorage(), "__Host-session", wsm.WithCookieDomain("example.com"))
+	if !errors.Is(err, wsm.ErrHostCookieDomain) {
+		t.Fatalf("got %v for a __Host- prefixed cookie with a Domain, want ErrHostCookieDomain", err)
+	}
+}
+
+func TestSessionCookiesHaveNoMaxAgeNorExpires(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithSessionCookie(true), wsm.WithCookieMaxAge(3600),
+		wsm.WithRollingCookie(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := httptest.NewRecorder()
+	if _, _, err = manager.StartSession(started, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	header := started.Header().Get("Set-Cookie")
+	if strings.Contains(header, "Max-Age") || strings.Contains(header, "Expires") {
+		t.Fatalf("got Set-Cookie %q, want a session cookie without Max-Age nor Expires", header)
+	}
+	resumed := httptest.NewRecorder()
+	if _, _, err = manager.StartSession(resumed, requestWithCookies(started)); err != nil {
+		t.Fatal(err)
+	}
+	if header = resumed.Header().Get("Set-Cookie"); header == "" || strings.Contains(header, "Max-Age") {
+		t.Fatalf("got Set-Cookie %q for the rolled cookie, want a session cookie", header)
+	}
+	ended := httptest.NewRecorder()
+	if _, err = manager.EndSession(ended, requestWithCookies(started)); err != nil {
+		t.Fatal(err)
+	}
+	if expired := ended.Result().Cookies()[0]; expired.MaxAge >= 0 || expired.Value != "" {
+		t.Fatalf("got MaxAge %d and value %q, want the session cookie expired", expired.MaxAge, expired.Value)
+	}
+}
+
+func TestInsecureCookieForLocalDevFollowsTheRequestScheme(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithInsecureCookieForLocalDev(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := httptest.NewRequest("GET", "http://example.com/", nil)
+	forwarded.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	proxiedPlain := httptest.NewRequest("GET", "http://example.com/", nil)
+	proxiedPlain.Header.Set("X-Forwarded-Proto", "http")
+	for _, test := range []struct {
+		name    string
+		request *http.Request
+		secure  bool
+	}{
+		{"TLS", httptest.NewRequest("GET", "https://example.com/", nil), true},
+		{"forwarded HTTPS", forwarded, true},
+		{"plain HTTP", httptest.NewRequest("GET", "http://localhost/", nil), false},
+		{"forwarded HTTP", proxiedPlain, false},
+	} {
+		started := httptest.NewRecorder()
+		if _, _, err = manager.StartSession(started, test.request); err != nil {
+			t.Fatal(err)
+		}
+		ended := httptest.NewRecorder()
+		resumed := test.request.Clone(test.request.Context())
+		for _, cookie := range started.Result().Cookies() {
+			resumed.AddCookie(cookie)
+		}
+		if _, err = manager.EndSession(ended, resumed); err != nil {
+			t.Fatal(err)
+		}
+		for _, response := range []*httptest.ResponseRecorder{started, ended} {
+			if cookies := response.Result().Cookies(); len(cookies) != 1 || cookies[0].Secure != test.secure {
+				t.Errorf("%s request: got cookies %v, want Secure %v", test.name, cookies, test.secure)
+			}
+		}
+	}
+	written := httptest.NewRecorder()
+	session, _, err := manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.WriteCookie(written, session, 60)
+	if cookies := written.Result().Cookies(); len(cookies) != 1 || !cookies[0].Secure {
+		t.Fatalf("got cookies %v from WriteCookie, want a Secure cookie", cookies)
+	}
+}
+
+func TestInsecureCookieForLocalDevKeepsRequiredSecureCookies(t *testing.T) {
+	for _, option := range []wsm.Option{wsm.WithCookieSecure(true), wsm.WithCookieSameSite(http.SameSiteNoneMode)} {
+		manager, _, err := wsmtest.NewSessionManager(wsm.WithInsecureCookieForLocalDev(true), option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie := sessionCookie(t, manager); !cookie.Secure {
+			t.Fatal("required Secure attribute dropped on a plain HTTP request")
+		}
+	}
+	manager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	if _, _, err = manager.StartSession(response, httptest.NewRequest("GET", "https://example.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := response.Result().Cookies(); len(cookies) != 1 || cookies[0].Secure {
+		t.Fatalf("got cookies %v, want the static Secure attribute without the option", cookies)
+	}
+}
+
+func TestPaddedCookiesRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		blockSize  int
+		signingKey []byte
+	}{
+		{64, nil},
+		{7, nil},
+		{64, []byte("signing key")},
+	} {
+		options := []wsm.Option{wsm.WithCookiePadding(test.blockSize)}
+		if test.signingKey != nil {
+			options = append(options, wsm.WithCookieSigningKey(test.signingKey))
+		}
+		manager, _, err := wsmtest.NewSessionManager(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := httptest.NewRecorder()
+		session, _, err := manager.StartSession(started, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies := started.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("got cookies %v, want the session cookie", cookies)
+		}
+		if value := cookies[0].Value; len(value)%test.blockSize != 0 || !strings.HasSuffix(value, "*") {
+			t.Fatalf("got the cookie value %q, want it padded to a multiple of %d characters", value, test.blockSize)
+		}
+		resumed, isNew, err := manager.StartSession(httptest.NewRecorder(), requestWithCookies(started))
+		if err != nil || isNew || resumed.GetSessionId() != session.GetSessionId() {
+			t.Fatalf("padded cookie not decoded to its session: new %v, error %v", isNew, err)
+		}
+		manager.Stop()
+	}
+	if _, _, err := wsmtest.NewSessionManager(wsm.WithCookiePadding(0)); err == nil {
+		t.Fatal("padding block size of zero accepted")
+	}
+}
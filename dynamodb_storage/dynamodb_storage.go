@@ -0,0 +1,592 @@
+// Package dynamodb_storage provides a storage media keeping sessions in a DynamoDB table, through the AWS SDK v2,
+// each session stored as an item expired by the TTL of DynamoDB itself.
+package dynamodb_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTableName is the table sessions are stored in when DynamoDBConfig has no TableName set.
+const DefaultTableName = "sessions"
+
+// ExpiresAtAttribute is the attribute holding the unix time in seconds a session expires at,
+// the TTL attribute of the sessions table. Pinned sessions are stored without it.
+const ExpiresAtAttribute = "expiresAt"
+
+// Attributes of the item of a session: its ID, the partition key, its encoded content,
+// and its version, incremented on every change.
+const (
+	idAttribute      = "id"
+	dataAttribute    = "data"
+	versionAttribute = "version"
+)
+
+// tableCreationTimeout is how long EnsureTable waits for a table it created to become active.
+const tableCreationTimeout = 2 * time.Minute
+
+// ErrNotConfigured is an error used when a DynamoDBStorage is used before being opened with a configuration.
+var ErrNotConfigured = errors.New("wsm: dynamodb storage is not configured")
+
+// ErrAlreadyOpen is an error used when a DynamoDBStorage already opened is opened again.
+var ErrAlreadyOpen = errors.New("wsm: dynamodb storage is already open")
+
+// tableNamePattern matches the table names DynamoDB accepts.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,255}$`)
+
+// DynamoDBAPI is the part of the DynamoDB client used by DynamoDBStorage, implemented by *dynamodb.Client.
+type DynamoDBAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+// DynamoDBConfig is the configuration of a DynamoDBStorage.
+// Client is the DynamoDB client sessions are stored through, e.g. dynamodb.NewFromConfig(awsConfig),
+// and TableName the table holding them, created with its TTL on the expiresAt attribute by EnsureTable
+// if it doesn't exist, unless SkipEnsureTable is set, e.g. when the table is managed by infrastructure as code.
+type DynamoDBConfig struct {
+	Client    DynamoDBAPI
+	TableName string
+	// SkipEnsureTable skips creating the sessions table on opening.
+	SkipEnsureTable bool
+}
+
+// DynamoDBStorage represents a DynamoDB storage media type to store sessions in, an item per session
+// in its sessions table, with an expiresAt attribute of the maximum lifetime, or of their own expiry,
+// renewed on every change, so DynamoDB expires sessions by itself through the TTL of the table.
+// DynamoDB deletes expired items up to a few days late, so they are never retrieved once expired.
+// Pinned sessions are stored without expiresAt. Sessions are stored as json, so values are retrieved
+// as decoded by encoding/json, and every change is a conditional write on their version,
+// so concurrent requests of a session never overwrite each other.
+// It must be created by NewDynamoDBStorage, or opened by Open before being used.
+type DynamoDBStorage struct {
+	sync.Mutex
+	client          DynamoDBAPI
+	tableName       string
+	maxLifetime     time.Duration
+	clock           abstract_definition.ClockHolder
+	maxSessionBytes atomic.Int64
+}
+
+// SetClock is a method for DynamoDBStorage that sets the clock stamping the last access time of sessions
+// and the time they expire at.
+func (storage *DynamoDBStorage) SetClock(clock abstract_definition.Clock) {
+	storage.clock.SetClock(clock)
+}
+
+// Now is a method for DynamoDBStorage that returns the current time of its clock.
+func (storage *DynamoDBStorage) Now() time.Time {
+	return storage.clock.Now()
+}
+
+// NewDynamoDBStorage is a function that opens a DynamoDBStorage from the configuration,
+// ensuring its sessions table exists unless SkipEnsureTable is set.
+// It returns an error if the configuration is invalid, or the sessions table could not be created.
+func NewDynamoDBStorage(config DynamoDBConfig) (*DynamoDBStorage, error) {
+	storage := &DynamoDBStorage{}
+	if err := storage.Open(config); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// Open is a method for DynamoDBStorage that configures the storage from the configuration,
+// ensuring its sessions table exists unless SkipEnsureTable is set.
+// It returns an ErrAlreadyOpen error if the storage is already open, and an error if the configuration is invalid,
+// or the sessions table could not be created.
+func (storage *DynamoDBStorage) Open(config DynamoDBConfig) error {
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.client != nil {
+		return ErrAlreadyOpen
+	}
+	if config.Client == nil {
+		return errors.New("wsm: dynamodb client must not be nil")
+	}
+	tableName := config.TableName
+	if tableName == "" {
+		tableName = DefaultTableName
+	}
+	if !tableNamePattern.MatchString(tableName) {
+		return fmt.Errorf("wsm: invalid dynamodb table name %q", tableName)
+	}
+	openedStorage := &DynamoDBStorage{client: config.Client, tableName: tableName}
+	if !config.SkipEnsureTable {
+		if err := openedStorage.EnsureTable(context.Background()); err != nil {
+			return err
+		}
+	}
+	storage.client, storage.tableName = config.Client, tableName
+	return nil
+}
+
+// configured is a method for DynamoDBStorage that returns its client and table,
+// or an ErrNotConfigured error if it was not opened.
+func (storage *DynamoDBStorage) configured() (DynamoDBAPI, *string, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.client == nil {
+		return nil, nil, ErrNotConfigured
+	}
+	return storage.client, aws.String(storage.tableName), nil
+}
+
+// EnsureTable is a method for DynamoDBStorage that creates the sessions table, billed per request
+// and partitioned by session ID, if it doesn't exist, waits for it to become active, and enables its TTL
+// on the expiresAt attribute unless it's already enabled.
+// It returns an error if the table could not be described, created, or given its TTL.
+func (storage *DynamoDBStorage) EnsureTable(ctx context.Context) error {
+	client, tableName, err := storage.configured()
+	if err != nil {
+		return err
+	}
+	_, err = client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: tableName})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		_, err = client.CreateTable(ctx, &dynamodb.CreateTableInput{
+			TableName:            tableName,
+			AttributeDefinitions: []types.AttributeDefinition{{AttributeName: aws.String(idAttribute), AttributeType: types.ScalarAttributeTypeS}},
+			KeySchema:            []types.KeySchemaElement{{AttributeName: aws.String(idAttribute), KeyType: types.KeyTypeHash}},
+			BillingMode:          types.BillingModePayPerRequest,
+		})
+		if err != nil {
+			return fmt.Errorf("wsm: could not create the dynamodb sessions table: %w", err)
+		}
+		waiter := dynamodb.NewTableExistsWaiter(client, func(options *dynamodb.TableExistsWaiterOptions) {
+			options.MinDelay = time.Second
+		})
+		err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: tableName}, tableCreationTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("wsm: could not describe the dynamodb sessions table: %w", err)
+	}
+	timeToLive, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: tableName})
+	if err != nil {
+		return fmt.Errorf("wsm: could not describe the TTL of the dynamodb sessions table: %w", err)
+	}
+	if isTimeToLiveEnabled(timeToLive.TimeToLiveDescription) {
+		return nil
+	}
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: tableName,
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(ExpiresAtAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("wsm: could not enable the TTL of the dynamodb sessions table: %w", err)
+	}
+	return nil
+}
+
+// isTimeToLiveEnabled is a function that reports whether the TTL of a table is enabled, or being enabled,
+// on the expiresAt attribute, DynamoDB rejecting an UpdateTimeToLive enabling it again.
+func isTimeToLiveEnabled(description *types.TimeToLiveDescription) bool {
+	if description == nil || aws.ToString(description.AttributeName) != ExpiresAtAttribute {
+		return false
+	}
+	return description.TimeToLiveStatus == types.TimeToLiveStatusEnabled ||
+		description.TimeToLiveStatus == types.TimeToLiveStatusEnabling
+}
+
+// expiresAt is a method for DynamoDBStorage that returns the unix time in seconds a session expires at,
+// after its own expiry or the maximum lifetime from its last access, and false for pinned sessions,
+// stored without expiration.
+func (storage *DynamoDBStorage) expiresAt(data abstract_definition.SessionData) (int64, bool) {
+	if data.Pinned {
+		return 0, false
+	}
+	storage.Lock()
+	lifetime := storage.maxLifetime
+	storage.Unlock()
+	if data.Expiry > 0 {
+		lifetime = data.Expiry
+	}
+	return data.LastAccessTime.Add(lifetime + time.Second - 1).Unix(), true
+}
+
+// newItem is a method for DynamoDBStorage that encodes a session into the item storing it at the given version.
+func (storage *DynamoDBStorage) newItem(data abstract_definition.SessionData, version int64) (map[string]types.AttributeValue, error) {
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return nil, fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	item := map[string]types.AttributeValue{
+		idAttribute:      &types.AttributeValueMemberS{Value: data.Id},
+		dataAttribute:    &types.AttributeValueMemberB{Value: encodedData},
+		versionAttribute: numberAttribute(version),
+	}
+	if expiresAt, expires := storage.expiresAt(data); expires {
+		item[ExpiresAtAttribute] = numberAttribute(expiresAt)
+	}
+	return item, nil
+}
+
+// numberAttribute is a function that returns the DynamoDB number attribute of an integer.
+func numberAttribute(value int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(value, 10)}
+}
+
+// itemNumber is a function that returns the integer of a number attribute of an item, and false if it's missing.
+func itemNumber(item map[string]types.AttributeValue, attribute string) (int64, bool, error) {
+	number, isNumber := item[attribute].(*types.AttributeValueMemberN)
+	if !isNumber {
+		return 0, false, nil
+	}
+	value, err := strconv.ParseInt(number.Value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("wsm: invalid %s attribute %q: %w", attribute, number.Value, err)
+	}
+	return value, true, nil
+}
+
+// isExpired is a method for DynamoDBStorage that reports whether an item has expired, even if DynamoDB
+// has not deleted it yet.
+func (storage *DynamoDBStorage) isExpired(item map[string]types.AttributeValue) (bool, error) {
+	expiresAt, expires, err := itemNumber(item, ExpiresAtAttribute)
+	if err != nil || !expires {
+		return false, err
+	}
+	return storage.Now().Unix() >= expiresAt, nil
+}
+
+// readSession is a method for DynamoDBStorage that reads the item of the session belonging to the given ID
+// with a strongly consistent read, and decodes it along with its version.
+// If it doesn't exist, or has expired, it returns a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) readSession(sessionId string) (abstract_definition.SessionData, int64, error) {
+	client, tableName, err := storage.configured()
+	if err != nil {
+		return abstract_definition.SessionData{}, 0, err
+	}
+	output, err := client.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName:      tableName,
+		Key:            map[string]types.AttributeValue{idAttribute: &types.AttributeValueMemberS{Value: sessionId}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return abstract_definition.SessionData{}, 0, err
+	}
+	if output.Item == nil {
+		return abstract_definition.SessionData{}, 0, abstract_definition.SessionNotExist
+	}
+	if expired, err := storage.isExpired(output.Item); err != nil || expired {
+		if err == nil {
+			err = abstract_definition.SessionNotExist
+		}
+		return abstract_definition.SessionData{}, 0, err
+	}
+	version, _, err := itemNumber(output.Item, versionAttribute)
+	if err != nil {
+		return abstract_definition.SessionData{}, 0, err
+	}
+	encodedData, isBinary := output.Item[dataAttribute].(*types.AttributeValueMemberB)
+	if !isBinary {
+		return abstract_definition.SessionData{}, 0, errors.New("wsm: could not decode the session: missing data attribute")
+	}
+	data, err := stored_session.UnmarshalSessionData(encodedData.Value)
+	if err != nil {
+		return abstract_definition.SessionData{}, 0, fmt.Errorf("wsm: could not decode the session: %w", err)
+	}
+	return data, version, nil
+}
+
+// putSession is a method for DynamoDBStorage that stores the item of a session at the given version,
+// only if the stored item is at the previous version when the version is greater than one.
+// It returns a types.ConditionalCheckFailedException error if the stored item changed in the meantime.
+func (storage *DynamoDBStorage) putSession(data abstract_definition.SessionData, version int64) error {
+	client, tableName, err := storage.configured()
+	if err != nil {
+		return err
+	}
+	item, err := storage.newItem(data, version)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{TableName: tableName, Item: item}
+	if version > 1 {
+		input.ConditionExpression = aws.String("#version = :previous")
+		input.ExpressionAttributeNames = map[string]string{"#version": versionAttribute}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{":previous": numberAttribute(version - 1)}
+	}
+	_, err = client.PutItem(context.Background(), input)
+	return err
+}
+
+// SetMaxLifetime is a method for DynamoDBStorage that sets the maximum lifetime sessions are stored with,
+// rounded up to whole seconds as DynamoDB expires items.
+func (storage *DynamoDBStorage) SetMaxLifetime(maxLifetime time.Duration) {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.maxLifetime = maxLifetime
+}
+
+// SetMaxSessionBytes is a method for DynamoDBStorage that sets the maximum size of sessions as encoded in their item,
+// zero meaning no limit.
+func (storage *DynamoDBStorage) SetMaxSessionBytes(maxBytes int) {
+	storage.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// CheckSessionSize is a method for DynamoDBStorage that returns an abstract_definition.ErrSessionTooLarge error
+// if the content of a session would exceed the maximum size once encoded in its item.
+func (storage *DynamoDBStorage) CheckSessionSize(data abstract_definition.SessionData) error {
+	maxBytes := storage.maxSessionBytes.Load()
+	if maxBytes == 0 {
+		return nil
+	}
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return stored_session.CheckSize(len(encodedData), maxBytes)
+}
+
+// UpdateSession is a method for DynamoDBStorage that reads the session belonging to the given ID,
+// applies the update to it, stores it back only if it hasn't been changed in the meantime, retrying otherwise,
+// and returns its new content.
+// It returns the error of the update without storing anything if the update fails.
+func (storage *DynamoDBStorage) UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	for {
+		data, version, err := storage.readSession(sessionId)
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		if err = update(&data); err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		err = storage.putSession(data, version+1)
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) {
+			continue
+		}
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		return stored_session.CopySessionData(data), nil
+	}
+}
+
+// InitializeSession is a method for DynamoDBStorage that takes a session ID argument of type string
+// creates a new session, stores it in the sessions table, and then return that session.
+// It returns an error if the session could not be stored.
+func (storage *DynamoDBStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	now := storage.Now()
+	data := abstract_definition.SessionData{
+		Id:             sessionId,
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values:         make(map[interface{}]interface{}),
+	}
+	if err := storage.putSession(data, 1); err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSession is a method for DynamoDBStorage that takes session ID of type string as an argument
+// and returns the session stored in the sessions table that belongs to the given ID, if it doesn't exist
+// or has expired it returns a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	data, _, err := storage.readSession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSessionAndTouch is a method for DynamoDBStorage that takes session ID of type string as an argument
+// and returns the session stored in the sessions table that belongs to the given ID, updating its last access time
+// and renewing its expiration in the same conditional write, if it doesn't exist it returns
+// a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	data, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// UpdateSessionLastAccess is a method for DynamoDBStorage that updates the session's
+// last access time when it's used, renewing its expiration.
+func (storage *DynamoDBStorage) UpdateSessionLastAccess(sessionId string) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	return err
+}
+
+// DestroySession is a method for DynamoDBStorage that deletes a session from the sessions table if found,
+// otherwise it returns a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) DestroySession(sessionId string) error {
+	client, tableName, err := storage.configured()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName:                tableName,
+		Key:                      map[string]types.AttributeValue{idAttribute: &types.AttributeValueMemberS{Value: sessionId}},
+		ConditionExpression:      aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]string{"#id": idAttribute},
+	})
+	var notFound *types.ConditionalCheckFailedException
+	if errors.As(err, &notFound) {
+		return abstract_definition.SessionNotExist
+	}
+	return err
+}
+
+// Ping is a method for DynamoDBStorage that describes the sessions table, checking it can be reached.
+// It returns an ErrNotConfigured error if the storage was not opened, and an error if the table could not be described.
+func (storage *DynamoDBStorage) Ping(ctx context.Context) error {
+	client, tableName, err := storage.configured()
+	if err != nil {
+		return err
+	}
+	if _, err = client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: tableName}); err != nil {
+		return fmt.Errorf("wsm: could not reach the dynamodb sessions table: %w", err)
+	}
+	return nil
+}
+
+// DestroyAllSessions is a method for DynamoDBStorage that deletes all the sessions from the sessions table,
+// one item at a time. Sessions already removed are skipped.
+func (storage *DynamoDBStorage) DestroyAllSessions() error {
+	sessionIds, err := storage.scanSessionIds(false)
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		err = storage.DestroySession(sessionId)
+		if err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// TerminateSessionOnExpiration is a method for DynamoDBStorage that records the maximum lifetime
+// sessions are stored with, since DynamoDB expires sessions by itself, so it never terminates any.
+func (storage *DynamoDBStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	storage.SetMaxLifetime(maxLifetime)
+	return 0, nil
+}
+
+// scanSessionIds is a method for DynamoDBStorage that scans the whole sessions table for the IDs of its sessions,
+// leaving out the expired ones not deleted yet unless all of them are wanted, and returns them sorted.
+func (storage *DynamoDBStorage) scanSessionIds(unexpiredOnly bool) ([]string, error) {
+	client, tableName, err := storage.configured()
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                tableName,
+		ProjectionExpression:     aws.String("#id, #expiresAt"),
+		ExpressionAttributeNames: map[string]string{"#id": idAttribute, "#expiresAt": ExpiresAtAttribute},
+	}
+	var sessionIds []string
+	for {
+		output, err := client.Scan(context.Background(), input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range output.Items {
+			id, isString := item[idAttribute].(*types.AttributeValueMemberS)
+			if !isString {
+				continue
+			}
+			if unexpiredOnly {
+				if expired, err := storage.isExpired(item); err != nil || expired {
+					continue
+				}
+			}
+			sessionIds = append(sessionIds, id.Value)
+		}
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+	sort.Strings(sessionIds)
+	return sessionIds, nil
+}
+
+// ListSessions is a method for DynamoDBStorage that returns the IDs of all the unexpired sessions,
+// scanning the whole sessions table.
+func (storage *DynamoDBStorage) ListSessions() ([]string, error) {
+	return storage.scanSessionIds(true)
+}
+
+// ScanSessions is a method for DynamoDBStorage that returns a page of at most limit session IDs following
+// the cursor, in ascending order, and the cursor of the next page. A DynamoDB scan being unordered,
+// the whole sessions table is scanned for every page.
+func (storage *DynamoDBStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", abstract_definition.ErrInvalidScanLimit
+	}
+	sessionIds, err := storage.scanSessionIds(true)
+	if err != nil {
+		return nil, "", err
+	}
+	return abstract_definition.PageSessionIds(sessionIds, cursor, limit)
+}
+
+// ExportSession is a method for DynamoDBStorage that returns the full content of the session
+// belonging to the given ID, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	data, _, err := storage.readSession(sessionId)
+	return data, err
+}
+
+// ImportSession is a method for DynamoDBStorage that stores a session from its full content,
+// replacing any session with the same ID.
+// It returns an error if a key is not a string, the session is larger than the maximum session size,
+// with an abstract_definition.ErrSessionTooLarge error, or the session could not be stored.
+func (storage *DynamoDBStorage) ImportSession(data abstract_definition.SessionData) error {
+	if err := storage.CheckSessionSize(data); err != nil {
+		return err
+	}
+	return storage.putSession(data, 1)
+}
+
+// Pin is a method for DynamoDBStorage that stores the session belonging to the given ID without expiration,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) Pin(sessionId string) error {
+	return storage.setPinned(sessionId, true)
+}
+
+// Unpin is a method for DynamoDBStorage that makes a pinned session belonging to the given ID expire again,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *DynamoDBStorage) Unpin(sessionId string) error {
+	return storage.setPinned(sessionId, false)
+}
+
+// setPinned is a method for DynamoDBStorage that sets the pin state of the session belonging to the given ID.
+func (storage *DynamoDBStorage) setPinned(sessionId string, pinned bool) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.Pinned = pinned
+		return nil
+	})
+	return err
+}
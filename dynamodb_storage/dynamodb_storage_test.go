@@ -0,0 +1,437 @@
+package dynamodb_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"local/zyrx/backup/abstract_definition"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDynamoDB is a DynamoDBAPI keeping the items of a single table in memory, answering the conditions
+// DynamoDBStorage writes with, and scanning pageSize items per page.
+type fakeDynamoDB struct {
+	sync.Mutex
+	tableExists   bool
+	ttlAttribute  string
+	ttlUpdates    int
+	items         map[string]map[string]types.AttributeValue
+	pageSize      int
+	beforePutItem func()
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]map[string]types.AttributeValue), pageSize: 2}
+}
+
+func itemKey(key map[string]types.AttributeValue) string {
+	return key[idAttribute].(*types.AttributeValueMemberS).Value
+}
+
+func copyItem(item map[string]types.AttributeValue) map[string]types.AttributeValue {
+	copied := make(map[string]types.AttributeValue, len(item))
+	for attribute, value := range item {
+		copied[attribute] = value
+	}
+	return copied
+}
+
+func (fake *fakeDynamoDB) GetItem(_ context.Context, input *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	item, found := fake.items[itemKey(input.Key)]
+	if !found {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(item)}, nil
+}
+
+func (fake *fakeDynamoDB) PutItem(_ context.Context, input *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	fake.Lock()
+	beforePutItem := fake.beforePutItem
+	fake.beforePutItem = nil
+	fake.Unlock()
+	if beforePutItem != nil {
+		beforePutItem()
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	id := itemKey(input.Item)
+	if input.ConditionExpression != nil {
+		stored, found := fake.items[id]
+		previous := input.ExpressionAttributeValues[":previous"].(*types.AttributeValueMemberN).Value
+		if !found || stored[versionAttribute].(*types.AttributeValueMemberN).Value != previous {
+			return nil, &types.ConditionalCheckFailedException{Message: aws.String("version changed")}
+		}
+	}
+	fake.items[id] = copyItem(input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (fake *fakeDynamoDB) DeleteItem(_ context.Context, input *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	id := itemKey(input.Key)
+	if _, found := fake.items[id]; !found && input.ConditionExpression != nil {
+		return nil, &types.ConditionalCheckFailedException{Message: aws.String("no item")}
+	}
+	delete(fake.items, id)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (fake *fakeDynamoDB) Scan(_ context.Context, input *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	ids := make([]string, 0, len(fake.items))
+	for id := range fake.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start := 0
+	if input.ExclusiveStartKey != nil {
+		start = sort.SearchStrings(ids, itemKey(input.ExclusiveStartKey)) + 1
+	}
+	output := &dynamodb.ScanOutput{}
+	for index, id := range ids[start:] {
+		if len(output.Items) == fake.pageSize {
+			output.LastEvaluatedKey = map[string]types.AttributeValue{idAttribute: fake.items[ids[start+index-1]][idAttribute]}
+			break
+		}
+		item := map[string]types.AttributeValue{idAttribute: fake.items[id][idAttribute]}
+		if expiresAt, expires := fake.items[id][ExpiresAtAttribute]; expires {
+			item[ExpiresAtAttribute] = expiresAt
+		}
+		output.Items = append(output.Items, item)
+	}
+	return output, nil
+}
+
+func (fake *fakeDynamoDB) DescribeTable(_ context.Context, input *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	if !fake.tableExists {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("no table")}
+	}
+	return &dynamodb.DescribeTableOutput{Table: &types.TableDescription{TableName: input.TableName, TableStatus: types.TableStatusActive}}, nil
+}
+
+func (fake *fakeDynamoDB) CreateTable(context.Context, *dynamodb.CreateTableInput, ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.tableExists = true
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (fake *fakeDynamoDB) DescribeTimeToLive(context.Context, *dynamodb.DescribeTimeToLiveInput, ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.ttlAttribute == "" {
+		return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}}, nil
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &types.TimeToLiveDescription{
+		AttributeName: aws.String(fake.ttlAttribute), TimeToLiveStatus: types.TimeToLiveStatusEnabled}}, nil
+}
+
+func (fake *fakeDynamoDB) UpdateTimeToLive(_ context.Context, input *dynamodb.UpdateTimeToLiveInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.ttlAttribute = aws.ToString(input.TimeToLiveSpecification.AttributeName)
+	fake.ttlUpdates++
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+// storedExpiresAt returns the expiresAt attribute of the item of a session, and false if it has none.
+func (fake *fakeDynamoDB) storedExpiresAt(t *testing.T, sessionId string) (int64, bool) {
+	t.Helper()
+	fake.Lock()
+	defer fake.Unlock()
+	value, expires := fake.items[sessionId][ExpiresAtAttribute]
+	if !expires {
+		return 0, false
+	}
+	expiresAt, err := strconv.ParseInt(value.(*types.AttributeValueMemberN).Value, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expiresAt, true
+}
+
+// fixedClock is a clock only moving when it's advanced.
+type fixedClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (clock *fixedClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *fixedClock) advance(duration time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// newStorage returns a storage opened on a new fakeDynamoDB, with a maximum lifetime of a minute
+// and a fixedClock.
+func newStorage(t *testing.T) (*DynamoDBStorage, *fakeDynamoDB, *fixedClock) {
+	t.Helper()
+	fake := newFakeDynamoDB()
+	storage, err := NewDynamoDBStorage(DynamoDBConfig{Client: fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fixedClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	storage.SetClock(clock)
+	storage.SetMaxLifetime(time.Minute)
+	return storage, fake, clock
+}
+
+func TestEnsureTableCreatesTheTableWithItsTTL(t *testing.T) {
+	_, fake, _ := newStorage(t)
+	if !fake.tableExists || fake.ttlAttribute != ExpiresAtAttribute {
+		t.Fatalf("table created %v, TTL on %q", fake.tableExists, fake.ttlAttribute)
+	}
+	if _, err := NewDynamoDBStorage(DynamoDBConfig{Client: fake}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.ttlUpdates != 1 {
+		t.Fatalf("TTL enabled %d times, want once", fake.ttlUpdates)
+	}
+}
+
+func TestSessionsArePutRetrievedAndDeleted(t *testing.T) {
+	storage, _, _ := newStorage(t)
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := retrieved.GetValue("username"); value != "zyrx" {
+		t.Fatalf("got %v, want the stored value", value)
+	}
+	if err = storage.DestroySession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v after the deletion, want SessionNotExist", err)
+	}
+	if err = storage.DestroySession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v deleting a missing session, want SessionNotExist", err)
+	}
+}
+
+func TestExpiresAtFollowsTheLastAccessAndExpiry(t *testing.T) {
+	storage, fake, clock := newStorage(t)
+	start := clock.Now()
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt, _ := fake.storedExpiresAt(t, "id"); expiresAt != start.Add(time.Minute).Unix() {
+		t.Fatalf("got expiresAt %d, want the maximum lifetime from the creation", expiresAt)
+	}
+	clock.advance(30 * time.Second)
+	if err = storage.UpdateSessionLastAccess("id"); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt, _ := fake.storedExpiresAt(t, "id"); expiresAt != start.Add(90*time.Second).Unix() {
+		t.Fatalf("got expiresAt %d, want it renewed by the access", expiresAt)
+	}
+	if err = session.SetExpiry(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if expiresAt, _ := fake.storedExpiresAt(t, "id"); expiresAt != start.Add(40*time.Second).Unix() {
+		t.Fatalf("got expiresAt %d, want the expiry of the session from its last access", expiresAt)
+	}
+	if err = storage.Pin("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, expires := fake.storedExpiresAt(t, "id"); expires {
+		t.Fatal("pinned session stored with expiresAt")
+	}
+	if err = storage.Unpin("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, expires := fake.storedExpiresAt(t, "id"); !expires {
+		t.Fatal("unpinned session stored without expiresAt")
+	}
+}
+
+func TestExpiredItemsAreNotRetrieved(t *testing.T) {
+	storage, fake, clock := newStorage(t)
+	for _, sessionId := range []string{"expiring", "pinned"} {
+		if _, err := storage.InitializeSession(sessionId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Pin("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+	if count, err := storage.TerminateSessionOnExpiration(time.Minute); err != nil || count != 0 {
+		t.Fatalf("terminated %d sessions, error %v, DynamoDB expires them by itself", count, err)
+	}
+	if _, err := storage.RetrieveSession("expiring"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for an expired item not deleted yet, want SessionNotExist", err)
+	}
+	if ids, err := storage.ListSessions(); err != nil || len(ids) != 1 || ids[0] != "pinned" {
+		t.Fatalf("listed %v, error %v, want only the pinned session", ids, err)
+	}
+	if len(fake.items) != 2 {
+		t.Fatalf("%d items left, expired items are deleted by DynamoDB", len(fake.items))
+	}
+}
+
+func TestConcurrentChangeIsRetried(t *testing.T) {
+	storage, fake, _ := newStorage(t)
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSession, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.beforePutItem = func() {
+		if err := otherSession.SetValue("other", "value"); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = session.SetValue("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retrieved.GetValue("key") != "value" || retrieved.GetValue("other") != "value" {
+		t.Fatal("concurrent change overwritten")
+	}
+}
+
+func TestScanSessionsPagesInOrder(t *testing.T) {
+	storage, _, _ := newStorage(t)
+	for index := 4; index >= 0; index-- {
+		if _, err := storage.InitializeSession(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var scanned []string
+	cursor := ""
+	for {
+		ids, next, err := storage.ScanSessions(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned = append(scanned, ids...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprint(scanned) != "[id0 id1 id2 id3 id4]" {
+		t.Fatalf("scanned %v", scanned)
+	}
+	if err := storage.DestroyAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := storage.ListSessions(); err != nil || len(ids) != 0 {
+		t.Fatalf("listed %v after destroying all the sessions, error %v", ids, err)
+	}
+}
+
+func TestPingDescribesTheTable(t *testing.T) {
+	storage, fake, _ := newStorage(t)
+	if err := storage.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.tableExists = false
+	if err := storage.Ping(context.Background()); err == nil {
+		t.Fatal("missing table reported as reachable")
+	}
+	if err := (&DynamoDBStorage{}).Ping(context.Background()); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("got %v, want ErrNotConfigured", err)
+	}
+}
+
+func TestOpenRefusesToReopen(t *testing.T) {
+	storage, _, _ := newStorage(t)
+	if err := storage.Open(DynamoDBConfig{Client: newFakeDynamoDB()}); !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("got %v, want ErrAlreadyOpen", err)
+	}
+	if _, err := NewDynamoDBStorage(DynamoDBConfig{Client: newFakeDynamoDB(), TableName: "a"}); err == nil {
+		t.Fatal("invalid table name accepted")
+	}
+}
+
+// TestDynaliteSessions runs against a local DynamoDB, such as dynalite, at the endpoint in WSM_DYNAMODB_ENDPOINT,
+// e.g. http://localhost:4567 after npx dynalite --port 4567. It's skipped if the variable isn't set.
+func TestDynaliteSessions(t *testing.T) {
+	endpoint := os.Getenv("WSM_DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("WSM_DYNAMODB_ENDPOINT is not set")
+	}
+	client := dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "local", SecretAccessKey: "local"}, nil
+		}),
+	})
+	tableName := fmt.Sprint("wsm_sessions_", time.Now().UnixNano())
+	probe := &DynamoDBStorage{client: client, tableName: tableName}
+	// dynalite doesn't implement TTL, so the table is only created, its TTL being enabled by EnsureTable on DynamoDB.
+	if err := probe.EnsureTable(context.Background()); err != nil {
+		t.Logf("EnsureTable: %v", err)
+	}
+	storage, err := NewDynamoDBStorage(DynamoDBConfig{Client: client, TableName: tableName, SkipEnsureTable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.SetMaxLifetime(time.Minute)
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	output, err := client.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key:       map[string]types.AttributeValue{idAttribute: &types.AttributeValueMemberS{Value: "id"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt, expires, err := itemNumber(output.Item, ExpiresAtAttribute)
+	if err != nil || !expires || expiresAt != session.LastAccessedAt().Add(time.Minute+time.Second-1).Unix() {
+		t.Fatalf("got expiresAt %d (%v), error %v", expiresAt, expires, err)
+	}
+	retrieved, err := storage.RetrieveSession("id")
+	if err != nil || retrieved.GetValue("username") != "zyrx" {
+		t.Fatalf("session not retrieved: %v", err)
+	}
+	if err = storage.DestroySession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v after the deletion, want SessionNotExist", err)
+	}
+}
@@ -0,0 +1,152 @@
+package wsm_backup
+
+import (
+	"errors"
+	"local/zyrx/backup/abstract_definition"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscriberBufferSize is the number of session events buffered for each subscriber before dropping them.
+const subscriberBufferSize = 64
+
+// SessionEventKind is the kind of change of a session reported by a SessionEvent.
+type SessionEventKind int
+
+const (
+	// SessionCreated is the kind of event emitted when a new session is initialized.
+	SessionCreated SessionEventKind = iota
+	// SessionDestroyed is the kind of event emitted when a session is destroyed.
+	SessionDestroyed
+	// SessionExpired is the kind of event emitted when a session is terminated on expiration.
+	SessionExpired
+)
+
+// String is a method for SessionEventKind that returns the name of the kind of event.
+func (kind SessionEventKind) String() string {
+	switch kind {
+	case SessionCreated:
+		return "created"
+	case SessionDestroyed:
+		return "destroyed"
+	case SessionExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// SessionEvent is a change of a session, holding its kind, the ID of the session, and when it happened.
+type SessionEvent struct {
+	Kind      SessionEventKind
+	SessionId string
+	Time      time.Time
+}
+
+// OnSessionEvent is an option that sets a handler called with every session event as it happens,
+// e.g. to keep an audit trail of sessions creation, destruction, and expiration.
+// Unlike Subscribe, events are never dropped, and the handler is called while the manager is locked,
+// so it must return quickly and must not call the SessionManager. Events of concurrent requests are passed
+// concurrently, so the handler must be safe for concurrent use. A nil handler sets no handler.
+func OnSessionEvent(handler func(event SessionEvent)) Option {
+	return func(manager *SessionManager) error {
+		manager.sessionEventHandler = handler
+		return nil
+	}
+}
+
+// sessionEventSubscribers holds the channels of the subscribers to the session events of a SessionManager,
+// and the count of events dropped because a subscriber was too slow to receive them.
+type sessionEventSubscribers struct {
+	sync.Mutex
+	channels      map[int]chan SessionEvent
+	nextId        int
+	droppedEvents uint64
+}
+
+// Subscribe is a method for SessionManager used to receive a live feed of session events, e.g. for dashboards.
+// Events are buffered, and dropped when the subscriber is too slow to receive them so the manager is never
+// blocked, see DroppedSessionEvents. The returned function unsubscribes and closes the channel.
+func (manager *SessionManager) Subscribe() (<-chan SessionEvent, func()) {
+	subscribers := &manager.subscribers
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	if subscribers.channels == nil {
+		subscribers.channels = make(map[int]chan SessionEvent)
+	}
+	subscriberId := subscribers.nextId
+	subscribers.nextId += 1
+	events := make(chan SessionEvent, subscriberBufferSize)
+	subscribers.channels[subscriberId] = events
+	var unsubscribeOnce sync.Once
+	unsubscribe := func() {
+		unsubscribeOnce.Do(func() {
+			subscribers.Lock()
+			defer subscribers.Unlock()
+			delete(subscribers.channels, subscriberId)
+			close(events)
+		})
+	}
+	return events, unsubscribe
+}
+
+// DroppedSessionEvents is a method for SessionManager that returns the number of session events
+// dropped because a subscriber was too slow to receive them.
+func (manager *SessionManager) DroppedSessionEvents() uint64 {
+	return atomic.LoadUint64(&manager.subscribers.droppedEvents)
+}
+
+// observesSessionIds is a method for SessionManager that reports whether any subscriber, event handler,
+// metrics observer or audit sink needs the IDs of sessions removed in bulk, to avoid listing sessions
+// when nobody needs them.
+func (manager *SessionManager) observesSessionIds() bool {
+	return manager.metricsObserver != nil || manager.auditSink != nil || manager.observesSessionEvents()
+}
+
+// observesSessionEvents is a method for SessionManager that reports whether an event handler
+// or any subscriber receives session events.
+func (manager *SessionManager) observesSessionEvents() bool {
+	if manager.sessionEventHandler != nil {
+		return true
+	}
+	manager.subscribers.Lock()
+	defer manager.subscribers.Unlock()
+	return len(manager.subscribers.channels) > 0
+}
+
+// emitSessionEvent is a method for SessionManager used to pass a session event to the event handler if one is set,
+// and send it to all subscribers without blocking.
+func (manager *SessionManager) emitSessionEvent(kind SessionEventKind, sessionId string) {
+	event := SessionEvent{Kind: kind, SessionId: sessionId, Time: manager.clock.Now()}
+	if manager.sessionEventHandler != nil {
+		manager.sessionEventHandler(event)
+	}
+	subscribers := &manager.subscribers
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for _, events := range subscribers.channels {
+		select {
+		case events <- event:
+		default:
+			atomic.AddUint64(&subscribers.droppedEvents, 1)
+		}
+	}
+}
+
+// terminateSessionsOnExpiration is a method for SessionManager used to terminate expired sessions, returning
+// their number and, if the storage media implements abstract_definition.ExpiryReporter, their IDs, so the events
+// of expired sessions only ever report sessions the expiration did terminate. Storage media expiring sessions
+// by themselves, such as the memcached, dynamodb and cookie ones, report none, their expired sessions
+// disappearing without the manager knowing. Expired opaque tokens of the WithOpaqueTokens option are left out
+// of the reported sessions, but not of the number of storage media only able to count their expired entries.
+func (manager *SessionManager) terminateSessionsOnExpiration() (int, []string, error) {
+	if expiryReporter, reportsExpiry := manager.storageMedia.(abstract_definition.ExpiryReporter); reportsExpiry {
+		expiredSessionIds, err := expiryReporter.TerminateExpiredSessions(manager.maxLifetime)
+		if !errors.Is(err, abstract_definition.ErrNotSupported) {
+			expiredSessionIds = manager.withoutTokens(expiredSessionIds)
+			return len(expiredSessionIds), expiredSessionIds, err
+		}
+	}
+	expiredSessionsCount, err := manager.storageMedia.TerminateSessionOnExpiration(manager.maxLifetime)
+	return expiredSessionsCount, nil, err
+}
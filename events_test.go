@@ -0,0 +1,135 @@
+package wsm_backup_test
+
+import (
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/wsmtest"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnSessionEventReportsTheLifecycleOfSessions(t *testing.T) {
+	var handled sync.Mutex
+	var events []wsm.SessionEvent
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute),
+		wsm.OnSessionEvent(func(event wsm.SessionEvent) {
+			handled.Lock()
+			defer handled.Unlock()
+			events = append(events, event)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	endedId, request := requestWithSession(t, manager)
+	if _, err = manager.EndSession(httptest.NewRecorder(), request); err != nil {
+		t.Fatal(err)
+	}
+	expiredId := startSessions(t, manager, 1)[0]
+	storage.Advance(2 * time.Minute)
+	manager.SessionsExpirationRoutine()
+	handled.Lock()
+	defer handled.Unlock()
+	want := []struct {
+		kind      wsm.SessionEventKind
+		sessionId string
+	}{
+		{wsm.SessionCreated, endedId},
+		{wsm.SessionDestroyed, endedId},
+		{wsm.SessionCreated, expiredId},
+		{wsm.SessionExpired, expiredId},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got events %v, want %d", events, len(want))
+	}
+	for index, event := range events {
+		if event.Kind != want[index].kind || event.SessionId != want[index].sessionId {
+			t.Errorf("event %d is %s of %s, want %s of %s", index, event.Kind, event.SessionId, want[index].kind, want[index].sessionId)
+		}
+	}
+}
+
+// racingStorage is a fake storage media running a hook right before terminating expired sessions, e.g. a request
+// destroying a session concurrently, and failing to list its sessions if unlistable, as memcached does.
+type racingStorage struct {
+	*wsmtest.FakeStorage
+	beforeExpiry func()
+	unlistable   bool
+}
+
+func (storage *racingStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	if storage.beforeExpiry != nil {
+		storage.beforeExpiry()
+	}
+	return storage.FakeStorage.TerminateExpiredSessions(maxLifetime)
+}
+
+func (storage *racingStorage) ListSessions() ([]string, error) {
+	if storage.unlistable {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return storage.FakeStorage.ListSessions()
+}
+
+// receivedEvents returns the events received by a subscriber so far.
+func receivedEvents(events <-chan wsm.SessionEvent) []wsm.SessionEvent {
+	var received []wsm.SessionEvent
+	for {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		default:
+			return received
+		}
+	}
+}
+
+func TestSubscribersOnlyReceiveTerminatedSessionsAsExpired(t *testing.T) {
+	for _, unlistable := range []bool{false, true} {
+		storage := &racingStorage{FakeStorage: wsmtest.NewFakeStorage(), unlistable: unlistable}
+		manager, err := wsm.NewSessionManagerWithStorage(storage, wsmtest.CookieName,
+			wsm.WithClock(storage.Clock), wsm.WithMaxLifetime(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, unsubscribe := manager.Subscribe()
+		sessionIds := startSessions(t, manager, 2)
+		expiredId, destroyedId := sessionIds[0], sessionIds[1]
+		storage.Advance(2 * time.Minute)
+		storage.beforeExpiry = func() {
+			if err := storage.DestroySession(destroyedId); err != nil {
+				t.Error(err)
+			}
+		}
+		manager.SessionsExpirationRoutine()
+		received := receivedEvents(events)
+		if len(received) != 3 || received[2].Kind != wsm.SessionExpired || received[2].SessionId != expiredId {
+			t.Fatalf("unlistable %v: received %v, want the creation of both sessions and the expiration of %s only",
+				unlistable, received, expiredId)
+		}
+		unsubscribe()
+		if _, open := <-events; open {
+			t.Fatal("channel still open once unsubscribed")
+		}
+		manager.Stop()
+	}
+}
+
+func TestSlowSubscribersDropEvents(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	events, unsubscribe := manager.Subscribe()
+	defer unsubscribe()
+	startSessions(t, manager, 70)
+	if received := len(receivedEvents(events)); received != 64 {
+		t.Fatalf("received %d events, want the 64 buffered", received)
+	}
+	if dropped := manager.DroppedSessionEvents(); dropped != 6 {
+		t.Fatalf("dropped %d events, want 6", dropped)
+	}
+}
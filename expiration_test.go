@@ -0,0 +1,183 @@
+package wsm_backup_test
+
+import (
+	"context"
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/wsmtest"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitFor fails the test if the condition doesn't hold within a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startExpiringSession starts a session with the manager and moves the clock of the storage past its lifetime.
+func startExpiringSession(t *testing.T, manager *wsm.SessionManager, storage *wsmtest.FakeStorage) string {
+	t.Helper()
+	session, _, err := manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Advance(2 * time.Minute)
+	return session.GetSessionId()
+}
+
+func TestSessionsExpirationRoutineReturnsAfterTerminating(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionId := startExpiringSession(t, manager, storage)
+	manager.SessionsExpirationRoutine()
+	if storage.HasSession(sessionId) {
+		t.Fatal("expired session not terminated before SessionsExpirationRoutine returned")
+	}
+}
+
+func TestStartExpiryLoopFiresRepeatedly(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute), wsm.WithExpiryInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager.StartExpiryLoop(ctx)
+	for run := 0; run < 3; run++ {
+		sessionId := startExpiringSession(t, manager, storage)
+		waitFor(t, func() bool { return !storage.HasSession(sessionId) })
+	}
+}
+
+func TestStartExpiryLoopStopsOnCancel(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute), wsm.WithExpiryInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	manager.StartExpiryLoop(ctx)
+	sessionId := startExpiringSession(t, manager, storage)
+	waitFor(t, func() bool { return !storage.HasSession(sessionId) })
+	cancel()
+	// Past a run in progress when cancelled, the loop must not terminate sessions anymore.
+	time.Sleep(20 * time.Millisecond)
+	sessionId = startExpiringSession(t, manager, storage)
+	time.Sleep(50 * time.Millisecond)
+	if !storage.HasSession(sessionId) {
+		t.Fatal("expired session terminated after the context was cancelled")
+	}
+}
+
+func TestStopEndsExpiryLoops(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute), wsm.WithExpiryInterval(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.SessionsExpirationRoutine()
+	manager.StartExpiryLoop(context.Background())
+	manager.Stop()
+	manager.Stop()
+	time.Sleep(20 * time.Millisecond)
+	sessionId := startExpiringSession(t, manager, storage)
+	time.Sleep(50 * time.Millisecond)
+	if !storage.HasSession(sessionId) {
+		t.Fatal("expired session terminated after Stop")
+	}
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(sessionId) {
+		t.Fatal("SessionsExpirationRoutine terminated sessions after Stop")
+	}
+}
+
+func TestWithExpiryIntervalRejectsNonPositive(t *testing.T) {
+	if _, _, err := wsmtest.NewSessionManager(wsm.WithExpiryInterval(0)); err == nil {
+		t.Fatal("expected an error for a zero expiry interval")
+	}
+}
+
+func TestPinnedSessionsAreExemptFromExpiry(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	pinned := startExpiringSession(t, manager, storage)
+	if err = manager.Pin(pinned); err != nil {
+		t.Fatal(err)
+	}
+	expiring := startExpiringSession(t, manager, storage)
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(pinned) {
+		t.Fatal("pinned session expired")
+	}
+	if storage.HasSession(expiring) {
+		t.Fatal("session left unpinned kept past its maximum lifetime")
+	}
+	if err = manager.Unpin(pinned); err != nil {
+		t.Fatal(err)
+	}
+	manager.SessionsExpirationRoutine()
+	if storage.HasSession(pinned) {
+		t.Fatal("unpinned session kept past its maximum lifetime")
+	}
+	if err = manager.Pin(pinned); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v pinning a missing session, want SessionNotExist", err)
+	}
+}
+
+func TestSetExpiryOverridesTheMaximumLifetimeOfASession(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionIds := startSessions(t, manager, 3)
+	for index, expiry := range []time.Duration{time.Hour, 10 * time.Second} {
+		session, err := manager.LookupSession(sessionIds[index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = session.SetExpiry(expiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remembered, shortLived, regular := sessionIds[0], sessionIds[1], sessionIds[2]
+	storage.Advance(30 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if storage.HasSession(shortLived) || !storage.HasSession(regular) {
+		t.Fatal("session with a shorter expiry not expired before the others")
+	}
+	storage.Advance(time.Minute)
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(remembered) || storage.HasSession(regular) {
+		t.Fatal("session with a longer expiry not kept past the maximum lifetime")
+	}
+	session, err := manager.LookupSession(remembered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetExpiry(-time.Second); err == nil {
+		t.Fatal("expected an error for a negative expiry")
+	}
+	if err = session.SetExpiry(0); err != nil {
+		t.Fatal(err)
+	}
+	manager.SessionsExpirationRoutine()
+	if storage.HasSession(remembered) {
+		t.Fatal("session kept past the maximum lifetime once its expiry was reset")
+	}
+}
@@ -0,0 +1,107 @@
+package wsm_backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"time"
+)
+
+// exportedSession is the json representation of a session used to export and import sessions.
+type exportedSession struct {
+	Id             string                 `json:"id"`
+	CreatedAt      time.Time              `json:"created-at"`
+	LastAccessTime time.Time              `json:"last-access-time"`
+	Values         map[string]interface{} `json:"values"`
+	Pinned         bool                   `json:"pinned,omitempty"`
+	Expiry         time.Duration          `json:"expiry,omitempty"`
+	UserID         string                 `json:"user-id,omitempty"`
+}
+
+// ExportSession is a method for SessionManager used to serialize the entire content of the session
+// belonging to the given ID to json, e.g. for backups and debugging.
+// Session keys are strings, keys of other types allowed by custom storage media are converted with fmt.Sprint,
+// and it returns an error if two keys convert to the same string or a value is not json serializable.
+func (manager *SessionManager) ExportSession(sessionId string) ([]byte, error) {
+	manager.RLock()
+	sessionData, err := manager.storageMedia.ExportSession(sessionId)
+	manager.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(sessionData.Values))
+	for key, value := range sessionData.Values {
+		stringKey := fmt.Sprint(key)
+		if _, collides := values[stringKey]; collides {
+			return nil, fmt.Errorf("wsm: session keys convert to the same json key %q", stringKey)
+		}
+		values[stringKey] = value
+	}
+	return json.Marshal(exportedSession{
+		Id:             sessionData.Id,
+		CreatedAt:      sessionData.CreatedAt,
+		LastAccessTime: sessionData.LastAccessTime,
+		Values:         values,
+		Pinned:         sessionData.Pinned,
+		Expiry:         sessionData.Expiry,
+		UserID:         sessionData.UserID,
+	})
+}
+
+// ImportSession is a method for SessionManager used to store a session previously serialized by ExportSession,
+// replacing any session with the same ID, and then return it.
+// Values are restored as decoded by encoding/json, meaning string keys, and numbers become float64,
+// arrays []interface{}, and objects map[string]interface{}.
+func (manager *SessionManager) ImportSession(data []byte) (abstract_definition.Session, error) {
+	var importedSession exportedSession
+	if err := json.Unmarshal(data, &importedSession); err != nil {
+		return nil, fmt.Errorf("wsm: could not decode the imported session: %w", err)
+	}
+	if importedSession.Id == "" {
+		return nil, fmt.Errorf("wsm: imported session has no ID")
+	}
+	values := make(map[interface{}]interface{}, len(importedSession.Values))
+	for key, value := range importedSession.Values {
+		values[key] = value
+	}
+	manager.RLock()
+	defer manager.RUnlock()
+	err := manager.storageMedia.ImportSession(abstract_definition.SessionData{
+		Id:             importedSession.Id,
+		CreatedAt:      importedSession.CreatedAt,
+		LastAccessTime: importedSession.LastAccessTime,
+		Values:         values,
+		Pinned:         importedSession.Pinned,
+		Expiry:         importedSession.Expiry,
+		UserID:         importedSession.UserID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manager.storageMedia.RetrieveSession(importedSession.Id)
+}
+
+// DataFingerprint is a method for SessionManager used to compute a stable SHA-256 hash of the values of a session,
+// e.g. for change detection or ETags of session derived responses. Identical values always give the same
+// fingerprint since they are serialized to json, which sorts map keys, and any change of a value changes it.
+// It returns an error if the session doesn't exist or a value is not json serializable.
+func (manager *SessionManager) DataFingerprint(session abstract_definition.Session) (string, error) {
+	manager.RLock()
+	sessionData, err := manager.storageMedia.ExportSession(session.GetSessionId())
+	manager.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	values := make(map[string]interface{}, len(sessionData.Values))
+	for key, value := range sessionData.Values {
+		values[fmt.Sprint(key)] = value
+	}
+	serializedValues, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("wsm: could not serialize the session values: %w", err)
+	}
+	fingerprint := sha256.Sum256(serializedValues)
+	return hex.EncodeToString(fingerprint[:]), nil
+}
@@ -0,0 +1,139 @@
+package wsm_backup_test
+
+import (
+	"local/zyrx/backup/wsmtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportedSessionsAreImportedByAnotherManager(t *testing.T) {
+	source, sourceStorage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	session, err := source.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := session.GetSessionId()
+	for key, value := range map[string]interface{}{"username": "zyrx", "visits": 3, "cart": map[string]interface{}{"items": []string{"book"}}} {
+		if err = session.SetValue(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = source.SetUserID(session, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if err = source.Pin(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	sourceStorage.Advance(time.Minute)
+	if err = sourceStorage.UpdateSessionLastAccess(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := source.ExportSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, targetStorage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Stop()
+	imported, err := target.ImportSession(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[interface{}]interface{}{
+		"username": "zyrx",
+		"visits":   float64(3),
+		"cart":     map[string]interface{}{"items": []interface{}{"book"}},
+	}
+	if values := imported.Values(); imported.GetSessionId() != sessionId || !reflect.DeepEqual(values, want) {
+		t.Fatalf("imported %s holding %v, want %s holding %v", imported.GetSessionId(), values, sessionId, want)
+	}
+	data, err := targetStorage.ExportSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data.Pinned || data.UserID != "user" || !data.LastAccessTime.Equal(wsmtest.DefaultStartTime.Add(time.Minute)) {
+		t.Fatalf("imported the pin %v, user %q and last access %v, want them kept", data.Pinned, data.UserID, data.LastAccessTime)
+	}
+	reexported, err := target.ExportSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reexported) != string(exported) {
+		t.Fatalf("exported %s once imported, want %s", reexported, exported)
+	}
+}
+
+func TestMalformedSessionsAreNotImported(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	for _, data := range []string{
+		``,
+		`{"id": "truncated"`,
+		`["not", "a", "session"]`,
+		`{"values": {"username": "zyrx"}}`,
+		`{"id": "typed", "values": ["username"]}`,
+		`{"id": "typed", "last-access-time": "yesterday"}`,
+	} {
+		if _, err = manager.ImportSession([]byte(data)); err == nil {
+			t.Errorf("imported %q", data)
+		}
+	}
+	if count := storage.SessionCount(); count != 0 {
+		t.Fatalf("storage holds %d sessions, want none", count)
+	}
+}
+
+func TestDataFingerprintFollowsTheValuesOnly(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	fingerprints := map[string]bool{}
+	for order := 0; order < len(keys); order++ {
+		session, err := manager.CreateSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nested := map[string]interface{}{}
+		for index := range keys {
+			key := keys[(index+order)%len(keys)]
+			nested[key] = key
+		}
+		for index := range keys {
+			key := keys[(index+order)%len(keys)]
+			if err = session.SetValue(key, map[string]interface{}{"value": key, "nested": nested}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fingerprint, err := manager.DataFingerprint(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints[fingerprint] = true
+		if err = session.SetValue("a", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := manager.DataFingerprint(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed == fingerprint {
+			t.Fatal("fingerprint unchanged by a changed value")
+		}
+	}
+	if len(fingerprints) != 1 {
+		t.Fatalf("got %d fingerprints of the same values set in different orders, want one", len(fingerprints))
+	}
+}
@@ -0,0 +1,546 @@
+package file_storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDirectory is the directory sessions files are stored in when FileStorage has no Directory set.
+const DefaultDirectory = "sessions"
+
+// sessionFileExtension is the extension of the files holding sessions.
+const sessionFileExtension = ".session"
+
+// temporaryFileExtension is the extension of the temporary files sessions are written to before replacing their file.
+const temporaryFileExtension = ".tmp"
+
+// ErrCorruptSession is an error used when a session file could not be decrypted or decoded.
+var ErrCorruptSession = errors.New("wsm: session file is corrupt")
+
+// ErrInvalidSessionId is an error used when a session ID is not a base64 URL token, and can't be used as a file name.
+var ErrInvalidSessionId = errors.New("wsm: session ID is not a valid base64 URL token")
+
+// sessionIdPattern matches the base64 URL tokens accepted as session IDs, with or without padding,
+// which never contain path separators nor dots.
+var sessionIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+={0,2}$`)
+
+// ErrInvalidEncryptionKey is an error used when the encryption key of the file storage is not 32 bytes long.
+var ErrInvalidEncryptionKey = errors.New("wsm: file storage encryption key must be 32 bytes long")
+
+// FileStorage represents a file storage media type to store sessions in, a file per session in its Directory,
+// or in DefaultDirectory if it's not set.
+// If an EncryptionKey of 32 bytes is set, sessions files are encrypted at rest with AES-256-GCM.
+// Sessions files are replaced atomically, so a crash mid-write never leaves a corrupt session,
+// and each is locked while it's read and written, so concurrent requests of a session never overwrite each other.
+// Sessions are encoded by its Codec, or as json if it's not set, so values are retrieved as decoded by encoding/json
+// unless another codec, such as stored_session.GobCodec, is set. Changing the codec makes existing sessions corrupt.
+type FileStorage struct {
+	sync.Mutex
+	Directory       string
+	EncryptionKey   []byte
+	Codec           stored_session.Codec
+	clock           abstract_definition.ClockHolder
+	sessionLocks    map[string]*sessionLock
+	maxSessionBytes atomic.Int64
+}
+
+// codec is a method for FileStorage that returns the codec sessions are encoded with.
+func (storage *FileStorage) codec() stored_session.Codec {
+	if storage.Codec == nil {
+		return stored_session.JSONCodec{}
+	}
+	return storage.Codec
+}
+
+// SetClock is a method for FileStorage that sets the clock stamping the last access time of sessions
+// and deciding their expiration.
+func (storage *FileStorage) SetClock(clock abstract_definition.Clock) {
+	storage.clock.SetClock(clock)
+}
+
+// Now is a method for FileStorage that returns the current time of its clock.
+func (storage *FileStorage) Now() time.Time {
+	return storage.clock.Now()
+}
+
+// SetMaxSessionBytes is a method for FileStorage that sets the maximum size of sessions as encoded by its codec,
+// before encryption, zero meaning no limit.
+func (storage *FileStorage) SetMaxSessionBytes(maxBytes int) {
+	storage.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// CheckSessionSize is a method for FileStorage that returns an abstract_definition.ErrSessionTooLarge error
+// if the content of a session would exceed the maximum size once encoded by its codec.
+func (storage *FileStorage) CheckSessionSize(data abstract_definition.SessionData) error {
+	maxBytes := storage.maxSessionBytes.Load()
+	if maxBytes == 0 {
+		return nil
+	}
+	encodedData, err := stored_session.MarshalSessionDataWith(storage.codec(), data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return stored_session.CheckSize(len(encodedData), maxBytes)
+}
+
+// directory is a method for FileStorage that returns the directory sessions files are stored in.
+func (storage *FileStorage) directory() string {
+	if storage.Directory == "" {
+		return DefaultDirectory
+	}
+	return storage.Directory
+}
+
+// sessionPath is a method for FileStorage that returns the path of the file of the session belonging to the given ID.
+// The decoded session ID is used as is, the "=" padding of generated base64 URL IDs being safe in file names.
+// It returns an ErrInvalidSessionId error if the ID is not a base64 URL token, so a crafted cookie value
+// such as "../../etc/passwd" can never point outside the directory.
+func (storage *FileStorage) sessionPath(sessionId string) (string, error) {
+	if !sessionIdPattern.MatchString(sessionId) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidSessionId, sessionId)
+	}
+	return filepath.Join(storage.directory(), sessionId+sessionFileExtension), nil
+}
+
+// readSession is a method for FileStorage that reads the session belonging to the given ID from its file,
+// if it doesn't exist it returns a wsm.SessionNotExists error, and an ErrCorruptSession error if it
+// could not be decrypted or decoded. It must be called while holding the session lock.
+func (storage *FileStorage) readSession(sessionId string) (abstract_definition.SessionData, error) {
+	sessionPath, err := storage.sessionPath(sessionId)
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	fileData, err := os.ReadFile(sessionPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	if storage.EncryptionKey != nil {
+		if fileData, err = storage.decrypt(fileData); err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+	}
+	data, err := stored_session.UnmarshalSessionDataWith(storage.codec(), fileData)
+	if err != nil {
+		return abstract_definition.SessionData{}, fmt.Errorf("%w: %v", ErrCorruptSession, err)
+	}
+	return data, nil
+}
+
+// writeSession is a method for FileStorage that writes a session to its file, encrypting it if the storage
+// has an encryption key. It returns an error if a key is not a string, or the file could not be written.
+// It must be called while holding the session lock.
+func (storage *FileStorage) writeSession(data abstract_definition.SessionData) error {
+	sessionPath, err := storage.sessionPath(data.Id)
+	if err != nil {
+		return err
+	}
+	fileData, err := stored_session.MarshalSessionDataWith(storage.codec(), data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	if storage.EncryptionKey != nil {
+		if fileData, err = storage.encrypt(fileData); err != nil {
+			return err
+		}
+	}
+	if err = storage.CreateDirectory(); err != nil {
+		return err
+	}
+	return writeFileAtomically(sessionPath, fileData)
+}
+
+// CreateDirectory is a method for FileStorage that creates the directory sessions files are stored in,
+// and its parents, if it doesn't exist yet, so Ping succeeds before the first session is written.
+// SessionManager calls it when it starts using the storage. It returns an error if the directory could not be created.
+func (storage *FileStorage) CreateDirectory() error {
+	if err := os.MkdirAll(storage.directory(), 0700); err != nil {
+		return fmt.Errorf("wsm: could not create the sessions directory: %w", err)
+	}
+	return nil
+}
+
+// renameFile renames the temporary files of writeFileAtomically over the files they replace, it's replaced by tests
+// to fail renames.
+var renameFile = os.Rename
+
+// writeFileAtomically is a function that replaces the content of a file by writing it to a temporary file
+// in the same directory, syncing it, and renaming it over the file, then syncing the directory,
+// so a crash mid-write never leaves a truncated file, only the previous or the new content.
+// The temporary file, which isn't listed as a session, is removed if the content could not be written.
+func writeFileAtomically(path string, content []byte) error {
+	temporaryFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+temporaryFileExtension)
+	if err != nil {
+		return err
+	}
+	temporaryPath := temporaryFile.Name()
+	if err = writeAndSync(temporaryFile, content); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	if err = renameFile(temporaryPath, path); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+	return syncDirectory(filepath.Dir(path))
+}
+
+// writeAndSync is a function that writes the content to a file, syncs it to disk, and closes it.
+func writeAndSync(file *os.File, content []byte) error {
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDirectory is a function that syncs a directory to disk, so a file renamed in it is durable.
+func syncDirectory(path string) error {
+	directory, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
+
+// newCipher is a method for FileStorage that returns the AES-GCM cipher of its encryption key,
+// or an ErrInvalidEncryptionKey error if the key is not 32 bytes long.
+func (storage *FileStorage) newCipher() (cipher.AEAD, error) {
+	if len(storage.EncryptionKey) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(storage.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt is a method for FileStorage that encrypts the content of a session file,
+// returning a random nonce followed by the ciphertext.
+func (storage *FileStorage) encrypt(plaintext []byte) ([]byte, error) {
+	aead, err := storage.newCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt is a method for FileStorage that decrypts the content of a session file written by encrypt,
+// it returns an ErrCorruptSession error if it could not be decrypted.
+func (storage *FileStorage) decrypt(fileData []byte) ([]byte, error) {
+	aead, err := storage.newCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(fileData) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: too short to be encrypted", ErrCorruptSession)
+	}
+	nonce, ciphertext := fileData[:aead.NonceSize()], fileData[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSession, err)
+	}
+	return plaintext, nil
+}
+
+// UpdateSession is a method for FileStorage that reads the session belonging to the given ID from its file,
+// applies the update to it, writes it back, and returns its new content.
+// It returns the error of the update without writing anything if the update fails.
+func (storage *FileStorage) UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	defer storage.lockSession(sessionId)()
+	data, err := storage.readSession(sessionId)
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	if err = update(&data); err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	if err = storage.writeSession(data); err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	return stored_session.CopySessionData(data), nil
+}
+
+// InitializeSession is a method for FileStorage that takes a session ID argument of type string
+// creates a new session, writes it to its file, and then return that session.
+// It returns an error if the file could not be written.
+func (storage *FileStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	defer storage.lockSession(sessionId)()
+	now := storage.Now()
+	data := abstract_definition.SessionData{
+		Id:             sessionId,
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values:         make(map[interface{}]interface{}),
+	}
+	if err := storage.writeSession(data); err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSession is a method for FileStorage that takes session ID of type string as an argument
+// and returns the session stored in the file that belongs to the given ID, if it doesn't exist
+// it returns a wsm.SessionNotExists error.
+func (storage *FileStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	defer storage.lockSession(sessionId)()
+	data, err := storage.readSession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSessionAndTouch is a method for FileStorage that takes session ID of type string as an argument
+// and returns the session stored in the file that belongs to the given ID, updating its last access time
+// in the same locked read and write, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *FileStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	data, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// UpdateSessionLastAccess is a method for FileStorage that updates the session's
+// last access time when it's used
+func (storage *FileStorage) UpdateSessionLastAccess(sessionId string) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	return err
+}
+
+// DestroySession is a method for FileStorage that deletes the file of a session if found,
+// otherwise it returns an error.
+func (storage *FileStorage) DestroySession(sessionId string) error {
+	defer storage.lockSession(sessionId)()
+	sessionPath, err := storage.sessionPath(sessionId)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(sessionPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return abstract_definition.SessionNotExist
+	}
+	return err
+}
+
+// Ping is a method for FileStorage that checks the directory sessions files are stored in exists.
+// It returns an error if the context is done, or the directory could not be found or is not a directory.
+func (storage *FileStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	info, err := os.Stat(storage.directory())
+	if err != nil {
+		return fmt.Errorf("wsm: could not reach the sessions directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("wsm: sessions directory %q is not a directory", storage.directory())
+	}
+	return nil
+}
+
+// DestroyAllSessions is a method for FileStorage that deletes the files of all the sessions.
+func (storage *FileStorage) DestroyAllSessions() error {
+	sessionIds, err := storage.listSessions()
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		unlock := storage.lockSession(sessionId)
+		err = os.Remove(filepath.Join(storage.directory(), sessionId+sessionFileExtension))
+		unlock()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// TerminateSessionOnExpiration is a method for FileStorage that deletes the files of sessions
+// that has exceeded a passed maximum lifetime parameter of type time.Duration.
+// Pinned sessions are never deleted, and sessions with their own expiry use it instead of the maximum lifetime.
+// Corrupt sessions files are left untouched.
+// It returns the number of deleted sessions, and an error if the sessions files could not be listed or deleted,
+// along with the number of sessions deleted before it.
+func (storage *FileStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	terminated, err := storage.TerminateExpiredSessions(maxLifetime)
+	return len(terminated), err
+}
+
+// TerminateExpiredSessions is a method for FileStorage that deletes the files of expired sessions
+// like TerminateSessionOnExpiration, and returns the IDs of the deleted sessions.
+func (storage *FileStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	sessionIds, err := storage.listSessions()
+	if err != nil {
+		return nil, err
+	}
+	now := storage.Now()
+	var terminated []string
+	for _, sessionId := range sessionIds {
+		expired, err := storage.terminateSessionIfExpired(sessionId, maxLifetime, now)
+		if err != nil {
+			return terminated, err
+		}
+		if expired {
+			terminated = append(terminated, sessionId)
+		}
+	}
+	return terminated, nil
+}
+
+// terminateSessionIfExpired is a method for FileStorage that deletes the file of a session if it has exceeded
+// its lifetime at the given time, holding the session lock so a request touching it can't be lost in between.
+// It reports whether the session was deleted, and returns an error if its file could not be deleted.
+func (storage *FileStorage) terminateSessionIfExpired(sessionId string, maxLifetime time.Duration, now time.Time) (bool, error) {
+	defer storage.lockSession(sessionId)()
+	data, err := storage.readSession(sessionId)
+	if err != nil || data.Pinned {
+		return false, nil
+	}
+	lifetime := maxLifetime
+	if data.Expiry > 0 {
+		lifetime = data.Expiry
+	}
+	if !data.LastAccessTime.Add(lifetime).Before(now) {
+		return false, nil
+	}
+	err = os.Remove(filepath.Join(storage.directory(), sessionId+sessionFileExtension))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListSessions is a method for FileStorage that returns the IDs of all the sessions having a file.
+func (storage *FileStorage) ListSessions() ([]string, error) {
+	return storage.listSessions()
+}
+
+// ScanSessions is a method for FileStorage that returns a page of at most limit session IDs having a file
+// in ascending order, following the cursor, and the cursor of the next page, empty once there's none.
+// It returns an abstract_definition.ErrInvalidScanLimit error if the limit is not greater than zero,
+// or an error if the sessions files could not be listed.
+func (storage *FileStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	sessionIds, err := storage.listSessions()
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Strings(sessionIds)
+	return abstract_definition.PageSessionIds(sessionIds, cursor, limit)
+}
+
+// listSessions is a method for FileStorage that returns the IDs of all the sessions having a file.
+func (storage *FileStorage) listSessions() ([]string, error) {
+	fileMatches, err := filepath.Glob(filepath.Join(storage.directory(), "*"+sessionFileExtension))
+	if err != nil {
+		return nil, err
+	}
+	sessionIds := make([]string, 0, len(fileMatches))
+	for _, fileMatch := range fileMatches {
+		sessionIds = append(sessionIds, strings.TrimSuffix(filepath.Base(fileMatch), sessionFileExtension))
+	}
+	return sessionIds, nil
+}
+
+// ExportSession is a method for FileStorage that returns the full content of the session
+// belonging to the given ID, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *FileStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	defer storage.lockSession(sessionId)()
+	return storage.readSession(sessionId)
+}
+
+// ImportSession is a method for FileStorage that writes a session from its full content,
+// replacing any session with the same ID.
+// It returns an error if a key is not a string, the session is larger than the maximum session size,
+// with an abstract_definition.ErrSessionTooLarge error, or the file could not be written.
+func (storage *FileStorage) ImportSession(data abstract_definition.SessionData) error {
+	if err := storage.CheckSessionSize(data); err != nil {
+		return err
+	}
+	defer storage.lockSession(data.Id)()
+	return storage.writeSession(data)
+}
+
+// SetSessionUserID is a method for FileStorage that associates the session belonging to the given ID
+// with a user, so it's listed among the user's sessions, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *FileStorage) SetSessionUserID(sessionId, userID string) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.UserID = userID
+		return nil
+	})
+	return err
+}
+
+// UserSessionIDs is a method for FileStorage that returns the IDs of all the sessions associated with a user.
+// There's no index of the users, so every session file is read, and corrupt ones are skipped.
+// Sessions files being replaced atomically, they're read without locking them.
+func (storage *FileStorage) UserSessionIDs(userID string) ([]string, error) {
+	sessionIds, err := storage.listSessions()
+	if err != nil {
+		return nil, err
+	}
+	var userSessionIds []string
+	for _, sessionId := range sessionIds {
+		data, err := storage.readSession(sessionId)
+		if err == nil && data.UserID == userID {
+			userSessionIds = append(userSessionIds, sessionId)
+		}
+	}
+	return userSessionIds, nil
+}
+
+// Pin is a method for FileStorage that marks the session belonging to the given ID as exempt
+// from termination on expiration, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *FileStorage) Pin(sessionId string) error {
+	return storage.setPinned(sessionId, true)
+}
+
+// Unpin is a method for FileStorage that makes a pinned session belonging to the given ID expire again,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *FileStorage) Unpin(sessionId string) error {
+	return storage.setPinned(sessionId, false)
+}
+
+// setPinned is a method for FileStorage that sets the pin state of the session belonging to the given ID.
+func (storage *FileStorage) setPinned(sessionId string, pinned bool) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.Pinned = pinned
+		return nil
+	})
+	return err
+}
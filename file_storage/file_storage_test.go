@@ -0,0 +1,254 @@
+package file_storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// limitSessionBytes sets the maximum session size of the storage to the encoded size of the given session
+// with a few bytes to spare.
+func limitSessionBytes(t *testing.T, storage *FileStorage, sessionId string) {
+	t.Helper()
+	data, err := storage.ExportSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.SetMaxSessionBytes(len(encodedData) + 10)
+}
+
+func TestMaxSessionBytesLimitsWrites(t *testing.T) {
+	storage := &FileStorage{Directory: t.TempDir()}
+	session, err := storage.InitializeSession("limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("key", ""); err != nil {
+		t.Fatal(err)
+	}
+	limitSessionBytes(t, storage, "limited")
+	if err = session.SetValue("key", "01234"); err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("key", strings.Repeat("x", 20)); !errors.Is(err, abstract_definition.ErrSessionTooLarge) {
+		t.Fatalf("got %v, want ErrSessionTooLarge", err)
+	}
+	retrieved, err := storage.RetrieveSession("limited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := retrieved.GetValue("key"); value != "01234" {
+		t.Fatalf("got %v, the rejected write reached the file", value)
+	}
+}
+
+func TestMaxSessionBytesLimitsImports(t *testing.T) {
+	storage := &FileStorage{Directory: t.TempDir()}
+	if _, err := storage.InitializeSession("limited"); err != nil {
+		t.Fatal(err)
+	}
+	limitSessionBytes(t, storage, "limited")
+	data := abstract_definition.SessionData{Id: "imported", Values: map[interface{}]interface{}{"key": strings.Repeat("x", 100)}}
+	if err := storage.ImportSession(data); !errors.Is(err, abstract_definition.ErrSessionTooLarge) {
+		t.Fatalf("got %v, want ErrSessionTooLarge", err)
+	}
+	if _, err := storage.RetrieveSession("imported"); err == nil {
+		t.Fatal("too large session imported")
+	}
+}
+
+func TestEncryptedSessionsAreUnreadableOnDisk(t *testing.T) {
+	directory := t.TempDir()
+	storage := &FileStorage{Directory: directory, EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	session, err := storage.InitializeSession("encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("name", "secret value"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(directory, "encrypted.session")
+	fileData, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(fileData, []byte("secret value")) {
+		t.Fatal("session value stored in plaintext")
+	}
+	retrieved, err := storage.RetrieveSession("encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := retrieved.GetValue("name"); name != "secret value" {
+		t.Fatalf("got %v, want the decrypted value", name)
+	}
+	otherKey := &FileStorage{Directory: directory, EncryptionKey: bytes.Repeat([]byte{2}, 32)}
+	if _, err = otherKey.RetrieveSession("encrypted"); !errors.Is(err, ErrCorruptSession) {
+		t.Fatalf("got %v with another key, want ErrCorruptSession", err)
+	}
+	if err = os.WriteFile(path, []byte("tampered"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.RetrieveSession("encrypted"); !errors.Is(err, ErrCorruptSession) {
+		t.Fatalf("got %v for a tampered file, want ErrCorruptSession", err)
+	}
+}
+
+func TestSessionIdsOutsideTheDirectoryAreRejected(t *testing.T) {
+	parent := t.TempDir()
+	storage := &FileStorage{Directory: filepath.Join(parent, "sessions")}
+	for _, sessionId := range []string{"../../etc/passwd", "../escaped", "a/b", ""} {
+		if _, err := storage.InitializeSession(sessionId); !errors.Is(err, ErrInvalidSessionId) {
+			t.Errorf("got %v initializing %q, want ErrInvalidSessionId", err, sessionId)
+		}
+		if _, err := storage.RetrieveSession(sessionId); !errors.Is(err, ErrInvalidSessionId) {
+			t.Errorf("got %v retrieving %q, want ErrInvalidSessionId", err, sessionId)
+		}
+		if err := storage.DestroySession(sessionId); !errors.Is(err, ErrInvalidSessionId) {
+			t.Errorf("got %v destroying %q, want ErrInvalidSessionId", err, sessionId)
+		}
+	}
+	if _, err := storage.InitializeSession("abc_-Z9=="); err != nil {
+		t.Fatalf("base64 URL session ID rejected: %v", err)
+	}
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "sessions" {
+		t.Fatalf("files written outside the storage directory: %v", entries)
+	}
+}
+
+func TestPingChecksTheDirectory(t *testing.T) {
+	directory := t.TempDir()
+	storage := &FileStorage{Directory: directory}
+	if err := storage.Ping(context.Background()); err != nil {
+		t.Fatalf("existing directory not reached: %v", err)
+	}
+	notADirectory := filepath.Join(directory, "file")
+	if err := os.WriteFile(notADirectory, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, badDirectory := range []string{filepath.Join(directory, "missing"), notADirectory} {
+		if err := (&FileStorage{Directory: badDirectory}).Ping(context.Background()); err == nil {
+			t.Errorf("bad directory %s reported as reachable", badDirectory)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := storage.Ping(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestCompareAndSwapValueDetectsLostUpdates(t *testing.T) {
+	storage := &FileStorage{Directory: t.TempDir()}
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("visits", 1); err != nil {
+		t.Fatal(err)
+	}
+	// both requests read the session before either writes it back
+	firstRequest, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondRequest, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstRead, secondRead := firstRequest.GetValue("visits"), secondRequest.GetValue("visits")
+	if swapped, err := firstRequest.CompareAndSwapValue("visits", firstRead, firstRead.(float64)+1); err != nil || !swapped {
+		t.Fatalf("got %v, %v swapping an unchanged value", swapped, err)
+	}
+	readVersion := secondRequest.Version()
+	if swapped, err := secondRequest.CompareAndSwapValue("visits", secondRead, secondRead.(float64)+1); err != nil || swapped {
+		t.Fatalf("got %v, %v swapping a value changed in between, want a conflict", swapped, err)
+	}
+	if secondRequest.Version() <= readVersion {
+		t.Fatal("conflicting session not refreshed with the stored version")
+	}
+	secondRead = secondRequest.GetValue("visits")
+	if swapped, err := secondRequest.CompareAndSwapValue("visits", secondRead, secondRead.(float64)+1); err != nil || !swapped {
+		t.Fatalf("got %v, %v retrying on the refreshed value", swapped, err)
+	}
+	data, err := storage.ExportSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Values["visits"] != float64(3) || data.Version != secondRequest.Version() {
+		t.Fatalf("got %+v, want both increments stored under the last version", data)
+	}
+}
+
+func TestGetValueOkTellsNilValuesFromMissingKeys(t *testing.T) {
+	storage := &FileStorage{Directory: t.TempDir()}
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("cleared", nil); err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, isSet := retrieved.GetValueOk("cleared"); value != nil || !isSet {
+		t.Fatalf("got %v, %v for a value stored as nil", value, isSet)
+	}
+	if value, isSet := retrieved.GetValueOk("missing"); value != nil || isSet {
+		t.Fatalf("got %v, %v for a missing key", value, isSet)
+	}
+}
+
+func TestFailedWritesKeepThePreviousFile(t *testing.T) {
+	directory := t.TempDir()
+	storage := &FileStorage{Directory: directory}
+	session, err := storage.InitializeSession("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("key", "previous"); err != nil {
+		t.Fatal(err)
+	}
+	sessionPath := filepath.Join(directory, "kept"+sessionFileExtension)
+	previousContent, err := os.ReadFile(sessionPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renameErr := errors.New("rename failed")
+	renameFile = func(string, string) error { return renameErr }
+	defer func() { renameFile = os.Rename }()
+	if err = session.SetValue("key", "new"); !errors.Is(err, renameErr) {
+		t.Fatalf("got %v, want the rename error", err)
+	}
+	if content, err := os.ReadFile(sessionPath); err != nil || !bytes.Equal(content, previousContent) {
+		t.Fatalf("session file changed by a failed write: %q, error %v", content, err)
+	}
+	temporaryFiles, err := filepath.Glob(filepath.Join(directory, "*"+temporaryFileExtension))
+	if err != nil || len(temporaryFiles) != 0 {
+		t.Fatalf("temporary files %v left by a failed write, error %v", temporaryFiles, err)
+	}
+	renameFile = os.Rename
+	retrieved, err := storage.RetrieveSession("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := retrieved.GetValue("key"); value != "previous" {
+		t.Fatalf("got %v once a write failed, want the previous value", value)
+	}
+}
@@ -0,0 +1,40 @@
+package file_storage
+
+import "sync"
+
+// sessionLock is the lock of a single session file, counting the callers holding or waiting for it
+// so it's removed from the storage once none are left.
+type sessionLock struct {
+	sync.Mutex
+	references int
+}
+
+// lockSession is a method for FileStorage that locks the file of the session belonging to the given ID,
+// so its read, update and write can't interleave with those of other callers of the same session, while
+// other sessions are read and written concurrently. It returns the function unlocking it.
+// The storage lock only guards the sessions locks, which are created on demand and removed once unlocked
+// by every caller, so destroyed or expired sessions don't leave locks behind.
+// Sessions files are only locked within the process, other processes sharing the directory must not write them.
+func (storage *FileStorage) lockSession(sessionId string) func() {
+	storage.Lock()
+	if storage.sessionLocks == nil {
+		storage.sessionLocks = make(map[string]*sessionLock)
+	}
+	lock, found := storage.sessionLocks[sessionId]
+	if !found {
+		lock = &sessionLock{}
+		storage.sessionLocks[sessionId] = lock
+	}
+	lock.references++
+	storage.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		storage.Lock()
+		lock.references--
+		if lock.references == 0 {
+			delete(storage.sessionLocks, sessionId)
+		}
+		storage.Unlock()
+	}
+}
@@ -0,0 +1,68 @@
+package file_storage
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentWritesOfASessionAreAllKept(t *testing.T) {
+	storage := &FileStorage{Directory: t.TempDir()}
+	for _, sessionId := range []string{"hammered", "other"} {
+		if _, err := storage.InitializeSession(sessionId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var writers sync.WaitGroup
+	for writer := 0; writer < 16; writer++ {
+		writers.Add(1)
+		go func(writer int) {
+			defer writers.Done()
+			for _, sessionId := range []string{"hammered", "other"} {
+				session, err := storage.RetrieveSession(sessionId)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err = session.SetValue(fmt.Sprint("writer", writer), writer); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	writers.Wait()
+	for _, sessionId := range []string{"hammered", "other"} {
+		// The file is decoded again, a corrupt one would fail with ErrCorruptSession.
+		session, err := storage.RetrieveSession(sessionId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for writer := 0; writer < 16; writer++ {
+			if session.GetValue(fmt.Sprint("writer", writer)) == nil {
+				t.Errorf("write of writer %d to session %s lost", writer, sessionId)
+			}
+		}
+	}
+	if len(storage.sessionLocks) != 0 {
+		t.Fatalf("%d session locks left after every write", len(storage.sessionLocks))
+	}
+}
+
+func TestDestroyedSessionsLeaveNoLocks(t *testing.T) {
+	storage := &FileStorage{Directory: t.TempDir()}
+	for index := 0; index < 10; index++ {
+		if _, err := storage.InitializeSession(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.DestroySession("id0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DestroyAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage.sessionLocks) != 0 {
+		t.Fatalf("%d session locks left after destroying every session", len(storage.sessionLocks))
+	}
+}
@@ -0,0 +1,219 @@
+package wsm_backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/cookie_storage"
+	"time"
+)
+
+// WithHashedStorageKeys is an option that makes the SessionManager keep sessions in its storage media
+// under the SHA-256 hash of their ID instead of the ID itself, so a leak of the storage layer, e.g. dumped keys
+// or file names, doesn't reveal valid session tokens. Cookies still carry the session ID, which is hashed
+// on every lookup, and sessions resolved from a request report their ID as usual.
+// Since a hash can't be turned back into an ID, ListSessions, ScanSessions and the events of expired sessions
+// report storage keys rather than session IDs, SessionsForUser and FindSessionsByValue, which return sessions
+// to act on by their ID, aren't supported, and sessions stored without hashing can't be resolved anymore
+// once the option is set. DestroySessionsForUser destroys the sessions of a user as usual.
+// The cookie storage media can't hash its keys, its session IDs being the sealed content of their cookie.
+func WithHashedStorageKeys(hashed bool) Option {
+	return func(manager *SessionManager) error {
+		manager.hashedStorageKeys = hashed
+		return nil
+	}
+}
+
+// hashedStorageMedia is a method for SessionManager that returns the storage media keeping sessions under
+// the hash of their ID with the WithHashedStorageKeys option, or the storage media itself otherwise.
+// It returns an error if the storage media can't hash its keys.
+func (manager *SessionManager) hashedStorageMedia(storageMedia abstract_definition.StorageMedia) (abstract_definition.StorageMedia, error) {
+	if !manager.hashedStorageKeys {
+		return storageMedia, nil
+	}
+	if _, isCookieStorage := storageMedia.(*cookie_storage.CookieStorage); isCookieStorage {
+		return nil, errors.New("wsm: the cookie storage media can't hash its keys")
+	}
+	return &hashedStorage{storage: storageMedia}, nil
+}
+
+// checkSessionIdsKnown is a method for SessionManager that returns an abstract_definition.ErrNotSupported error
+// naming what needs them with the WithHashedStorageKeys option, the storage media knowing storage keys only,
+// which can't be turned back into session IDs.
+func (manager *SessionManager) checkSessionIdsKnown(what string) error {
+	if _, isHashed := manager.storageMedia.(*hashedStorage); isHashed {
+		return fmt.Errorf("%w: %s need session IDs, which hashed storage keys don't keep", abstract_definition.ErrNotSupported, what)
+	}
+	return nil
+}
+
+// keyedStorageMedia is a function that returns the storage media addressing sessions by the storage keys
+// its ListSessions, ScanSessions and UserSessionIDs methods return, which is the storage media itself
+// unless it hashes its keys, e.g. to retrieve or move every listed session.
+func keyedStorageMedia(storageMedia abstract_definition.StorageMedia) abstract_definition.StorageMedia {
+	if hashed, isHashed := storageMedia.(*hashedStorage); isHashed {
+		return hashed.storage
+	}
+	return storageMedia
+}
+
+// hashStorageKey is a function that returns the storage key of a session ID, the unpadded base64 URL encoding
+// of its SHA-256 hash, which every storage media accepts as a session ID.
+func hashStorageKey(sessionId string) string {
+	hash := sha256.Sum256([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// hashedStorage is a storage media keeping sessions in another storage media under the hash of their ID.
+type hashedStorage struct {
+	storage abstract_definition.StorageMedia
+}
+
+// hashedSession is a session of a hashedStorage, its ID being the one it was resolved from rather than its storage key.
+type hashedSession struct {
+	abstract_definition.Session
+	id string
+}
+
+// GetSessionId is a method for hashedSession that retrieves the session ID it was resolved from.
+func (session *hashedSession) GetSessionId() string {
+	return session.id
+}
+
+// wrap is a method for hashedStorage that returns a session of the underlying storage media as resolved from its ID.
+func (hashed *hashedStorage) wrap(sessionId string, session abstract_definition.Session, err error) (abstract_definition.Session, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &hashedSession{Session: session, id: sessionId}, nil
+}
+
+// InitializeSession is a method for hashedStorage that creates a new session under the hash of its ID.
+func (hashed *hashedStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	session, err := hashed.storage.InitializeSession(hashStorageKey(sessionId))
+	return hashed.wrap(sessionId, session, err)
+}
+
+// RetrieveSession is a method for hashedStorage that retrieves a session from the hash of its ID,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (hashed *hashedStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	session, err := hashed.storage.RetrieveSession(hashStorageKey(sessionId))
+	return hashed.wrap(sessionId, session, err)
+}
+
+// RetrieveSessionAndTouch is a method for hashedStorage that retrieves a session from the hash of its ID
+// and updates its last access time, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (hashed *hashedStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	session, err := hashed.storage.RetrieveSessionAndTouch(hashStorageKey(sessionId))
+	return hashed.wrap(sessionId, session, err)
+}
+
+// UpdateSessionLastAccess is a method for hashedStorage that updates the last access time of a session.
+func (hashed *hashedStorage) UpdateSessionLastAccess(sessionId string) error {
+	return hashed.storage.UpdateSessionLastAccess(hashStorageKey(sessionId))
+}
+
+// DestroySession is a method for hashedStorage that destroys a session.
+func (hashed *hashedStorage) DestroySession(sessionId string) error {
+	return hashed.storage.DestroySession(hashStorageKey(sessionId))
+}
+
+// Ping is a method for hashedStorage that checks the underlying storage media can be reached.
+func (hashed *hashedStorage) Ping(ctx context.Context) error {
+	return hashed.storage.Ping(ctx)
+}
+
+// DestroyAllSessions is a method for hashedStorage that destroys every session of the underlying storage media.
+func (hashed *hashedStorage) DestroyAllSessions() error {
+	return hashed.storage.DestroyAllSessions()
+}
+
+// TerminateSessionOnExpiration is a method for hashedStorage that terminates expired sessions
+// of the underlying storage media, and returns the number of terminated sessions.
+func (hashed *hashedStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	return hashed.storage.TerminateSessionOnExpiration(maxLifetime)
+}
+
+// TerminateExpiredSessions is a method for hashedStorage that terminates expired sessions of the underlying
+// storage media, and returns the storage keys of the terminated sessions.
+// It returns an abstract_definition.ErrNotSupported error if the underlying storage media can't report them.
+func (hashed *hashedStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	expiryReporter, reportsExpiry := hashed.storage.(abstract_definition.ExpiryReporter)
+	if !reportsExpiry {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return expiryReporter.TerminateExpiredSessions(maxLifetime)
+}
+
+// ListSessions is a method for hashedStorage that returns the storage keys of the sessions.
+func (hashed *hashedStorage) ListSessions() ([]string, error) {
+	return hashed.storage.ListSessions()
+}
+
+// ScanSessions is a method for hashedStorage that returns a page of the storage keys of the sessions
+// and the cursor of the next page.
+func (hashed *hashedStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	return hashed.storage.ScanSessions(cursor, limit)
+}
+
+// ExportSession is a method for hashedStorage that returns the full content of a session, holding its ID.
+func (hashed *hashedStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	data, err := hashed.storage.ExportSession(hashStorageKey(sessionId))
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	data.Id = sessionId
+	return data, nil
+}
+
+// ImportSession is a method for hashedStorage that stores a session under the hash of its ID from its full content.
+func (hashed *hashedStorage) ImportSession(data abstract_definition.SessionData) error {
+	data.Id = hashStorageKey(data.Id)
+	return hashed.storage.ImportSession(data)
+}
+
+// Pin is a method for hashedStorage that exempts a session from expiration.
+func (hashed *hashedStorage) Pin(sessionId string) error {
+	return hashed.storage.Pin(hashStorageKey(sessionId))
+}
+
+// Unpin is a method for hashedStorage that makes a pinned session expire again.
+func (hashed *hashedStorage) Unpin(sessionId string) error {
+	return hashed.storage.Unpin(hashStorageKey(sessionId))
+}
+
+// SetSessionUserID is a method for hashedStorage that associates a session with a user.
+// It returns an abstract_definition.ErrNotSupported error if the underlying storage media can't associate
+// sessions with users.
+func (hashed *hashedStorage) SetSessionUserID(sessionId, userID string) error {
+	userIndex, indexesUsers := hashed.storage.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return abstract_definition.ErrNotSupported
+	}
+	return userIndex.SetSessionUserID(hashStorageKey(sessionId), userID)
+}
+
+// UserSessionIDs is a method for hashedStorage that returns the storage keys of the sessions associated with a user.
+// It returns an abstract_definition.ErrNotSupported error if the underlying storage media can't associate
+// sessions with users.
+func (hashed *hashedStorage) UserSessionIDs(userID string) ([]string, error) {
+	userIndex, indexesUsers := hashed.storage.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return userIndex.UserSessionIDs(userID)
+}
+
+// SessionIDsByValue is a method for hashedStorage that returns the storage keys of the sessions holding the value
+// under the key. It returns an abstract_definition.ErrNotSupported error if the underlying storage media can't query
+// sessions by their values.
+func (hashed *hashedStorage) SessionIDsByValue(ctx context.Context, key string, value interface{}) ([]string, error) {
+	valueIndex, indexesValues := hashed.storage.(abstract_definition.ValueIndex)
+	if !indexesValues {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return valueIndex.SessionIDsByValue(ctx, key, value)
+}
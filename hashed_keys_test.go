@@ -0,0 +1,135 @@
+package wsm_backup_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/memory_storage"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// storageKey returns the storage key of a session ID with hashed storage keys.
+func storageKey(sessionId string) string {
+	hash := sha256.Sum256([]byte(sessionId))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// newHashedManager returns a manager keeping its sessions in the storage under hashed keys.
+func newHashedManager(t *testing.T, storage *memory_storage.MemoryStorage, options ...wsm.Option) *wsm.SessionManager {
+	t.Helper()
+	options = append([]wsm.Option{wsm.WithHashedStorageKeys(true)}, options...)
+	manager, err := wsm.NewSessionManagerWithStorage(storage, "session", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestHashedStorageKeysHideSessionIds(t *testing.T) {
+	storage := &memory_storage.MemoryStorage{}
+	manager := newHashedManager(t, storage)
+	sessionId, request := requestWithSession(t, manager)
+	cookie, err := request.Cookie("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := storage.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != storageKey(sessionId) {
+		t.Fatalf("got storage keys %v, want the hash of the session ID", keys)
+	}
+	if strings.Contains(cookie.Value, keys[0]) || strings.Contains(keys[0], sessionId) {
+		t.Fatal("storage key reveals the cookie value")
+	}
+	if _, err = storage.RetrieveSession(sessionId); err == nil {
+		t.Fatal("session stored under its ID")
+	}
+	session, isNew, err := manager.StartSession(httptest.NewRecorder(), request)
+	if err != nil || isNew || session.GetSessionId() != sessionId {
+		t.Fatalf("session not resolved from its cookie: new %v, error %v", isNew, err)
+	}
+	if existed, err := manager.EndSession(httptest.NewRecorder(), request); err != nil || !existed {
+		t.Fatalf("session not ended: existed %v, error %v", existed, err)
+	}
+	if count := storage.ActiveSessions(); count != 0 {
+		t.Fatalf("%d sessions left after ending the session", count)
+	}
+}
+
+func TestHashedStorageKeysWithANamespace(t *testing.T) {
+	storage := &memory_storage.MemoryStorage{}
+	manager := newHashedManager(t, storage, wsm.WithNamespace("tenant"))
+	sessionId := startSessions(t, manager, 1)[0]
+	if _, err := storage.RetrieveSession("tenant_" + storageKey(sessionId)); err != nil {
+		t.Fatalf("session not stored under the namespaced hash of its ID: %v", err)
+	}
+	if _, err := manager.LookupSession(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := manager.ListSessions(); err != nil || len(keys) != 1 || keys[0] != storageKey(sessionId) {
+		t.Fatalf("got storage keys %v of the namespace, error %v", keys, err)
+	}
+}
+
+func TestMigrationKeepsHashedStorageKeys(t *testing.T) {
+	manager := newHashedManager(t, &memory_storage.MemoryStorage{})
+	sessionIds := startSessions(t, manager, 3)
+	target := &memory_storage.MemoryStorage{}
+	if report := waitForMigration(t, manager.MigrateStorageMedia(target)); report.Migrated != 3 {
+		t.Fatalf("migrated %d sessions, want 3", report.Migrated)
+	}
+	for _, sessionId := range sessionIds {
+		if _, err := target.RetrieveSession(storageKey(sessionId)); err != nil {
+			t.Errorf("session not moved under the hash of its ID: %v", err)
+		}
+		if _, err := manager.LookupSession(sessionId); err != nil {
+			t.Errorf("migrated session not resolved from its ID: %v", err)
+		}
+	}
+}
+
+func TestCookieStorageCantHashItsKeys(t *testing.T) {
+	if _, err := wsm.NewSessionManager("cookie", "session", 60, wsm.WithRegistrationDir(t.TempDir()),
+		wsm.WithCookieStorageKey(make([]byte, 32)), wsm.WithHashedStorageKeys(true)); err == nil {
+		t.Fatal("cookie storage media accepted with hashed storage keys")
+	}
+}
+
+func TestHashedStorageKeysRejectLookupsReturningSessionIds(t *testing.T) {
+	storage := &memory_storage.MemoryStorage{}
+	manager, err := wsm.NewSessionManagerWithStorage(valueIndexedStorage{storage}, "session", wsm.WithHashedStorageKeys(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionId, _ := requestWithSession(t, manager)
+	session, err := manager.LookupSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("role", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.SetUserID(session, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.SessionsForUser("user"); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Errorf("got %v for the sessions of a user, want ErrNotSupported", err)
+	}
+	if _, err = manager.FindSessionsByValue(context.Background(), "role", "admin"); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Errorf("got %v for the sessions found by value, want ErrNotSupported", err)
+	}
+	if err = manager.DestroySessionsForUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	if count := storage.ActiveSessions(); count != 0 {
+		t.Fatalf("%d sessions left after destroying the sessions of their user", count)
+	}
+}
@@ -0,0 +1,90 @@
+package wsm_backup_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/wsmtest"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIDGeneratorNamesNewSessions(t *testing.T) {
+	var generated int64
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithIDGenerator(func() (string, error) {
+		return fmt.Sprintf("session-%d", atomic.AddInt64(&generated, 1)), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	started := httptest.NewRecorder()
+	session, _, err := manager.StartSession(started, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionId := session.GetSessionId(); sessionId != "session-1" {
+		t.Fatalf("started the session %s, want session-1", sessionId)
+	}
+	if cookies := started.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != "session-1" {
+		t.Fatalf("set cookies %v, want the cookie of session-1", cookies)
+	}
+	if session, err = manager.CreateSession(); err != nil || session.GetSessionId() != "session-2" {
+		t.Fatalf("created a session with error %v, want session-2", err)
+	}
+	if _, _, err = wsmtest.NewSessionManager(wsm.WithIDGenerator(nil)); err == nil {
+		t.Fatal("nil ID generator accepted")
+	}
+}
+
+func TestIDGeneratorFailuresCreateNoSession(t *testing.T) {
+	generatorErr := errors.New("generator failed")
+	for _, generator := range []wsm.IDGenerator{
+		func() (string, error) { return "", generatorErr },
+		func() (string, error) { return "", nil },
+	} {
+		manager, storage, err := wsmtest.NewSessionManager(wsm.WithIDGenerator(generator))
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := httptest.NewRecorder()
+		if _, _, err = manager.StartSession(started, httptest.NewRequest("GET", "/", nil)); err == nil {
+			t.Fatal("session started without an ID")
+		}
+		if cookies := started.Result().Cookies(); len(cookies) != 0 {
+			t.Fatalf("set cookies %v without a session", cookies)
+		}
+		if _, err = manager.CreateSession(); err == nil {
+			t.Fatal("session created without an ID")
+		}
+		if count := storage.SessionCount(); count != 0 {
+			t.Fatalf("storage holds %d sessions, want none", count)
+		}
+		manager.Stop()
+	}
+}
+
+func TestIDLengthSetsTheRandomBytesOfGeneratedIDs(t *testing.T) {
+	for _, length := range []int{16, 24, 48} {
+		manager, _, err := wsmtest.NewSessionManager(wsm.WithIDLength(length))
+		if err != nil {
+			t.Fatalf("length of %d bytes rejected: %v", length, err)
+		}
+		session, err := manager.CreateSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base64.URLEncoding.DecodeString(session.GetSessionId())
+		if err != nil || len(decoded) != length {
+			t.Errorf("generated %q, decoding to %d bytes with error %v, want %d random bytes", session.GetSessionId(), len(decoded), err, length)
+		}
+		manager.Stop()
+	}
+	for _, length := range []int{0, 15} {
+		if _, _, err := wsmtest.NewSessionManager(wsm.WithIDLength(length)); err == nil {
+			t.Errorf("length of %d bytes accepted, below the 16 bytes minimum", length)
+		}
+	}
+}
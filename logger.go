@@ -0,0 +1,29 @@
+package wsm_backup
+
+import (
+	"errors"
+)
+
+// Logger receives the internal diagnostics of a SessionManager, such as storage errors that can't be returned
+// to a caller. It's satisfied by *log.Logger, and can wrap any other logging library.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// noopLogger is the default Logger of SessionManager, discarding all diagnostics.
+type noopLogger struct{}
+
+// Printf is a method for noopLogger that discards the diagnostic.
+func (noopLogger) Printf(string, ...interface{}) {}
+
+// WithLogger is an option that sets the logger receiving the internal diagnostics of the manager,
+// e.g. log.Default() or an adapter to the application's log pipeline. By default, diagnostics are discarded.
+func WithLogger(logger Logger) Option {
+	return func(manager *SessionManager) error {
+		if logger == nil {
+			return errors.New("wsm: logger must not be nil")
+		}
+		manager.logger = logger
+		return nil
+	}
+}
@@ -0,0 +1,326 @@
+// Package memcached_storage provides a storage media keeping sessions in memcached,
+// each session stored under a prefixed key and expired by memcached itself.
+package memcached_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultServer is the memcached server used when MemcachedStorage has no Servers set.
+const DefaultServer = "localhost:11211"
+
+// DefaultKeyPrefix is the prefix of the keys sessions are stored under when MemcachedStorage has no KeyPrefix set.
+const DefaultKeyPrefix = "wsm:session:"
+
+// maxRelativeExpiration is the longest expiration memcached accepts in seconds from now,
+// longer ones must be given as a unix timestamp.
+const maxRelativeExpiration = 30 * 24 * 60 * 60
+
+// MemcachedStorage represents a memcached storage media type to store sessions in, on its Servers,
+// or on DefaultServer if none is set. Each session is stored as json under its ID prefixed with KeyPrefix,
+// with an expiration of the maximum lifetime renewed on every change, so memcached expires it by itself.
+// Pinned sessions are stored without expiration, though memcached may still evict them when it's full.
+// Values are stored as json, so they are retrieved as decoded by encoding/json.
+type MemcachedStorage struct {
+	sync.Mutex
+	Servers         []string
+	KeyPrefix       string
+	client          *memcache.Client
+	maxLifetime     time.Duration
+	clock           abstract_definition.ClockHolder
+	maxSessionBytes atomic.Int64
+}
+
+// SetClock is a method for MemcachedStorage that sets the clock stamping the last access time of sessions
+// it stores, memcached expiring them by itself on its own clock.
+func (storage *MemcachedStorage) SetClock(clock abstract_definition.Clock) {
+	storage.clock.SetClock(clock)
+}
+
+// Now is a method for MemcachedStorage that returns the current time of its clock.
+func (storage *MemcachedStorage) Now() time.Time {
+	return storage.clock.Now()
+}
+
+// memcachedClient is a method for MemcachedStorage that returns the client of its servers,
+// creating it on its first use.
+func (storage *MemcachedStorage) memcachedClient() *memcache.Client {
+	storage.Lock()
+	defer storage.Unlock()
+	if storage.client == nil {
+		servers := storage.Servers
+		if len(servers) == 0 {
+			servers = []string{DefaultServer}
+		}
+		storage.client = memcache.New(servers...)
+	}
+	return storage.client
+}
+
+// sessionKey is a method for MemcachedStorage that returns the key the session belonging to the given ID is stored under.
+func (storage *MemcachedStorage) sessionKey(sessionId string) string {
+	if storage.KeyPrefix == "" {
+		return DefaultKeyPrefix + sessionId
+	}
+	return storage.KeyPrefix + sessionId
+}
+
+// expiration is a method for MemcachedStorage that returns the memcached expiration of a session,
+// its own expiry or the maximum lifetime, and none for pinned sessions.
+func (storage *MemcachedStorage) expiration(data abstract_definition.SessionData) int32 {
+	if data.Pinned {
+		return 0
+	}
+	storage.Lock()
+	lifetime := storage.maxLifetime
+	storage.Unlock()
+	if data.Expiry > 0 {
+		lifetime = data.Expiry
+	}
+	lifetimeSeconds := int64((lifetime + time.Second - 1) / time.Second)
+	if lifetimeSeconds > maxRelativeExpiration {
+		// absolute expirations are compared to the clock of the memcached servers, not the storage clock
+		return int32(time.Now().Unix() + lifetimeSeconds)
+	}
+	return int32(lifetimeSeconds)
+}
+
+// newItem is a method for MemcachedStorage that encodes a session into the memcached item storing it.
+func (storage *MemcachedStorage) newItem(data abstract_definition.SessionData) (*memcache.Item, error) {
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return nil, fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return &memcache.Item{Key: storage.sessionKey(data.Id), Value: encodedData, Expiration: storage.expiration(data)}, nil
+}
+
+// readSession is a method for MemcachedStorage that reads the item of the session belonging to the given ID,
+// and decodes it. If it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) readSession(sessionId string) (*memcache.Item, abstract_definition.SessionData, error) {
+	item, err := storage.memcachedClient().Get(storage.sessionKey(sessionId))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	if err != nil {
+		return nil, abstract_definition.SessionData{}, err
+	}
+	data, err := stored_session.UnmarshalSessionData(item.Value)
+	if err != nil {
+		return nil, abstract_definition.SessionData{}, fmt.Errorf("wsm: could not decode the session: %w", err)
+	}
+	return item, data, nil
+}
+
+// SetMaxLifetime is a method for MemcachedStorage that sets the maximum lifetime sessions are stored with,
+// rounded up to whole seconds as memcached expires items.
+func (storage *MemcachedStorage) SetMaxLifetime(maxLifetime time.Duration) {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.maxLifetime = maxLifetime
+}
+
+// SetMaxSessionBytes is a method for MemcachedStorage that sets the maximum size of sessions as encoded in their item,
+// zero meaning no limit.
+func (storage *MemcachedStorage) SetMaxSessionBytes(maxBytes int) {
+	storage.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// CheckSessionSize is a method for MemcachedStorage that returns an abstract_definition.ErrSessionTooLarge error
+// if the content of a session would exceed the maximum size once encoded in its item.
+func (storage *MemcachedStorage) CheckSessionSize(data abstract_definition.SessionData) error {
+	maxBytes := storage.maxSessionBytes.Load()
+	if maxBytes == 0 {
+		return nil
+	}
+	encodedData, err := stored_session.MarshalSessionData(data)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session: %w", err)
+	}
+	return stored_session.CheckSize(len(encodedData), maxBytes)
+}
+
+// UpdateSession is a method for MemcachedStorage that reads the session belonging to the given ID,
+// applies the update to it, stores it back only if it hasn't been changed in the meantime, retrying otherwise,
+// and returns its new content.
+// It returns the error of the update without storing anything if the update fails.
+func (storage *MemcachedStorage) UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	for {
+		item, data, err := storage.readSession(sessionId)
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		if err = update(&data); err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		newItem, err := storage.newItem(data)
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		item.Value, item.Expiration = newItem.Value, newItem.Expiration
+		err = storage.memcachedClient().CompareAndSwap(item)
+		if errors.Is(err, memcache.ErrCASConflict) {
+			continue
+		}
+		if errors.Is(err, memcache.ErrNotStored) {
+			return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+		}
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		return stored_session.CopySessionData(data), nil
+	}
+}
+
+// InitializeSession is a method for MemcachedStorage that takes a session ID argument of type string
+// creates a new session, stores it in memcached, and then return that session.
+// It returns an error if the session could not be stored.
+func (storage *MemcachedStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	now := storage.Now()
+	data := abstract_definition.SessionData{
+		Id:             sessionId,
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values:         make(map[interface{}]interface{}),
+	}
+	item, err := storage.newItem(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.memcachedClient().Set(item); err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSession is a method for MemcachedStorage that takes session ID of type string as an argument
+// and returns the session stored in memcached that belongs to the given ID, on a cache miss
+// it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	_, data, err := storage.readSession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSessionAndTouch is a method for MemcachedStorage that takes session ID of type string as an argument
+// and returns the session stored in memcached that belongs to the given ID, updating its last access time
+// and renewing its expiration in the same compare-and-swap, on a cache miss it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	data, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// UpdateSessionLastAccess is a method for MemcachedStorage that updates the session's
+// last access time when it's used, renewing its expiration.
+func (storage *MemcachedStorage) UpdateSessionLastAccess(sessionId string) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.LastAccessTime = storage.Now()
+		return nil
+	})
+	return err
+}
+
+// DestroySession is a method for MemcachedStorage that deletes a session from memcached if found,
+// otherwise it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) DestroySession(sessionId string) error {
+	err := storage.memcachedClient().Delete(storage.sessionKey(sessionId))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return abstract_definition.SessionNotExist
+	}
+	return err
+}
+
+// Ping is a method for MemcachedStorage that checks every server of the storage is reachable.
+// The memcached client can't be canceled, so only a context already done stops it.
+func (storage *MemcachedStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := storage.memcachedClient().Ping(); err != nil {
+		return fmt.Errorf("wsm: could not reach the memcached servers: %w", err)
+	}
+	return nil
+}
+
+// DestroyAllSessions is a method for MemcachedStorage that returns an abstract_definition.ErrNotSupported error,
+// since memcached keys can't be enumerated, and flushing would delete the keys of other applications too.
+func (storage *MemcachedStorage) DestroyAllSessions() error {
+	return abstract_definition.ErrNotSupported
+}
+
+// TerminateSessionOnExpiration is a method for MemcachedStorage that records the maximum lifetime
+// sessions are stored with, since memcached expires sessions by itself, so it never terminates any.
+func (storage *MemcachedStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	storage.SetMaxLifetime(maxLifetime)
+	return 0, nil
+}
+
+// ListSessions is a method for MemcachedStorage that returns an abstract_definition.ErrNotSupported error,
+// since memcached keys can't be enumerated.
+func (storage *MemcachedStorage) ListSessions() ([]string, error) {
+	return nil, abstract_definition.ErrNotSupported
+}
+
+// ScanSessions is a method for MemcachedStorage that returns an abstract_definition.ErrNotSupported error,
+// since memcached keys can't be enumerated.
+func (storage *MemcachedStorage) ScanSessions(string, int) ([]string, string, error) {
+	return nil, "", abstract_definition.ErrNotSupported
+}
+
+// ExportSession is a method for MemcachedStorage that returns the full content of the session
+// belonging to the given ID, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	_, data, err := storage.readSession(sessionId)
+	return data, err
+}
+
+// ImportSession is a method for MemcachedStorage that stores a session from its full content,
+// replacing any session with the same ID.
+// It returns an error if a key is not a string, the session is larger than the maximum session size,
+// with an abstract_definition.ErrSessionTooLarge error, or the session could not be stored.
+func (storage *MemcachedStorage) ImportSession(data abstract_definition.SessionData) error {
+	if err := storage.CheckSessionSize(data); err != nil {
+		return err
+	}
+	item, err := storage.newItem(data)
+	if err != nil {
+		return err
+	}
+	return storage.memcachedClient().Set(item)
+}
+
+// Pin is a method for MemcachedStorage that stores the session belonging to the given ID without expiration,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) Pin(sessionId string) error {
+	return storage.setPinned(sessionId, true)
+}
+
+// Unpin is a method for MemcachedStorage that makes a pinned session belonging to the given ID expire again,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *MemcachedStorage) Unpin(sessionId string) error {
+	return storage.setPinned(sessionId, false)
+}
+
+// setPinned is a method for MemcachedStorage that sets the pin state of the session belonging to the given ID.
+func (storage *MemcachedStorage) setPinned(sessionId string, pinned bool) error {
+	_, err := storage.UpdateSession(sessionId, func(data *abstract_definition.SessionData) error {
+		data.Pinned = pinned
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,275 @@
+package memcached_storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"local/zyrx/backup/abstract_definition"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeItem is an item stored by fakeMemcached, expiring at expiresAt unless it's zero.
+type fakeItem struct {
+	value      []byte
+	flags      uint32
+	expiration int64
+	expiresAt  time.Time
+	cas        uint64
+}
+
+// fakeMemcached is a memcached server speaking the text protocol commands of the memcached client,
+// expiring items on its own clock, which only moves when it's advanced.
+type fakeMemcached struct {
+	sync.Mutex
+	listener net.Listener
+	items    map[string]*fakeItem
+	now      time.Time
+	nextCas  uint64
+}
+
+// startFakeMemcached starts a fakeMemcached on a local port, stopped once the test ends.
+func startFakeMemcached(t *testing.T) *fakeMemcached {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeMemcached{listener: listener, items: make(map[string]*fakeItem), now: time.Unix(1700000000, 0)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeMemcached) advance(duration time.Duration) {
+	server.Lock()
+	defer server.Unlock()
+	server.now = server.now.Add(duration)
+}
+
+// item is a method for fakeMemcached that returns the item under the key, if it hasn't expired.
+// It must be called while holding the server lock.
+func (server *fakeMemcached) item(key string) *fakeItem {
+	item, exists := server.items[key]
+	if !exists {
+		return nil
+	}
+	if !item.expiresAt.IsZero() && !server.now.Before(item.expiresAt) {
+		delete(server.items, key)
+		return nil
+	}
+	return item
+}
+
+// stored is a method for fakeMemcached that returns the item under the key, or nil if it is missing or expired.
+func (server *fakeMemcached) stored(key string) *fakeItem {
+	server.Lock()
+	defer server.Unlock()
+	return server.item(key)
+}
+
+func (server *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var response string
+		switch fields[0] {
+		case "gets", "get":
+			response = server.get(fields[1:])
+		case "set", "cas":
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err = io.ReadFull(reader, value); err != nil {
+				return
+			}
+			response = server.store(fields, value[:size])
+		case "delete":
+			response = server.delete(fields[1])
+		case "version":
+			response = "VERSION fake\r\n"
+		default:
+			response = "ERROR\r\n"
+		}
+		if _, err = io.WriteString(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+func (server *fakeMemcached) get(keys []string) string {
+	server.Lock()
+	defer server.Unlock()
+	var response strings.Builder
+	for _, key := range keys {
+		if item := server.item(key); item != nil {
+			fmt.Fprintf(&response, "VALUE %s %d %d %d\r\n%s\r\n", key, item.flags, len(item.value), item.cas, item.value)
+		}
+	}
+	response.WriteString("END\r\n")
+	return response.String()
+}
+
+func (server *fakeMemcached) store(fields []string, value []byte) string {
+	server.Lock()
+	defer server.Unlock()
+	key := fields[1]
+	flags, _ := strconv.ParseUint(fields[2], 10, 32)
+	expiration, _ := strconv.ParseInt(fields[3], 10, 64)
+	if fields[0] == "cas" {
+		existing := server.item(key)
+		if existing == nil {
+			return "NOT_FOUND\r\n"
+		}
+		if cas, _ := strconv.ParseUint(fields[5], 10, 64); cas != existing.cas {
+			return "EXISTS\r\n"
+		}
+	}
+	server.nextCas++
+	item := &fakeItem{value: append([]byte(nil), value...), flags: uint32(flags), expiration: expiration, cas: server.nextCas}
+	switch {
+	case expiration > maxRelativeExpiration:
+		item.expiresAt = time.Unix(expiration, 0)
+	case expiration > 0:
+		item.expiresAt = server.now.Add(time.Duration(expiration) * time.Second)
+	}
+	server.items[key] = item
+	return "STORED\r\n"
+}
+
+func (server *fakeMemcached) delete(key string) string {
+	server.Lock()
+	defer server.Unlock()
+	if server.item(key) == nil {
+		return "NOT_FOUND\r\n"
+	}
+	delete(server.items, key)
+	return "DELETED\r\n"
+}
+
+// newStorage returns a storage on the fake server, storing sessions for the given maximum lifetime.
+func newStorage(server *fakeMemcached, maxLifetime time.Duration) *MemcachedStorage {
+	storage := &MemcachedStorage{Servers: []string{server.listener.Addr().String()}}
+	storage.SetMaxLifetime(maxLifetime)
+	return storage
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	storage := newStorage(startFakeMemcached(t), time.Hour)
+	session, err := storage.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	retrieved, err := storage.RetrieveSessionAndTouch("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := retrieved.GetValue("username"); value != "zyrx" {
+		t.Fatalf("got %v, want the stored value", value)
+	}
+	if err = retrieved.DeleteValue("username"); err != nil {
+		t.Fatal(err)
+	}
+	if retrieved, err = storage.RetrieveSession("id"); err != nil || retrieved.GetValue("username") != nil {
+		t.Fatalf("got %v, error %v, want the value deleted", retrieved, err)
+	}
+	if err = storage.DestroySession("id"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storage.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v after the deletion, want SessionNotExist", err)
+	}
+	if err = storage.DestroySession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v deleting a missing session, want SessionNotExist", err)
+	}
+	if err = storage.Ping(context.Background()); err != nil {
+		t.Fatalf("fake server not reached: %v", err)
+	}
+}
+
+func TestCacheMissesAreMissingSessions(t *testing.T) {
+	storage := newStorage(startFakeMemcached(t), time.Hour)
+	if _, err := storage.RetrieveSession("missing"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v, want SessionNotExist", err)
+	}
+	if _, err := storage.RetrieveSessionAndTouch("missing"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v touching a missing session, want SessionNotExist", err)
+	}
+	if _, err := storage.ExportSession("missing"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v exporting a missing session, want SessionNotExist", err)
+	}
+}
+
+func TestItemsExpireAfterTheMaximumLifetime(t *testing.T) {
+	server := startFakeMemcached(t)
+	storage := newStorage(server, 90*time.Second+500*time.Millisecond)
+	if _, err := storage.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	key := DefaultKeyPrefix + "id"
+	if expiration := server.stored(key).expiration; expiration != 91 {
+		t.Fatalf("stored with an expiration of %d seconds, want the maximum lifetime rounded up to 91", expiration)
+	}
+	server.advance(60 * time.Second)
+	if err := storage.UpdateSessionLastAccess("id"); err != nil {
+		t.Fatal(err)
+	}
+	server.advance(60 * time.Second)
+	if _, err := storage.RetrieveSession("id"); err != nil {
+		t.Fatalf("expiration not renewed by the access: %v", err)
+	}
+	server.advance(31 * time.Second)
+	if _, err := storage.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v after the maximum lifetime, want SessionNotExist", err)
+	}
+	if _, err := storage.InitializeSession("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Pin("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if expiration := server.stored(DefaultKeyPrefix + "pinned").expiration; expiration != 0 {
+		t.Fatalf("pinned session stored with an expiration of %d seconds, want none", expiration)
+	}
+	storage.SetMaxLifetime(60 * 24 * time.Hour)
+	if err := storage.Unpin("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if expiration := server.stored(DefaultKeyPrefix + "pinned").expiration; expiration <= maxRelativeExpiration {
+		t.Fatalf("got the expiration %d for a lifetime beyond 30 days, want a unix timestamp", expiration)
+	}
+}
+
+func TestUnsupportedOperations(t *testing.T) {
+	storage := newStorage(startFakeMemcached(t), time.Hour)
+	if _, err := storage.ListSessions(); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Fatalf("got %v listing sessions, want ErrNotSupported", err)
+	}
+	if err := storage.DestroyAllSessions(); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Fatalf("got %v destroying all sessions, want ErrNotSupported", err)
+	}
+}
@@ -0,0 +1,61 @@
+package memory_storage
+
+import (
+	"reflect"
+)
+
+// sessionOverheadBytes is the fixed estimated cost of a session in memory, regardless of its values.
+var sessionOverheadBytes = int64(reflect.TypeOf(MemorySession{}).Size())
+
+// approximateSize is a function that estimates the number of bytes a value occupies in memory,
+// walking through maps, slices, arrays, structs and pointers.
+// It keeps track of the already visited references so shared or cyclic values are counted once.
+func approximateSize(value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	return approximateValueSize(reflect.ValueOf(value), map[uintptr]bool{})
+}
+
+// approximateValueSize is the recursive part of approximateSize working on reflected values.
+func approximateValueSize(value reflect.Value, visited map[uintptr]bool) int64 {
+	switch value.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.String:
+		return int64(value.Type().Size()) + int64(value.Len())
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if value.IsNil() {
+			return int64(value.Type().Size())
+		}
+		if visited[value.Pointer()] {
+			return int64(value.Type().Size())
+		}
+		visited[value.Pointer()] = true
+	}
+	size := int64(value.Type().Size())
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			size += approximateValueSize(value.Elem(), visited)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			size += approximateValueSize(value.Index(i), visited)
+		}
+	case reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			size += approximateValueSize(value.Index(i), visited) - int64(value.Index(i).Type().Size())
+		}
+	case reflect.Map:
+		iterator := value.MapRange()
+		for iterator.Next() {
+			size += approximateValueSize(iterator.Key(), visited) + approximateValueSize(iterator.Value(), visited)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			size += approximateValueSize(value.Field(i), visited) - int64(value.Field(i).Type().Size())
+		}
+	}
+	return size
+}
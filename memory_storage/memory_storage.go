@@ -1,122 +1,713 @@
 package memory_storage
 
 import (
+	"container/list"
+	"context"
 	"errors"
+	"fmt"
 	"local/zyrx/backup/abstract_definition"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrMemoryBudgetExceeded is an error used when a single session would exceed on its own
+// the maximum total memory of the storage.
+var ErrMemoryBudgetExceeded = errors.New("wsm: session exceeds the maximum memory of the storage")
+
+// ErrValueTooDeep is an error used when a session value is nested deeper than the storage allows.
+var ErrValueTooDeep = errors.New("wsm: session value is nested too deeply")
+
 // MemorySession is a struct holding the core data of a session, its unique ID,
-// last time it has been accessed, and its value.
+// when it has been created and last accessed, its value, whether it's pinned to never expire,
+// and its own expiry overriding the maximum lifetime if not zero.
+// Its value is guarded by its own lock, so concurrent requests of the same session are safe.
 type MemorySession struct {
+	sync.RWMutex
 	id             string
+	createdAt      time.Time
 	lastAccessTime time.Time
 	value          map[interface{}]interface{}
+	pinned         bool
+	expiry         time.Duration
+	storage        *MemoryStorage
+	shard          *memoryShard
+	recencyElement *list.Element
+	approxBytes    int64
+	userID         string
+	version        int64
 }
 
 // SetValue is a method for Session that takes key, value arguments both of type interface{}
 // to set the session's value, and then save this change to the registered storage media
 // as well as updating the session's last access time.
+// If the storage has a maximum total memory, least-recently-used sessions get evicted to make room,
+// and an ErrMemoryBudgetExceeded error is returned if the session alone doesn't fit.
+// If the storage has a maximum value depth, values nested deeper are rejected with an ErrValueTooDeep error.
+// If the storage has a maximum session size, an abstract_definition.ErrSessionTooLarge error is returned when
+// the estimated memory size of the session would exceed it.
+// It returns an abstract_definition.ErrInvalidKey error if the key is not a string.
 func (session *MemorySession) SetValue(key, value interface{}) error {
-	// update this session in the registered storage media.
+	if err := abstract_definition.ValidateKey(key); err != nil {
+		return err
+	}
+	memory := session.storage
+	if memory.MaxValueDepth > 0 && exceedsDepth(value, memory.MaxValueDepth) {
+		return fmt.Errorf("%w: the maximum depth is %d", ErrValueTooDeep, memory.MaxValueDepth)
+	}
+	if err := session.storeValue(key, value); err != nil {
+		return err
+	}
+	memory.evictOverBudget(session)
+	return nil
+}
+
+// storeValue is a method for MemorySession used by SetValue to set the session's value while holding the lock
+// of its shard and its own, accounting its new size in the storage total.
+// It returns an error without changing the value if the session would be too large.
+func (session *MemorySession) storeValue(key, value interface{}) error {
+	session.shard.Lock()
+	defer session.shard.Unlock()
+	session.Lock()
+	defer session.Unlock()
+	return session.storeLockedValue(key, value)
+}
+
+// storeLockedValue is a method for MemorySession used by storeValue and swapValue to set the session's value
+// once the lock of its shard and its own are held, incrementing its version.
+// It returns an error without changing the value if the session would be too large.
+func (session *MemorySession) storeLockedValue(key, value interface{}) error {
+	memory := session.storage
+	previousValue, previouslySet := session.value[key]
 	session.value[key] = value
+	restorePreviousValue := func() {
+		if previouslySet {
+			session.value[key] = previousValue
+		} else {
+			delete(session.value, key)
+		}
+	}
+	approxBytes := session.approxMemoryBytes()
+	if maxBytes := memory.maxSessionBytes.Load(); maxBytes > 0 && approxBytes > maxBytes {
+		restorePreviousValue()
+		return fmt.Errorf("%w: about %d bytes, at most %d", abstract_definition.ErrSessionTooLarge, approxBytes, maxBytes)
+	}
+	if memory.MaxMemoryBytes > 0 && approxBytes > memory.MaxMemoryBytes {
+		restorePreviousValue()
+		return ErrMemoryBudgetExceeded
+	}
+	session.lastAccessTime = memory.clock.Now()
+	session.version++
+	memory.accountSession(session)
 	return nil
 }
 
+// CompareAndSwapValue is a method for Session that takes key, old, new arguments all of type interface{}
+// and sets the session's value to new like SetValue if it still holds old for the key, under a single lock,
+// reporting whether it was swapped, so across concurrent read-modify-write cycles of the same key
+// none overwrites a value it didn't read.
+// It returns the errors of SetValue if the new value can't be set.
+func (session *MemorySession) CompareAndSwapValue(key, old, new interface{}) (bool, error) {
+	if err := abstract_definition.ValidateKey(key); err != nil {
+		return false, err
+	}
+	memory := session.storage
+	if memory.MaxValueDepth > 0 && exceedsDepth(new, memory.MaxValueDepth) {
+		return false, fmt.Errorf("%w: the maximum depth is %d", ErrValueTooDeep, memory.MaxValueDepth)
+	}
+	swapped, err := session.swapValue(key, old, new)
+	if err != nil || !swapped {
+		return false, err
+	}
+	memory.evictOverBudget(session)
+	return true, nil
+}
+
+// swapValue is a method for MemorySession used by CompareAndSwapValue to set the session's value
+// if it still holds old, while holding the lock of its shard and its own.
+func (session *MemorySession) swapValue(key, old, new interface{}) (bool, error) {
+	session.shard.Lock()
+	defer session.shard.Unlock()
+	session.Lock()
+	defer session.Unlock()
+	if !reflect.DeepEqual(session.value[key], old) {
+		return false, nil
+	}
+	if err := session.storeLockedValue(key, new); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Version is a method for Session that returns the version of the session, incremented by each of its changes.
+func (session *MemorySession) Version() int64 {
+	session.RLock()
+	defer session.RUnlock()
+	return session.version
+}
+
 // GetValue is a method for Session that takes a key argument of type interface{}
 // to retrieve the session's value if it exists, otherwise it returns nil.
-// It retrieves the value from the provided storage media and updates the session's last access time.
+// It only reads the value under the session's read lock, leaving its last access time untouched.
 func (session *MemorySession) GetValue(key interface{}) interface{} {
+	session.RLock()
+	defer session.RUnlock()
 	return session.value[key]
 }
 
+// GetValueOr is a method for Session that takes key, fallback arguments both of type interface{}
+// to retrieve the session's value if it exists, otherwise it returns the fallback.
+// A value explicitly set to nil exists, so it's returned instead of the fallback.
+func (session *MemorySession) GetValueOr(key, fallback interface{}) interface{} {
+	session.RLock()
+	defer session.RUnlock()
+	if value, valueExists := session.value[key]; valueExists {
+		return value
+	}
+	return fallback
+}
+
+// GetValueOk is a method for Session that takes a key argument of type interface{}
+// to retrieve the session's value and whether it exists, so a value set to nil is told from a missing key.
+func (session *MemorySession) GetValueOk(key interface{}) (interface{}, bool) {
+	session.RLock()
+	defer session.RUnlock()
+	value, valueExists := session.value[key]
+	return value, valueExists
+}
+
+// Values is a method for Session that returns a copy of all the session's values by key,
+// read under the session's read lock.
+func (session *MemorySession) Values() map[interface{}]interface{} {
+	session.RLock()
+	defer session.RUnlock()
+	values := make(map[interface{}]interface{}, len(session.value))
+	for key, value := range session.value {
+		values[key] = value
+	}
+	return values
+}
+
 // DeleteValue is a method for Session that takes a key argument of type interface{}
 // and delete the session's value stored in the storage media as well as updating the
 // session's last access time.
 // It returns nil for error on a successful deletion, otherwise it returns that error.
 func (session *MemorySession) DeleteValue(key interface{}) error {
+	memory := session.storage
+	session.shard.Lock()
+	defer session.shard.Unlock()
+	session.Lock()
+	defer session.Unlock()
 	delete(session.value, key)
+	session.lastAccessTime = memory.clock.Now()
+	session.version++
+	memory.accountSession(session)
 	return nil
 }
 
+// DeleteValueIfExists is a method for Session that takes a key argument of type interface{}
+// and deletes the session's value like DeleteValue, reporting whether it existed.
+// Deleting from memory never fails, so the returned error is always nil.
+func (session *MemorySession) DeleteValueIfExists(key interface{}) (bool, error) {
+	_, valueExisted := session.GetAndDelete(key)
+	return valueExisted, nil
+}
+
+// GetAndDelete is a method for Session that takes a key argument of type interface{}
+// and deletes the session's value under a single lock, returning the deleted value and whether it existed,
+// so across concurrent calls for the same key exactly one observes the value.
+func (session *MemorySession) GetAndDelete(key interface{}) (interface{}, bool) {
+	memory := session.storage
+	session.shard.Lock()
+	defer session.shard.Unlock()
+	session.Lock()
+	defer session.Unlock()
+	value, valueExists := session.value[key]
+	if !valueExists {
+		return nil, false
+	}
+	delete(session.value, key)
+	session.lastAccessTime = memory.clock.Now()
+	session.version++
+	memory.accountSession(session)
+	return value, true
+}
+
 // GetSessionId is a method for Session that retrieves the current session ID
 // calling this method.
 func (session *MemorySession) GetSessionId() string {
 	return session.id
 }
 
+// CreatedAt is a method for Session that returns when the session was created.
+func (session *MemorySession) CreatedAt() time.Time {
+	session.RLock()
+	defer session.RUnlock()
+	return session.createdAt
+}
+
+// LastAccessedAt is a method for Session that returns when the session was last accessed.
+func (session *MemorySession) LastAccessedAt() time.Time {
+	session.RLock()
+	defer session.RUnlock()
+	return session.lastAccessTime
+}
+
+// SetExpiry is a method for Session that overrides the maximum lifetime of this session only,
+// so it outlives (or expires before) the other sessions. A zero expiry restores the maximum lifetime.
+// It returns an error if the expiry is negative.
+func (session *MemorySession) SetExpiry(expiry time.Duration) error {
+	if expiry < 0 {
+		return fmt.Errorf("wsm: session expiry must not be negative, got %v", expiry)
+	}
+	session.shard.Lock()
+	defer session.shard.Unlock()
+	session.expiry = expiry
+	session.Lock()
+	session.version++
+	session.Unlock()
+	return nil
+}
+
+// ApproxMemoryBytes is a method for MemorySession that estimates the number of bytes
+// the session, including its ID and values, occupies in memory.
+func (session *MemorySession) ApproxMemoryBytes() int64 {
+	session.RLock()
+	defer session.RUnlock()
+	return session.approxMemoryBytes()
+}
+
+// approxMemoryBytes is a method for MemorySession that estimates its memory size,
+// it must be called while holding the session lock.
+func (session *MemorySession) approxMemoryBytes() int64 {
+	size := sessionOverheadBytes + int64(len(session.id))
+	for key, value := range session.value {
+		size += approximateSize(key) + approximateSize(value)
+	}
+	return size
+}
+
 // MemoryStorage represents a memory storage media type to store sessions in.
+// MaxMemoryBytes limits the total estimated memory of the stored sessions, when exceeded
+// on new writes least-recently-used sessions get evicted. A value of zero means no limit.
+// MaxValueDepth limits how deeply a value set in a session can be nested. A value of zero means no limit.
+// Sessions held in memory not being serialized, their maximum size set by SessionManager limits their estimated memory size.
+// Sessions are split into ShardCount shards by the hash of their ID, DefaultShardCount if it's not set,
+// each with its own lock, so concurrent requests of sessions of different shards never contend for a lock,
+// and lookups share the read lock of their shard. ShardCount is fixed on the first use of the storage.
 type MemoryStorage struct {
-	sync.Mutex
-	activeSessions int64
-	sessions       map[string]*MemorySession
+	MaxMemoryBytes  int64
+	MaxValueDepth   int
+	ShardCount      int
+	shards          []*memoryShard
+	shardsOnce      sync.Once
+	activeSessions  atomic.Int64
+	usedBytes       atomic.Int64
+	evictions       sync.Mutex
+	recencyLock     sync.Mutex
+	recency         *list.List
+	users           sync.Mutex
+	userSessions    map[string]map[string]struct{}
+	clock           abstract_definition.ClockHolder
+	maxSessionBytes atomic.Int64
 	//sessionsList []sessions
 }
 
+// SetMaxSessionBytes is a method for MemoryStorage that sets the maximum estimated memory size of each session,
+// as reported by MemorySession.ApproxMemoryBytes, zero meaning no limit.
+func (memory *MemoryStorage) SetMaxSessionBytes(maxBytes int) {
+	memory.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// SetClock is a method for MemoryStorage that sets the clock stamping the last access time of sessions
+// and deciding their expiration.
+func (memory *MemoryStorage) SetClock(clock abstract_definition.Clock) {
+	memory.clock.SetClock(clock)
+}
+
 // InitializeSession is a method for MemoryStorage that takes a session ID argument of type string
 // creates a new session, add it to memory, increasing the total active sessions count, and then return that session.
-func (memory *MemoryStorage) InitializeSession(sessionId string) abstract_definition.Session {
-	memory.Lock()
-	defer memory.Unlock()
-	var sessionValue map[interface{}]interface{}
-	newSession := MemorySession{
+// Storing in memory never fails, so the returned error is always nil.
+func (memory *MemoryStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	shard := memory.shardFor(sessionId)
+	now := memory.clock.Now()
+	newSession := &MemorySession{
 		id:             sessionId,
-		lastAccessTime: time.Now(),
-		value:          sessionValue,
+		createdAt:      now,
+		lastAccessTime: now,
+		value:          make(map[interface{}]interface{}),
+		storage:        memory,
+		shard:          shard,
 	}
-	memory.activeSessions += 1
-	memory.sessions[sessionId] = &newSession
-	return &newSession
+	shard.Lock()
+	memory.activeSessions.Add(1)
+	shard.sessions[sessionId] = newSession
+	newSession.Lock()
+	memory.accountSession(newSession)
+	newSession.Unlock()
+	shard.Unlock()
+	memory.evictOverBudget(newSession)
+	return newSession, nil
 }
 
 // RetrieveSession is a method for MemoryStorage that takes session ID of type string as an argument
 // and returns the session stored in memory that belongs to the given ID, if it doesn't exist
 // it returns a wsm.SessionNotExists error.
 func (memory *MemoryStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
-	memory.Lock()
-	defer memory.Unlock()
-	session, sessionExists := memory.sessions[sessionId]
-	if !sessionExists {
-		return nil, abstract_definition.SessionNotExist
+	shard := memory.shardFor(sessionId)
+	shard.RLock()
+	defer shard.RUnlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
+		return nil, err
 	}
 	return session, nil
 }
 
+// RetrieveSessionAndTouch is a method for MemoryStorage that takes session ID of type string as an argument
+// and returns the session stored in memory that belongs to the given ID, updating its last access time
+// while holding the read lock of its shard, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (memory *MemoryStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	shard := memory.shardFor(sessionId)
+	shard.RLock()
+	defer shard.RUnlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	session.Lock()
+	session.lastAccessTime = memory.clock.Now()
+	session.Unlock()
+	memory.markUsed(session)
+	return session, nil
+}
+
 // UpdateSessionLastAccess is a method for MemoryStorage that updates the session's
 // last access time when it's used
 func (memory *MemoryStorage) UpdateSessionLastAccess(sessionId string) error {
-	memory.Lock()
-	defer memory.Unlock()
-	if _, err := memory.RetrieveSession(sessionId); errors.Is(err, abstract_definition.SessionNotExist) {
+	shard := memory.shardFor(sessionId)
+	shard.RLock()
+	defer shard.RUnlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
 		return err
 	}
-	memory.sessions[sessionId].lastAccessTime = time.Now()
+	session.Lock()
+	session.lastAccessTime = memory.clock.Now()
+	session.Unlock()
+	memory.markUsed(session)
 	return nil
 }
 
 // DestroySession is an implemented-overridden method for MemoryStorage that deletes a session
 // from memory storage if found, otherwise it returns an error.
+// The existence check and the deletion happen under the same shard lock, so concurrent destroys
+// of the same session decrement the active sessions count only once.
 func (memory *MemoryStorage) DestroySession(sessionId string) error {
-	memory.Lock()
-	defer memory.Unlock()
-	if _, err := memory.RetrieveSession(sessionId); errors.Is(err, abstract_definition.SessionNotExist) {
+	shard := memory.shardFor(sessionId)
+	shard.Lock()
+	defer shard.Unlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
 		return err
 	}
-	delete(memory.sessions, sessionId)
-	memory.activeSessions -= 1
+	memory.removeSession(session)
+	return nil
+}
+
+// removeSession is a method for MemoryStorage that deletes a stored session from memory, from the sessions
+// of its user, and from the storage totals. It must be called while holding the write lock of its shard.
+func (memory *MemoryStorage) removeSession(session *MemorySession) {
+	memory.usedBytes.Add(-session.approxBytes)
+	memory.forgetUsed(session)
+	delete(session.shard.sessions, session.id)
+	memory.activeSessions.Add(-1)
+	memory.indexUser(session, "")
+}
+
+// indexUser is a method for MemoryStorage that associates a stored session with a user, replacing its previous one
+// in the user sessions index. An empty user ID removes the association.
+// It must be called while holding the write lock of the session's shard.
+func (memory *MemoryStorage) indexUser(session *MemorySession, userID string) {
+	memory.users.Lock()
+	defer memory.users.Unlock()
+	if session.userID != "" {
+		delete(memory.userSessions[session.userID], session.id)
+		if len(memory.userSessions[session.userID]) == 0 {
+			delete(memory.userSessions, session.userID)
+		}
+	}
+	session.userID = userID
+	if userID == "" {
+		return
+	}
+	if memory.userSessions == nil {
+		memory.userSessions = make(map[string]map[string]struct{})
+	}
+	if memory.userSessions[userID] == nil {
+		memory.userSessions[userID] = make(map[string]struct{})
+	}
+	memory.userSessions[userID][session.id] = struct{}{}
+}
+
+// SetSessionUserID is a method for MemoryStorage that associates the session belonging to the given ID
+// with a user, so it's listed among the user's sessions, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (memory *MemoryStorage) SetSessionUserID(sessionId, userID string) error {
+	shard := memory.shardFor(sessionId)
+	shard.Lock()
+	defer shard.Unlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
+		return err
+	}
+	memory.indexUser(session, userID)
+	return nil
+}
+
+// UserSessionIDs is a method for MemoryStorage that returns the IDs of all the sessions associated with a user.
+func (memory *MemoryStorage) UserSessionIDs(userID string) ([]string, error) {
+	memory.users.Lock()
+	defer memory.users.Unlock()
+	sessionIds := make([]string, 0, len(memory.userSessions[userID]))
+	for sessionId := range memory.userSessions[userID] {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	return sessionIds, nil
+}
+
+// Ping is a method for MemoryStorage that returns nil, since sessions held in memory are always reachable.
+func (memory *MemoryStorage) Ping(context.Context) error {
+	return nil
+}
+
+// DestroyAllSessions is a method for MemoryStorage that deletes all the sessions from memory storage,
+// resetting the total active sessions count. Every shard is locked, in order, while they're emptied.
+func (memory *MemoryStorage) DestroyAllSessions() error {
+	shards := memory.allShards()
+	for _, shard := range shards {
+		shard.Lock()
+		defer shard.Unlock()
+	}
+	for _, shard := range shards {
+		shard.sessions = make(map[string]*MemorySession)
+	}
+	memory.users.Lock()
+	memory.userSessions = nil
+	memory.users.Unlock()
+	memory.recencyLock.Lock()
+	memory.recency = nil
+	memory.recencyLock.Unlock()
+	memory.activeSessions.Store(0)
+	memory.usedBytes.Store(0)
 	return nil
 }
 
 // TerminateSessionOnExpiration is an overridden-implemented method for MemoryStorage that deletes
-// sessions from memory that has exceeded a passed maximum lifetime parameter of type int64.
-func (memory *MemoryStorage) TerminateSessionOnExpiration(maxLifetime int64) {
-	memory.Lock()
-	defer memory.Unlock()
-	for sessionId, session := range memory.sessions {
-		if session.lastAccessTime.Unix()+maxLifetime > time.Now().Unix() {
-			delete(memory.sessions, sessionId)
-			memory.activeSessions -= 1
+// sessions from memory that has exceeded a passed maximum lifetime parameter of type time.Duration.
+// Pinned sessions are never deleted, and sessions with their own expiry use it instead of the maximum lifetime.
+// It returns the number of deleted sessions. Shards are locked one at a time, so sessions of the other shards
+// are used while expired ones are deleted.
+func (memory *MemoryStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	terminated, err := memory.TerminateExpiredSessions(maxLifetime)
+	return len(terminated), err
+}
+
+// TerminateExpiredSessions is a method for MemoryStorage that deletes expired sessions from memory
+// like TerminateSessionOnExpiration, and returns the IDs of the deleted sessions.
+func (memory *MemoryStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	now := memory.clock.Now()
+	var terminated []string
+	for _, shard := range memory.allShards() {
+		shard.Lock()
+		for _, session := range shard.sessions {
+			if session.pinned {
+				continue
+			}
+			lifetime := maxLifetime
+			if session.expiry > 0 {
+				lifetime = session.expiry
+			}
+			if session.lastAccessTime.Add(lifetime).Before(now) {
+				memory.removeSession(session)
+				terminated = append(terminated, session.id)
+			}
+		}
+		shard.Unlock()
+	}
+	return terminated, nil
+}
+
+// ListSessions is a method for MemoryStorage that returns the IDs of all the sessions stored in memory.
+func (memory *MemoryStorage) ListSessions() ([]string, error) {
+	sessionIds := make([]string, 0, memory.activeSessions.Load())
+	for _, shard := range memory.allShards() {
+		shard.RLock()
+		for sessionId := range shard.sessions {
+			sessionIds = append(sessionIds, sessionId)
+		}
+		shard.RUnlock()
+	}
+	return sessionIds, nil
+}
+
+// ScanSessions is a method for MemoryStorage that returns a page of at most limit session IDs stored in memory
+// in ascending order, following the cursor, and the cursor of the next page, empty once there's none.
+// It returns an abstract_definition.ErrInvalidScanLimit error if the limit is not greater than zero.
+func (memory *MemoryStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	sessionIds, _ := memory.ListSessions()
+	sort.Strings(sessionIds)
+	return abstract_definition.PageSessionIds(sessionIds, cursor, limit)
+}
+
+// ExportSession is a method for MemoryStorage that returns a copy of the full content of the session
+// belonging to the given ID, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (memory *MemoryStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	shard := memory.shardFor(sessionId)
+	shard.RLock()
+	defer shard.RUnlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	session.RLock()
+	defer session.RUnlock()
+	values := make(map[interface{}]interface{}, len(session.value))
+	for key, value := range session.value {
+		values[key] = value
+	}
+	return abstract_definition.SessionData{
+		Id:             session.id,
+		CreatedAt:      session.createdAt,
+		LastAccessTime: session.lastAccessTime,
+		Values:         values,
+		Pinned:         session.pinned,
+		Expiry:         session.expiry,
+		UserID:         session.userID,
+		Version:        session.version,
+	}, nil
+}
+
+// ImportSession is a method for MemoryStorage that stores a session from its full content,
+// replacing any session with the same ID.
+// It returns an error if a key is not a string, a value is nested deeper than MaxValueDepth, the session is larger
+// than the maximum session size, with an abstract_definition.ErrSessionTooLarge error, or the session alone exceeds MaxMemoryBytes.
+func (memory *MemoryStorage) ImportSession(data abstract_definition.SessionData) error {
+	shard := memory.shardFor(data.Id)
+	importedSession := &MemorySession{
+		id:             data.Id,
+		createdAt:      data.CreatedAt,
+		lastAccessTime: data.LastAccessTime,
+		value:          make(map[interface{}]interface{}, len(data.Values)),
+		pinned:         data.Pinned,
+		expiry:         data.Expiry,
+		storage:        memory,
+		shard:          shard,
+		version:        data.Version,
+	}
+	for key, value := range data.Values {
+		if err := abstract_definition.ValidateKey(key); err != nil {
+			return err
+		}
+		if memory.MaxValueDepth > 0 && exceedsDepth(value, memory.MaxValueDepth) {
+			return fmt.Errorf("%w: the maximum depth is %d", ErrValueTooDeep, memory.MaxValueDepth)
+		}
+		importedSession.value[key] = value
+	}
+	approxBytes := importedSession.approxMemoryBytes()
+	if maxBytes := memory.maxSessionBytes.Load(); maxBytes > 0 && approxBytes > maxBytes {
+		return fmt.Errorf("%w: about %d bytes, at most %d", abstract_definition.ErrSessionTooLarge, approxBytes, maxBytes)
+	}
+	if memory.MaxMemoryBytes > 0 && approxBytes > memory.MaxMemoryBytes {
+		return ErrMemoryBudgetExceeded
+	}
+	shard.Lock()
+	if replacedSession, sessionExists := shard.sessions[data.Id]; sessionExists {
+		memory.removeSession(replacedSession)
+	}
+	memory.activeSessions.Add(1)
+	shard.sessions[data.Id] = importedSession
+	memory.indexUser(importedSession, data.UserID)
+	importedSession.Lock()
+	memory.accountSession(importedSession)
+	importedSession.Unlock()
+	shard.Unlock()
+	memory.evictOverBudget(importedSession)
+	return nil
+}
+
+// Pin is a method for MemoryStorage that marks the session belonging to the given ID as exempt
+// from termination on expiration, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (memory *MemoryStorage) Pin(sessionId string) error {
+	return memory.setPinned(sessionId, true)
+}
+
+// Unpin is a method for MemoryStorage that makes a pinned session belonging to the given ID expire again,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (memory *MemoryStorage) Unpin(sessionId string) error {
+	return memory.setPinned(sessionId, false)
+}
+
+// setPinned is a method for MemoryStorage that sets the pin state of the session belonging to the given ID.
+func (memory *MemoryStorage) setPinned(sessionId string, pinned bool) error {
+	shard := memory.shardFor(sessionId)
+	shard.Lock()
+	defer shard.Unlock()
+	session, err := shard.lookup(sessionId)
+	if err != nil {
+		return err
+	}
+	session.Lock()
+	session.pinned = pinned
+	session.Unlock()
+	return nil
+}
+
+// ActiveSessions is a method for MemoryStorage that returns the number of sessions stored in memory.
+// The count is updated atomically, so it can be read without holding any lock, e.g. by a metrics getter.
+func (memory *MemoryStorage) ActiveSessions() int64 {
+	return memory.activeSessions.Load()
+}
+
+// ApproxMemoryBytes is a method for MemoryStorage that returns the total estimated number of bytes
+// occupied in memory by the stored sessions.
+func (memory *MemoryStorage) ApproxMemoryBytes() int64 {
+	return memory.usedBytes.Load()
+}
+
+// accountSession is a method for MemoryStorage that refreshes the estimated size of a written session
+// in the storage total, and marks it as the most recently used. It must be called while holding the write lock of the session's shard and the session's lock.
+func (memory *MemoryStorage) accountSession(session *MemorySession) {
+	if session.shard.sessions[session.id] != session {
+		return
+	}
+	newSize := session.approxMemoryBytes()
+	memory.usedBytes.Add(newSize - session.approxBytes)
+	session.approxBytes = newSize
+	memory.markUsed(session)
+}
+
+// evictOverBudget is a method for MemoryStorage that evicts least-recently-used sessions other than the written one,
+// taken from the back of the least-recently-used list, while the storage total exceeds MaxMemoryBytes.
+// It must be called without holding any shard or session lock, evictions being serialized so concurrent writes
+// don't evict more sessions than needed.
+func (memory *MemoryStorage) evictOverBudget(written *MemorySession) {
+	if memory.MaxMemoryBytes <= 0 {
+		return
+	}
+	memory.evictions.Lock()
+	defer memory.evictions.Unlock()
+	for memory.usedBytes.Load() > memory.MaxMemoryBytes {
+		leastRecentlyUsed := memory.leastRecentlyUsed(written)
+		if leastRecentlyUsed == nil {
+			return
+		}
+		shard := leastRecentlyUsed.shard
+		shard.Lock()
+		if shard.sessions[leastRecentlyUsed.id] == leastRecentlyUsed {
+			memory.removeSession(leastRecentlyUsed)
 		}
+		shard.Unlock()
 	}
 }
@@ -0,0 +1,78 @@
+package memory_storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkSessions is the number of sessions the benchmarks spread their lookups over.
+const benchmarkSessions = 1024
+
+// newBenchmarkStorage returns a memory storage of the given shard count holding benchmarkSessions sessions,
+// and their IDs.
+func newBenchmarkStorage(b *testing.B, shardCount int) (*MemoryStorage, []string) {
+	b.Helper()
+	memory := &MemoryStorage{ShardCount: shardCount}
+	sessionIds := make([]string, benchmarkSessions)
+	for index := range sessionIds {
+		sessionIds[index] = fmt.Sprint("id", index)
+		session, err := memory.InitializeSession(sessionIds[index])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = session.SetValue("value", index); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	return memory, sessionIds
+}
+
+// BenchmarkRetrieveParallel measures lookups of sessions and their values from parallel goroutines,
+// which share the read lock of the session's shard.
+func BenchmarkRetrieveParallel(b *testing.B) {
+	memory, sessionIds := newBenchmarkStorage(b, 0)
+	b.RunParallel(func(pb *testing.PB) {
+		for index := 0; pb.Next(); index++ {
+			session, err := memory.RetrieveSession(sessionIds[index%benchmarkSessions])
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			session.GetValue("value")
+		}
+	})
+}
+
+// BenchmarkShardedAccessParallel compares a single shard, which is a single lock, to the default shards
+// under parallel touches of sessions, taking the read lock of their shard, mixed with sessions
+// created and destroyed, taking its write lock.
+func BenchmarkShardedAccessParallel(b *testing.B) {
+	for _, shardCount := range []int{1, DefaultShardCount} {
+		b.Run(fmt.Sprint(shardCount, "_shards"), func(b *testing.B) {
+			memory, sessionIds := newBenchmarkStorage(b, shardCount)
+			var goroutines atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				goroutine := goroutines.Add(1)
+				for index := 0; pb.Next(); index++ {
+					if err := memory.UpdateSessionLastAccess(sessionIds[index%benchmarkSessions]); err != nil {
+						b.Error(err)
+						return
+					}
+					if index%8 == 0 {
+						sessionId := fmt.Sprint("new", goroutine, "_", index)
+						if _, err := memory.InitializeSession(sessionId); err != nil {
+							b.Error(err)
+							return
+						}
+						if err := memory.DestroySession(sessionId); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}
+			})
+		})
+	}
+}
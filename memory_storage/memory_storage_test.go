@@ -0,0 +1,452 @@
+package memory_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// initializeWithValue creates a session holding a value of the given length, failing the test otherwise.
+func initializeWithValue(t *testing.T, memory *MemoryStorage, sessionId string, length int) *MemorySession {
+	t.Helper()
+	session, err := memory.InitializeSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("value", strings.Repeat("x", length)); err != nil {
+		t.Fatal(err)
+	}
+	return session.(*MemorySession)
+}
+
+func TestEvictionKeepsTheTotalWithinTheBudget(t *testing.T) {
+	memory := &MemoryStorage{MaxMemoryBytes: 5000}
+	for index := 0; index < 20; index++ {
+		initializeWithValue(t, memory, fmt.Sprint("id", index), 500)
+		if used := memory.ApproxMemoryBytes(); used > memory.MaxMemoryBytes {
+			t.Fatalf("%d bytes used after session %d, the budget is %d", used, index, memory.MaxMemoryBytes)
+		}
+	}
+	if _, err := memory.RetrieveSession("id0"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("least recently used session kept, got error %v", err)
+	}
+	if _, err := memory.RetrieveSession("id19"); err != nil {
+		t.Fatalf("last written session evicted: %v", err)
+	}
+	ids, _ := memory.ListSessions()
+	if int64(len(ids)) != memory.ActiveSessions() {
+		t.Fatalf("%d sessions listed, %d active", len(ids), memory.ActiveSessions())
+	}
+}
+
+func TestEvictionFollowsRecentUse(t *testing.T) {
+	sessionBytes := initializeWithValue(t, &MemoryStorage{}, "id", 100).ApproxMemoryBytes()
+	memory := &MemoryStorage{MaxMemoryBytes: 3*sessionBytes + sessionBytes/2}
+	for index := 0; index < 3; index++ {
+		initializeWithValue(t, memory, fmt.Sprint("id", index), 100)
+	}
+	for index := 0; index < 3; index++ {
+		if _, err := memory.RetrieveSessionAndTouch(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// id0 is now the least recently used, until it's touched again.
+	if err := memory.UpdateSessionLastAccess("id0"); err != nil {
+		t.Fatal(err)
+	}
+	initializeWithValue(t, memory, "id3", 100)
+	if _, err := memory.RetrieveSession("id1"); err == nil {
+		t.Fatal("least recently used session id1 kept")
+	}
+	for _, sessionId := range []string{"id0", "id2", "id3"} {
+		if _, err := memory.RetrieveSession(sessionId); err != nil {
+			t.Errorf("recently used session %s evicted: %v", sessionId, err)
+		}
+	}
+}
+
+func TestSessionLargerThanTheBudgetIsRejected(t *testing.T) {
+	memory := &MemoryStorage{MaxMemoryBytes: 5000}
+	session := initializeWithValue(t, memory, "id", 100)
+	if err := session.SetValue("big", strings.Repeat("x", 6000)); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Fatalf("got %v, want ErrMemoryBudgetExceeded", err)
+	}
+	if session.GetValue("big") != nil {
+		t.Fatal("rejected value kept")
+	}
+	if _, err := memory.RetrieveSession("id"); err != nil {
+		t.Fatalf("session evicted to make room for its own rejected value: %v", err)
+	}
+}
+
+func TestDestroyAllSessionsResetsTheTotals(t *testing.T) {
+	memory := &MemoryStorage{MaxMemoryBytes: 1 << 20}
+	for index := 0; index < 10; index++ {
+		initializeWithValue(t, memory, fmt.Sprint("id", index), 100)
+	}
+	if err := memory.DestroyAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if memory.ActiveSessions() != 0 || memory.ApproxMemoryBytes() != 0 {
+		t.Fatalf("%d sessions of %d bytes left", memory.ActiveSessions(), memory.ApproxMemoryBytes())
+	}
+	initializeWithValue(t, memory, "id", 100)
+	if memory.ActiveSessions() != 1 {
+		t.Fatalf("got %d active sessions, want 1", memory.ActiveSessions())
+	}
+}
+
+func TestMaxSessionBytesLimitsWritesAndImports(t *testing.T) {
+	memory := &MemoryStorage{}
+	session := initializeWithValue(t, memory, "id", 10)
+	memory.SetMaxSessionBytes(int(session.ApproxMemoryBytes()) + 100)
+	if err := session.SetValue("value", strings.Repeat("x", 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetValue("value", strings.Repeat("x", 200)); !errors.Is(err, abstract_definition.ErrSessionTooLarge) {
+		t.Fatalf("got %v, want ErrSessionTooLarge", err)
+	}
+	if value := session.GetValue("value"); value != strings.Repeat("x", 50) {
+		t.Fatal("value of the rejected write not restored")
+	}
+	data := abstract_definition.SessionData{Id: "imported", Values: map[interface{}]interface{}{"value": strings.Repeat("x", 200)}}
+	if err := memory.ImportSession(data); !errors.Is(err, abstract_definition.ErrSessionTooLarge) {
+		t.Fatalf("got %v, want ErrSessionTooLarge", err)
+	}
+	if _, err := memory.RetrieveSession("imported"); err == nil {
+		t.Fatal("too large session imported")
+	}
+}
+
+// steppedClock is a clock only moving when it's advanced.
+type steppedClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (clock *steppedClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+func (clock *steppedClock) advance(duration time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// runConcurrently runs the function from the given number of goroutines at once, and waits for them all to return.
+func runConcurrently(goroutines int, function func(goroutine int)) {
+	var start, done sync.WaitGroup
+	start.Add(1)
+	done.Add(goroutines)
+	for goroutine := 0; goroutine < goroutines; goroutine++ {
+		go func(goroutine int) {
+			defer done.Done()
+			start.Wait()
+			function(goroutine)
+		}(goroutine)
+	}
+	start.Done()
+	done.Wait()
+}
+
+func TestSessionValuesAreSafeForConcurrentUse(t *testing.T) {
+	memory := &MemoryStorage{}
+	session, err := memory.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runConcurrently(16, func(goroutine int) {
+		key := fmt.Sprint("key", goroutine)
+		for write := 0; write < 100; write++ {
+			if err := session.SetValue(key, write); err != nil {
+				t.Error(err)
+				return
+			}
+			if value := session.GetValue(key); value != write {
+				t.Errorf("read %v of %s after writing %d", value, key, write)
+				return
+			}
+			session.SetValue("shared", goroutine)
+			session.GetValue("shared")
+		}
+		if err := session.DeleteValue(key); err != nil {
+			t.Error(err)
+		}
+	})
+	for goroutine := 0; goroutine < 16; goroutine++ {
+		if value := session.GetValue(fmt.Sprint("key", goroutine)); value != nil {
+			t.Fatalf("deleted value of goroutine %d kept: %v", goroutine, value)
+		}
+	}
+}
+
+func TestRetrieveSessionAndTouchRacesExpiration(t *testing.T) {
+	clock := &steppedClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	memory := &MemoryStorage{}
+	memory.SetClock(clock)
+	for index := 0; index < 50; index++ {
+		if _, err := memory.InitializeSession(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(2 * time.Minute)
+	runConcurrently(8, func(goroutine int) {
+		if goroutine == 0 {
+			if _, err := memory.TerminateSessionOnExpiration(time.Minute); err != nil {
+				t.Error(err)
+			}
+			return
+		}
+		for index := goroutine; index < 50; index += 7 {
+			session, err := memory.RetrieveSessionAndTouch(fmt.Sprint("id", index))
+			if errors.Is(err, abstract_definition.SessionNotExist) {
+				continue
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !session.LastAccessedAt().Equal(clock.Now()) {
+				t.Errorf("touched session %s returned with the last access %v", session.GetSessionId(), session.LastAccessedAt())
+			}
+		}
+	})
+	// Every session left was touched before the expiration reached it, and must not expire anymore.
+	remaining := memory.ActiveSessions()
+	if expired, err := memory.TerminateSessionOnExpiration(time.Minute); err != nil || expired != 0 {
+		t.Fatalf("terminated %d touched sessions, error %v", expired, err)
+	}
+	if memory.ActiveSessions() != remaining {
+		t.Fatalf("%d sessions left, want %d", memory.ActiveSessions(), remaining)
+	}
+}
+
+func TestActiveSessionsCountsConcurrentChanges(t *testing.T) {
+	memory := &MemoryStorage{}
+	runConcurrently(16, func(goroutine int) {
+		for index := 0; index < 100; index++ {
+			sessionId := fmt.Sprint("id", goroutine, "_", index)
+			if _, err := memory.InitializeSession(sessionId); err != nil {
+				t.Error(err)
+				return
+			}
+			if index%2 == 0 {
+				if err := memory.DestroySession(sessionId); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	})
+	if count := memory.ActiveSessions(); count != 16*50 {
+		t.Fatalf("got %d active sessions, want %d", count, 16*50)
+	}
+}
+
+func TestConcurrentDestroysOfASessionDecrementOnce(t *testing.T) {
+	memory := &MemoryStorage{}
+	for index := 0; index < 3; index++ {
+		if _, err := memory.InitializeSession(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var destroyed sync.Map
+	runConcurrently(16, func(goroutine int) {
+		for index := 0; index < 3; index++ {
+			err := memory.DestroySession(fmt.Sprint("id", index))
+			if err == nil {
+				if _, twice := destroyed.LoadOrStore(index, goroutine); twice {
+					t.Errorf("session id%d destroyed twice", index)
+				}
+			} else if !errors.Is(err, abstract_definition.SessionNotExist) {
+				t.Error(err)
+			}
+		}
+	})
+	if count := memory.ActiveSessions(); count != 0 {
+		t.Fatalf("got %d active sessions, want 0", count)
+	}
+}
+
+func TestLookupsUnderMixedReadWriteLoad(t *testing.T) {
+	memory := &MemoryStorage{}
+	for index := 0; index < 10; index++ {
+		initializeWithValue(t, memory, fmt.Sprint("kept", index), 10)
+	}
+	runConcurrently(16, func(goroutine int) {
+		for operation := 0; operation < 200; operation++ {
+			if goroutine%4 == 0 {
+				sessionId := fmt.Sprint("churn", goroutine, "_", operation)
+				if _, err := memory.InitializeSession(sessionId); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := memory.DestroySession(sessionId); err != nil {
+					t.Error(err)
+					return
+				}
+				continue
+			}
+			session, err := memory.RetrieveSession(fmt.Sprint("kept", operation%10))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if value := session.GetValue("value"); value != strings.Repeat("x", 10) {
+				t.Errorf("read %v from session %s", value, session.GetSessionId())
+				return
+			}
+		}
+	})
+	if count := memory.ActiveSessions(); count != 10 {
+		t.Fatalf("got %d active sessions, want 10", count)
+	}
+}
+
+func TestPingAlwaysSucceeds(t *testing.T) {
+	if err := (&MemoryStorage{}).Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompareAndSwapValueDetectsLostUpdates(t *testing.T) {
+	memory := &MemoryStorage{}
+	session, err := memory.InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("visits", 1); err != nil {
+		t.Fatal(err)
+	}
+	// both requests read the same value before either writes it back
+	firstRequest, _ := memory.RetrieveSession("id")
+	secondRequest, _ := memory.RetrieveSession("id")
+	firstRead, secondRead := firstRequest.GetValue("visits"), secondRequest.GetValue("visits")
+	readVersion := secondRequest.Version()
+	if swapped, err := firstRequest.CompareAndSwapValue("visits", firstRead, firstRead.(int)+1); err != nil || !swapped {
+		t.Fatalf("got %v, %v swapping an unchanged value", swapped, err)
+	}
+	if swapped, err := secondRequest.CompareAndSwapValue("visits", secondRead, secondRead.(int)+1); err != nil || swapped {
+		t.Fatalf("got %v, %v swapping a value changed in between, want a conflict", swapped, err)
+	}
+	if secondRequest.Version() == readVersion {
+		t.Fatal("version unchanged by the concurrent update")
+	}
+	if swapped, err := session.CompareAndSwapValue("missing", nil, "set"); err != nil || !swapped {
+		t.Fatalf("got %v, %v swapping a missing key from nil", swapped, err)
+	}
+	if _, err = session.CompareAndSwapValue(1, nil, "set"); !errors.Is(err, abstract_definition.ErrInvalidKey) {
+		t.Fatalf("got %v, want ErrInvalidKey", err)
+	}
+	runConcurrently(16, func(int) {
+		for increment := 0; increment < 50; increment++ {
+			for {
+				visits := session.GetValue("visits")
+				swapped, err := session.CompareAndSwapValue("visits", visits, visits.(int)+1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if swapped {
+					break
+				}
+			}
+		}
+	})
+	if visits := session.GetValue("visits"); visits != 2+16*50 {
+		t.Fatalf("got %v visits, increments were lost", visits)
+	}
+}
+
+func TestGetValueOkTellsNilValuesFromMissingKeys(t *testing.T) {
+	session, err := (&MemoryStorage{}).InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("cleared", nil); err != nil {
+		t.Fatal(err)
+	}
+	if value, isSet := session.GetValueOk("cleared"); value != nil || !isSet {
+		t.Fatalf("got %v, %v for a value set to nil", value, isSet)
+	}
+	if value, isSet := session.GetValueOk("missing"); value != nil || isSet {
+		t.Fatalf("got %v, %v for a missing key", value, isSet)
+	}
+}
+
+// appointment is a session value nesting an opaque time.Time, and a struct of its own.
+type appointment struct {
+	At    time.Time
+	Place struct{ Room string }
+}
+
+func TestMaxValueDepthLimitsNestedValues(t *testing.T) {
+	memory := &MemoryStorage{MaxValueDepth: 2}
+	session, err := memory.InitializeSession("nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("at-the-limit", map[string][]int{"ids": {1, 2}}); err != nil {
+		t.Fatalf("value at the maximum depth rejected: %v", err)
+	}
+	if err = session.SetValue("beyond-the-limit", map[string][][]int{"ids": {{1}}}); !errors.Is(err, ErrValueTooDeep) {
+		t.Fatalf("got %v for a value beyond the maximum depth, want ErrValueTooDeep", err)
+	}
+	if session.GetValue("beyond-the-limit") != nil {
+		t.Fatal("value beyond the maximum depth stored")
+	}
+	if err = session.SetValue("time", time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("time.Time counted as a struct: %v", err)
+	}
+	if err = session.SetValue("appointment", appointment{At: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)}); err != nil {
+		t.Fatalf("time.Time field counted as a struct: %v", err)
+	}
+	if err = session.SetValue("appointments", []appointment{{}}); !errors.Is(err, ErrValueTooDeep) {
+		t.Fatalf("got %v for a slice of structs of structs, want ErrValueTooDeep", err)
+	}
+}
+
+func TestGetValueOrFallsBackForMissingKeysOnly(t *testing.T) {
+	session, err := (&MemoryStorage{}).InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := session.GetValueOr("theme", "light"); value != "light" {
+		t.Fatalf("got %v for a missing key, want the fallback", value)
+	}
+	for _, value := range []interface{}{"dark", nil} {
+		if err = session.SetValue("theme", value); err != nil {
+			t.Fatal(err)
+		}
+		if got := session.GetValueOr("theme", "light"); got != value {
+			t.Fatalf("got %v for a key set to %v, want its value", got, value)
+		}
+	}
+}
+
+func TestDeleteValueIfExistsReportsWhetherAValueWasDeleted(t *testing.T) {
+	session, err := (&MemoryStorage{}).InitializeSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("cart", "items"); err != nil {
+		t.Fatal(err)
+	}
+	if existed, err := session.DeleteValueIfExists("cart"); err != nil || !existed {
+		t.Fatalf("got %v, %v deleting a stored value", existed, err)
+	}
+	if _, isSet := session.GetValueOk("cart"); isSet {
+		t.Fatal("deleted value still set")
+	}
+	if existed, err := session.DeleteValueIfExists("cart"); err != nil || existed {
+		t.Fatalf("got %v, %v deleting a missing key", existed, err)
+	}
+}
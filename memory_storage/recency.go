@@ -0,0 +1,50 @@
+package memory_storage
+
+import "container/list"
+
+// markUsed is a method for MemoryStorage that moves a session to the front of the least-recently-used list
+// evictions are taken from, adding it if it's not in the list yet. The list is only kept when the storage
+// has a maximum total memory, so it costs nothing otherwise.
+// It must be called while holding the lock of the session's shard, read or write, and the session must be stored.
+func (memory *MemoryStorage) markUsed(session *MemorySession) {
+	if memory.MaxMemoryBytes <= 0 {
+		return
+	}
+	memory.recencyLock.Lock()
+	defer memory.recencyLock.Unlock()
+	if memory.recency == nil {
+		memory.recency = list.New()
+	}
+	if session.recencyElement == nil {
+		session.recencyElement = memory.recency.PushFront(session)
+		return
+	}
+	memory.recency.MoveToFront(session.recencyElement)
+}
+
+// forgetUsed is a method for MemoryStorage that removes a session from the least-recently-used list.
+// It must be called while holding the write lock of the session's shard.
+func (memory *MemoryStorage) forgetUsed(session *MemorySession) {
+	memory.recencyLock.Lock()
+	defer memory.recencyLock.Unlock()
+	if session.recencyElement != nil {
+		memory.recency.Remove(session.recencyElement)
+		session.recencyElement = nil
+	}
+}
+
+// leastRecentlyUsed is a method for MemoryStorage that returns the least recently used session other than
+// the given one, or nil if there's none.
+func (memory *MemoryStorage) leastRecentlyUsed(except *MemorySession) *MemorySession {
+	memory.recencyLock.Lock()
+	defer memory.recencyLock.Unlock()
+	if memory.recency == nil {
+		return nil
+	}
+	for element := memory.recency.Back(); element != nil; element = element.Prev() {
+		if session := element.Value.(*MemorySession); session != except {
+			return session
+		}
+	}
+	return nil
+}
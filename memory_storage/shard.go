@@ -0,0 +1,53 @@
+package memory_storage
+
+import (
+	"hash/fnv"
+	"local/zyrx/backup/abstract_definition"
+	"sync"
+)
+
+// DefaultShardCount is the number of shards the sessions of a MemoryStorage are split into when it has no ShardCount set.
+const DefaultShardCount = 32
+
+// memoryShard is a part of the sessions of a MemoryStorage, those whose ID hashes to it, guarded by its own lock
+// so sessions of different shards are added, removed, and written without contending for the same lock.
+type memoryShard struct {
+	sync.RWMutex
+	sessions map[string]*MemorySession
+}
+
+// lookup is a method for memoryShard that returns the session of the shard that belongs to the given ID,
+// if it doesn't exist it returns a wsm.SessionNotExists error. It must be called while holding the shard lock,
+// read or write.
+func (shard *memoryShard) lookup(sessionId string) (*MemorySession, error) {
+	session, sessionExists := shard.sessions[sessionId]
+	if !sessionExists {
+		return nil, abstract_definition.SessionNotExist
+	}
+	return session, nil
+}
+
+// allShards is a method for MemoryStorage that returns its shards, creating them on first use
+// with ShardCount shards, or DefaultShardCount if it's not greater than zero.
+func (memory *MemoryStorage) allShards() []*memoryShard {
+	memory.shardsOnce.Do(func() {
+		shardCount := memory.ShardCount
+		if shardCount <= 0 {
+			shardCount = DefaultShardCount
+		}
+		memory.shards = make([]*memoryShard, shardCount)
+		for index := range memory.shards {
+			memory.shards[index] = &memoryShard{sessions: make(map[string]*MemorySession)}
+		}
+	})
+	return memory.shards
+}
+
+// shardFor is a method for MemoryStorage that returns the shard of the session belonging to the given ID,
+// chosen by the FNV-1a hash of the ID.
+func (memory *MemoryStorage) shardFor(sessionId string) *memoryShard {
+	shards := memory.allShards()
+	hash := fnv.New32a()
+	hash.Write([]byte(sessionId))
+	return shards[hash.Sum32()%uint32(len(shards))]
+}
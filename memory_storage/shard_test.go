@@ -0,0 +1,58 @@
+package memory_storage
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestSessionsAreKeptInTheirShardOnly(t *testing.T) {
+	memory := &MemoryStorage{ShardCount: 8}
+	for index := 0; index < 100; index++ {
+		if _, err := memory.InitializeSession(fmt.Sprint("id", index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if shards := len(memory.allShards()); shards != 8 {
+		t.Fatalf("got %d shards, want 8", shards)
+	}
+	held := 0
+	for _, shard := range memory.allShards() {
+		for sessionId, session := range shard.sessions {
+			if memory.shardFor(sessionId) != shard || session.shard != shard {
+				t.Errorf("session %s held by another shard than its own", sessionId)
+			}
+			held++
+		}
+	}
+	if held != 100 || memory.ActiveSessions() != 100 {
+		t.Fatalf("%d sessions held by the shards, %d active, want 100", held, memory.ActiveSessions())
+	}
+	sessionIds, err := memory.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(sessionIds)
+	for index := 1; index < len(sessionIds); index++ {
+		if sessionIds[index] == sessionIds[index-1] {
+			t.Fatalf("session %s listed twice", sessionIds[index])
+		}
+	}
+	if len(sessionIds) != 100 {
+		t.Fatalf("listed %d sessions, want 100", len(sessionIds))
+	}
+}
+
+func TestShardCountIsFixedOnFirstUse(t *testing.T) {
+	memory := &MemoryStorage{}
+	if _, err := memory.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	memory.ShardCount = 4
+	if shards := len(memory.allShards()); shards != DefaultShardCount {
+		t.Fatalf("got %d shards, want %d", shards, DefaultShardCount)
+	}
+	if _, err := memory.RetrieveSession("id"); err != nil {
+		t.Fatalf("session lost after changing the shard count: %v", err)
+	}
+}
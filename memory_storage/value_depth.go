@@ -0,0 +1,89 @@
+package memory_storage
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+)
+
+// opaqueInterfaces are the interfaces of types encoding themselves, such as time.Time, counted as plain values
+// whatever their fields, like every struct without exported fields.
+var opaqueInterfaces = []reflect.Type{
+	reflect.TypeOf((*json.Marshaler)(nil)).Elem(),
+	reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem(),
+}
+
+// exceedsDepth is a function that walks a value and reports whether it nests maps, slices, arrays or structs
+// deeper than the given maximum depth. A plain value has a depth of zero, and each container level adds one.
+// Opaque structs, encoding themselves or without exported fields such as time.Time, are plain values.
+// The walk stops as soon as the maximum depth is exceeded, so cyclic values are handled safely.
+func exceedsDepth(value interface{}, maxDepth int) bool {
+	if value == nil {
+		return false
+	}
+	return valueDepthExceeds(reflect.ValueOf(value), 0, maxDepth)
+}
+
+// valueDepthExceeds is the recursive part of exceedsDepth working on reflected values.
+func valueDepthExceeds(value reflect.Value, depth, maxDepth int) bool {
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if value.IsNil() {
+			return false
+		}
+		return valueDepthExceeds(value.Elem(), depth, maxDepth)
+	case reflect.Struct:
+		if isOpaque(value.Type()) {
+			return false
+		}
+		depth += 1
+		if depth > maxDepth {
+			return true
+		}
+	case reflect.Map, reflect.Slice, reflect.Array:
+		depth += 1
+		if depth > maxDepth {
+			return true
+		}
+	default:
+		return false
+	}
+	switch value.Kind() {
+	case reflect.Map:
+		iterator := value.MapRange()
+		for iterator.Next() {
+			if valueDepthExceeds(iterator.Key(), depth, maxDepth) || valueDepthExceeds(iterator.Value(), depth, maxDepth) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if valueDepthExceeds(value.Index(i), depth, maxDepth) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).IsExported() && valueDepthExceeds(value.Field(i), depth, maxDepth) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isOpaque is a function that reports whether a struct type is a plain value, encoding itself by value or pointer,
+// or having no exported field.
+func isOpaque(structType reflect.Type) bool {
+	for _, opaqueInterface := range opaqueInterfaces {
+		if structType.Implements(opaqueInterface) || reflect.PointerTo(structType).Implements(opaqueInterface) {
+			return true
+		}
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		if structType.Field(i).IsExported() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package wsm_backup
+
+import (
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"sort"
+)
+
+// MergeSessions is a method for SessionManager used to copy all the values of a session into another one,
+// e.g. the cart of a guest session into the session started on login, each value being saved to the storage media
+// of the destination session. Keys the destination session already has are kept, unless overwrite is set,
+// in which case they take the value of the source session. The source session is left unchanged, and values
+// are copied in the order of their keys, so a failure leaves the ones before it copied.
+// It returns an error naming the key whose value could not be set.
+func (manager *SessionManager) MergeSessions(src, dst abstract_definition.Session, overwrite bool) error {
+	values := src.Values()
+	keys := make([]interface{}, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+	for _, key := range keys {
+		if !overwrite {
+			if _, isSet := dst.GetValueOk(key); isSet {
+				continue
+			}
+		}
+		if err := dst.SetValue(key, values[key]); err != nil {
+			return fmt.Errorf("wsm: could not merge the value of %v: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package wsm_backup_test
+
+import (
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/wsmtest"
+	"testing"
+)
+
+// sessionWithValues creates a session holding the given values, failing the test otherwise.
+func sessionWithValues(t *testing.T, storage *wsmtest.FakeStorage, sessionId string, values map[string]interface{}) abstract_definition.Session {
+	t.Helper()
+	session, err := storage.InitializeSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range values {
+		if err = session.SetValue(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return session
+}
+
+func TestMergeSessions(t *testing.T) {
+	for _, test := range []struct {
+		overwrite bool
+		wantTheme interface{}
+	}{
+		{overwrite: false, wantTheme: "dark"},
+		{overwrite: true, wantTheme: "light"},
+	} {
+		manager, storage, err := wsmtest.NewSessionManager()
+		if err != nil {
+			t.Fatal(err)
+		}
+		guest := sessionWithValues(t, storage, "guest", map[string]interface{}{"cart": "3 items", "theme": "light"})
+		user := sessionWithValues(t, storage, "user", map[string]interface{}{"username": "zyrx", "theme": "dark"})
+		if err = manager.MergeSessions(guest, user, test.overwrite); err != nil {
+			t.Fatal(err)
+		}
+		merged, err := storage.RetrieveSession("user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cart, username := merged.GetValue("cart"), merged.GetValue("username"); cart != "3 items" || username != "zyrx" {
+			t.Errorf("overwrite %v: got cart %v and username %v, want both sessions' values", test.overwrite, cart, username)
+		}
+		if theme := merged.GetValue("theme"); theme != test.wantTheme {
+			t.Errorf("overwrite %v: got theme %v, want %v", test.overwrite, theme, test.wantTheme)
+		}
+		if values := guest.Values(); len(values) != 2 {
+			t.Errorf("overwrite %v: source session changed to %v", test.overwrite, values)
+		}
+		manager.Stop()
+	}
+}
@@ -0,0 +1,20 @@
+package wsm_backup
+
+// MetricsObserver receives the lifecycle metrics of the sessions of a SessionManager:
+// OnStart when a new session is started, OnEnd when a session is ended,
+// and OnExpire with the number of sessions terminated by each expiration run.
+// Its methods are called concurrently by concurrent requests.
+type MetricsObserver interface {
+	OnStart()
+	OnEnd()
+	OnExpire(count int)
+}
+
+// WithMetricsObserver is an option that sets the observer receiving the sessions lifecycle metrics,
+// see the prometheus_metrics package for a Prometheus observer. By default, no metrics are observed.
+func WithMetricsObserver(observer MetricsObserver) Option {
+	return func(manager *SessionManager) error {
+		manager.metricsObserver = observer
+		return nil
+	}
+}
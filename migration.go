@@ -0,0 +1,166 @@
+package wsm_backup
+
+import (
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"reflect"
+)
+
+// ChangeStorageMedia is a function that moves every session, with its values and last access time,
+// from an old storage media to a new one, and then clears the old storage media.
+// Sessions destroyed in the old storage media while moving are skipped.
+// It returns an error if a session could not be listed, exported, imported, or cleared.
+func ChangeStorageMedia(oldStorageMedia, newStorageMedia abstract_definition.StorageMedia) error {
+	sessionIds, err := oldStorageMedia.ListSessions()
+	if err != nil {
+		return fmt.Errorf("wsm: could not list sessions to change storage media: %w", err)
+	}
+	var movedSessionIds []string
+	for _, sessionId := range sessionIds {
+		sessionData, err := oldStorageMedia.ExportSession(sessionId)
+		if errors.Is(err, abstract_definition.SessionNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("wsm: could not export session to change storage media: %w", err)
+		}
+		if err = newStorageMedia.ImportSession(sessionData); err != nil {
+			return fmt.Errorf("wsm: could not import session to change storage media: %w", err)
+		}
+		movedSessionIds = append(movedSessionIds, sessionId)
+	}
+	for _, sessionId := range movedSessionIds {
+		err = oldStorageMedia.DestroySession(sessionId)
+		if err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+			return fmt.Errorf("wsm: could not clear the old storage media: %w", err)
+		}
+	}
+	return nil
+}
+
+// MigrationProgress reports the progress of a live storage media migration.
+// Done is true on the last report, which holds the error that stopped the migration if it failed.
+type MigrationProgress struct {
+	Migrated int
+	Total    int
+	Done     bool
+	Err      error
+}
+
+// MigrateStorageMedia is a method for SessionManager used to move all sessions to a target storage media
+// while the manager keeps handling requests against its current storage media.
+// Sessions are streamed to the target in the background, then in a final pass holding the manager write lock, pausing requests,
+// sessions created or changed in any way after being streamed are copied again, sessions destroyed meanwhile are
+// removed from the target, and the target atomically replaces the current storage media, which gets cleared.
+// Progress is reported on the returned channel, which is closed after the final report. Intermediate reports
+// are dropped if the previous one was not received yet, so a slow reader never blocks the migration.
+func (manager *SessionManager) MigrateStorageMedia(targetStorageMedia abstract_definition.StorageMedia) <-chan MigrationProgress {
+	progress := make(chan MigrationProgress, 1)
+	go func() {
+		defer close(progress)
+		migrated, err := manager.migrateStorageMedia(targetStorageMedia, progress)
+		select {
+		case <-progress:
+		default:
+		}
+		progress <- MigrationProgress{Migrated: migrated, Total: migrated, Done: true, Err: err}
+	}()
+	return progress
+}
+
+// migrateStorageMedia is a method for SessionManager that performs the live migration of MigrateStorageMedia,
+// returning the number of migrated sessions.
+func (manager *SessionManager) migrateStorageMedia(targetStorageMedia abstract_definition.StorageMedia, progress chan MigrationProgress) (int, error) {
+	manager.RLock()
+	sourceStorageMedia := keyedStorageMedia(manager.storageMedia)
+	preparedStorageMedia, err := manager.prepareStorageMedia(targetStorageMedia)
+	manager.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	targetStorageMedia = keyedStorageMedia(preparedStorageMedia)
+	sessionIds, err := sourceStorageMedia.ListSessions()
+	if err != nil {
+		return 0, fmt.Errorf("wsm: could not list sessions to migrate: %w", err)
+	}
+	streamedSessions := make(map[string]abstract_definition.SessionData, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		if err = copySession(sourceStorageMedia, targetStorageMedia, sessionId, streamedSessions); err != nil {
+			return len(streamedSessions), err
+		}
+		select {
+		case progress <- MigrationProgress{Migrated: len(streamedSessions), Total: len(sessionIds)}:
+		default:
+		}
+	}
+
+	manager.Lock()
+	defer manager.Unlock()
+	remainingSessionIds, err := sourceStorageMedia.ListSessions()
+	if err != nil {
+		return len(streamedSessions), fmt.Errorf("wsm: could not list sessions to migrate: %w", err)
+	}
+	remainingSessions := make(map[string]bool, len(remainingSessionIds))
+	for _, sessionId := range remainingSessionIds {
+		remainingSessions[sessionId] = true
+		streamedSession, streamed := streamedSessions[sessionId]
+		if streamed {
+			sessionData, err := sourceStorageMedia.ExportSession(sessionId)
+			if err != nil {
+				return len(streamedSessions), fmt.Errorf("wsm: could not export session to migrate: %w", err)
+			}
+			if !sessionChanged(streamedSession, sessionData) {
+				continue
+			}
+		}
+		if err = copySession(sourceStorageMedia, targetStorageMedia, sessionId, streamedSessions); err != nil {
+			return len(streamedSessions), err
+		}
+	}
+	for sessionId := range streamedSessions {
+		if remainingSessions[sessionId] {
+			continue
+		}
+		err = targetStorageMedia.DestroySession(sessionId)
+		if err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+			return len(streamedSessions), fmt.Errorf("wsm: could not remove a destroyed session from the target: %w", err)
+		}
+		delete(streamedSessions, sessionId)
+	}
+	manager.storageMedia = preparedStorageMedia
+	for sessionId := range streamedSessions {
+		err = sourceStorageMedia.DestroySession(sessionId)
+		if err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+			return len(streamedSessions), fmt.Errorf("wsm: could not clear the old storage media: %w", err)
+		}
+	}
+	return len(streamedSessions), nil
+}
+
+// copySession is a function that copies a session from a source to a target storage media,
+// keeping track of its copied content. Sessions that no longer exist in the source are skipped.
+func copySession(sourceStorageMedia, targetStorageMedia abstract_definition.StorageMedia, sessionId string,
+	copiedSessions map[string]abstract_definition.SessionData) error {
+	sessionData, err := sourceStorageMedia.ExportSession(sessionId)
+	if errors.Is(err, abstract_definition.SessionNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("wsm: could not export session to migrate: %w", err)
+	}
+	if err = targetStorageMedia.ImportSession(sessionData); err != nil {
+		return fmt.Errorf("wsm: could not import session to migrate: %w", err)
+	}
+	copiedSessions[sessionId] = sessionData
+	return nil
+}
+
+// sessionChanged is a function that reports whether the content of a session differs from a previous copy,
+// comparing everything exported and not only the last access time, which pinning, setting the expiry
+// or the user of a session leave untouched.
+func sessionChanged(previous, current abstract_definition.SessionData) bool {
+	return !current.LastAccessTime.Equal(previous.LastAccessTime) || !current.CreatedAt.Equal(previous.CreatedAt) ||
+		current.Pinned != previous.Pinned || current.Expiry != previous.Expiry || current.UserID != previous.UserID ||
+		!reflect.DeepEqual(current.Values, previous.Values)
+}
@@ -0,0 +1,255 @@
+package wsm_backup_test
+
+import (
+	"errors"
+	"fmt"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memory_storage"
+	"local/zyrx/backup/wsmtest"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// migrationSource is a memory storage media running a hook when its sessions are listed for the second time,
+// which is when MigrateStorageMedia starts its final pass.
+type migrationSource struct {
+	*memory_storage.MemoryStorage
+	lists          sync.Mutex
+	listCount      int
+	beforeFinalRun func()
+}
+
+func (source *migrationSource) ListSessions() ([]string, error) {
+	source.lists.Lock()
+	source.listCount++
+	listCount := source.listCount
+	source.lists.Unlock()
+	if listCount == 2 && source.beforeFinalRun != nil {
+		source.beforeFinalRun()
+	}
+	return source.MemoryStorage.ListSessions()
+}
+
+// startSessions starts the given number of sessions with the manager and returns their IDs.
+func startSessions(t *testing.T, manager *wsm.SessionManager, count int) []string {
+	t.Helper()
+	sessionIds := make([]string, count)
+	for index := range sessionIds {
+		session, _, err := manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIds[index] = session.GetSessionId()
+	}
+	return sessionIds
+}
+
+// waitForMigration fails the test if the migration reports an error.
+func waitForMigration(t *testing.T, progress <-chan wsm.MigrationProgress) wsm.MigrationProgress {
+	t.Helper()
+	var last wsm.MigrationProgress
+	for report := range progress {
+		last = report
+	}
+	if !last.Done || last.Err != nil {
+		t.Fatalf("migration did not complete: %+v", last)
+	}
+	return last
+}
+
+func TestMigrateStorageMediaKeepsChangesMadeWhileStreaming(t *testing.T) {
+	source := &migrationSource{MemoryStorage: &memory_storage.MemoryStorage{}}
+	manager, err := wsm.NewSessionManagerWithStorage(source, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionIds := startSessions(t, manager, 3)
+	source.beforeFinalRun = func() {
+		if err := source.Pin(sessionIds[0]); err != nil {
+			t.Error(err)
+		}
+		if err := source.SetSessionUserID(sessionIds[1], "user"); err != nil {
+			t.Error(err)
+		}
+		session, err := source.MemoryStorage.RetrieveSession(sessionIds[2])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := session.SetExpiry(time.Hour); err != nil {
+			t.Error(err)
+		}
+	}
+	target := &memory_storage.MemoryStorage{}
+	if report := waitForMigration(t, manager.MigrateStorageMedia(target)); report.Migrated != 3 {
+		t.Fatalf("migrated %d sessions, want 3", report.Migrated)
+	}
+	exported := make([]abstract_definition.SessionData, len(sessionIds))
+	for index, sessionId := range sessionIds {
+		if exported[index], err = target.ExportSession(sessionId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !exported[0].Pinned {
+		t.Error("pin made while streaming was lost")
+	}
+	if exported[1].UserID != "user" {
+		t.Errorf("user bound while streaming was lost, got %q", exported[1].UserID)
+	}
+	if exported[2].Expiry != time.Hour {
+		t.Errorf("expiry set while streaming was lost, got %v", exported[2].Expiry)
+	}
+	if count := source.ActiveSessions(); count != 0 {
+		t.Errorf("source still holds %d sessions", count)
+	}
+}
+
+func TestMigrateStorageMediaConfiguresTarget(t *testing.T) {
+	clock := wsmtest.NewManualClock(wsmtest.DefaultStartTime)
+	manager, err := wsm.NewSessionManagerWithStorage(&memory_storage.MemoryStorage{}, "session",
+		wsm.WithClock(clock), wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionIds := startSessions(t, manager, 1)
+	target := &memory_storage.MemoryStorage{}
+	waitForMigration(t, manager.MigrateStorageMedia(target))
+	// On the system clock, sessions stamped by the manual clock would be long expired.
+	manager.SessionsExpirationRoutine()
+	if _, err := target.RetrieveSession(sessionIds[0]); err != nil {
+		t.Fatalf("session expired on the target, which doesn't use the manager clock: %v", err)
+	}
+	clock.Advance(2 * time.Minute)
+	manager.SessionsExpirationRoutine()
+	if _, err := target.RetrieveSession(sessionIds[0]); err == nil {
+		t.Fatal("expired session kept by the target")
+	}
+}
+
+// concurrentSource is a memory storage media destroying a session, as a concurrent request would,
+// when another one is first exported, its sessions being listed in order.
+type concurrentSource struct {
+	*memory_storage.MemoryStorage
+	destroyOnce  sync.Once
+	exportedId   string
+	destroyedId  string
+	destroyedErr error
+}
+
+func (source *concurrentSource) ListSessions() ([]string, error) {
+	sessionIds, err := source.MemoryStorage.ListSessions()
+	sort.Strings(sessionIds)
+	return sessionIds, err
+}
+
+func (source *concurrentSource) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	if sessionId == source.exportedId {
+		source.destroyOnce.Do(func() { source.destroyedErr = source.DestroySession(source.destroyedId) })
+	}
+	return source.MemoryStorage.ExportSession(sessionId)
+}
+
+// seedSessions initializes sessions holding their index in the storage media and returns their IDs.
+func seedSessions(t *testing.T, storage abstract_definition.StorageMedia, count int) []string {
+	t.Helper()
+	sessionIds := make([]string, count)
+	for index := range sessionIds {
+		sessionIds[index] = fmt.Sprintf("session-%02d", index)
+		session, err := storage.InitializeSession(sessionIds[index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = session.SetValue("index", index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return sessionIds
+}
+
+func TestChangeStorageMediaFromMemoryToFileWhileRequestsRun(t *testing.T) {
+	source := &concurrentSource{MemoryStorage: &memory_storage.MemoryStorage{}}
+	sessionIds := seedSessions(t, source, 20)
+	source.exportedId, source.destroyedId = sessionIds[0], sessionIds[19]
+	target := &file_storage.FileStorage{Directory: t.TempDir()}
+	done := make(chan struct{})
+	var requests sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		requests.Add(1)
+		go func(worker int) {
+			defer requests.Done()
+			for index := worker; ; index = (index + 4) % 19 {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if session, err := source.RetrieveSession(sessionIds[index]); err == nil {
+					session.GetValue("index")
+				}
+			}
+		}(worker)
+	}
+	err := wsm.ChangeStorageMedia(source, target)
+	close(done)
+	requests.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.destroyedErr != nil {
+		t.Fatal(source.destroyedErr)
+	}
+	if count := source.ActiveSessions(); count != 0 {
+		t.Errorf("old storage media still holds %d sessions", count)
+	}
+	for index, sessionId := range sessionIds[:19] {
+		session, err := target.RetrieveSession(sessionId)
+		if err != nil {
+			t.Fatalf("session %s not moved: %v", sessionId, err)
+		}
+		if value, _ := session.GetValue("index").(float64); int(value) != index {
+			t.Errorf("session %s moved with the index %v, want %d", sessionId, session.GetValue("index"), index)
+		}
+	}
+	if _, err = target.RetrieveSession(source.destroyedId); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for the session destroyed while moving, want it skipped", err)
+	}
+}
+
+// failingTarget is a memory storage media failing to import sessions once it imported a number of them.
+type failingTarget struct {
+	*memory_storage.MemoryStorage
+	imports int
+}
+
+func (target *failingTarget) ImportSession(data abstract_definition.SessionData) error {
+	if target.imports == 0 {
+		return errors.New("disk full")
+	}
+	target.imports--
+	return target.MemoryStorage.ImportSession(data)
+}
+
+func TestChangeStorageMediaFailingPartWayKeepsTheOldStorageMedia(t *testing.T) {
+	source := &memory_storage.MemoryStorage{}
+	sessionIds := seedSessions(t, source, 5)
+	target := &failingTarget{MemoryStorage: &memory_storage.MemoryStorage{}, imports: 2}
+	if err := wsm.ChangeStorageMedia(source, target); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("got %v, want the import error", err)
+	}
+	for index, sessionId := range sessionIds {
+		session, err := source.RetrieveSession(sessionId)
+		if err != nil {
+			t.Fatalf("session %s lost by the failed change: %v", sessionId, err)
+		}
+		if value := session.GetValue("index"); value != index {
+			t.Errorf("session %s holds the index %v, want %d", sessionId, value, index)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package wsm_backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/cookie_storage"
+	"strings"
+	"time"
+)
+
+// namespaceSeparator separates the namespace from the session ID in storage keys. Namespaces never contain it,
+// so the namespace of a storage key is always the part before its first separator, whatever the session ID is.
+const namespaceSeparator = "_"
+
+// WithNamespace is an option that isolates the sessions of a SessionManager from those of other managers
+// sharing the same storage media, e.g. one per tenant in the same process, by prefixing their storage keys
+// with the namespace, and suffixing the cookie name with it. A session ID is never resolved in another namespace,
+// even if it collides with the ID of a session of another namespace.
+// Expired sessions are still terminated across all namespaces with the maximum lifetime of the manager running
+// the expiration routine, so managers sharing a storage media should share their maximum lifetime.
+// The cookie storage media can't be namespaced, its sessions being isolated by their cookie name and encryption key.
+// It returns an error if the namespace is empty or has characters other than ASCII letters, digits and "-".
+func WithNamespace(namespace string) Option {
+	return func(manager *SessionManager) error {
+		if namespace == "" {
+			return errors.New("wsm: namespace must not be empty")
+		}
+		for _, character := range namespace {
+			isLetterOrDigit := (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z') ||
+				(character >= '0' && character <= '9')
+			if !isLetterOrDigit && character != '-' {
+				return fmt.Errorf("wsm: invalid namespace %q, character %q is not allowed", namespace, character)
+			}
+		}
+		manager.namespace = namespace
+		return nil
+	}
+}
+
+// namespacedStorageMedia is a method for SessionManager that returns the storage media as seen from its namespace,
+// or the storage media itself without a namespace.
+// It returns an error if the storage media can't be namespaced.
+func (manager *SessionManager) namespacedStorageMedia(storageMedia abstract_definition.StorageMedia) (abstract_definition.StorageMedia, error) {
+	if manager.namespace == "" {
+		return storageMedia, nil
+	}
+	if _, isCookieStorage := storageMedia.(*cookie_storage.CookieStorage); isCookieStorage {
+		return nil, errors.New("wsm: the cookie storage media can't be namespaced")
+	}
+	return &namespacedStorage{storage: storageMedia, prefix: manager.namespace + namespaceSeparator}, nil
+}
+
+// namespacedStorage is a storage media keeping the sessions of a namespace in a storage media shared with other
+// namespaces, prefixing their IDs with the namespace in the shared storage media.
+type namespacedStorage struct {
+	storage abstract_definition.StorageMedia
+	prefix  string
+}
+
+// namespacedSession is a session of a namespacedStorage, its ID being the one without the namespace prefix.
+type namespacedSession struct {
+	abstract_definition.Session
+	prefix string
+}
+
+// GetSessionId is a method for namespacedSession that retrieves the session ID without the namespace prefix.
+func (session *namespacedSession) GetSessionId() string {
+	return strings.TrimPrefix(session.Session.GetSessionId(), session.prefix)
+}
+
+// key is a method for namespacedStorage that returns the ID of a session in the shared storage media.
+func (namespaced *namespacedStorage) key(sessionId string) string {
+	return namespaced.prefix + sessionId
+}
+
+// wrap is a method for namespacedStorage that returns a session of the shared storage media as seen from the namespace.
+func (namespaced *namespacedStorage) wrap(session abstract_definition.Session, err error) (abstract_definition.Session, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &namespacedSession{Session: session, prefix: namespaced.prefix}, nil
+}
+
+// ownSessionIds is a method for namespacedStorage that keeps the session IDs of the namespace among IDs
+// of the shared storage media, removing their prefix.
+func (namespaced *namespacedStorage) ownSessionIds(keys []string) []string {
+	sessionIds := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if strings.HasPrefix(key, namespaced.prefix) {
+			sessionIds = append(sessionIds, strings.TrimPrefix(key, namespaced.prefix))
+		}
+	}
+	return sessionIds
+}
+
+// InitializeSession is a method for namespacedStorage that creates a new session in the shared storage media.
+func (namespaced *namespacedStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	return namespaced.wrap(namespaced.storage.InitializeSession(namespaced.key(sessionId)))
+}
+
+// RetrieveSession is a method for namespacedStorage that retrieves a session of the namespace,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (namespaced *namespacedStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	return namespaced.wrap(namespaced.storage.RetrieveSession(namespaced.key(sessionId)))
+}
+
+// RetrieveSessionAndTouch is a method for namespacedStorage that retrieves a session of the namespace
+// and updates its last access time, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (namespaced *namespacedStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	return namespaced.wrap(namespaced.storage.RetrieveSessionAndTouch(namespaced.key(sessionId)))
+}
+
+// UpdateSessionLastAccess is a method for namespacedStorage that updates the last access time of a session of the namespace.
+func (namespaced *namespacedStorage) UpdateSessionLastAccess(sessionId string) error {
+	return namespaced.storage.UpdateSessionLastAccess(namespaced.key(sessionId))
+}
+
+// DestroySession is a method for namespacedStorage that destroys a session of the namespace.
+func (namespaced *namespacedStorage) DestroySession(sessionId string) error {
+	return namespaced.storage.DestroySession(namespaced.key(sessionId))
+}
+
+// Ping is a method for namespacedStorage that checks the shared storage media can be reached.
+func (namespaced *namespacedStorage) Ping(ctx context.Context) error {
+	return namespaced.storage.Ping(ctx)
+}
+
+// DestroyAllSessions is a method for namespacedStorage that destroys every session of the namespace,
+// leaving the sessions of other namespaces. Sessions already removed are skipped.
+// It returns an error if the sessions could not be listed or a session could not be destroyed.
+func (namespaced *namespacedStorage) DestroyAllSessions() error {
+	sessionIds, err := namespaced.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		err = namespaced.DestroySession(sessionId)
+		if err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// TerminateSessionOnExpiration is a method for namespacedStorage that terminates expired sessions
+// of the shared storage media, across all namespaces, and returns the number of terminated sessions.
+func (namespaced *namespacedStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	return namespaced.storage.TerminateSessionOnExpiration(maxLifetime)
+}
+
+// TerminateExpiredSessions is a method for namespacedStorage that terminates expired sessions of the shared
+// storage media, across all namespaces, and returns the IDs of the terminated sessions of the namespace.
+// It returns an abstract_definition.ErrNotSupported error if the shared storage media can't report them.
+func (namespaced *namespacedStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	expiryReporter, reportsExpiry := namespaced.storage.(abstract_definition.ExpiryReporter)
+	if !reportsExpiry {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	keys, err := expiryReporter.TerminateExpiredSessions(maxLifetime)
+	return namespaced.ownSessionIds(keys), err
+}
+
+// ListSessions is a method for namespacedStorage that returns the IDs of the sessions of the namespace.
+func (namespaced *namespacedStorage) ListSessions() ([]string, error) {
+	keys, err := namespaced.storage.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	return namespaced.ownSessionIds(keys), nil
+}
+
+// SessionIDsByValue is a method for namespacedStorage that returns the IDs of the sessions of the namespace
+// holding the value under the key. It returns an abstract_definition.ErrNotSupported error if the shared storage media
+// can't query sessions by their values.
+func (namespaced *namespacedStorage) SessionIDsByValue(ctx context.Context, key string, value interface{}) ([]string, error) {
+	valueIndex, indexesValues := namespaced.storage.(abstract_definition.ValueIndex)
+	if !indexesValues {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	keys, err := valueIndex.SessionIDsByValue(ctx, key, value)
+	if err != nil {
+		return nil, err
+	}
+	return namespaced.ownSessionIds(keys), nil
+}
+
+// ScanSessions is a method for namespacedStorage that returns a page of the session IDs of the namespace
+// and the cursor of the next page. The storage keys of a namespace all following its prefix in ascending order,
+// the page is scanned from the prefix and ends at the first key of another namespace.
+func (namespaced *namespacedStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	keyCursor := namespaced.prefix
+	if cursor != "" {
+		keyCursor = namespaced.key(cursor)
+	}
+	keys, nextKey, err := namespaced.storage.ScanSessions(keyCursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	sessionIds := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(key, namespaced.prefix) {
+			return sessionIds, "", nil
+		}
+		sessionIds = append(sessionIds, strings.TrimPrefix(key, namespaced.prefix))
+	}
+	if !strings.HasPrefix(nextKey, namespaced.prefix) {
+		return sessionIds, "", nil
+	}
+	return sessionIds, strings.TrimPrefix(nextKey, namespaced.prefix), nil
+}
+
+// ExportSession is a method for namespacedStorage that returns the full content of a session of the namespace.
+func (namespaced *namespacedStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	data, err := namespaced.storage.ExportSession(namespaced.key(sessionId))
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	data.Id = sessionId
+	return data, nil
+}
+
+// ImportSession is a method for namespacedStorage that stores a session in the namespace from its full content.
+func (namespaced *namespacedStorage) ImportSession(data abstract_definition.SessionData) error {
+	data.Id = namespaced.key(data.Id)
+	return namespaced.storage.ImportSession(data)
+}
+
+// Pin is a method for namespacedStorage that exempts a session of the namespace from expiration.
+func (namespaced *namespacedStorage) Pin(sessionId string) error {
+	return namespaced.storage.Pin(namespaced.key(sessionId))
+}
+
+// Unpin is a method for namespacedStorage that makes a pinned session of the namespace expire again.
+func (namespaced *namespacedStorage) Unpin(sessionId string) error {
+	return namespaced.storage.Unpin(namespaced.key(sessionId))
+}
+
+// SetSessionUserID is a method for namespacedStorage that associates a session of the namespace with a user.
+// It returns an abstract_definition.ErrNotSupported error if the shared storage media can't associate sessions with users.
+func (namespaced *namespacedStorage) SetSessionUserID(sessionId, userID string) error {
+	userIndex, indexesUsers := namespaced.storage.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return abstract_definition.ErrNotSupported
+	}
+	return userIndex.SetSessionUserID(namespaced.key(sessionId), userID)
+}
+
+// UserSessionIDs is a method for namespacedStorage that returns the IDs of the sessions of the namespace
+// associated with a user. It returns an abstract_definition.ErrNotSupported error if the shared storage media
+// can't associate sessions with users.
+func (namespaced *namespacedStorage) UserSessionIDs(userID string) ([]string, error) {
+	userIndex, indexesUsers := namespaced.storage.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	keys, err := userIndex.UserSessionIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	return namespaced.ownSessionIds(keys), nil
+}
@@ -0,0 +1,72 @@
+package wsm_backup_test
+
+import (
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/memory_storage"
+	"testing"
+)
+
+// newNamespacedManager returns a manager of the given namespace keeping its sessions in the storage.
+func newNamespacedManager(t *testing.T, storage *memory_storage.MemoryStorage, namespace string) *wsm.SessionManager {
+	t.Helper()
+	manager, err := wsm.NewSessionManagerWithStorage(storage, "session", wsm.WithNamespace(namespace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestNamespacesShareAStorageWithoutSeeingEachOther(t *testing.T) {
+	storage := &memory_storage.MemoryStorage{}
+	first := newNamespacedManager(t, storage, "first")
+	second := newNamespacedManager(t, storage, "second")
+	if cookie := sessionCookie(t, first); cookie.Name != "session-first" {
+		t.Fatalf("got cookie name %q, want session-first", cookie.Name)
+	}
+	sessionId := startSessions(t, first, 1)[0]
+	startSessions(t, second, 1)
+	if _, err := second.LookupSession(sessionId); err == nil {
+		t.Fatal("session of another namespace found")
+	}
+	if _, err := first.LookupSession(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.DestroyAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	sessionIds, err := first.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessionIds) != 2 {
+		t.Fatalf("got sessions %v of the first namespace after destroying the second, want 2", sessionIds)
+	}
+	if count := storage.ActiveSessions(); count != 2 {
+		t.Fatalf("%d sessions left in the storage, want the 2 of the first namespace", count)
+	}
+}
+
+func TestScanSessionsPagesThroughTheNamespace(t *testing.T) {
+	storage := &memory_storage.MemoryStorage{}
+	for _, key := range []string{"first_1", "first_2", "first_3", "second_1", "0"} {
+		if _, err := storage.InitializeSession(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manager := newNamespacedManager(t, storage, "first")
+	sessionIds, next, err := manager.ScanSessions("", 2)
+	if err != nil || len(sessionIds) != 2 || next == "" {
+		t.Fatalf("got first page %v and cursor %q, error %v", sessionIds, next, err)
+	}
+	scanned := sessionIds
+	sessionIds, next, err = manager.ScanSessions(next, 2)
+	if err != nil || len(sessionIds) != 1 || next != "" {
+		t.Fatalf("got last page %v and cursor %q, error %v", sessionIds, next, err)
+	}
+	scanned = append(scanned, sessionIds...)
+	for index, sessionId := range []string{"1", "2", "3"} {
+		if scanned[index] != sessionId {
+			t.Fatalf("scanned %v, want the sessions 1, 2 and 3 of the namespace", scanned)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package wsm_backup
+
+import (
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/cookie_storage"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenNamespace is the namespace the opaque tokens of the WithOpaqueTokens option are kept in,
+// in the storage media of the sessions they map to.
+const tokenNamespace = "wsm-token"
+
+// tokenKeyPrefix is the prefix of the storage keys of opaque tokens in the storage media of the manager.
+const tokenKeyPrefix = tokenNamespace + namespaceSeparator
+
+// tokenSessionIdKey is the key of the value holding the session ID an opaque token maps to.
+const tokenSessionIdKey = "session-id"
+
+// WithOpaqueTokens is an option that makes session cookies carry a random opaque token instead of the session ID,
+// mapped to the session ID in the storage media under a namespace of its own, so the session ID never leaves
+// the server. Tokens are resolved, and their last access time updated, on every lookup from a request, and they
+// expire like sessions, after the maximum lifetime without being used. RotateToken replaces the token of a request
+// without changing its session, and EndSession revokes it. The header of the WithHeaderTokenFallback option
+// and SessionToken carry tokens as well.
+// Tokens are entries of the storage media, expiring along with sessions, but they're left out of ListSessions,
+// ScanSessions, FindSessionsByValue, Warm, and the events and metrics of destroyed and expired sessions.
+// The cookie storage media can't map tokens, its sessions being the sealed content of their cookie.
+func WithOpaqueTokens(opaque bool) Option {
+	return func(manager *SessionManager) error {
+		manager.opaqueTokens = opaque
+		return nil
+	}
+}
+
+// checkOpaqueTokens is a method for SessionManager that returns an error if the storage media can't map
+// opaque tokens with the WithOpaqueTokens option.
+func (manager *SessionManager) checkOpaqueTokens(storageMedia abstract_definition.StorageMedia) error {
+	if _, isCookieStorage := storageMedia.(*cookie_storage.CookieStorage); manager.opaqueTokens && isCookieStorage {
+		return errors.New("wsm: the cookie storage media can't map opaque tokens")
+	}
+	return nil
+}
+
+// tokenStorage is a method for SessionManager that returns the storage media keeping opaque tokens,
+// the namespace of tokens in the storage media of the manager. With the WithHashedStorageKeys option tokens
+// are hashed within the namespace, so their storage keys keep the prefix of the namespace.
+func (manager *SessionManager) tokenStorage() abstract_definition.StorageMedia {
+	if hashed, isHashed := manager.storageMedia.(*hashedStorage); isHashed {
+		return &hashedStorage{storage: &namespacedStorage{storage: hashed.storage, prefix: tokenKeyPrefix}}
+	}
+	return &namespacedStorage{storage: manager.storageMedia, prefix: tokenKeyPrefix}
+}
+
+// withoutTokens is a method for SessionManager that removes the storage keys of opaque tokens from storage keys
+// of the storage media of the manager, in place, with the WithOpaqueTokens option.
+func (manager *SessionManager) withoutTokens(keys []string) []string {
+	if !manager.opaqueTokens {
+		return keys
+	}
+	sessionKeys := keys[:0]
+	for _, key := range keys {
+		if !strings.HasPrefix(key, tokenKeyPrefix) {
+			sessionKeys = append(sessionKeys, key)
+		}
+	}
+	return sessionKeys
+}
+
+// issueToken is a method for SessionManager used to create a new opaque token mapped to a session ID,
+// which expires after the given expiry without being used, or after the maximum lifetime for a zero expiry.
+// It must be called while holding the manager read lock.
+// It returns an error if a token could not be generated or stored.
+func (manager *SessionManager) issueToken(sessionId string, expiry time.Duration) (string, error) {
+	token, err := manager.generateUniqueSessionID()
+	if err != nil {
+		return "", err
+	}
+	tokenStorage := manager.tokenStorage()
+	entry, err := tokenStorage.InitializeSession(token)
+	if err != nil {
+		return "", fmt.Errorf("wsm: could not store the opaque token: %w", err)
+	}
+	if err = entry.SetValue(tokenSessionIdKey, sessionId); err == nil && expiry > 0 {
+		err = entry.SetExpiry(expiry)
+	}
+	if err != nil {
+		tokenStorage.DestroySession(token)
+		return "", fmt.Errorf("wsm: could not store the opaque token: %w", err)
+	}
+	return token, nil
+}
+
+// resolveToken is a method for SessionManager used to retrieve the session ID an opaque token maps to,
+// updating the last access time of the token. It must be called while holding the manager read lock.
+// It returns a wsm.SessionNotExists error if the token doesn't exist.
+func (manager *SessionManager) resolveToken(token string) (string, error) {
+	entry, err := manager.tokenStorage().RetrieveSessionAndTouch(token)
+	if err != nil {
+		return "", err
+	}
+	sessionId, isString := entry.GetValue(tokenSessionIdKey).(string)
+	if !isString {
+		return "", abstract_definition.SessionNotExist
+	}
+	return sessionId, nil
+}
+
+// cookieSessionId is a method for SessionManager used to retrieve the session ID carried by the value of a session
+// cookie, decoded by decodeCookieValue, and resolved from its opaque token with the WithOpaqueTokens option.
+// It returns the session ID along with the one the cookie carries, the opaque token or the session ID itself.
+// It must be called while holding the manager read lock.
+// It returns a wsm.SessionNotExists error if the token doesn't exist, or the errors of decodeCookieValue.
+func (manager *SessionManager) cookieSessionId(value string) (sessionId string, cookieId string, err error) {
+	cookieId, err = manager.decodeCookieValue(value)
+	if err != nil || !manager.opaqueTokens {
+		return cookieId, cookieId, err
+	}
+	sessionId, err = manager.resolveToken(cookieId)
+	return sessionId, cookieId, err
+}
+
+// newCookieId is a method for SessionManager used to return what a new cookie of a session carries,
+// a new opaque token expiring after the given expiry with the WithOpaqueTokens option, or the session ID otherwise.
+// It must be called while holding the manager read lock.
+// It returns an error if a token could not be issued.
+func (manager *SessionManager) newCookieId(sessionId string, expiry time.Duration) (string, error) {
+	if !manager.opaqueTokens {
+		return sessionId, nil
+	}
+	return manager.issueToken(sessionId, expiry)
+}
+
+// RotateToken is a method for SessionManager used with the WithOpaqueTokens option to replace the opaque token
+// carried by the request with a new one mapped to the same session, e.g. on privilege changes, revoking the old one
+// and setting the cookie of the new one. The session itself and its values are left unchanged.
+// It returns an abstract_definition.ErrNotSupported error without the WithOpaqueTokens option,
+// a wsm.SessionNotExists error if the request carries no token or its token doesn't exist,
+// or an error if the cookie value could not be read or the tokens could not be stored.
+func (manager *SessionManager) RotateToken(response http.ResponseWriter, request *http.Request) error {
+	if !manager.opaqueTokens {
+		return fmt.Errorf("%w: tokens are only rotated with the WithOpaqueTokens option", abstract_definition.ErrNotSupported)
+	}
+	value := manager.requestSessionValue(request)
+	if value == "" {
+		return abstract_definition.SessionNotExist
+	}
+	manager.RLock()
+	defer manager.RUnlock()
+	sessionId, token, err := manager.cookieSessionId(value)
+	if err != nil {
+		return err
+	}
+	newToken, err := manager.issueToken(sessionId, 0)
+	if err != nil {
+		return err
+	}
+	if err = manager.tokenStorage().DestroySession(token); err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+		manager.tokenStorage().DestroySession(newToken)
+		return fmt.Errorf("wsm: could not revoke the rotated opaque token: %w", err)
+	}
+	http.SetCookie(response, manager.newSessionCookie(newToken, manager.sessionCookieMaxAge(), request))
+	return nil
+}
@@ -0,0 +1,166 @@
+package wsm_backup_test
+
+import (
+	"context"
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/wsmtest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// assertNoSessionId fails the test if a cookie set by the response carries the session ID.
+func assertNoSessionId(t *testing.T, response *httptest.ResponseRecorder, sessionId string) {
+	t.Helper()
+	for _, header := range response.Header().Values("Set-Cookie") {
+		if strings.Contains(header, sessionId) || strings.Contains(header, url.QueryEscape(sessionId)) {
+			t.Fatalf("Set-Cookie %q carries the session ID %s", header, sessionId)
+		}
+	}
+}
+
+func TestOpaqueTokensResolveToTheirSession(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithOpaqueTokens(true), wsm.WithRollingCookie(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	started := httptest.NewRecorder()
+	session, _, err := manager.StartSession(started, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := session.GetSessionId()
+	assertNoSessionId(t, started, sessionId)
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	resumed := httptest.NewRecorder()
+	session, isNew, err := manager.StartSession(resumed, requestWithCookies(started))
+	if err != nil || isNew || session.GetSessionId() != sessionId {
+		t.Fatalf("token not resolved to its session: new %v, error %v", isNew, err)
+	}
+	assertNoSessionId(t, resumed, sessionId)
+	refreshed := httptest.NewRecorder()
+	if _, err = manager.RefreshSession(refreshed, requestWithCookies(started)); err != nil {
+		t.Fatal(err)
+	}
+	assertNoSessionId(t, refreshed, sessionId)
+	written := httptest.NewRecorder()
+	manager.WriteCookie(written, session, 3600)
+	assertNoSessionId(t, written, sessionId)
+	if token := manager.SessionToken(session); token == "" || strings.Contains(token, sessionId) {
+		t.Fatalf("got the header token %q, want an opaque one", token)
+	}
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.AddCookie(&http.Cookie{Name: wsmtest.CookieName, Value: url.QueryEscape(sessionId)})
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), forged); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for a cookie carrying the raw session ID, want SessionNotExist", err)
+	}
+}
+
+func TestRotateTokenKeepsTheSession(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager(wsm.WithOpaqueTokens(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionId, request := requestWithSession(t, manager)
+	session, err := manager.LookupSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("cart", "3 items"); err != nil {
+		t.Fatal(err)
+	}
+	rotated := httptest.NewRecorder()
+	if err = manager.RotateToken(rotated, request); err != nil {
+		t.Fatal(err)
+	}
+	assertNoSessionId(t, rotated, sessionId)
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), request); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for the rotated token, want SessionNotExist", err)
+	}
+	session, _, err = manager.StartSession(httptest.NewRecorder(), requestWithCookies(rotated))
+	if err != nil || session.GetSessionId() != sessionId {
+		t.Fatalf("new token not resolved to the session: %v", err)
+	}
+	if cart := session.GetValue("cart"); cart != "3 items" {
+		t.Fatalf("got cart %v, the rotation disturbed the session", cart)
+	}
+	ended := httptest.NewRecorder()
+	if existed, err := manager.EndSession(ended, requestWithCookies(rotated)); err != nil || !existed {
+		t.Fatalf("got %v, %v ending the session of the new token", existed, err)
+	}
+	if existed, err := manager.EndSession(httptest.NewRecorder(), requestWithCookies(rotated)); err != nil || existed {
+		t.Fatalf("got %v, %v for a revoked token, want a stale cookie", existed, err)
+	}
+	plain, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Stop()
+	if err = plain.RotateToken(httptest.NewRecorder(), request); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Fatalf("got %v without WithOpaqueTokens, want ErrNotSupported", err)
+	}
+}
+
+func TestOpaqueTokensRejectTheCookieStorageMedia(t *testing.T) {
+	if _, err := wsm.NewSessionManager("cookie", "session", 60, wsm.WithRegistrationDir(t.TempDir()),
+		wsm.WithCookieStorageKey(make([]byte, 32)), wsm.WithOpaqueTokens(true)); err == nil {
+		t.Fatal("cookie storage media accepted with opaque tokens")
+	}
+}
+
+func TestOpaqueTokensAreLeftOutOfSessionsWithHashedKeys(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithOpaqueTokens(true), wsm.WithHashedStorageKeys(true),
+		wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	events, unsubscribe := manager.Subscribe()
+	defer unsubscribe()
+	sessionIds := startSessions(t, manager, 2)
+	if count := storage.SessionCount(); count != 4 {
+		t.Fatalf("storage holds %d entries, want both sessions and their tokens", count)
+	}
+	want := map[string]bool{storageKey(sessionIds[0]): true, storageKey(sessionIds[1]): true}
+	assertSessionKeys := func(name string, keys []string) {
+		t.Helper()
+		if len(keys) != len(want) || !want[keys[0]] || !want[keys[1]] {
+			t.Errorf("%s returned %v, want the storage keys of both sessions only", name, keys)
+		}
+	}
+	listed, err := manager.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSessionKeys("ListSessions", listed)
+	scanned, _, err := manager.ScanSessions("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSessionKeys("ScanSessions", scanned)
+	if loaded, failed, err := manager.Warm(context.Background()); err != nil || loaded != 2 || failed != 0 {
+		t.Errorf("warmed %d sessions, %d failed, error %v, want both sessions only", loaded, failed, err)
+	}
+	receivedEvents(events)
+	storage.Advance(2 * time.Minute)
+	manager.SessionsExpirationRoutine()
+	var expired []string
+	for _, event := range receivedEvents(events) {
+		if event.Kind == wsm.SessionExpired {
+			expired = append(expired, event.SessionId)
+		}
+	}
+	assertSessionKeys("the expiration events", expired)
+	if count := storage.SessionCount(); count != 0 {
+		t.Fatalf("storage still holds %d entries once expired, want the tokens expired too", count)
+	}
+}
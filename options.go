@@ -0,0 +1,527 @@
+package wsm_backup
+
+import (
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/bolt_storage"
+	"local/zyrx/backup/cookie_storage"
+	"local/zyrx/backup/dynamodb_storage"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memcached_storage"
+	"local/zyrx/backup/memory_storage"
+	"local/zyrx/backup/postgres_storage"
+	"local/zyrx/backup/stored_session"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// minimumIDLength is the minimum number of random bytes of a session ID generated by default (128 bits).
+const minimumIDLength = 16
+
+// Option is a function used to configure an optional setting of a SessionManager on its creation.
+// It returns an error if the provided setting is invalid.
+type Option func(manager *SessionManager) error
+
+// configureStorageMedia is a method for SessionManager used by the options of a built-in storage media type
+// to record a setting, applied to the storage media of that type once the manager builds it.
+func (manager *SessionManager) configureStorageMedia(storageMediaType string, setting storageMediaSetting) {
+	if manager.storageMediaSettings == nil {
+		manager.storageMediaSettings = make(map[string][]storageMediaSetting)
+	}
+	manager.storageMediaSettings[storageMediaType] = append(manager.storageMediaSettings[storageMediaType], setting)
+}
+
+// IDGenerator is a function used to generate a unique session ID for newly created sessions,
+// it's called concurrently by concurrent requests. It returns an error if an ID could not be generated,
+// and sessions are never created with an error or an empty ID.
+type IDGenerator func() (string, error)
+
+// WithIDGenerator is an option that replaces the default session ID generator, a secure random
+// base64 encoded number, with a custom one (e.g. prefixed IDs, UUIDs, or a deterministic generator in tests).
+func WithIDGenerator(generator IDGenerator) Option {
+	return func(manager *SessionManager) error {
+		if generator == nil {
+			return errors.New("wsm: session ID generator must not be nil")
+		}
+		manager.idGenerator = generator
+		return nil
+	}
+}
+
+// WithIDLength is an option that sets the number of random bytes of the session IDs generated by default,
+// which is 32 bytes otherwise. It returns an error if the length is below 16 bytes (128 bits).
+// Generated IDs are always base64.URLEncoding.EncodedLen(length) characters long.
+func WithIDLength(length int) Option {
+	return func(manager *SessionManager) error {
+		if length < minimumIDLength {
+			return fmt.Errorf("wsm: session ID length must be at least %d bytes, got %d", minimumIDLength, length)
+		}
+		manager.idLength = length
+		return nil
+	}
+}
+
+// ForceStorageMedia is an option that replaces a previously registered storage media of a different type
+// with the requested one, moving all its sessions. Without it, NewSessionManager returns a
+// StorageMediaMismatchError, wrapping ErrStorageMediaMismatch, when the registered and requested storage media types differ.
+func ForceStorageMedia() Option {
+	return func(manager *SessionManager) error {
+		manager.forceStorageMedia = true
+		return nil
+	}
+}
+
+// WithResetRegistrationOnCorrupt is an option that makes NewSessionManager replace a file of the registered
+// storage media that can't be decoded, e.g. truncated or edited by hand, with the registration of the requested
+// storage media type, logging the reset, instead of failing with a CorruptRegistrationError.
+// The type of the corrupted registration being unknown, its sessions aren't moved to the requested storage media.
+func WithResetRegistrationOnCorrupt(reset bool) Option {
+	return func(manager *SessionManager) error {
+		manager.resetRegistrationOnCorrupt = reset
+		return nil
+	}
+}
+
+// WithCookiePadding is an option that pads the cookie values to a multiple of the given block size,
+// so cookies don't reveal the length of their payload. Choosing a block size at least as long as
+// the longest value makes all session cookies the same length.
+// It returns an error if the block size is not greater than zero.
+func WithCookiePadding(blockSize int) Option {
+	return func(manager *SessionManager) error {
+		if blockSize <= 0 {
+			return fmt.Errorf("wsm: cookie padding block size must be greater than zero, got %d", blockSize)
+		}
+		manager.cookiePaddingBlockSize = blockSize
+		return nil
+	}
+}
+
+// WithFileEncryptionKey is an option that encrypts the sessions files of the file storage media at rest
+// with AES-256-GCM using the given key, so sessions holding personal data are not readable on disk.
+// The same key must be used to read previously encrypted sessions.
+// It returns an error if the key is not 32 bytes long.
+func WithFileEncryptionKey(key []byte) Option {
+	return func(manager *SessionManager) error {
+		if len(key) != 32 {
+			return fmt.Errorf("%w, got %d", file_storage.ErrInvalidEncryptionKey, len(key))
+		}
+		encryptionKey := append([]byte(nil), key...)
+		manager.configureStorageMedia("file", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*file_storage.FileStorage).EncryptionKey = encryptionKey
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithFileCodec is an option that sets the codec the file storage media encodes sessions with instead of json,
+// e.g. stored_session.GobCodec{} so values keep their Go types. Changing it makes existing sessions files corrupt.
+// It returns an error if the codec is nil.
+func WithFileCodec(codec stored_session.Codec) Option {
+	return func(manager *SessionManager) error {
+		if codec == nil {
+			return errors.New("wsm: file storage codec must not be nil")
+		}
+		manager.configureStorageMedia("file", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*file_storage.FileStorage).Codec = codec
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithCookieSigningKey is an option that signs the session ID carried by cookies with HMAC-SHA256,
+// the cookie value becoming the session ID followed by its signature, so tampered or forged cookies are
+// rejected with an ErrInvalidCookieSignature error before the storage media is looked up.
+// It returns an error if the key is empty.
+func WithCookieSigningKey(key []byte) Option {
+	return func(manager *SessionManager) error {
+		if len(key) == 0 {
+			return errors.New("wsm: cookie signing key must not be empty")
+		}
+		manager.cookieSigningKey = append([]byte(nil), key...)
+		return nil
+	}
+}
+
+// WithCookieStorageKey is an option that sets the key the cookie storage media encrypts and authenticates
+// the sessions kept in cookies with, using AES-256-GCM. It's required by the cookie storage media,
+// and changing it invalidates all the sessions.
+// It returns an error if the key is not 32 bytes long.
+func WithCookieStorageKey(key []byte) Option {
+	return func(manager *SessionManager) error {
+		if len(key) != 32 {
+			return fmt.Errorf("%w, got %d", cookie_storage.ErrInvalidEncryptionKey, len(key))
+		}
+		encryptionKey := append([]byte(nil), key...)
+		manager.configureStorageMedia("cookie", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*cookie_storage.CookieStorage).EncryptionKey = encryptionKey
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithMemcachedServers is an option that sets the servers the memcached storage media stores sessions on,
+// instead of memcached_storage.DefaultServer.
+// It returns an error if no server is given.
+func WithMemcachedServers(servers ...string) Option {
+	return func(manager *SessionManager) error {
+		if len(servers) == 0 {
+			return errors.New("wsm: at least one memcached server must be given")
+		}
+		memcachedServers := append([]string(nil), servers...)
+		manager.configureStorageMedia("memcached", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*memcached_storage.MemcachedStorage).Servers = memcachedServers
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithMemoryShards is an option that sets the number of shards the memory storage media splits its sessions into,
+// instead of memory_storage.DefaultShardCount, more shards reducing the lock contention between concurrent requests.
+// It returns an error if the count is not greater than zero.
+func WithMemoryShards(shardCount int) Option {
+	return func(manager *SessionManager) error {
+		if shardCount <= 0 {
+			return fmt.Errorf("wsm: memory shard count must be greater than zero, got %d", shardCount)
+		}
+		manager.configureStorageMedia("memory", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*memory_storage.MemoryStorage).ShardCount = shardCount
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithMaxMemoryBytes is an option that sets the maximum total estimated memory of the sessions of the memory
+// storage media, least-recently-used sessions being evicted on new writes once it's exceeded, and sessions
+// larger than it alone rejected with a memory_storage.ErrMemoryBudgetExceeded error.
+// It returns an error if the size is not greater than zero.
+func WithMaxMemoryBytes(maxBytes int64) Option {
+	return func(manager *SessionManager) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("wsm: maximum memory must be greater than zero, got %d bytes", maxBytes)
+		}
+		manager.configureStorageMedia("memory", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*memory_storage.MemoryStorage).MaxMemoryBytes = maxBytes
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithMaxValueDepth is an option that sets how deeply the values set in sessions of the memory storage media
+// can be nested, maps, slices, arrays and structs each adding a level, values nested deeper being rejected with
+// a memory_storage.ErrValueTooDeep error. Opaque structs such as time.Time count as plain values.
+// It returns an error if the depth is not greater than zero.
+func WithMaxValueDepth(maxDepth int) Option {
+	return func(manager *SessionManager) error {
+		if maxDepth <= 0 {
+			return fmt.Errorf("wsm: maximum value depth must be greater than zero, got %d", maxDepth)
+		}
+		manager.configureStorageMedia("memory", func(storageMedia abstract_definition.StorageMedia) error {
+			storageMedia.(*memory_storage.MemoryStorage).MaxValueDepth = maxDepth
+			return nil
+		})
+		return nil
+	}
+}
+
+// WithRegistrationDir is an option that sets the directory the registered storage media is written in
+// and read from, instead of registered_storage relative to the working directory. It's created if needed.
+// It returns an error if the path is empty.
+func WithRegistrationDir(path string) Option {
+	return func(manager *SessionManager) error {
+		if path == "" {
+			return errors.New("wsm: registration directory must not be empty")
+		}
+		manager.registrationDir = path
+		return nil
+	}
+}
+
+// WithMaxLifetime is an option that sets the maximum lifetime of sessions,
+// overriding the one given to NewSessionManager, or the 30 minutes default of NewSessionManagerWithStorage.
+// The MaxAge of session cookies is the maximum lifetime in whole seconds.
+// It returns an error if the maximum lifetime is shorter than one second.
+func WithMaxLifetime(maxLifetime time.Duration) Option {
+	return func(manager *SessionManager) error {
+		if err := validateMaxLifetime(maxLifetime); err != nil {
+			return err
+		}
+		manager.maxLifetime = maxLifetime
+		return nil
+	}
+}
+
+// WithExpiryInterval is an option that sets how often SessionsExpirationRoutine and StartExpiryLoop
+// terminate expired sessions, instead of every maximum lifetime.
+// It returns an error if the interval is not greater than zero.
+func WithExpiryInterval(interval time.Duration) Option {
+	return func(manager *SessionManager) error {
+		if interval <= 0 {
+			return fmt.Errorf("wsm: expiry interval must be greater than zero, got %v", interval)
+		}
+		manager.expiryInterval = interval
+		return nil
+	}
+}
+
+// secondsToLifetime is a function that converts a maximum lifetime in seconds to a time.Duration.
+// It returns an error if the maximum lifetime is not greater than zero, or too long to be a time.Duration.
+func secondsToLifetime(maxLifetime int64) (time.Duration, error) {
+	if maxLifetime <= 0 {
+		return 0, fmt.Errorf("wsm: maximum lifetime must be greater than zero seconds, got %d", maxLifetime)
+	}
+	if maxLifetime > math.MaxInt64/int64(time.Second) {
+		return 0, fmt.Errorf("wsm: maximum lifetime of %d seconds is too long", maxLifetime)
+	}
+	return time.Duration(maxLifetime) * time.Second, nil
+}
+
+// validateMaxLifetime is a function that checks a maximum lifetime is at least one second,
+// the precision of the MaxAge of session cookies.
+func validateMaxLifetime(maxLifetime time.Duration) error {
+	if maxLifetime < time.Second {
+		return fmt.Errorf("wsm: maximum lifetime must be at least one second, got %v", maxLifetime)
+	}
+	return nil
+}
+
+// WithRenewOnMissing is an option that makes StartSession create a new session and cookie when the cookie
+// refers to a session that no longer exists, e.g. already terminated on expiration, instead of returning
+// a wsm.SessionNotExists error.
+func WithRenewOnMissing(renew bool) Option {
+	return func(manager *SessionManager) error {
+		manager.renewOnMissing = renew
+		return nil
+	}
+}
+
+// WithPostgresConfig is an option that opens the connection pool of the postgres storage media
+// from the given configuration, ensuring its sessions table exists, once the manager builds it.
+// The manager creation returns an error if the configuration is invalid or the database could not be connected to.
+func WithPostgresConfig(config postgres_storage.PostgresConfig) Option {
+	return func(manager *SessionManager) error {
+		manager.configureStorageMedia("postgres", func(storageMedia abstract_definition.StorageMedia) error {
+			return storageMedia.(*postgres_storage.PostgresStorage).Open(config)
+		})
+		return nil
+	}
+}
+
+// WithDynamoDBConfig is an option that opens the dynamodb storage media from the given configuration,
+// ensuring its sessions table exists with its TTL, once the manager builds it.
+// The manager creation returns an error if the configuration is invalid or the sessions table could not be created.
+func WithDynamoDBConfig(config dynamodb_storage.DynamoDBConfig) Option {
+	return func(manager *SessionManager) error {
+		manager.configureStorageMedia("dynamodb", func(storageMedia abstract_definition.StorageMedia) error {
+			return storageMedia.(*dynamodb_storage.DynamoDBStorage).Open(config)
+		})
+		return nil
+	}
+}
+
+// WithBoltConfig is an option that opens the database file of the bolt storage media from the given configuration,
+// creating its sessions bucket, once the manager builds it.
+// The manager creation returns an error if the path is empty or the database could not be opened.
+func WithBoltConfig(config bolt_storage.BoltConfig) Option {
+	return func(manager *SessionManager) error {
+		manager.configureStorageMedia("bolt", func(storageMedia abstract_definition.StorageMedia) error {
+			return storageMedia.(*bolt_storage.BoltStorage).Open(config)
+		})
+		return nil
+	}
+}
+
+// WithCookieMaxAge is an option that sets the MaxAge in seconds of session cookies apart from the maximum lifetime
+// of sessions, which otherwise it follows. Zero emits session cookies, without MaxAge nor Expires, discarded
+// when the browser closes while the session itself lives on the server for its maximum lifetime.
+// It returns an error if the MaxAge is negative.
+func WithCookieMaxAge(maxAge int) Option {
+	return func(manager *SessionManager) error {
+		if maxAge < 0 {
+			return fmt.Errorf("wsm: cookie MaxAge must not be negative, got %d", maxAge)
+		}
+		manager.cookieMaxAge = maxAge
+		manager.cookieMaxAgeSet = true
+		return nil
+	}
+}
+
+// WithSessionCookie is an option that makes session cookies true session cookies, emitted without MaxAge
+// nor Expires whatever the WithCookieMaxAge option, so browsers discard them when they close, relying on
+// the maximum lifetime of sessions on the server alone. Cookies set by WriteCookie with their own MaxAge keep it,
+// and EndSession still expires the cookie.
+func WithSessionCookie(sessionCookie bool) Option {
+	return func(manager *SessionManager) error {
+		manager.sessionCookie = sessionCookie
+		return nil
+	}
+}
+
+// WithCookieSameSite is an option that sets the SameSite attribute of session cookies, unset by default.
+// http.SameSiteNoneMode, needed for cross-site embedding, makes session cookies Secure as browsers require.
+func WithCookieSameSite(sameSite http.SameSite) Option {
+	return func(manager *SessionManager) error {
+		manager.cookieSameSite = sameSite
+		return nil
+	}
+}
+
+// WithCookieSecure is an option that sets the Secure attribute of session cookies, so they're only sent over HTTPS.
+// Disabling it along with WithCookieSameSite(http.SameSiteNoneMode) makes the SessionManager creation fail
+// with an ErrInsecureSameSiteNone error, and with a __Host- prefixed cookie name with an ErrInsecureHostCookie error.
+func WithCookieSecure(secure bool) Option {
+	return func(manager *SessionManager) error {
+		manager.cookieSecure = secure
+		manager.cookieSecureSet = true
+		return nil
+	}
+}
+
+// WithInsecureCookieForLocalDev is an option that derives the Secure attribute of session cookies from the scheme
+// of each request instead of a static flag: cookies are Secure in response to HTTPS requests, received over TLS
+// or reported so by the X-Forwarded-Proto header of a TLS terminating proxy, and not Secure for plain HTTP ones,
+// e.g. on http://localhost. Session cookies required to be Secure, by WithCookieSecure(true), SameSite=None
+// or a __Host- prefixed cookie name, stay Secure, and so do the ones of WriteCookie, not given the request.
+func WithInsecureCookieForLocalDev(insecure bool) Option {
+	return func(manager *SessionManager) error {
+		manager.insecureCookieForLocalDev = insecure
+		return nil
+	}
+}
+
+// WithUniqueCookieName is an option that makes the SessionManager creation fail with an ErrCookieNameInUse error
+// when another session manager of the process uses the same cookie name, instead of logging a warning.
+// Managers with distinct namespaces never share their cookie name, which is suffixed with the namespace,
+// and a manager releases its cookie name once stopped.
+func WithUniqueCookieName(unique bool) Option {
+	return func(manager *SessionManager) error {
+		manager.uniqueCookieName = unique
+		return nil
+	}
+}
+
+// WithPath is an option that sets the Path attribute of session cookies, "/" by default, e.g. "/app" for an app
+// mounted under a sub-path, so its cookie isn't sent to unrelated paths. The cookie expired by EndSession
+// has the same Path, which browsers require to clear the session cookie.
+// It returns an error if the path doesn't start with "/" or has a character not allowed in a cookie attribute.
+func WithPath(path string) Option {
+	return func(manager *SessionManager) error {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("wsm: cookie path must start with \"/\", got %q", path)
+		}
+		if err := validateCookieAttribute("path", path); err != nil {
+			return err
+		}
+		manager.cookiePath = path
+		return nil
+	}
+}
+
+// WithCookieDomain is an option that sets the Domain attribute of session cookies, unset by default,
+// e.g. "example.com" to share sessions with its subdomains. The cookie expired by EndSession has the same Domain,
+// which browsers require to clear the session cookie.
+// It returns an error if the domain is empty or has a character not allowed in a cookie domain.
+func WithCookieDomain(domain string) Option {
+	return func(manager *SessionManager) error {
+		if domain == "" {
+			return errors.New("wsm: cookie domain must not be empty")
+		}
+		if err := validateCookieAttribute("domain", domain); err != nil {
+			return err
+		}
+		if strings.ContainsAny(domain, " /") {
+			return fmt.Errorf("wsm: invalid cookie domain %q", domain)
+		}
+		manager.cookieDomain = domain
+		return nil
+	}
+}
+
+// validateCookieAttribute is a function that checks the value of a cookie attribute has no control character,
+// non-ASCII character, or ";", which would end the attribute in the Set-Cookie header.
+func validateCookieAttribute(attribute, value string) error {
+	for _, character := range value {
+		if character < ' ' || character >= 0x7f || character == ';' {
+			return fmt.Errorf("wsm: invalid cookie %s %q, character %q is not allowed", attribute, value, character)
+		}
+	}
+	return nil
+}
+
+// WithClock is an option that sets the clock stamping the last access time of sessions, deciding their expiration,
+// and timing session events, instead of the system clock, e.g. a fake clock advanced by hand in tests
+// to make sessions expire without waiting. It's passed to the storage media reading the current time from a clock.
+// The expiration routine is still scheduled on the system clock.
+// It returns an error if the clock is nil.
+func WithClock(clock abstract_definition.Clock) Option {
+	return func(manager *SessionManager) error {
+		if clock == nil {
+			return errors.New("wsm: clock must not be nil")
+		}
+		manager.clock = clock
+		return nil
+	}
+}
+
+// WithRollingCookie is an option that makes StartSession set the cookie of a resumed session again on each request,
+// with a refreshed MaxAge, so the cookie of an active user slides forward along with the last access time
+// of their session, instead of expiring on the browser while the session is still valid.
+func WithRollingCookie(rolling bool) Option {
+	return func(manager *SessionManager) error {
+		manager.rollingCookie = rolling
+		return nil
+	}
+}
+
+// WithMaxSessionBytes is an option that limits the size of each session to the given number of bytes,
+// as serialized by the codec of the storage media, or as estimated in memory by the memory storage media,
+// so SetValue returns an abstract_definition.ErrSessionTooLarge error instead of storing a session exceeding it.
+// It's passed to the storage media able to limit the size of sessions.
+// It returns an error if the maximum size is not greater than zero.
+func WithMaxSessionBytes(maxBytes int) Option {
+	return func(manager *SessionManager) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("wsm: maximum session size must be greater than zero bytes, got %d", maxBytes)
+		}
+		manager.maxSessionBytes = maxBytes
+		return nil
+	}
+}
+
+// WithExpiryBatchSize is an option that makes the termination of expired sessions delete them in chunks
+// of at most the given number of sessions, pausing between chunks, so sweeping millions of sessions
+// doesn't lock the storage for long. It's passed to the storage media able to terminate sessions in chunks,
+// such as the postgres storage media, the others terminating every expired session at once.
+// It returns an error if the batch size is not greater than zero.
+func WithExpiryBatchSize(batchSize int) Option {
+	return func(manager *SessionManager) error {
+		if batchSize <= 0 {
+			return fmt.Errorf("wsm: expiry batch size must be greater than zero, got %d", batchSize)
+		}
+		manager.expiryBatchSize = batchSize
+		return nil
+	}
+}
+
+// WithHeaderTokenFallback is an option that makes requests without a session cookie carry their session
+// in the named header instead, e.g. "Authorization" for single-page apps and native clients sending
+// "Authorization: Bearer <token>", the token being returned by SessionManager.SessionToken.
+// The cookie takes precedence when a request carries both.
+// It returns an error if the header name is empty.
+func WithHeaderTokenFallback(headerName string) Option {
+	return func(manager *SessionManager) error {
+		if headerName == "" {
+			return errors.New("wsm: session token header name must not be empty")
+		}
+		manager.tokenHeaderName = headerName
+		return nil
+	}
+}
@@ -0,0 +1,183 @@
+package wsm_backup
+
+import (
+	"errors"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/bolt_storage"
+	"local/zyrx/backup/dynamodb_storage"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memory_storage"
+	"local/zyrx/backup/stored_session"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStorageMediaOptionsOnlyConfigureTheirManager(t *testing.T) {
+	shardedManager, err := NewSessionManager("memory", "session", 60,
+		WithRegistrationDir(t.TempDir()), WithMemoryShards(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultManager, err := NewSessionManager("memory", "session", 60, WithRegistrationDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardedStorage := shardedManager.storageMedia.(*memory_storage.MemoryStorage)
+	defaultStorage := defaultManager.storageMedia.(*memory_storage.MemoryStorage)
+	if shardedStorage == defaultStorage {
+		t.Fatal("managers share their memory storage media")
+	}
+	if shardedStorage.ShardCount != 4 {
+		t.Errorf("got %d shards, want 4", shardedStorage.ShardCount)
+	}
+	if defaultStorage.ShardCount != 0 {
+		t.Errorf("shard count leaked to another manager: %d", defaultStorage.ShardCount)
+	}
+}
+
+func TestMaxMemoryBytesEvictsSessionsOfTheMemoryStorageMedia(t *testing.T) {
+	manager, err := NewSessionManager("memory", "session", 60, WithRegistrationDir(t.TempDir()), WithMaxMemoryBytes(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxBytes := manager.storageMedia.(*memory_storage.MemoryStorage).MaxMemoryBytes; maxBytes != 1024 {
+		t.Fatalf("got a memory budget of %d bytes, want 1024", maxBytes)
+	}
+	evicted, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		session, err := manager.CreateSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = session.SetValue("padding", strings.Repeat("x", 128)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = manager.LookupSession(evicted.GetSessionId()); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for the least recently used session, want it evicted", err)
+	}
+	if _, err = NewSessionManager("memory", "session", 60, WithRegistrationDir(t.TempDir()), WithMaxMemoryBytes(0)); err == nil {
+		t.Fatal("memory budget of zero accepted")
+	}
+}
+
+func TestMaxValueDepthConfiguresTheMemoryStorageMedia(t *testing.T) {
+	manager, err := NewSessionManager("memory", "session", 60, WithRegistrationDir(t.TempDir()), WithMaxValueDepth(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("roles", [][]string{{"admin"}}); !errors.Is(err, memory_storage.ErrValueTooDeep) {
+		t.Fatalf("got %v for a value beyond the maximum depth, want memory_storage.ErrValueTooDeep", err)
+	}
+	if _, err = NewSessionManager("memory", "session", 60, WithRegistrationDir(t.TempDir()), WithMaxValueDepth(0)); err == nil {
+		t.Fatal("maximum value depth of zero accepted")
+	}
+}
+
+// inTemporaryDirectory runs the rest of the test in a temporary working directory, where file storage media
+// without a directory create theirs.
+func inTemporaryDirectory(t *testing.T) {
+	t.Helper()
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(workingDirectory) })
+}
+
+func TestFileOptionsConfigureTheFileStorageMedia(t *testing.T) {
+	inTemporaryDirectory(t)
+	manager, err := NewSessionManager("file", "session", 60,
+		WithRegistrationDir(t.TempDir()), WithFileCodec(stored_session.GobCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isGob := manager.storageMedia.(*file_storage.FileStorage).Codec.(stored_session.GobCodec); !isGob {
+		t.Fatal("file codec not set on the storage media of the manager")
+	}
+	otherManager, err := NewSessionManager("file", "session", 60, WithRegistrationDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec := otherManager.storageMedia.(*file_storage.FileStorage).Codec; codec != nil {
+		t.Fatalf("file codec leaked to another manager: %T", codec)
+	}
+}
+
+func TestStorageMediaOptionOfAnotherTypeFails(t *testing.T) {
+	_, err := NewSessionManager("memory", "session", 60,
+		WithRegistrationDir(t.TempDir()), WithFileCodec(stored_session.GobCodec{}))
+	if !errors.Is(err, ErrStorageMediaOptionUnused) {
+		t.Fatalf("got %v, want ErrStorageMediaOptionUnused", err)
+	}
+	_, err = NewSessionManagerWithStorage(&memory_storage.MemoryStorage{}, "session", WithMemoryShards(4))
+	if !errors.Is(err, ErrStorageMediaOptionUnused) {
+		t.Fatalf("got %v, want ErrStorageMediaOptionUnused", err)
+	}
+}
+
+func TestDynamoDBConfigIsRequiredByTheDynamoDBStorageMedia(t *testing.T) {
+	_, err := NewSessionManager("dynamodb", "session", 60,
+		WithRegistrationDir(t.TempDir()), WithDynamoDBConfig(dynamodb_storage.DynamoDBConfig{}))
+	if err == nil {
+		t.Fatal("dynamodb storage media opened without a client")
+	}
+	_, err = NewSessionManager("memory", "session", 60,
+		WithRegistrationDir(t.TempDir()), WithDynamoDBConfig(dynamodb_storage.DynamoDBConfig{}))
+	if !errors.Is(err, ErrStorageMediaOptionUnused) {
+		t.Fatalf("got %v, want ErrStorageMediaOptionUnused", err)
+	}
+}
+
+func TestBoltConfigOpensTheBoltStorageMedia(t *testing.T) {
+	manager, err := NewSessionManager("bolt", "session", 60, WithRegistrationDir(t.TempDir()),
+		WithBoltConfig(bolt_storage.BoltConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.storageMedia.(*bolt_storage.BoltStorage).Close()
+	session, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.LookupSession(session.GetSessionId()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// batchingStorage is a memory storage media recording the expiry batch size it's given.
+type batchingStorage struct {
+	*memory_storage.MemoryStorage
+	batchSize int
+}
+
+func (storage *batchingStorage) SetExpiryBatchSize(batchSize int) {
+	storage.batchSize = batchSize
+}
+
+func TestExpiryBatchSizeIsPassedToTheStorageMedia(t *testing.T) {
+	storage := &batchingStorage{MemoryStorage: &memory_storage.MemoryStorage{}}
+	manager, err := NewSessionManagerWithStorage(storage, "session", WithExpiryBatchSize(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	if storage.batchSize != 500 {
+		t.Fatalf("got a batch size of %d, want 500", storage.batchSize)
+	}
+	if _, err = NewSessionManagerWithStorage(&memory_storage.MemoryStorage{}, "session", WithExpiryBatchSize(0)); err == nil {
+		t.Fatal("batch size of zero accepted")
+	}
+}
@@ -0,0 +1,657 @@
+// Package postgres_storage provides a storage media keeping sessions in a postgres database table,
+// through database/sql. A postgres driver, such as github.com/lib/pq or the database/sql driver of pgx,
+// must be imported by the application.
+package postgres_storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDriverName is the database/sql driver used when PostgresConfig has no DriverName set.
+const DefaultDriverName = "postgres"
+
+// DefaultTableName is the table sessions are stored in when PostgresConfig has no TableName set.
+const DefaultTableName = "sessions"
+
+// DefaultSchemaName is the schema of the sessions table when PostgresConfig has no SchemaName set.
+const DefaultSchemaName = "public"
+
+// ExpiryBatchPause is how long TerminateSessionOnExpiration pauses between the chunks of expired sessions
+// it deletes with an expiry batch size, letting other statements through.
+const ExpiryBatchPause = 10 * time.Millisecond
+
+// ErrNotConfigured is an error used when a PostgresStorage is used before being opened with a configuration.
+var ErrNotConfigured = errors.New("wsm: postgres storage is not configured")
+
+// ErrAlreadyOpen is an error used when a PostgresStorage already opened is opened again,
+// which would close the connection pool its sessions are being used through.
+var ErrAlreadyOpen = errors.New("wsm: postgres storage is already open")
+
+// identifierPattern matches the table and schema names accepted in PostgresConfig,
+// so they can be safely quoted into queries.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// PostgresConfig is the configuration of a PostgresStorage.
+// DSN is either a postgres:// URL or key=value connection string, MaxOpenConns and MaxIdleConns
+// configure the connection pool, zero keeping the database/sql defaults, and TableName and SchemaName
+// locate the sessions table, created with its schema by EnsureSchema if they don't exist,
+// unless SkipEnsureSchema is set, e.g. when the schema is managed by migrations.
+type PostgresConfig struct {
+	DriverName   string
+	DSN          string
+	MaxOpenConns int
+	MaxIdleConns int
+	TableName    string
+	SchemaName   string
+	// SkipEnsureSchema skips creating the sessions table on opening.
+	SkipEnsureSchema bool
+	// Codec encodes the values of sessions, e.g. stored_session.GobCodec{} so they keep their Go types,
+	// in the encoded_value bytea column instead of the value jsonb column. Values are stored as jsonb if it's not set.
+	Codec stored_session.Codec
+}
+
+// PostgresStorage represents a postgres storage media type to store sessions in, a row per session
+// in its sessions table. Values are stored as jsonb, so they are retrieved as decoded by encoding/json,
+// unless a codec is configured. Rows are versioned, each change incrementing their version, and updated
+// only if their version is still the one read, so concurrent updates never lose each other's changes.
+// It must be created by NewPostgresStorage, or opened by Open before being used.
+type PostgresStorage struct {
+	opening         sync.Mutex
+	database        *sql.DB
+	schemaName      string
+	tableName       string
+	codec           stored_session.Codec
+	clock           abstract_definition.ClockHolder
+	maxSessionBytes atomic.Int64
+	expiryBatchSize atomic.Int64
+}
+
+// SetClock is a method for PostgresStorage that sets the clock stamping the last access time of sessions
+// and deciding their expiration.
+func (storage *PostgresStorage) SetClock(clock abstract_definition.Clock) {
+	storage.clock.SetClock(clock)
+}
+
+// Now is a method for PostgresStorage that returns the current time of its clock.
+func (storage *PostgresStorage) Now() time.Time {
+	return storage.clock.Now()
+}
+
+// NewPostgresStorage is a function that opens a connection pool to a postgres database from the configuration,
+// and ensures the sessions table exists unless SkipEnsureSchema is set.
+// It returns an error if the configuration is invalid, the database could not be connected to,
+// or the sessions table could not be created.
+func NewPostgresStorage(config PostgresConfig) (*PostgresStorage, error) {
+	storage := &PostgresStorage{}
+	if err := storage.Open(config); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// Open is a method for PostgresStorage that opens a connection pool to a postgres database from the configuration,
+// and ensures the sessions table exists unless SkipEnsureSchema is set, used to configure the storage media built by the session manager.
+// A storage is opened once, before being used, so its connection pool is never replaced while in use.
+// It returns an ErrAlreadyOpen error if the storage is already open, or an error if the configuration is invalid,
+// the database could not be connected to, or the sessions table could not be created.
+func (storage *PostgresStorage) Open(config PostgresConfig) error {
+	storage.opening.Lock()
+	defer storage.opening.Unlock()
+	if storage.database != nil {
+		return ErrAlreadyOpen
+	}
+	if err := validateDSN(config.DSN); err != nil {
+		return err
+	}
+	driverName, schemaName, tableName := config.DriverName, config.SchemaName, config.TableName
+	if driverName == "" {
+		driverName = DefaultDriverName
+	}
+	if schemaName == "" {
+		schemaName = DefaultSchemaName
+	}
+	if tableName == "" {
+		tableName = DefaultTableName
+	}
+	if !identifierPattern.MatchString(schemaName) || !identifierPattern.MatchString(tableName) {
+		return fmt.Errorf("wsm: invalid postgres schema or table name %q.%q", schemaName, tableName)
+	}
+	database, err := sql.Open(driverName, config.DSN)
+	if err != nil {
+		return fmt.Errorf("wsm: could not open the postgres database: %w", err)
+	}
+	if config.MaxOpenConns > 0 {
+		database.SetMaxOpenConns(config.MaxOpenConns)
+	}
+	if config.MaxIdleConns > 0 {
+		database.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	if err = database.Ping(); err != nil {
+		database.Close()
+		return fmt.Errorf("wsm: could not connect to the postgres database: %w", err)
+	}
+	openedStorage := &PostgresStorage{database: database, schemaName: schemaName, tableName: tableName}
+	if !config.SkipEnsureSchema {
+		if err = openedStorage.EnsureSchema(context.Background()); err != nil {
+			database.Close()
+			return err
+		}
+	}
+	storage.database, storage.schemaName, storage.tableName = database, schemaName, tableName
+	storage.codec = config.Codec
+	return nil
+}
+
+// Close is a method for PostgresStorage that closes its connection pool.
+func (storage *PostgresStorage) Close() error {
+	if storage.database == nil {
+		return nil
+	}
+	return storage.database.Close()
+}
+
+// validateDSN is a function that checks a postgres DSN is either a valid postgres:// URL
+// or a key=value connection string.
+func validateDSN(dsn string) error {
+	if strings.TrimSpace(dsn) == "" {
+		return errors.New("wsm: postgres DSN must not be empty")
+	}
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		if _, err := url.Parse(dsn); err != nil {
+			return fmt.Errorf("wsm: invalid postgres DSN: %w", err)
+		}
+		return nil
+	}
+	if !strings.Contains(dsn, "=") {
+		return errors.New("wsm: invalid postgres DSN, expected a postgres:// URL or key=value pairs")
+	}
+	return nil
+}
+
+// table is a method for PostgresStorage that returns the quoted qualified name of its sessions table.
+func (storage *PostgresStorage) table() string {
+	return fmt.Sprintf(`"%s"."%s"`, storage.schemaName, storage.tableName)
+}
+
+// EnsureSchema is a method for PostgresStorage that creates the schema, the sessions table, the index
+// on its last access time used by expiration sweeps, and the index of its users, if they don't exist.
+// Running it again changes nothing.
+// It returns an error if one of them could not be created.
+func (storage *PostgresStorage) EnsureSchema(ctx context.Context) error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	_, err := storage.database.ExecContext(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, storage.schemaName))
+	if err != nil {
+		return fmt.Errorf("wsm: could not create the postgres schema: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id text PRIMARY KEY,
+	last_access timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	pinned boolean NOT NULL DEFAULT false,
+	expiry bigint NOT NULL DEFAULT 0,
+	value jsonb NOT NULL DEFAULT '{}',
+	encoded_value bytea,
+	user_id text,
+	version bigint NOT NULL DEFAULT 0
+)`, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not create the postgres sessions table: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS user_id text`, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not add the postgres sessions user column: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS encoded_value bytea`, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not add the postgres sessions encoded value column: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0`, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not add the postgres sessions version column: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_last_access_idx" ON %s (last_access)`,
+		storage.tableName, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not create the postgres sessions last access index: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_user_id_idx" ON %s (user_id)`,
+		storage.tableName, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not create the postgres sessions user index: %w", err)
+	}
+	_, err = storage.database.ExecContext(ctx, fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_value_idx" ON %s USING gin (value jsonb_path_ops)`,
+		storage.tableName, storage.table()))
+	if err != nil {
+		return fmt.Errorf("wsm: could not create the postgres sessions value index: %w", err)
+	}
+	return nil
+}
+
+// rowScanner is implemented by both sql.Row and sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// selectedColumns are the columns of a session row scanned by scanSession, in order.
+const selectedColumns = "id, created_at, last_access, pinned, expiry, value, coalesce(user_id, ''), encoded_value, version"
+
+// scanSession is a method for PostgresStorage that scans a session row of selectedColumns,
+// returning a wsm.SessionNotExists error if there's no row.
+func (storage *PostgresStorage) scanSession(row rowScanner) (abstract_definition.SessionData, error) {
+	var data abstract_definition.SessionData
+	var expiry int64
+	var jsonValues, encodedValues []byte
+	err := row.Scan(&data.Id, &data.CreatedAt, &data.LastAccessTime, &data.Pinned, &expiry, &jsonValues, &data.UserID, &encodedValues, &data.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	if err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	data.Expiry = time.Duration(expiry)
+	if data.Values, err = storage.decodeValues(jsonValues, encodedValues); err != nil {
+		return abstract_definition.SessionData{}, fmt.Errorf("wsm: could not decode the session values: %w", err)
+	}
+	return data, nil
+}
+
+// encodeValues is a method for PostgresStorage that encodes the values of a session for the value jsonb column,
+// or with its codec for the encoded_value column if one is configured, the value column then holding an empty object.
+// It returns an abstract_definition.ErrInvalidKey error if a key is not a string, or an error if a value could not be encoded.
+func (storage *PostgresStorage) encodeValues(values map[interface{}]interface{}) (jsonValues []byte, encodedValues []byte, err error) {
+	if storage.codec == nil {
+		jsonValues, err = stored_session.MarshalSessionValues(values)
+		return jsonValues, nil, err
+	}
+	encodedValues, err = stored_session.MarshalSessionValuesWith(storage.codec, values)
+	return []byte("{}"), encodedValues, err
+}
+
+// SetMaxSessionBytes is a method for PostgresStorage that sets the maximum size of the values of sessions
+// as encoded for their column, zero meaning no limit.
+func (storage *PostgresStorage) SetMaxSessionBytes(maxBytes int) {
+	storage.maxSessionBytes.Store(int64(maxBytes))
+}
+
+// CheckSessionSize is a method for PostgresStorage that returns an abstract_definition.ErrSessionTooLarge error
+// if the values of a session would exceed the maximum size once encoded for the column storing them.
+func (storage *PostgresStorage) CheckSessionSize(data abstract_definition.SessionData) error {
+	maxBytes := storage.maxSessionBytes.Load()
+	if maxBytes == 0 {
+		return nil
+	}
+	jsonValues, encodedValues, err := storage.encodeValues(data.Values)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session values: %w", err)
+	}
+	if encodedValues != nil {
+		return stored_session.CheckSize(len(encodedValues), maxBytes)
+	}
+	return stored_session.CheckSize(len(jsonValues), maxBytes)
+}
+
+// decodeValues is a method for PostgresStorage that decodes the values of a session encoded by encodeValues.
+// It returns an error if the values could not be decoded, or were encoded with a codec while none is configured.
+func (storage *PostgresStorage) decodeValues(jsonValues, encodedValues []byte) (map[interface{}]interface{}, error) {
+	if encodedValues == nil {
+		return stored_session.UnmarshalSessionValues(jsonValues)
+	}
+	if storage.codec == nil {
+		return nil, errors.New("wsm: session values are encoded with a codec, but none is configured")
+	}
+	return stored_session.UnmarshalSessionValuesWith(storage.codec, encodedValues)
+}
+
+// UpdateSession is a method for PostgresStorage that reads the session belonging to the given ID,
+// applies the update to it, writes it back only if its version hasn't changed in the meantime, retrying otherwise,
+// and returns its new content, so concurrent updates never overwrite each other without locking its row.
+// Its last access time only moves forward, touching a session leaving its version unchanged.
+// It returns the error of the update without writing anything if the update fails.
+func (storage *PostgresStorage) UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	if storage.database == nil {
+		return abstract_definition.SessionData{}, ErrNotConfigured
+	}
+	for {
+		data, err := storage.scanSession(storage.database.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = $1",
+			selectedColumns, storage.table()), sessionId))
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		readVersion := data.Version
+		if err = update(&data); err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		jsonValues, encodedValues, err := storage.encodeValues(data.Values)
+		if err != nil {
+			return abstract_definition.SessionData{}, fmt.Errorf("wsm: could not encode the session values: %w", err)
+		}
+		result, err := storage.database.Exec(fmt.Sprintf("UPDATE %s SET last_access = GREATEST(last_access, $2), pinned = $3, expiry = $4, "+
+			"value = $5, user_id = NULLIF($6, ''), encoded_value = $7, version = version + 1 WHERE id = $1 AND version = $8", storage.table()),
+			sessionId, data.LastAccessTime, data.Pinned, int64(data.Expiry), jsonValues, data.UserID, encodedValues, readVersion)
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		affectedRows, err := result.RowsAffected()
+		if err != nil {
+			return abstract_definition.SessionData{}, err
+		}
+		if affectedRows == 1 {
+			data.Version = readVersion + 1
+			return stored_session.CopySessionData(data), nil
+		}
+	}
+}
+
+// InitializeSession is a method for PostgresStorage that takes a session ID argument of type string
+// creates a new session, inserts it in the sessions table, and then return that session.
+// It returns an error if the session could not be inserted.
+func (storage *PostgresStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	now := storage.Now()
+	data := abstract_definition.SessionData{
+		Id:             sessionId,
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values:         make(map[interface{}]interface{}),
+	}
+	_, err := storage.database.Exec(fmt.Sprintf("INSERT INTO %s (id, created_at, last_access) VALUES ($1, $2, $2)", storage.table()),
+		sessionId, now)
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSession is a method for PostgresStorage that takes session ID of type string as an argument
+// and returns the session stored in the sessions table that belongs to the given ID, if it doesn't exist
+// it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	data, err := storage.scanSession(storage.database.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = $1",
+		selectedColumns, storage.table()), sessionId))
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// RetrieveSessionAndTouch is a method for PostgresStorage that takes session ID of type string as an argument
+// and returns the session stored in the sessions table that belongs to the given ID, updating its last access time
+// in the same statement, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	data, err := storage.scanSession(storage.database.QueryRow(fmt.Sprintf("UPDATE %s SET last_access = $2 WHERE id = $1 RETURNING %s",
+		storage.table(), selectedColumns), sessionId, storage.Now()))
+	if err != nil {
+		return nil, err
+	}
+	return stored_session.NewStoredSession(data, storage), nil
+}
+
+// UpdateSessionLastAccess is a method for PostgresStorage that updates the session's
+// last access time when it's used
+func (storage *PostgresStorage) UpdateSessionLastAccess(sessionId string) error {
+	return storage.execOnSession(fmt.Sprintf("UPDATE %s SET last_access = $2 WHERE id = $1", storage.table()),
+		sessionId, storage.Now())
+}
+
+// DestroySession is a method for PostgresStorage that deletes a session from the sessions table if found,
+// otherwise it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) DestroySession(sessionId string) error {
+	return storage.execOnSession(fmt.Sprintf("DELETE FROM %s WHERE id = $1", storage.table()), sessionId)
+}
+
+// execOnSession is a method for PostgresStorage that executes a statement changing the row of the session
+// whose ID is its first argument, returning a wsm.SessionNotExists error if there's no such row.
+func (storage *PostgresStorage) execOnSession(query string, sessionId string, arguments ...interface{}) error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	result, err := storage.database.Exec(query, append([]interface{}{sessionId}, arguments...)...)
+	if err != nil {
+		return err
+	}
+	affectedRows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affectedRows == 0 {
+		return abstract_definition.SessionNotExist
+	}
+	return nil
+}
+
+// Ping is a method for PostgresStorage that runs a SELECT 1 on the database, through the connection pool.
+// It returns an ErrNotConfigured error if the storage was not opened, and an error if the query failed.
+func (storage *PostgresStorage) Ping(ctx context.Context) error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	var one int
+	if err := storage.database.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return fmt.Errorf("wsm: could not reach the postgres database: %w", err)
+	}
+	return nil
+}
+
+// DestroyAllSessions is a method for PostgresStorage that deletes all the sessions from the sessions table.
+func (storage *PostgresStorage) DestroyAllSessions() error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	_, err := storage.database.Exec(fmt.Sprintf("DELETE FROM %s", storage.table()))
+	return err
+}
+
+// expiredCondition is the condition of the rows of expired sessions, given the oldest last access time
+// of sessions without their own expiry and the current time as $1 and $2.
+const expiredCondition = `NOT pinned AND (
+	(expiry = 0 AND last_access < $1) OR
+	(expiry > 0 AND last_access + make_interval(secs => expiry / 1000000000.0) < $2)
+)`
+
+// SetExpiryBatchSize is a method for PostgresStorage that sets the maximum number of sessions
+// TerminateSessionOnExpiration deletes in a single statement, zero meaning no limit.
+func (storage *PostgresStorage) SetExpiryBatchSize(batchSize int) {
+	storage.expiryBatchSize.Store(int64(batchSize))
+}
+
+// TerminateSessionOnExpiration is a method for PostgresStorage that deletes sessions from the sessions table
+// that has exceeded a passed maximum lifetime parameter of type time.Duration, in a single statement,
+// or with an expiry batch size, in statements deleting at most that many sessions each, pausing
+// ExpiryBatchPause between them, until fewer are deleted, so a large sweep never locks the table for long.
+// Pinned sessions are never deleted, and sessions with their own expiry use it instead of the maximum lifetime.
+// Sessions without their own expiry are matched through the index on their last access time.
+// It returns the number of deleted sessions, and an error if the sessions could not be deleted,
+// along with the number of sessions deleted by the chunks before it.
+func (storage *PostgresStorage) TerminateSessionOnExpiration(maxLifetime time.Duration) (int, error) {
+	terminated, err := storage.TerminateExpiredSessions(maxLifetime)
+	return len(terminated), err
+}
+
+// TerminateExpiredSessions is a method for PostgresStorage that deletes expired sessions from the sessions table
+// like TerminateSessionOnExpiration, and returns the IDs of the deleted sessions, as returned by the deletions.
+func (storage *PostgresStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	now := storage.Now()
+	batchSize := storage.expiryBatchSize.Load()
+	if batchSize == 0 {
+		return storage.querySessionIds(fmt.Sprintf("DELETE FROM %s WHERE %s RETURNING id", storage.table(), expiredCondition),
+			now.Add(-maxLifetime), now)
+	}
+	var terminated []string
+	for {
+		deleted, err := storage.querySessionIds(fmt.Sprintf("DELETE FROM %s WHERE id IN (SELECT id FROM %s WHERE %s LIMIT $3) RETURNING id",
+			storage.table(), storage.table(), expiredCondition), now.Add(-maxLifetime), now, batchSize)
+		terminated = append(terminated, deleted...)
+		if err != nil {
+			return terminated, err
+		}
+		if int64(len(deleted)) < batchSize {
+			return terminated, nil
+		}
+		time.Sleep(ExpiryBatchPause)
+	}
+}
+
+// ListSessions is a method for PostgresStorage that returns the IDs of all the sessions in the sessions table.
+func (storage *PostgresStorage) ListSessions() ([]string, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	return storage.querySessionIds(fmt.Sprintf("SELECT id FROM %s", storage.table()))
+}
+
+// ScanSessions is a method for PostgresStorage that returns a page of at most limit session IDs of the sessions
+// table in ascending order, following the cursor, and the cursor of the next page, empty once there's none.
+// Pages are selected by keyset pagination on the primary key, the cursor being the last ID of the previous page,
+// so each page is read from the index without counting the rows of the previous ones.
+// It returns an abstract_definition.ErrInvalidScanLimit error if the limit is not greater than zero.
+func (storage *PostgresStorage) ScanSessions(cursor string, limit int) ([]string, string, error) {
+	if storage.database == nil {
+		return nil, "", ErrNotConfigured
+	}
+	if limit <= 0 {
+		return nil, "", abstract_definition.ErrInvalidScanLimit
+	}
+	sessionIds, err := storage.querySessionIds(fmt.Sprintf("SELECT id FROM %s WHERE id > $1 ORDER BY id LIMIT $2",
+		storage.table()), cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(sessionIds) <= limit {
+		return sessionIds, "", nil
+	}
+	return sessionIds[:limit], sessionIds[limit-1], nil
+}
+
+// querySessionIds is a method for PostgresStorage that returns the session IDs selected by a query.
+func (storage *PostgresStorage) querySessionIds(query string, arguments ...interface{}) ([]string, error) {
+	return storage.querySessionIdsContext(context.Background(), query, arguments...)
+}
+
+// querySessionIdsContext is a method for PostgresStorage like querySessionIds, running the query with the context.
+func (storage *PostgresStorage) querySessionIdsContext(ctx context.Context, query string, arguments ...interface{}) ([]string, error) {
+	rows, err := storage.database.QueryContext(ctx, query, arguments...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessionIds []string
+	for rows.Next() {
+		var sessionId string
+		if err = rows.Scan(&sessionId); err != nil {
+			return nil, err
+		}
+		sessionIds = append(sessionIds, sessionId)
+	}
+	return sessionIds, rows.Err()
+}
+
+// ExportSession is a method for PostgresStorage that returns the full content of the session
+// belonging to the given ID, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) ExportSession(sessionId string) (abstract_definition.SessionData, error) {
+	if storage.database == nil {
+		return abstract_definition.SessionData{}, ErrNotConfigured
+	}
+	return storage.scanSession(storage.database.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = $1",
+		selectedColumns, storage.table()), sessionId))
+}
+
+// ImportSession is a method for PostgresStorage that inserts a session from its full content,
+// replacing any session with the same ID. A session without its creation time is recorded as created
+// at its last access time, since the creation time of a row is required. A replaced session gets a version beyond
+// its previous one, so the updates of its previous content are retried on the imported one.
+// It returns an error if a key is not a string, the session is larger than the maximum session size,
+// with an abstract_definition.ErrSessionTooLarge error, or the session could not be inserted.
+func (storage *PostgresStorage) ImportSession(data abstract_definition.SessionData) error {
+	if storage.database == nil {
+		return ErrNotConfigured
+	}
+	if err := storage.CheckSessionSize(data); err != nil {
+		return err
+	}
+	jsonValues, encodedValues, err := storage.encodeValues(data.Values)
+	if err != nil {
+		return fmt.Errorf("wsm: could not encode the session values: %w", err)
+	}
+	createdAt := data.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = data.LastAccessTime
+	}
+	_, err = storage.database.Exec(fmt.Sprintf(`INSERT INTO %s AS stored (id, last_access, pinned, expiry, value, user_id, created_at, encoded_value, version)
+VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9)
+ON CONFLICT (id) DO UPDATE SET last_access = EXCLUDED.last_access, pinned = EXCLUDED.pinned,
+	expiry = EXCLUDED.expiry, value = EXCLUDED.value, user_id = EXCLUDED.user_id, created_at = EXCLUDED.created_at,
+	encoded_value = EXCLUDED.encoded_value, version = GREATEST(stored.version + 1, EXCLUDED.version)`, storage.table()),
+		data.Id, data.LastAccessTime, data.Pinned, int64(data.Expiry), jsonValues, data.UserID, createdAt, encodedValues, data.Version)
+	return err
+}
+
+// SetSessionUserID is a method for PostgresStorage that associates the session belonging to the given ID
+// with a user, so it's listed among the user's sessions, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) SetSessionUserID(sessionId, userID string) error {
+	return storage.execOnSession(fmt.Sprintf("UPDATE %s SET user_id = NULLIF($2, ''), version = version + 1 WHERE id = $1", storage.table()),
+		sessionId, userID)
+}
+
+// UserSessionIDs is a method for PostgresStorage that returns the IDs of all the sessions associated with a user,
+// through the index of the users.
+func (storage *PostgresStorage) UserSessionIDs(userID string) ([]string, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	return storage.querySessionIds(fmt.Sprintf("SELECT id FROM %s WHERE user_id = $1", storage.table()), userID)
+}
+
+// Pin is a method for PostgresStorage that marks the session belonging to the given ID as exempt
+// from termination on expiration, if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) Pin(sessionId string) error {
+	return storage.execOnSession(fmt.Sprintf("UPDATE %s SET pinned = true, version = version + 1 WHERE id = $1", storage.table()), sessionId)
+}
+
+// Unpin is a method for PostgresStorage that makes a pinned session belonging to the given ID expire again,
+// if it doesn't exist it returns a wsm.SessionNotExists error.
+func (storage *PostgresStorage) Unpin(sessionId string) error {
+	return storage.execOnSession(fmt.Sprintf("UPDATE %s SET pinned = false, version = version + 1 WHERE id = $1", storage.table()), sessionId)
+}
+
+// SessionIDsByValue is a method for PostgresStorage that returns the IDs of all the sessions holding the value
+// under the key, through a jsonb containment query on the value column, served by its GIN index.
+// The value is compared as encoded by encoding/json, so e.g. a struct matches the object of its exported fields.
+// It returns an abstract_definition.ErrNotSupported error if a codec is configured, the values then being stored
+// in the encoded_value column, or an error if the value could not be encoded.
+func (storage *PostgresStorage) SessionIDsByValue(ctx context.Context, key string, value interface{}) ([]string, error) {
+	if storage.database == nil {
+		return nil, ErrNotConfigured
+	}
+	if storage.codec != nil {
+		return nil, fmt.Errorf("%w: values encoded with a codec can't be queried", abstract_definition.ErrNotSupported)
+	}
+	contained, err := stored_session.MarshalSessionValues(map[interface{}]interface{}{key: value})
+	if err != nil {
+		return nil, fmt.Errorf("wsm: could not encode the queried value: %w", err)
+	}
+	return storage.querySessionIdsContext(ctx, fmt.Sprintf("SELECT id FROM %s WHERE value @> $1::jsonb", storage.table()), string(contained))
+}
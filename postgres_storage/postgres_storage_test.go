@@ -0,0 +1,411 @@
+package postgres_storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/stored_session"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDriver is a database/sql driver whose connections only answer pings and a SELECT 1, enough to open
+// a PostgresStorage with SkipEnsureSchema. Connections of a DSN with host=down fail every query.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	return fakeConn{down: strings.Contains(dsn, "host=down")}, nil
+}
+
+// fakeConn is a connection of fakeDriver.
+type fakeConn struct {
+	down bool
+}
+
+func (conn fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if conn.down || query != "SELECT 1" {
+		return nil, errors.New("fake: connection refused")
+	}
+	return &oneRows{}, nil
+}
+
+// oneRows is the single row of a SELECT 1.
+type oneRows struct {
+	read bool
+}
+
+func (rows *oneRows) Columns() []string { return []string{"?column?"} }
+func (rows *oneRows) Close() error      { return nil }
+func (rows *oneRows) Next(dest []driver.Value) error {
+	if rows.read {
+		return io.EOF
+	}
+	rows.read = true
+	dest[0] = int64(1)
+	return nil
+}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("fake: not supported") }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("fake: not supported") }
+
+func init() {
+	sql.Register("wsm-fake", fakeDriver{})
+}
+
+func TestOpenRefusesToReopen(t *testing.T) {
+	config := PostgresConfig{DriverName: "wsm-fake", DSN: "host=localhost", SkipEnsureSchema: true}
+	storage, err := NewPostgresStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	database := storage.database
+	if err = storage.Open(config); !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("got %v, want ErrAlreadyOpen", err)
+	}
+	if storage.database != database {
+		t.Fatal("connection pool replaced by the refused Open")
+	}
+	if err = database.Ping(); err != nil {
+		t.Fatalf("connection pool closed by the refused Open: %v", err)
+	}
+}
+
+func TestUnopenedStorageIsNotConfigured(t *testing.T) {
+	storage := &PostgresStorage{}
+	if _, err := storage.InitializeSession("id"); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("got %v, want ErrNotConfigured", err)
+	}
+}
+
+func TestPingRunsAQuery(t *testing.T) {
+	storage, err := NewPostgresStorage(PostgresConfig{DriverName: "wsm-fake", DSN: "host=localhost", SkipEnsureSchema: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if err = storage.Ping(context.Background()); err != nil {
+		t.Fatalf("healthy database not reached: %v", err)
+	}
+	downStorage, err := NewPostgresStorage(PostgresConfig{DriverName: "wsm-fake", DSN: "host=down", SkipEnsureSchema: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downStorage.Close()
+	if err = downStorage.Ping(context.Background()); err == nil {
+		t.Fatal("failing database reported as reachable")
+	}
+	if err = (&PostgresStorage{}).Ping(context.Background()); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("got %v, want ErrNotConfigured", err)
+	}
+}
+
+// fakeTable is a sessions table answering the statements of UpdateSession, TerminateSessionOnExpiration
+// and SessionIDsByValue,
+// whose concurrentWrite, if set, changes a row once right before it's next updated, as another request would.
+// Rows accessed before the oldest last access time are expired, and the number of rows each deletion was
+// limited to is recorded, zero for an unlimited one.
+type fakeTable struct {
+	sync.Mutex
+	rows            map[string]*fakeRow
+	concurrentWrite func(row *fakeRow)
+	deletionLimits  []int64
+}
+
+// fakeRow is a row of fakeTable.
+type fakeRow struct {
+	createdAt, lastAccess time.Time
+	value                 []byte
+	version               int64
+}
+
+func (table *fakeTable) Connect(context.Context) (driver.Conn, error) {
+	return fakeTableConn{table}, nil
+}
+func (table *fakeTable) Driver() driver.Driver { return fakeDriver{} }
+
+// fakeTableConn is a connection to a fakeTable.
+type fakeTableConn struct {
+	table *fakeTable
+}
+
+func (conn fakeTableConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasSuffix(query, "WHERE value @> $1::jsonb") {
+		return conn.containingRows(args[0].Value.(string))
+	}
+	if strings.HasPrefix(query, "DELETE") && strings.HasSuffix(query, "RETURNING id") {
+		return conn.deleteExpired(args)
+	}
+	if !strings.HasPrefix(query, "SELECT "+selectedColumns) {
+		return nil, errors.New("fake: not supported")
+	}
+	conn.table.Lock()
+	defer conn.table.Unlock()
+	sessionId := args[0].Value.(string)
+	rows := &sessionRows{}
+	if row, rowExists := conn.table.rows[sessionId]; rowExists {
+		rows.values = []driver.Value{sessionId, row.createdAt, row.lastAccess, false, int64(0), row.value, "", nil, row.version}
+	}
+	return rows, nil
+}
+
+func (conn fakeTableConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "UPDATE") || !strings.HasSuffix(query, "WHERE id = $1 AND version = $8") {
+		return nil, errors.New("fake: not supported")
+	}
+	conn.table.Lock()
+	defer conn.table.Unlock()
+	row, rowExists := conn.table.rows[args[0].Value.(string)]
+	if !rowExists {
+		return driver.RowsAffected(0), nil
+	}
+	if conn.table.concurrentWrite != nil {
+		conn.table.concurrentWrite(row)
+		conn.table.concurrentWrite = nil
+	}
+	if row.version != args[7].Value.(int64) {
+		return driver.RowsAffected(0), nil
+	}
+	if lastAccess := args[1].Value.(time.Time); lastAccess.After(row.lastAccess) {
+		row.lastAccess = lastAccess
+	}
+	row.value = args[4].Value.([]byte)
+	row.version++
+	return driver.RowsAffected(1), nil
+}
+
+// containingRows is a method for fakeTableConn that selects the IDs of the rows whose json values
+// hold every top-level value of the contained json object, in order.
+func (conn fakeTableConn) containingRows(contained string) (driver.Rows, error) {
+	conn.table.Lock()
+	defer conn.table.Unlock()
+	var containedValues map[string]interface{}
+	if err := json.Unmarshal([]byte(contained), &containedValues); err != nil {
+		return nil, err
+	}
+	rows := &idRows{}
+	for sessionId, row := range conn.table.rows {
+		var values map[string]interface{}
+		if err := json.Unmarshal(row.value, &values); err != nil {
+			return nil, err
+		}
+		contains := true
+		for key, value := range containedValues {
+			contains = contains && reflect.DeepEqual(values[key], value)
+		}
+		if contains {
+			rows.ids = append(rows.ids, sessionId)
+		}
+	}
+	sort.Strings(rows.ids)
+	return rows, nil
+}
+
+// deleteExpired is a method for fakeTableConn that deletes the expired rows, at most as many as its limit if any,
+// returning their IDs.
+func (conn fakeTableConn) deleteExpired(args []driver.NamedValue) (driver.Rows, error) {
+	conn.table.Lock()
+	defer conn.table.Unlock()
+	var limit int64
+	if len(args) == 3 {
+		limit = args[2].Value.(int64)
+	}
+	conn.table.deletionLimits = append(conn.table.deletionLimits, limit)
+	oldestLastAccess := args[0].Value.(time.Time)
+	rows := &idRows{}
+	for sessionId, row := range conn.table.rows {
+		if limit > 0 && int64(len(rows.ids)) == limit {
+			break
+		}
+		if row.lastAccess.Before(oldestLastAccess) {
+			delete(conn.table.rows, sessionId)
+			rows.ids = append(rows.ids, sessionId)
+		}
+	}
+	return rows, nil
+}
+
+func (fakeTableConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake: not supported")
+}
+func (fakeTableConn) Close() error              { return nil }
+func (fakeTableConn) Begin() (driver.Tx, error) { return nil, errors.New("fake: not supported") }
+
+// sessionRows is the session row of a SELECT, if any.
+type sessionRows struct {
+	values []driver.Value
+}
+
+func (rows *sessionRows) Columns() []string {
+	return []string{"id", "created_at", "last_access", "pinned", "expiry", "value", "user_id", "encoded_value", "version"}
+}
+func (rows *sessionRows) Close() error { return nil }
+func (rows *sessionRows) Next(dest []driver.Value) error {
+	if rows.values == nil {
+		return io.EOF
+	}
+	copy(dest, rows.values)
+	rows.values = nil
+	return nil
+}
+
+// idRows are the session IDs of a SELECT id.
+type idRows struct {
+	ids []string
+}
+
+func (rows *idRows) Columns() []string { return []string{"id"} }
+func (rows *idRows) Close() error      { return nil }
+func (rows *idRows) Next(dest []driver.Value) error {
+	if len(rows.ids) == 0 {
+		return io.EOF
+	}
+	dest[0], rows.ids = rows.ids[0], rows.ids[1:]
+	return nil
+}
+
+// fixedClock is a clock always at the same time.
+type fixedClock time.Time
+
+func (clock fixedClock) Now() time.Time { return time.Time(clock) }
+
+// openFakeTable returns a storage on a fakeTable holding a session of the given json values.
+func openFakeTable(t *testing.T, sessionId, jsonValues string) (*PostgresStorage, *fakeTable) {
+	t.Helper()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := &fakeTable{rows: map[string]*fakeRow{sessionId: {createdAt: now, lastAccess: now, value: []byte(jsonValues)}}}
+	database := sql.OpenDB(table)
+	t.Cleanup(func() { database.Close() })
+	return &PostgresStorage{database: database, schemaName: DefaultSchemaName, tableName: DefaultTableName}, table
+}
+
+func TestUpdatesOfAChangedVersionAreRetried(t *testing.T) {
+	storage, table := openFakeTable(t, "id", `{"visits": 1}`)
+	session, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.concurrentWrite = func(row *fakeRow) {
+		row.value = []byte(`{"visits": 1, "theme": "dark"}`)
+		row.version++
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	values, err := stored_session.UnmarshalSessionValues(table.rows["id"].value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["theme"] != "dark" || values["username"] != "zyrx" {
+		t.Fatalf("stored %v, want both the concurrent and the retried change", values)
+	}
+	if version := session.Version(); version != 2 || table.rows["id"].version != 2 {
+		t.Fatalf("got version %d, stored %d, want 2", version, table.rows["id"].version)
+	}
+}
+
+func TestCompareAndSwapValueDetectsLostUpdates(t *testing.T) {
+	storage, table := openFakeTable(t, "id", `{"visits": 1}`)
+	session, err := storage.RetrieveSession("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	visits := session.GetValue("visits")
+	// another request increments the visits between this read and its write back
+	table.concurrentWrite = func(row *fakeRow) {
+		row.value = []byte(`{"visits": 2}`)
+		row.version++
+	}
+	swapped, err := session.CompareAndSwapValue("visits", visits, visits.(float64)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped {
+		t.Fatal("value changed in between swapped, losing the concurrent increment")
+	}
+	if visits = session.GetValue("visits"); visits != float64(2) {
+		t.Fatalf("got %v, want the session refreshed with the concurrent increment", visits)
+	}
+	if swapped, err = session.CompareAndSwapValue("visits", visits, visits.(float64)+1); err != nil || !swapped {
+		t.Fatalf("got %v, %v retrying on the refreshed value", swapped, err)
+	}
+	if stored := string(table.rows["id"].value); stored != `{"visits":3}` {
+		t.Fatalf("stored %s, want both increments", stored)
+	}
+	if _, err = storage.UpdateSession("missing", func(*abstract_definition.SessionData) error { return nil }); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v updating a missing session, want SessionNotExist", err)
+	}
+}
+
+func TestExpiredSessionsAreDeletedInBatches(t *testing.T) {
+	storage, table := openFakeTable(t, "fresh", "{}")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for index := 0; index < 5; index++ {
+		table.rows[fmt.Sprint("stale", index)] = &fakeRow{createdAt: now, lastAccess: now.Add(-time.Hour), value: []byte("{}")}
+	}
+	storage.SetClock(fixedClock(now))
+	storage.SetExpiryBatchSize(2)
+	terminated, err := storage.TerminateSessionOnExpiration(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terminated != 5 {
+		t.Fatalf("terminated %d sessions, want 5", terminated)
+	}
+	if fmt.Sprint(table.deletionLimits) != "[2 2 2]" {
+		t.Fatalf("deleted with limits %v, want three deletions of at most 2 sessions", table.deletionLimits)
+	}
+	if _, freshKept := table.rows["fresh"]; !freshKept || len(table.rows) != 1 {
+		t.Fatalf("kept %d sessions, want only the fresh one", len(table.rows))
+	}
+	storage.SetExpiryBatchSize(0)
+	table.rows["stale"] = &fakeRow{createdAt: now, lastAccess: now.Add(-time.Hour), value: []byte("{}")}
+	if expiredIds, err := storage.TerminateExpiredSessions(time.Minute); err != nil || fmt.Sprint(expiredIds) != "[stale]" {
+		t.Fatalf("terminated %v, error %v, want the stale session", expiredIds, err)
+	}
+	if fmt.Sprint(table.deletionLimits[3:]) != "[0]" {
+		t.Fatalf("deleted with limits %v, want a single unlimited deletion", table.deletionLimits[3:])
+	}
+}
+
+func TestSessionIDsByValueQueriesContainingSessions(t *testing.T) {
+	storage, table := openFakeTable(t, "alice", `{"role": "admin", "visits": 3}`)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for sessionId, jsonValues := range map[string]string{
+		"bob":   `{"role": "editor"}`,
+		"carol": `{"role": "admin"}`,
+		"dave":  `{"theme": "admin"}`,
+	} {
+		table.rows[sessionId] = &fakeRow{createdAt: now, lastAccess: now, value: []byte(jsonValues)}
+	}
+	admins, err := storage.SessionIDsByValue(context.Background(), "role", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(admins) != "[alice carol]" {
+		t.Fatalf("found %v, want the sessions of the admin role", admins)
+	}
+	if found, err := storage.SessionIDsByValue(context.Background(), "visits", 3); err != nil || fmt.Sprint(found) != "[alice]" {
+		t.Fatalf("found %v, error %v, want the session of 3 visits", found, err)
+	}
+	if found, err := storage.SessionIDsByValue(context.Background(), "role", "viewer"); err != nil || len(found) != 0 {
+		t.Fatalf("found %v, error %v, want no session", found, err)
+	}
+	storage.codec = stored_session.GobCodec{}
+	if _, err = storage.SessionIDsByValue(context.Background(), "role", "admin"); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Fatalf("got %v with a codec, want ErrNotSupported", err)
+	}
+	if _, err = (&PostgresStorage{}).SessionIDsByValue(context.Background(), "role", "admin"); !errors.Is(err, ErrNotConfigured) {
+		t.Fatalf("got %v, want ErrNotConfigured", err)
+	}
+}
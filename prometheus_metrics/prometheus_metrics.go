@@ -0,0 +1,61 @@
+// Package prometheus_metrics provides a wsm.MetricsObserver exporting the sessions lifecycle metrics to Prometheus.
+package prometheus_metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusObserver is a metrics observer for SessionManager that counts started, ended, and expired sessions,
+// and gauges the currently active ones.
+type PrometheusObserver struct {
+	startedSessions prometheus.Counter
+	endedSessions   prometheus.Counter
+	expiredSessions prometheus.Counter
+	activeSessions  prometheus.Gauge
+}
+
+// NewPrometheusObserver is a function that initializes a new PrometheusObserver, registering its metrics
+// to the provided registerer (e.g. prometheus.DefaultRegisterer).
+// It returns an error if a metric could not be registered, e.g. when it's already registered.
+func NewPrometheusObserver(registerer prometheus.Registerer) (*PrometheusObserver, error) {
+	observer := &PrometheusObserver{
+		startedSessions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "wsm", Name: "sessions_started_total", Help: "Number of sessions started.",
+		}),
+		endedSessions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "wsm", Name: "sessions_ended_total", Help: "Number of sessions ended.",
+		}),
+		expiredSessions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "wsm", Name: "sessions_expired_total", Help: "Number of sessions terminated on expiration.",
+		}),
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "wsm", Name: "sessions_active", Help: "Number of sessions currently active.",
+		}),
+	}
+	collectors := []prometheus.Collector{observer.startedSessions, observer.endedSessions,
+		observer.expiredSessions, observer.activeSessions}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return observer, nil
+}
+
+// OnStart is a method for PrometheusObserver that counts a started session as active.
+func (observer *PrometheusObserver) OnStart() {
+	observer.startedSessions.Inc()
+	observer.activeSessions.Inc()
+}
+
+// OnEnd is a method for PrometheusObserver that counts an ended session, no longer active.
+func (observer *PrometheusObserver) OnEnd() {
+	observer.endedSessions.Inc()
+	observer.activeSessions.Dec()
+}
+
+// OnExpire is a method for PrometheusObserver that counts the sessions terminated on expiration, no longer active.
+func (observer *PrometheusObserver) OnExpire(count int) {
+	observer.expiredSessions.Add(float64(count))
+	observer.activeSessions.Sub(float64(count))
+}
@@ -0,0 +1,67 @@
+package prometheus_metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/wsmtest"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// assertMetric fails the test unless the metric has the given value.
+func assertMetric(t *testing.T, name string, collector prometheus.Collector, want float64) {
+	t.Helper()
+	if value := testutil.ToFloat64(collector); value != want {
+		t.Errorf("%s is %v, want %v", name, value, want)
+	}
+}
+
+func TestMetricsFollowTheLifecycleOfSessions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	observer, err := NewPrometheusObserver(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMetricsObserver(observer), wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	started := httptest.NewRecorder()
+	for i := 0; i < 3; i++ {
+		started = httptest.NewRecorder()
+		if _, _, err = manager.StartSession(started, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertMetric(t, "started sessions", observer.startedSessions, 3)
+	assertMetric(t, "active sessions", observer.activeSessions, 3)
+	ended := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range started.Result().Cookies() {
+		ended.AddCookie(cookie)
+	}
+	if _, err = manager.EndSession(httptest.NewRecorder(), ended); err != nil {
+		t.Fatal(err)
+	}
+	assertMetric(t, "ended sessions", observer.endedSessions, 1)
+	assertMetric(t, "active sessions", observer.activeSessions, 2)
+	storage.Advance(2 * time.Minute)
+	manager.SessionsExpirationRoutine()
+	assertMetric(t, "expired sessions", observer.expiredSessions, 2)
+	assertMetric(t, "active sessions", observer.activeSessions, 0)
+	if count := testutil.CollectAndCount(registry); count != 4 {
+		t.Fatalf("registered %d metrics, want 4", count)
+	}
+}
+
+func TestMetricsAreRegisteredOnce(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if _, err := NewPrometheusObserver(registry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPrometheusObserver(registry); err == nil {
+		t.Fatal("metrics registered twice to the same registerer")
+	}
+}
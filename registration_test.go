@@ -0,0 +1,205 @@
+package wsm_backup_test
+
+import (
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/bolt_storage"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memory_storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRegistration writes the registration file of a storage media type with the given content.
+func writeRegistration(t *testing.T, registrationDir, storageMediaType, content string) string {
+	t.Helper()
+	path := filepath.Join(registrationDir, storageMediaType+".json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCorruptRegistrationIsReported(t *testing.T) {
+	registrationDir := t.TempDir()
+	path := writeRegistration(t, registrationDir, "memory", `{"type": "mem`)
+	_, err := wsm.NewSessionManager("memory", "session_corrupt", 60, wsm.WithRegistrationDir(registrationDir))
+	if !errors.Is(err, wsm.ErrCorruptRegistration) {
+		t.Fatalf("got %v, want ErrCorruptRegistration", err)
+	}
+	var corruptErr *wsm.CorruptRegistrationError
+	if !errors.As(err, &corruptErr) || corruptErr.File != path {
+		t.Fatalf("got %v, want a CorruptRegistrationError naming %s", err, path)
+	}
+	if fileData, _ := os.ReadFile(path); string(fileData) != `{"type": "mem` {
+		t.Fatalf("corrupted registration changed to %q without WithResetRegistrationOnCorrupt", fileData)
+	}
+}
+
+func TestCorruptRegistrationIsReset(t *testing.T) {
+	registrationDir := t.TempDir()
+	path := writeRegistration(t, registrationDir, "file", "not json")
+	logger := &recordingLogger{}
+	manager, err := wsm.NewSessionManager("memory", "session_reset", 60, wsm.WithRegistrationDir(registrationDir),
+		wsm.WithResetRegistrationOnCorrupt(true), wsm.WithLogger(logger))
+	if err != nil {
+		t.Fatalf("corrupted registration not reset: %v", err)
+	}
+	manager.Stop()
+	if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("corrupted registration kept: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(registrationDir, "memory.json")); err != nil {
+		t.Fatalf("requested storage media not registered: %v", err)
+	}
+	if len(logger.lines) != 1 {
+		t.Fatalf("logged %q, want the reset", logger.lines)
+	}
+	manager, err = wsm.NewSessionManager("memory", "session_reset", 60, wsm.WithRegistrationDir(registrationDir))
+	if err != nil {
+		t.Fatalf("rewritten registration not accepted: %v", err)
+	}
+	manager.Stop()
+}
+
+func TestStorageMediaMismatchFailsWithoutPrompting(t *testing.T) {
+	registrationDir := t.TempDir()
+	path := writeRegistration(t, registrationDir, "file", `{"type": "file"}`)
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinWriter.Close()
+	stdin := os.Stdin
+	os.Stdin = stdinReader
+	defer func() { os.Stdin = stdin }()
+	failed := make(chan error, 1)
+	go func() {
+		_, err := wsm.NewSessionManager("memory", "session_mismatch", 60, wsm.WithRegistrationDir(registrationDir))
+		failed <- err
+	}()
+	select {
+	case err = <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewSessionManager is waiting on the standard input")
+	}
+	if !errors.Is(err, wsm.ErrStorageMediaMismatch) {
+		t.Fatalf("got %v, want ErrStorageMediaMismatch", err)
+	}
+	if fileData, _ := os.ReadFile(path); string(fileData) != `{"type": "file"}` {
+		t.Fatalf("registration changed to %q by a mismatch", fileData)
+	}
+	if _, err = os.Stat(filepath.Join(registrationDir, "memory.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("requested storage media registered despite the mismatch: %v", err)
+	}
+}
+
+func TestStorageMediaMismatchErrorNamesBothTypes(t *testing.T) {
+	registrationDir := t.TempDir()
+	writeRegistration(t, registrationDir, "file", `{"type": "file"}`)
+	_, err := wsm.NewSessionManager("memory", "session_mismatch", 60, wsm.WithRegistrationDir(registrationDir))
+	var mismatchErr *wsm.StorageMediaMismatchError
+	if !errors.As(err, &mismatchErr) {
+		t.Fatalf("got %v, want a StorageMediaMismatchError", err)
+	}
+	if mismatchErr.Registered != "file" || mismatchErr.Requested != "memory" {
+		t.Fatalf("got the registered %q and requested %q types, want file and memory", mismatchErr.Registered, mismatchErr.Requested)
+	}
+}
+
+func TestForceStorageMediaMovesTheRegisteredSessions(t *testing.T) {
+	registrationDir := t.TempDir()
+	path := writeRegistration(t, registrationDir, "bolt", `{"type": "bolt"}`)
+	config := bolt_storage.BoltConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}
+	registered, err := bolt_storage.NewBoltStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := registered.InitializeSession("moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	if err = registered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manager, err := wsm.NewSessionManager("memory", "session_forced", 60, wsm.WithRegistrationDir(registrationDir),
+		wsm.WithBoltConfig(config), wsm.ForceStorageMedia())
+	if err != nil {
+		t.Fatalf("mismatch not bypassed by ForceStorageMedia: %v", err)
+	}
+	defer manager.Stop()
+	if session, err = manager.LookupSession("moved"); err != nil || session.GetValue("username") != "zyrx" {
+		t.Fatalf("registered session not moved: error %v", err)
+	}
+	if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("registration of the old storage media kept: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(registrationDir, "memory.json")); err != nil {
+		t.Fatalf("requested storage media not registered: %v", err)
+	}
+}
+
+func TestRegistrationFailuresAreReturned(t *testing.T) {
+	registrationDir := filepath.Join(t.TempDir(), "registration")
+	if err := os.WriteFile(registrationDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manager, err := wsm.NewSessionManager("memory", "session_unwritable", 60, wsm.WithRegistrationDir(registrationDir))
+	if err == nil {
+		manager.Stop()
+		t.Fatal("expected an error for a registration directory that is a file")
+	}
+	if !strings.HasPrefix(err.Error(), "wsm: ") {
+		t.Fatalf("got %q, want an error of the manager", err)
+	}
+}
+
+func TestRegistrationDirIsCreatedAndKeepsTheRegistration(t *testing.T) {
+	registrationDir := filepath.Join(t.TempDir(), "nested", "registration")
+	manager, err := wsm.NewSessionManager("memory", "session_registered", 60, wsm.WithRegistrationDir(registrationDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Stop()
+	if _, err = os.Stat(filepath.Join(registrationDir, "memory.json")); err != nil {
+		t.Fatalf("storage media not registered in the registration directory: %v", err)
+	}
+	_, err = wsm.NewSessionManager("file", "session_registered", 60, wsm.WithRegistrationDir(registrationDir))
+	var mismatchErr *wsm.StorageMediaMismatchError
+	if !errors.As(err, &mismatchErr) || mismatchErr.Registered != "memory" {
+		t.Fatalf("got %v, want the registration of the directory to be read back", err)
+	}
+	if _, err = wsm.NewSessionManager("memory", "session_registered", 60, wsm.WithRegistrationDir("")); err == nil {
+		t.Fatal("expected an error for an empty registration directory")
+	}
+}
+
+func TestNewSessionManagerWithStorageRegistersNothing(t *testing.T) {
+	registrationDir := filepath.Join(t.TempDir(), "registration")
+	first, err := wsm.NewSessionManagerWithStorage(&memory_storage.MemoryStorage{}, "session_first",
+		wsm.WithRegistrationDir(registrationDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Stop()
+	second, err := wsm.NewSessionManagerWithStorage(&file_storage.FileStorage{Directory: t.TempDir()}, "session_second",
+		wsm.WithRegistrationDir(registrationDir))
+	if err != nil {
+		t.Fatalf("second manager of another storage media type not created: %v", err)
+	}
+	defer second.Stop()
+	if _, err = os.Stat(registrationDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("registration directory written by NewSessionManagerWithStorage: %v", err)
+	}
+	sessionId := startSessions(t, first, 1)[0]
+	if _, err = second.LookupSession(sessionId); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for a session of the other manager, want SessionNotExist", err)
+	}
+}
@@ -0,0 +1,202 @@
+// Package retry_storage provides a storage media decorator retrying operations failing with transient errors,
+// in front of network storage media such as postgres or memcached.
+package retry_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"time"
+)
+
+// RetryPolicy configures the retries of a RetryStorage.
+// MaxAttempts caps the number of calls of an operation, the first one included.
+// The delay before each retry starts at InitialBackoff and doubles after every attempt, up to MaxBackoff
+// when it's set. IsTransient reports whether an error is worth retrying, every error is when it's nil.
+// A wsm.SessionNotExists error is never retried.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	IsTransient    func(err error) bool
+}
+
+// RetryStorage represents a storage media wrapping another one, retrying the retrieval, destruction,
+// and last access update of sessions, and the queries of the sessions of a user or value, when they fail
+// with a transient error, following its retry policy. The other operations are called once.
+// The optional interfaces of the wrapped storage media, such as abstract_definition.UserIndex
+// and abstract_definition.ValueIndex, are forwarded to it.
+type RetryStorage struct {
+	abstract_definition.StorageMedia
+	policy RetryPolicy
+	sleep  func(duration time.Duration)
+}
+
+// NewRetryStorage is a function that initializes a RetryStorage in front of the given storage media,
+// following the given retry policy.
+// It returns an error if the storage media is nil, the maximum attempts are not greater than zero,
+// or a backoff is negative.
+func NewRetryStorage(storage abstract_definition.StorageMedia, policy RetryPolicy) (*RetryStorage, error) {
+	if storage == nil {
+		return nil, errors.New("wsm: retried storage media must not be nil")
+	}
+	if policy.MaxAttempts <= 0 {
+		return nil, fmt.Errorf("wsm: retry maximum attempts must be greater than zero, got %d", policy.MaxAttempts)
+	}
+	if policy.InitialBackoff < 0 || policy.MaxBackoff < 0 {
+		return nil, fmt.Errorf("wsm: retry backoffs must not be negative, got %v and %v", policy.InitialBackoff, policy.MaxBackoff)
+	}
+	return &RetryStorage{StorageMedia: storage, policy: policy, sleep: time.Sleep}, nil
+}
+
+// retry is a method for RetryStorage that calls an operation until it succeeds, fails with an error
+// that is not transient, or reaches the maximum attempts, returning its last error.
+func (storage *RetryStorage) retry(operation func() error) error {
+	backoff := storage.policy.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = operation()
+		if err == nil || attempt >= storage.policy.MaxAttempts || !storage.isTransient(err) {
+			return err
+		}
+		storage.sleep(backoff)
+		backoff *= 2
+		if storage.policy.MaxBackoff > 0 && backoff > storage.policy.MaxBackoff {
+			backoff = storage.policy.MaxBackoff
+		}
+	}
+}
+
+// isTransient is a method for RetryStorage that reports whether an error is worth retrying.
+func (storage *RetryStorage) isTransient(err error) bool {
+	if errors.Is(err, abstract_definition.SessionNotExist) {
+		return false
+	}
+	return storage.policy.IsTransient == nil || storage.policy.IsTransient(err)
+}
+
+// RetrieveSession is a method for RetryStorage that retrieves a session from the wrapped storage media,
+// retrying on transient errors.
+func (storage *RetryStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	var session abstract_definition.Session
+	err := storage.retry(func() (err error) {
+		session, err = storage.StorageMedia.RetrieveSession(sessionId)
+		return err
+	})
+	return session, err
+}
+
+// RetrieveSessionAndTouch is a method for RetryStorage that retrieves a session from the wrapped storage media
+// updating its last access time, retrying on transient errors.
+func (storage *RetryStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	var session abstract_definition.Session
+	err := storage.retry(func() (err error) {
+		session, err = storage.StorageMedia.RetrieveSessionAndTouch(sessionId)
+		return err
+	})
+	return session, err
+}
+
+// UpdateSessionLastAccess is a method for RetryStorage that updates the session's last access time
+// in the wrapped storage media, retrying on transient errors.
+func (storage *RetryStorage) UpdateSessionLastAccess(sessionId string) error {
+	return storage.retry(func() error {
+		return storage.StorageMedia.UpdateSessionLastAccess(sessionId)
+	})
+}
+
+// DestroySession is a method for RetryStorage that deletes a session from the wrapped storage media,
+// retrying on transient errors. A retry may return a wsm.SessionNotExists error if a failed attempt
+// did delete the session.
+func (storage *RetryStorage) DestroySession(sessionId string) error {
+	return storage.retry(func() error {
+		return storage.StorageMedia.DestroySession(sessionId)
+	})
+}
+
+// SetClock is a method for RetryStorage that passes the clock to the wrapped storage media
+// if it reads the current time from a clock.
+func (storage *RetryStorage) SetClock(clock abstract_definition.Clock) {
+	if clockSetter, isClockSetter := storage.StorageMedia.(abstract_definition.ClockSetter); isClockSetter {
+		clockSetter.SetClock(clock)
+	}
+}
+
+// SetMaxLifetime is a method for RetryStorage that passes the maximum lifetime to the wrapped storage media
+// if it needs it.
+func (storage *RetryStorage) SetMaxLifetime(maxLifetime time.Duration) {
+	if lifetimeSetter, isLifetimeSetter := storage.StorageMedia.(abstract_definition.LifetimeSetter); isLifetimeSetter {
+		lifetimeSetter.SetMaxLifetime(maxLifetime)
+	}
+}
+
+// SetMaxSessionBytes is a method for RetryStorage that passes the maximum size of sessions to the wrapped storage media
+// if it can limit it.
+func (storage *RetryStorage) SetMaxSessionBytes(maxBytes int) {
+	if sizeLimiter, isSizeLimiter := storage.StorageMedia.(abstract_definition.SizeLimiter); isSizeLimiter {
+		sizeLimiter.SetMaxSessionBytes(maxBytes)
+	}
+}
+
+// SetExpiryBatchSize is a method for RetryStorage that passes the expiry batch size to the wrapped storage media
+// if it can terminate sessions in chunks.
+func (storage *RetryStorage) SetExpiryBatchSize(batchSize int) {
+	if expiryBatcher, isExpiryBatcher := storage.StorageMedia.(abstract_definition.ExpiryBatcher); isExpiryBatcher {
+		expiryBatcher.SetExpiryBatchSize(batchSize)
+	}
+}
+
+// SetSessionUserID is a method for RetryStorage that associates a session with a user in the wrapped storage media.
+// It returns an abstract_definition.ErrNotSupported error if the wrapped storage media can't associate sessions
+// with users.
+func (storage *RetryStorage) SetSessionUserID(sessionId, userID string) error {
+	userIndex, indexesUsers := storage.StorageMedia.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return abstract_definition.ErrNotSupported
+	}
+	return userIndex.SetSessionUserID(sessionId, userID)
+}
+
+// UserSessionIDs is a method for RetryStorage that returns the IDs of the sessions associated with a user
+// in the wrapped storage media, retrying on transient errors. It returns an abstract_definition.ErrNotSupported error
+// if the wrapped storage media can't associate sessions with users.
+func (storage *RetryStorage) UserSessionIDs(userID string) ([]string, error) {
+	userIndex, indexesUsers := storage.StorageMedia.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	var sessionIds []string
+	err := storage.retry(func() (err error) {
+		sessionIds, err = userIndex.UserSessionIDs(userID)
+		return err
+	})
+	return sessionIds, err
+}
+
+// SessionIDsByValue is a method for RetryStorage that returns the IDs of the sessions holding the value under the key
+// in the wrapped storage media, retrying on transient errors. It returns an abstract_definition.ErrNotSupported error
+// if the wrapped storage media can't query sessions by their values.
+func (storage *RetryStorage) SessionIDsByValue(ctx context.Context, key string, value interface{}) ([]string, error) {
+	valueIndex, indexesValues := storage.StorageMedia.(abstract_definition.ValueIndex)
+	if !indexesValues {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	var sessionIds []string
+	err := storage.retry(func() (err error) {
+		sessionIds, err = valueIndex.SessionIDsByValue(ctx, key, value)
+		return err
+	})
+	return sessionIds, err
+}
+
+// TerminateExpiredSessions is a method for RetryStorage that terminates expired sessions in the wrapped
+// storage media, and returns the IDs of the terminated sessions.
+// It returns an abstract_definition.ErrNotSupported error if the wrapped storage media can't report them.
+func (storage *RetryStorage) TerminateExpiredSessions(maxLifetime time.Duration) ([]string, error) {
+	expiryReporter, reportsExpiry := storage.StorageMedia.(abstract_definition.ExpiryReporter)
+	if !reportsExpiry {
+		return nil, abstract_definition.ErrNotSupported
+	}
+	return expiryReporter.TerminateExpiredSessions(maxLifetime)
+}
@@ -0,0 +1,134 @@
+package retry_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/memory_storage"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("fake: storage unavailable")
+
+// flakyStorage is a memory storage media whose retrievals and user queries fail with failWith, for their first
+// failures calls, counting every call.
+type flakyStorage struct {
+	*memory_storage.MemoryStorage
+	failures int
+	failWith error
+	calls    int
+}
+
+func (storage *flakyStorage) fail() error {
+	storage.calls++
+	if storage.calls <= storage.failures {
+		return storage.failWith
+	}
+	return nil
+}
+
+func (storage *flakyStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	if err := storage.fail(); err != nil {
+		return nil, err
+	}
+	return storage.MemoryStorage.RetrieveSession(sessionId)
+}
+
+func (storage *flakyStorage) UserSessionIDs(userID string) ([]string, error) {
+	if err := storage.fail(); err != nil {
+		return nil, err
+	}
+	return storage.MemoryStorage.UserSessionIDs(userID)
+}
+
+// newRetryStorage returns a RetryStorage around the flaky storage, recording its backoffs instead of sleeping.
+func newRetryStorage(t *testing.T, storage *flakyStorage, policy RetryPolicy) (*RetryStorage, *[]time.Duration) {
+	t.Helper()
+	retried, err := NewRetryStorage(storage, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backoffs []time.Duration
+	retried.sleep = func(duration time.Duration) { backoffs = append(backoffs, duration) }
+	return retried, &backoffs
+}
+
+func TestTransientErrorsAreRetriedWithCappedBackoff(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: &memory_storage.MemoryStorage{}, failures: 4, failWith: errUnavailable}
+	if _, err := storage.MemoryStorage.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	retried, backoffs := newRetryStorage(t, storage,
+		RetryPolicy{MaxAttempts: 10, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 25 * time.Millisecond})
+	if _, err := retried.RetrieveSession("id"); err != nil {
+		t.Fatalf("session not retrieved once the storage recovered: %v", err)
+	}
+	if storage.calls != 5 {
+		t.Fatalf("retrieved %d times, want 4 failures and a success", storage.calls)
+	}
+	if fmt.Sprint(*backoffs) != "[10ms 20ms 25ms 25ms]" {
+		t.Fatalf("backed off %v, want doubling backoffs capped at 25ms", *backoffs)
+	}
+}
+
+func TestMaxAttemptsReturnsTheLastError(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: &memory_storage.MemoryStorage{}, failures: 10, failWith: errUnavailable}
+	retried, backoffs := newRetryStorage(t, storage, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	if _, err := retried.UserSessionIDs("user"); !errors.Is(err, errUnavailable) {
+		t.Fatalf("got %v, want the last error of the storage", err)
+	}
+	if storage.calls != 3 || len(*backoffs) != 2 {
+		t.Fatalf("called %d times with backoffs %v, want 3 attempts", storage.calls, *backoffs)
+	}
+}
+
+func TestPermanentErrorsAreNotRetried(t *testing.T) {
+	errPermanent := errors.New("fake: permission denied")
+	isTransient := func(err error) bool { return errors.Is(err, errUnavailable) }
+	for _, failWith := range []error{abstract_definition.SessionNotExist, errPermanent} {
+		storage := &flakyStorage{MemoryStorage: &memory_storage.MemoryStorage{}, failures: 10, failWith: failWith}
+		retried, backoffs := newRetryStorage(t, storage, RetryPolicy{MaxAttempts: 5, IsTransient: isTransient})
+		if _, err := retried.RetrieveSession("id"); !errors.Is(err, failWith) {
+			t.Fatalf("got %v, want %v", err, failWith)
+		}
+		if storage.calls != 1 || len(*backoffs) != 0 {
+			t.Fatalf("%v retried: called %d times", failWith, storage.calls)
+		}
+	}
+	storage := &flakyStorage{MemoryStorage: &memory_storage.MemoryStorage{}, failures: 10, failWith: abstract_definition.SessionNotExist}
+	retried, _ := newRetryStorage(t, storage, RetryPolicy{MaxAttempts: 5})
+	if _, err := retried.RetrieveSession("id"); !errors.Is(err, abstract_definition.SessionNotExist) || storage.calls != 1 {
+		t.Fatalf("got %v after %d calls, want SessionNotExist never retried without IsTransient", err, storage.calls)
+	}
+}
+
+func TestOptionalInterfacesAreForwarded(t *testing.T) {
+	storage := &flakyStorage{MemoryStorage: &memory_storage.MemoryStorage{}, failures: 1, failWith: errUnavailable}
+	if _, err := storage.MemoryStorage.InitializeSession("id"); err != nil {
+		t.Fatal(err)
+	}
+	retried, _ := newRetryStorage(t, storage, RetryPolicy{MaxAttempts: 2})
+	if err := retried.SetSessionUserID("id", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := retried.UserSessionIDs("user"); err != nil || fmt.Sprint(ids) != "[id]" {
+		t.Fatalf("listed %v, error %v, want the session of the user once retried", ids, err)
+	}
+	if _, err := retried.SessionIDsByValue(context.Background(), "role", "admin"); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Fatalf("got %v from a storage media without value index, want ErrNotSupported", err)
+	}
+}
+
+func TestInvalidPoliciesAreRejected(t *testing.T) {
+	storage := &memory_storage.MemoryStorage{}
+	for _, policy := range []RetryPolicy{{}, {MaxAttempts: 1, InitialBackoff: -time.Second}, {MaxAttempts: 1, MaxBackoff: -time.Second}} {
+		if _, err := NewRetryStorage(storage, policy); err == nil {
+			t.Errorf("policy %+v accepted", policy)
+		}
+	}
+	if _, err := NewRetryStorage(nil, RetryPolicy{MaxAttempts: 1}); err == nil {
+		t.Fatal("nil storage media accepted")
+	}
+}
@@ -3,98 +3,213 @@
 package wsm_backup
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/bolt_storage"
+	"local/zyrx/backup/cookie_storage"
+	"local/zyrx/backup/dynamodb_storage"
 	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memcached_storage"
 	"local/zyrx/backup/memory_storage"
 	"local/zyrx/backup/postgres_storage"
-	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 // SessionManager provides a general way to manage sessions by maintaining a unique session ID,
-// keeping a single session per user, storing sessions in a supported storage media,
+// keeping a single session per browser, optionally associating several sessions with a user,
+// storing sessions in a supported storage media,
 // handle sessions expiration through lifetimes and correct cleanup.
+// Requests are handled concurrently under its read lock, relying on the storage media for the safety of
+// sessions, its write lock is only taken to change its own state, e.g. to replace its storage media on migration.
 type SessionManager struct {
-	sync.Mutex
-	cookieName   string
-	storageMedia abstract_definition.StorageMedia
-	maxLifetime  int64
+	sync.RWMutex
+	cookieName                 string
+	namespace                  string
+	storageMedia               abstract_definition.StorageMedia
+	maxLifetime                time.Duration
+	idGenerator                IDGenerator
+	idLength                   int
+	auditSink                  AuditSink
+	auditActor                 func(request *http.Request) string
+	metricsObserver            MetricsObserver
+	logger                     Logger
+	clock                      abstract_definition.Clock
+	forceStorageMedia          bool
+	resetRegistrationOnCorrupt bool
+	opaqueTokens               bool
+	subscribers                sessionEventSubscribers
+	sessionEventHandler        func(event SessionEvent)
+	cookiePaddingBlockSize     int
+	cookieSigningKey           []byte
+	registrationDir            string
+	renewOnMissing             bool
+	rollingCookie              bool
+	cookieMaxAge               int
+	cookieMaxAgeSet            bool
+	sessionCookie              bool
+	cookieSameSite             http.SameSite
+	cookieSecure               bool
+	cookieSecureSet            bool
+	insecureCookieForLocalDev  bool
+	cookiePath                 string
+	cookieDomain               string
+	uniqueCookieName           bool
+	cookieNameRegistered       bool
+	hashedStorageKeys          bool
+	maxSessionBytes            int
+	expiryBatchSize            int
+	tokenHeaderName            string
+	expiryInterval             time.Duration
+	storageMediaSettings       map[string][]storageMediaSetting
+	expirationStop             chan struct{}
+	expirationStopped          bool
 }
 
-// supportedStorageMedia is a map of built-in storage media types mapped to a string key (indicator).
-var supportedStorageMedia = map[string]abstract_definition.StorageMedia{
-	"memory":   &memory_storage.MemoryStorage{},
-	"file":     &file_storage.FileStorage{},
-	"postgres": &postgres_storage.PostgresStorage{},
+// supportedStorageMedia is a map of the constructors of built-in storage media types mapped to a string key (indicator).
+// Each SessionManager builds its own instance, so the options of one never change the storage media of another.
+var supportedStorageMedia = map[string]func() abstract_definition.StorageMedia{
+	"memory":    func() abstract_definition.StorageMedia { return &memory_storage.MemoryStorage{} },
+	"file":      func() abstract_definition.StorageMedia { return &file_storage.FileStorage{} },
+	"postgres":  func() abstract_definition.StorageMedia { return &postgres_storage.PostgresStorage{} },
+	"cookie":    func() abstract_definition.StorageMedia { return &cookie_storage.CookieStorage{} },
+	"memcached": func() abstract_definition.StorageMedia { return &memcached_storage.MemcachedStorage{} },
+	"dynamodb":  func() abstract_definition.StorageMedia { return &dynamodb_storage.DynamoDBStorage{} },
+	"bolt":      func() abstract_definition.StorageMedia { return &bolt_storage.BoltStorage{} },
+}
+
+// ErrStorageMediaOptionUnused is an error used when an option of a built-in storage media is given
+// to a SessionManager that doesn't build a storage media of that type, the option having no effect.
+var ErrStorageMediaOptionUnused = errors.New("wsm: option given for a storage media the session manager doesn't use")
+
+// storageMediaSetting is a function applying a setting given by an option to a built-in storage media
+// built for the SessionManager. It returns an error if the setting could not be applied.
+type storageMediaSetting func(storageMedia abstract_definition.StorageMedia) error
+
+// ErrStorageMediaMismatch is an error used when the requested storage media type differs from the registered one.
+var ErrStorageMediaMismatch = errors.New("wsm: requested storage media type differs from the registered one")
+
+// StorageMediaMismatchError is the error returned when the requested storage media type differs from the registered one,
+// holding both type names so the caller can decide what to do, e.g. retry with the ForceStorageMedia option.
+// It wraps ErrStorageMediaMismatch.
+type StorageMediaMismatchError struct {
+	Registered string
+	Requested  string
+}
+
+// Error is a method for StorageMediaMismatchError that describes the mismatch with both type names.
+func (err *StorageMediaMismatchError) Error() string {
+	return fmt.Sprintf("%v: registered %s, requested %s", ErrStorageMediaMismatch, err.Registered, err.Requested)
+}
+
+// Unwrap is a method for StorageMediaMismatchError that returns ErrStorageMediaMismatch,
+// so errors.Is matches it.
+func (err *StorageMediaMismatchError) Unwrap() error {
+	return ErrStorageMediaMismatch
+}
+
+// ErrCorruptRegistration is an error used when the file of the registered storage media can't be decoded,
+// e.g. after being truncated or edited by hand.
+var ErrCorruptRegistration = errors.New("wsm: the registered storage media file is corrupted")
+
+// CorruptRegistrationError is the error returned when the file of the registered storage media can't be decoded,
+// holding its path so operators can delete it, or the WithResetRegistrationOnCorrupt option can be set to rewrite it,
+// and the decoding error. It wraps ErrCorruptRegistration.
+type CorruptRegistrationError struct {
+	File string
+	Err  error
+}
+
+// Error is a method for CorruptRegistrationError that describes the corruption with the path of the file.
+func (err *CorruptRegistrationError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrCorruptRegistration, err.File, err.Err)
+}
+
+// Unwrap is a method for CorruptRegistrationError that returns ErrCorruptRegistration,
+// so errors.Is matches it.
+func (err *CorruptRegistrationError) Unwrap() error {
+	return ErrCorruptRegistration
 }
 
 // supportedStorageMediaTypes is a slice of the currently supported storage media types in the package.
 // Used to be displayed on the error of unsupported storage media type.
-var supportedStorageMediaTypes = []string{"memory", "file", "postgres"}
+var supportedStorageMediaTypes = []string{"memory", "file", "postgres", "cookie", "memcached", "dynamodb", "bolt"}
 
 // RegisteredStorageMedia is the storage media type that has already been used
 type RegisteredStorageMedia struct {
 	StorageMediaType string                           `json:"type"`
-	StorageMedia     abstract_definition.StorageMedia `json:"storage-media"`
+	StorageMedia     abstract_definition.StorageMedia `json:"-"`
 	//SessionType      Session      `json:"session-type"`
 }
 
-// sessionStorage checks for a json file holding the last registered storage media to retrieve it.
-// If it exists and the storage media type passed as an argument match, it gets retrieved,
-// otherwise a message prompts asking to confirm the replacement of the old storage with all its data
-// with the new one.
+// defaultRegistrationDir is the directory the registered storage media is written in,
+// relative to the working directory, unless the WithRegistrationDir option is set.
+const defaultRegistrationDir = "registered_storage"
+
+// sessionStorage is a method for SessionManager that checks for a json file holding the last registered
+// storage media in the registration directory to retrieve it.
+// If it exists and the storage media type passed as an argument match, the provided storage media is kept,
+// otherwise a StorageMediaMismatchError error is returned, unless the ForceStorageMedia option is set,
+// in which case the old storage, built with the settings of its type given to the manager, is replaced
+// with the new one, moving all its sessions through ChangeStorageMedia.
 // If the json file doesn't exist, it registers the provided storage media type if it is supported,
-// if it's not supported it returns an error.
-func sessionStorage(storageMediaType string, storageMedia abstract_definition.StorageMedia) (abstract_definition.StorageMedia, error) {
-	fileMatches, err := filepath.Glob("registered_storage/*.json")
+// creating the registration directory if needed, if it's not supported it returns an error.
+// A json file that can't be decoded fails with a CorruptRegistrationError, unless the WithResetRegistrationOnCorrupt
+// option is set, in which case it's replaced by the registration of the provided storage media type.
+// It returns an error if the registration could not be read or written, or if options were given
+// for a storage media type that is neither the registered nor the provided one.
+func (manager *SessionManager) sessionStorage(storageMediaType string, storageMedia abstract_definition.StorageMedia) (abstract_definition.StorageMedia, error) {
+	fileMatches, err := filepath.Glob(filepath.Join(manager.registrationDir, "*.json"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("wsm: could not look for the registered storage media: %w", err)
+	}
+	if fileMatches, err = manager.dropCorruptRegistration(fileMatches); err != nil {
+		return nil, err
 	}
 	if fileMatches != nil {
-		fileName := strings.Split(strings.Split(fileMatches[0], "\\")[1], ".")[0]
-		file, err := os.Open(fileMatches[0])
-		if err != nil {
-			log.Fatal(err)
+		fileName := strings.TrimSuffix(filepath.Base(fileMatches[0]), filepath.Ext(fileMatches[0]))
+		if _, registeredStorageSupported := supportedStorageMedia[fileName]; !registeredStorageSupported {
+			return nil, fmt.Errorf("wsm: unsupported registered storage media type %v", fileName)
+		}
+		if fileName == storageMediaType {
+			if err = manager.checkStorageMediaSettings(); err != nil {
+				return nil, err
+			}
+			return storageMedia, nil
+		}
+		if !manager.forceStorageMedia {
+			return nil, &StorageMediaMismatchError{Registered: fileName, Requested: storageMediaType}
 		}
-		defer file.Close()
-		fileData, err := io.ReadAll(file)
+		// The storage media instance can't be decoded from its json representation,
+		// so the registered storage media is a new one of its type, with the settings given to this manager.
+		registeredStorage, err := manager.newStorageMedia(fileName)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		var registeredStorageMedia RegisteredStorageMedia
-		err = json.Unmarshal(fileData, &registeredStorageMedia)
+		if err = manager.checkStorageMediaSettings(); err == nil {
+			err = ChangeStorageMedia(registeredStorage, storageMedia)
+		}
+		closeStorageMedia(registeredStorage)
 		if err != nil {
-			log.Fatal(err)
-		}
-		if fileName != storageMediaType {
-			fmt.Printf("Would you like to change storage type from %s to %s? ", fileName, storageMediaType)
-			var answer string
-			_, err = fmt.Scan(&answer)
-			if err != nil {
-				log.Fatal(err)
-			}
-			answer = strings.ToLower(answer)
-			if answer == "yes" || answer == "y" {
-				// ChangeStorageMedia(oldStorageType, newStorageType)
-				// Here we use this function to perform the transformation of sessions data from the old
-				// to the new storage media type.
-			} else {
-				return registeredStorageMedia.StorageMedia, nil
-			}
-		} else {
-			return registeredStorageMedia.StorageMedia, nil
+			return nil, err
+		}
+		if err = os.Remove(fileMatches[0]); err != nil {
+			return nil, fmt.Errorf("wsm: could not remove the old registered storage media: %w", err)
 		}
+		manager.logger.Printf("wsm: changed storage media from %s to %s", fileName, storageMediaType)
+	} else if err = manager.checkStorageMediaSettings(); err != nil {
+		return nil, err
 	}
 	registeredStorageMedia := RegisteredStorageMedia{
 		StorageMediaType: storageMediaType,
@@ -102,78 +217,349 @@ func sessionStorage(storageMediaType string, storageMedia abstract_definition.St
 	}
 	jsonRepresentation, err := json.MarshalIndent(registeredStorageMedia, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("wsm: could not encode the registered storage media: %w", err)
 	}
-	file, err := os.Create(fmt.Sprintf("registered_storage/%s.json", storageMediaType))
-	if err != nil {
-		log.Fatal(err)
+	if err = os.MkdirAll(manager.registrationDir, 0755); err != nil {
+		return nil, fmt.Errorf("wsm: could not create the registration directory: %w", err)
 	}
-	defer file.Close()
-	_, err = file.Write(jsonRepresentation)
+	err = os.WriteFile(filepath.Join(manager.registrationDir, storageMediaType+".json"), jsonRepresentation, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("wsm: could not write the registered storage media: %w", err)
 	}
 	return storageMedia, nil
 }
 
-// NewSessionManager is a function that initializes a new SessionManager,
-// setting its storage media to either memory, file, or postgres,
-// the cookie it's going to be sent in, and its maximum lifetime.
-// It returns an error in case the storage media type is not supported.
-func NewSessionManager(storageMediaType, cookieName string, maxLifetime int64) (*SessionManager, error) {
+// dropCorruptRegistration is a method for SessionManager used by sessionStorage to decode the first of the json files
+// of the registered storage media, returning them as is if it's valid. If it can't be decoded it returns
+// a CorruptRegistrationError, or with the WithResetRegistrationOnCorrupt option, removes it and checks the next one,
+// returning the files left.
+// It returns an error if a file could not be read or removed.
+func (manager *SessionManager) dropCorruptRegistration(fileMatches []string) ([]string, error) {
+	for len(fileMatches) > 0 {
+		fileData, err := os.ReadFile(fileMatches[0])
+		if err != nil {
+			return nil, fmt.Errorf("wsm: could not read the registered storage media: %w", err)
+		}
+		var registeredStorageMedia RegisteredStorageMedia
+		if err = json.Unmarshal(fileData, &registeredStorageMedia); err == nil {
+			return fileMatches, nil
+		}
+		corruptErr := &CorruptRegistrationError{File: fileMatches[0], Err: err}
+		if !manager.resetRegistrationOnCorrupt {
+			return nil, corruptErr
+		}
+		if err = os.Remove(fileMatches[0]); err != nil {
+			return nil, fmt.Errorf("wsm: could not remove the corrupted registered storage media: %w", err)
+		}
+		manager.logger.Printf("wsm: reset the registered storage media: %v", corruptErr)
+		fileMatches = fileMatches[1:]
+	}
+	return nil, nil
+}
+
+// defaultMaxLifetime is the maximum lifetime of sessions of a SessionManager created
+// by NewSessionManagerWithStorage, unless the WithMaxLifetime option is set.
+const defaultMaxLifetime = 30 * time.Minute
+
+// NewSessionManager is a function that initializes a new SessionManager like NewSessionManagerWithLifetime,
+// with its maximum lifetime given in seconds. It's kept for compatibility with callers predating time.Duration lifetimes.
+// It returns an error in case the maximum lifetime is not greater than zero, or any error of NewSessionManagerWithLifetime.
+func NewSessionManager(storageMediaType, cookieName string, maxLifetime int64, options ...Option) (*SessionManager, error) {
+	lifetime, err := secondsToLifetime(maxLifetime)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionManagerWithLifetime(storageMediaType, cookieName, lifetime, options...)
+}
+
+// NewSessionManagerWithLifetime is a function that initializes a new SessionManager,
+// setting its storage media to either memory, file, postgres, cookie, memcached, dynamodb, or bolt,
+// the cookie it's going to be sent in, its maximum lifetime, and any optional settings.
+// The maximum lifetime is only converted to seconds, truncated, for the MaxAge of session cookies.
+// The storage media is a new instance of its type, configured by the options of that type, e.g. WithFileCodec,
+// so managers of the same process never share their storage media nor its settings.
+// It returns an error in case the storage media type is not supported, the cookie name is invalid, or in use
+// with the WithUniqueCookieName option, the maximum lifetime is less than one second, an option is invalid,
+// the storage media type differs from the registered one without the ForceStorageMedia option,
+// or options of another storage media type are given, wrapping ErrStorageMediaOptionUnused.
+func NewSessionManagerWithLifetime(storageMediaType, cookieName string, maxLifetime time.Duration, options ...Option) (*SessionManager, error) {
 	storageMediaType = strings.ToLower(storageMediaType)
-	storageMedia, storageMediaSupported := supportedStorageMedia[storageMediaType]
-	if !storageMediaSupported {
+	if _, storageMediaSupported := supportedStorageMedia[storageMediaType]; !storageMediaSupported {
 		errorMessage := fmt.Errorf("wsm: unsupported storage media type %v, "+
 			"the supported storage media types are %v", storageMediaType, supportedStorageMediaTypes)
 		return nil, errorMessage
 	}
-	registeredStorage, err := sessionStorage(storageMediaType, storageMedia)
+	if err := validateMaxLifetime(maxLifetime); err != nil {
+		return nil, err
+	}
+	newSessionManager, err := newSessionManager(cookieName, maxLifetime, options)
 	if err != nil {
 		return nil, err
 	}
-	newSessionManager := &SessionManager{
-		cookieName:   cookieName,
-		storageMedia: registeredStorage,
-		maxLifetime:  maxLifetime,
+	storageMedia, err := newSessionManager.newStorageMedia(storageMediaType)
+	if err != nil {
+		return nil, err
+	}
+	registeredStorage, err := newSessionManager.sessionStorage(storageMediaType, storageMedia)
+	if err != nil {
+		closeStorageMedia(storageMedia)
+		return nil, err
+	}
+	if err = newSessionManager.setStorageMedia(registeredStorage); err != nil {
+		closeStorageMedia(registeredStorage)
+		return nil, err
+	}
+	if err = newSessionManager.registerCookieName(); err != nil {
+		closeStorageMedia(registeredStorage)
+		return nil, err
 	}
 	return newSessionManager, nil
 }
 
+// NewSessionManagerWithStorage is a function that initializes a new SessionManager using the provided
+// storage media as is, without registering it on disk, so several managers with their own storage media
+// can run in the same process, e.g. in tests. Its maximum lifetime is 30 minutes unless the WithMaxLifetime
+// option is set, and options about the registration, such as ForceStorageMedia, have no effect.
+// Options of built-in storage media, such as WithFileCodec, can't change the given storage media,
+// which must be configured beforehand.
+// It returns an error in case the storage media is nil, the cookie name is invalid, or in use with the
+// WithUniqueCookieName option, an option is invalid, or an option of a built-in storage media is given,
+// wrapping ErrStorageMediaOptionUnused.
+func NewSessionManagerWithStorage(storageMedia abstract_definition.StorageMedia, cookieName string, options ...Option) (*SessionManager, error) {
+	if storageMedia == nil {
+		return nil, errors.New("wsm: storage media must not be nil")
+	}
+	newSessionManager, err := newSessionManager(cookieName, defaultMaxLifetime, options)
+	if err != nil {
+		return nil, err
+	}
+	if err = newSessionManager.checkStorageMediaSettings(); err != nil {
+		return nil, err
+	}
+	if err = newSessionManager.setStorageMedia(storageMedia); err != nil {
+		return nil, err
+	}
+	if err = newSessionManager.registerCookieName(); err != nil {
+		return nil, err
+	}
+	return newSessionManager, nil
+}
+
+// newSessionManager is a function that initializes a new SessionManager without its storage media,
+// setting the cookie it's going to be sent in, its maximum lifetime, and applying the options.
+// It returns an error in case the cookie name is not a valid RFC 6265 token or an option is invalid.
+func newSessionManager(cookieName string, maxLifetime time.Duration, options []Option) (*SessionManager, error) {
+	if err := validateCookieName(cookieName); err != nil {
+		return nil, err
+	}
+	manager := &SessionManager{
+		cookieName:      cookieName,
+		maxLifetime:     maxLifetime,
+		idLength:        32,
+		logger:          noopLogger{},
+		clock:           abstract_definition.SystemClock{},
+		registrationDir: defaultRegistrationDir,
+		cookiePath:      "/",
+		expirationStop:  make(chan struct{}),
+	}
+	manager.idGenerator = manager.generateUniqueSessionID
+	for _, option := range options {
+		if err := option(manager); err != nil {
+			return nil, err
+		}
+	}
+	if manager.namespace != "" {
+		manager.cookieName += "-" + manager.namespace
+	}
+	if err := manager.enforceCookieSecure(); err != nil {
+		return nil, err
+	}
+	if err := manager.checkHostCookieScope(); err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
+
+// newStorageMedia is a method for SessionManager that builds a new built-in storage media of the given type,
+// applying the settings given by the options of that type, which are then consumed.
+// It returns an error if a setting could not be applied, e.g. the postgres database could not be connected to.
+func (manager *SessionManager) newStorageMedia(storageMediaType string) (abstract_definition.StorageMedia, error) {
+	storageMedia := supportedStorageMedia[storageMediaType]()
+	for _, setting := range manager.storageMediaSettings[storageMediaType] {
+		if err := setting(storageMedia); err != nil {
+			closeStorageMedia(storageMedia)
+			return nil, err
+		}
+	}
+	delete(manager.storageMediaSettings, storageMediaType)
+	return storageMedia, nil
+}
+
+// checkStorageMediaSettings is a method for SessionManager that makes sure no settings given by the options
+// of built-in storage media are left unapplied, which happens when the manager doesn't build a storage media
+// of their type. It returns an error wrapping ErrStorageMediaOptionUnused naming their types otherwise.
+func (manager *SessionManager) checkStorageMediaSettings() error {
+	if len(manager.storageMediaSettings) == 0 {
+		return nil
+	}
+	unusedTypes := make([]string, 0, len(manager.storageMediaSettings))
+	for storageMediaType := range manager.storageMediaSettings {
+		unusedTypes = append(unusedTypes, storageMediaType)
+	}
+	sort.Strings(unusedTypes)
+	return fmt.Errorf("%w: %s", ErrStorageMediaOptionUnused, strings.Join(unusedTypes, ", "))
+}
+
+// closeStorageMedia is a function that closes a storage media built for a SessionManager that could not be created,
+// if it holds resources to release, such as the connection pool of the postgres storage media.
+func closeStorageMedia(storageMedia abstract_definition.StorageMedia) {
+	if closer, isCloser := storageMedia.(io.Closer); isCloser {
+		closer.Close()
+	}
+}
+
+// setStorageMedia is a method for SessionManager used to set the storage media of a new SessionManager,
+// prepared by prepareStorageMedia. It returns an error if the storage media can't be namespaced.
+func (manager *SessionManager) setStorageMedia(storageMedia abstract_definition.StorageMedia) error {
+	preparedStorageMedia, err := manager.prepareStorageMedia(storageMedia)
+	if err != nil {
+		return err
+	}
+	manager.storageMedia = preparedStorageMedia
+	return nil
+}
+
+// prepareStorageMedia is a method for SessionManager that readies a storage media to be used by the manager,
+// passing it the maximum lifetime, the clock, the maximum session size and the expiry batch size if it needs them,
+// creating the directory of the file storage media, and returning it as seen from the namespace if one is set,
+// keeping sessions under the hash of their ID with the WithHashedStorageKeys option.
+// It returns an error if the storage media can't be namespaced or hash its keys, or the directory could not be created.
+func (manager *SessionManager) prepareStorageMedia(storageMedia abstract_definition.StorageMedia) (abstract_definition.StorageMedia, error) {
+	if lifetimeSetter, isLifetimeSetter := storageMedia.(abstract_definition.LifetimeSetter); isLifetimeSetter {
+		lifetimeSetter.SetMaxLifetime(manager.maxLifetime)
+	}
+	if clockSetter, isClockSetter := storageMedia.(abstract_definition.ClockSetter); isClockSetter {
+		clockSetter.SetClock(manager.clock)
+	}
+	if sizeLimiter, isSizeLimiter := storageMedia.(abstract_definition.SizeLimiter); isSizeLimiter {
+		sizeLimiter.SetMaxSessionBytes(manager.maxSessionBytes)
+	}
+	if expiryBatcher, isExpiryBatcher := storageMedia.(abstract_definition.ExpiryBatcher); isExpiryBatcher {
+		expiryBatcher.SetExpiryBatchSize(manager.expiryBatchSize)
+	}
+	if err := manager.checkOpaqueTokens(storageMedia); err != nil {
+		return nil, err
+	}
+	if fileStorage, isFileStorage := storageMedia.(*file_storage.FileStorage); isFileStorage {
+		if err := fileStorage.CreateDirectory(); err != nil {
+			return nil, err
+		}
+	}
+	namespacedStorageMedia, err := manager.namespacedStorageMedia(storageMedia)
+	if err != nil {
+		return nil, err
+	}
+	return manager.hashedStorageMedia(namespacedStorageMedia)
+}
+
 // generateUniqueSessionID is a method for SessionManager used to generate a secure random number
 // to serve as a unique session ID for newly created sessions.
-func (manager *SessionManager) generateUniqueSessionID() string {
-	b := make([]byte, 32)
+// It's the default IDGenerator of SessionManager, and returns an error if random bytes could not be read.
+func (manager *SessionManager) generateUniqueSessionID() (string, error) {
+	b := make([]byte, manager.idLength)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
-		return ""
+		return "", fmt.Errorf("wsm: could not generate a session ID: %w", err)
 	}
-	return base64.URLEncoding.EncodeToString(b)
+	return base64.URLEncoding.EncodeToString(b), nil
 }
 
 // StartSession is a method for SessionManager used to initialize a session with a unique ID for a new user,
 // generate and set the cookie with proper values.
-// If the user already has a session, it gets retrieved based on their cookie info.
-// Returns an error if session ID could not be read from cookie or the session could not be retrieved.
-func (manager *SessionManager) StartSession(response http.ResponseWriter, request *http.Request) (abstract_definition.Session, error) {
-	manager.Lock()
-	defer manager.Unlock()
-	var session abstract_definition.Session
-	cookie, err := request.Cookie(manager.cookieName)
-	if err != nil || cookie.Value == "" {
-		sessionId := manager.generateUniqueSessionID()
-		session = manager.storageMedia.InitializeSession(sessionId)
-		cookie = &http.Cookie{Name: manager.cookieName, Value: url.QueryEscape(sessionId), Path: "/",
-			HttpOnly: true, MaxAge: int(manager.maxLifetime)}
-		http.SetCookie(response, cookie)
-	} else {
-		sessionId, err := url.QueryUnescape(cookie.Value)
-		if err != nil {
-			return nil, err
-		}
-		session, err = manager.storageMedia.RetrieveSession(sessionId)
-		if err != nil {
-			return nil, err
-		}
+// If the user already has a session, it gets retrieved based on their cookie info, and its last access time
+// is updated in the same storage media operation. With the WithRenewOnMissing option, a cookie of a session
+// that no longer exists, e.g. already terminated on expiration, gets a new session instead.
+// With the WithRollingCookie option, the cookie of a resumed session is set again with a refreshed MaxAge.
+// With the WithHeaderTokenFallback option, a request without a session cookie may carry its session in a header,
+// as do the requests given to EndSession, Touch and RefreshSession.
+// The cookie of a new session is set only after the session has been stored successfully.
+// It also reports whether the session is newly created rather than resumed, e.g. for logging or correlation.
+// Returns an error if a session ID could not be generated or read from cookie, or the session could not be retrieved.
+func (manager *SessionManager) StartSession(response http.ResponseWriter, request *http.Request) (session abstract_definition.Session, isNew bool, err error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	value := manager.requestSessionValue(request)
+	if value == "" {
+		return manager.createSession(response, request)
+	}
+	sessionId, cookieId, err := manager.cookieSessionId(value)
+	if err == nil {
+		session, err = manager.storageMedia.RetrieveSessionAndTouch(sessionId)
+	}
+	if errors.Is(err, abstract_definition.SessionNotExist) && manager.renewOnMissing {
+		return manager.createSession(response, request)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if manager.rollingCookie {
+		http.SetCookie(response, manager.newSessionCookie(cookieId, manager.sessionCookieMaxAge(), request))
+	}
+	manager.recordAudit(request, AuditActionAccess, sessionId)
+	return session, false, nil
+}
+
+// createSession is a method for SessionManager used by StartSession to store a new session with a unique ID,
+// and set its cookie once stored, carrying a new opaque token with the WithOpaqueTokens option.
+// It must be called while holding the manager read lock.
+// Returns an error if a session ID could not be generated, or the session or its token could not be stored.
+func (manager *SessionManager) createSession(response http.ResponseWriter, request *http.Request) (abstract_definition.Session, bool, error) {
+	session, err := manager.initializeSession()
+	if err != nil {
+		return nil, false, err
+	}
+	cookieId, err := manager.newCookieId(session.GetSessionId(), 0)
+	if err != nil {
+		manager.storageMedia.DestroySession(session.GetSessionId())
+		return nil, false, err
+	}
+	http.SetCookie(response, manager.newSessionCookie(cookieId, manager.sessionCookieMaxAge(), request))
+	manager.recordAudit(request, AuditActionCreate, session.GetSessionId())
+	return session, true, nil
+}
+
+// CreateSession is a method for SessionManager used to create a session outside of any HTTP handler,
+// e.g. to seed a session for a queued job, without setting any cookie. The caller hands out its ID,
+// e.g. with LookupSession on the other end. Its audit event is recorded with the AuditActorApplication actor.
+// Returns an error if a session ID could not be generated or the session could not be stored.
+func (manager *SessionManager) CreateSession() (abstract_definition.Session, error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	session, err := manager.initializeSession()
+	if err != nil {
+		return nil, err
+	}
+	manager.recordActorAudit(AuditActorApplication, AuditActionCreate, session.GetSessionId())
+	return session, nil
+}
+
+// initializeSession is a method for SessionManager used to store a new session with a unique ID,
+// emitting its creation. It must be called while holding the manager read lock.
+// Returns an error if a session ID could not be generated, is empty, or the session could not be stored.
+func (manager *SessionManager) initializeSession() (abstract_definition.Session, error) {
+	sessionId, err := manager.idGenerator()
+	if err != nil {
+		return nil, err
+	}
+	if sessionId == "" {
+		return nil, errors.New("wsm: the session ID generator returned an empty ID")
+	}
+	session, err := manager.storageMedia.InitializeSession(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	manager.emitSessionEvent(SessionCreated, sessionId)
+	if manager.metricsObserver != nil {
+		manager.metricsObserver.OnStart()
 	}
 	return session, nil
 }
@@ -181,25 +567,339 @@ func (manager *SessionManager) StartSession(response http.ResponseWriter, reques
 // EndSession is a method for SessionManager used to reset the user's session on their logout.
 // It sets the cookie provided by previously set name in SessionManager, to expired values
 // rendering the session in-active.
-func (manager *SessionManager) EndSession(response http.ResponseWriter, request *http.Request) {
-	cookie, err := request.Cookie(manager.cookieName)
-	if err != nil || cookie.Value == "" {
-		return
+// It's idempotent: a request without a session, or whose session no longer exists, e.g. a stale cookie
+// of an already ended or expired session, ends successfully. The cookie of a request carrying one is always expired.
+// It reports whether a session existed and was destroyed, telling a logout from a stale cookie.
+// It returns an error if the cookie value could not be read, or the storage media failed to destroy the session.
+func (manager *SessionManager) EndSession(response http.ResponseWriter, request *http.Request) (existed bool, err error) {
+	_, existed, err = manager.endSession(response, request, false)
+	return existed, err
+}
+
+// EndSessionWithSnapshot is a method for SessionManager used like EndSession to reset the user's session
+// on their logout, returning a copy of the session values the moment before it's destroyed, e.g. to record
+// the user ID and roles of the logout in an audit log.
+// A request without a session, or whose session no longer exists, ends successfully with a nil snapshot.
+// It returns an error if the cookie value could not be read, or the storage media failed to retrieve
+// or destroy the session, in which case the session is not destroyed.
+func (manager *SessionManager) EndSessionWithSnapshot(response http.ResponseWriter, request *http.Request) (map[interface{}]interface{}, error) {
+	snapshot, _, err := manager.endSession(response, request, true)
+	return snapshot, err
+}
+
+// endSession is a method for SessionManager used by EndSession and EndSessionWithSnapshot to end the session
+// of a request, expiring its cookie, reporting whether it existed and, if a snapshot is asked for,
+// returning a copy of its values retrieved before destroying it.
+func (manager *SessionManager) endSession(response http.ResponseWriter, request *http.Request, snapshot bool) (values map[interface{}]interface{}, existed bool, err error) {
+	value := manager.requestSessionValue(request)
+	if value == "" {
+		return nil, false, nil
 	}
-	manager.Lock()
-	defer manager.Unlock()
-	err = manager.storageMedia.DestroySession(cookie.Value)
-	expiration := time.Now()
-	cookie = &http.Cookie{Name: manager.cookieName, Path: "/", HttpOnly: true, Expires: expiration, MaxAge: -1}
-	http.SetCookie(response, cookie)
+	manager.RLock()
+	defer manager.RUnlock()
+	http.SetCookie(response, manager.newExpiredSessionCookie(request))
+	sessionId, cookieId, err := manager.cookieSessionId(value)
+	if errors.Is(err, abstract_definition.SessionNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if manager.opaqueTokens {
+		if err = manager.tokenStorage().DestroySession(cookieId); err != nil && !errors.Is(err, abstract_definition.SessionNotExist) {
+			return nil, false, err
+		}
+	}
+	if snapshot {
+		session, err := manager.storageMedia.RetrieveSession(sessionId)
+		if errors.Is(err, abstract_definition.SessionNotExist) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		values = session.Values()
+	}
+	err = manager.storageMedia.DestroySession(sessionId)
+	if errors.Is(err, abstract_definition.SessionNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	manager.recordAudit(request, AuditActionDestroy, sessionId)
+	manager.emitSessionEvent(SessionDestroyed, sessionId)
+	if manager.metricsObserver != nil {
+		manager.metricsObserver.OnEnd()
+	}
+	return values, true, nil
+}
+
+// Destroy is a method for SessionManager used to destroy a session already held, outside of any HTTP handler,
+// e.g. to log a user out from a background task. The session's cookie is left as is, and gets no session
+// from it anymore. Its audit event is recorded with the AuditActorApplication actor.
+// It returns a wsm.SessionNotExists error if the session was already destroyed.
+func (manager *SessionManager) Destroy(session abstract_definition.Session) error {
+	manager.RLock()
+	defer manager.RUnlock()
+	sessionId := session.GetSessionId()
+	if err := manager.storageMedia.DestroySession(sessionId); err != nil {
+		return err
+	}
+	manager.recordActorAudit(AuditActorApplication, AuditActionDestroy, sessionId)
+	manager.emitSessionEvent(SessionDestroyed, sessionId)
+	if manager.metricsObserver != nil {
+		manager.metricsObserver.OnEnd()
+	}
+	return nil
 }
 
 // SessionsExpirationRoutine is a method for SessionManager, used as a go routine to terminate
 // sessions after they pass their expiration date.
-// It's called periodically after the set maximum lifetime value elapsed.
+// It terminates expired sessions right away, then returns, leaving a loop started in its own goroutine
+// terminating them every expiry interval, the maximum lifetime unless set with WithExpiryInterval,
+// until Stop is called. It does nothing once Stop has been called.
 func (manager *SessionManager) SessionsExpirationRoutine() {
+	if manager.expireSessions() {
+		go manager.runExpiryLoop(context.Background())
+	}
+}
+
+// StartExpiryLoop is a method for SessionManager that starts in a goroutine the termination of expired sessions
+// right away, then every expiry interval, the maximum lifetime unless set with WithExpiryInterval,
+// until the context is cancelled or Stop is called. It does nothing once Stop has been called.
+func (manager *SessionManager) StartExpiryLoop(ctx context.Context) {
+	go func() {
+		if ctx.Err() == nil && manager.expireSessions() {
+			manager.runExpiryLoop(ctx)
+		}
+	}()
+}
+
+// expireSessions is a method for SessionManager used by the expiration loops to terminate expired sessions
+// under the read lock, reporting false without terminating them once Stop has been called.
+func (manager *SessionManager) expireSessions() bool {
+	manager.RLock()
+	defer manager.RUnlock()
+	if manager.expirationStopped {
+		return false
+	}
+	manager.terminateExpiredSessions()
+	return true
+}
+
+// runExpiryLoop is a method for SessionManager used by SessionsExpirationRoutine and StartExpiryLoop to terminate
+// expired sessions on each tick of a ticker, until the context is cancelled or Stop is called.
+// Ticks missed while expired sessions are being terminated are dropped, so runs never pile up.
+func (manager *SessionManager) runExpiryLoop(ctx context.Context) {
+	manager.RLock()
+	interval := manager.expiryInterval
+	if interval <= 0 {
+		interval = manager.maxLifetime
+	}
+	manager.RUnlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-manager.expirationStop:
+			return
+		case <-ticker.C:
+			if !manager.expireSessions() {
+				return
+			}
+		}
+	}
+}
+
+// terminateExpiredSessions is a method for SessionManager used by SessionsExpirationRoutine to terminate
+// expired sessions, reporting their number to the metrics observer and the logger, and emitting an event
+// for each expired session reported by a storage media implementing abstract_definition.ExpiryReporter.
+func (manager *SessionManager) terminateExpiredSessions() {
+	expiredSessionsCount, expiredSessionIds, err := manager.terminateSessionsOnExpiration()
+	if err != nil {
+		manager.logger.Printf("wsm: could not terminate expired sessions: %v", err)
+	}
+	for _, sessionId := range expiredSessionIds {
+		manager.recordStorageKeyAudit(AuditActorExpiration, AuditActionExpire, sessionId)
+		manager.emitSessionEvent(SessionExpired, sessionId)
+	}
+	if manager.metricsObserver != nil {
+		manager.metricsObserver.OnExpire(expiredSessionsCount)
+	}
+	if expiredSessionsCount > 0 {
+		manager.logger.Printf("wsm: terminated %d expired sessions", expiredSessionsCount)
+	}
+}
+
+// Stop is a method for SessionManager used to stop the sessions expiration loops on shutdown,
+// those of SessionsExpirationRoutine and StartExpiryLoop, after their current run if any,
+// and to release its cookie name so another session manager can use it.
+// Any later call to SessionsExpirationRoutine or StartExpiryLoop does nothing, nor does calling it again.
+func (manager *SessionManager) Stop() {
 	manager.Lock()
 	defer manager.Unlock()
-	manager.storageMedia.TerminateSessionOnExpiration(manager.maxLifetime)
-	time.AfterFunc(time.Duration(manager.maxLifetime), manager.SessionsExpirationRoutine)
+	manager.releaseCookieName()
+	if !manager.expirationStopped {
+		manager.expirationStopped = true
+		close(manager.expirationStop)
+	}
+}
+
+// Ping is a method for SessionManager used to check its storage media can be reached, e.g. for a readiness probe
+// run before serving traffic. It returns the error of the storage media if it can't be reached.
+func (manager *SessionManager) Ping(ctx context.Context) error {
+	manager.RLock()
+	defer manager.RUnlock()
+	return manager.storageMedia.Ping(ctx)
+}
+
+// LookupSession is a method for SessionManager used to retrieve a session from its ID directly,
+// independent of HTTP cookies, e.g. for WebSocket handlers or clients sending the ID as a bearer token.
+// If the session doesn't exist it returns a wsm.SessionNotExists error.
+func (manager *SessionManager) LookupSession(sessionId string) (abstract_definition.Session, error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	return manager.storageMedia.RetrieveSession(sessionId)
+}
+
+// Touch is a method for SessionManager used to extend the lifetime of the session carried by the request's cookie
+// without reading or writing its values, e.g. for a keep-alive endpoint, by updating its last access time.
+// It returns a wsm.SessionNotExists error if the request has no session cookie or its session doesn't exist,
+// or an error if the cookie value could not be read.
+func (manager *SessionManager) Touch(request *http.Request) error {
+	value := manager.requestSessionValue(request)
+	if value == "" {
+		return abstract_definition.SessionNotExist
+	}
+	manager.RLock()
+	defer manager.RUnlock()
+	sessionId, _, err := manager.cookieSessionId(value)
+	if err != nil {
+		return err
+	}
+	return manager.storageMedia.UpdateSessionLastAccess(sessionId)
+}
+
+// RefreshSession is a method for SessionManager used to extend the session carried by the request's cookie
+// in one call, e.g. for a keep-alive endpoint, updating its last access time in the same storage media operation
+// as its retrieval, and setting its cookie again with a refreshed MaxAge, whatever the WithRollingCookie option.
+// The response is needed to set the cookie, and the refreshed session is returned.
+// It returns a wsm.SessionNotExists error if the request has no session cookie or its session doesn't exist,
+// or an error if the cookie value could not be read.
+func (manager *SessionManager) RefreshSession(response http.ResponseWriter, request *http.Request) (abstract_definition.Session, error) {
+	value := manager.requestSessionValue(request)
+	if value == "" {
+		return nil, abstract_definition.SessionNotExist
+	}
+	manager.RLock()
+	defer manager.RUnlock()
+	sessionId, cookieId, err := manager.cookieSessionId(value)
+	if err != nil {
+		return nil, err
+	}
+	session, err := manager.storageMedia.RetrieveSessionAndTouch(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(response, manager.newSessionCookie(cookieId, manager.sessionCookieMaxAge(), request))
+	manager.recordAudit(request, AuditActionAccess, sessionId)
+	return session, nil
+}
+
+// ListSessions is a method for SessionManager used by administrative tooling (forced logouts, audits)
+// to enumerate the IDs of all the sessions currently stored, without loading their values.
+func (manager *SessionManager) ListSessions() ([]string, error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	sessionIds, err := manager.storageMedia.ListSessions()
+	return manager.withoutTokens(sessionIds), err
+}
+
+// ScanSessions is a method for SessionManager used by administrative tooling, such as a dashboard paging through
+// the sessions, to enumerate the IDs of the sessions currently stored a page at a time, without loading them all.
+// It returns a page of at most limit session IDs in ascending order following the cursor, empty for the first page,
+// and the cursor of the next page, empty once there's none. Pages may hold fewer session IDs than the limit
+// with the WithOpaqueTokens option, opaque tokens being left out of them.
+// It returns an abstract_definition.ErrInvalidScanLimit error if the limit is not greater than zero,
+// or an abstract_definition.ErrNotSupported error if the storage media can't enumerate its sessions.
+func (manager *SessionManager) ScanSessions(cursor string, limit int) (ids []string, next string, err error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	ids, next, err = manager.storageMedia.ScanSessions(cursor, limit)
+	return manager.withoutTokens(ids), next, err
+}
+
+// Pin is a method for SessionManager used to exempt the session belonging to the given ID from expiration,
+// e.g. for support or administration sessions that must not be reaped. The pin state is kept in the storage media.
+func (manager *SessionManager) Pin(sessionId string) error {
+	manager.RLock()
+	defer manager.RUnlock()
+	return manager.storageMedia.Pin(sessionId)
+}
+
+// Unpin is a method for SessionManager used to make a pinned session belonging to the given ID expire again.
+func (manager *SessionManager) Unpin(sessionId string) error {
+	manager.RLock()
+	defer manager.RUnlock()
+	return manager.storageMedia.Unpin(sessionId)
+}
+
+// DestroyAllSessions is a method for SessionManager used to force-logout everyone at once,
+// e.g. when a secret is rotated or a breach is detected, by destroying every session in the storage media.
+func (manager *SessionManager) DestroyAllSessions() error {
+	manager.RLock()
+	defer manager.RUnlock()
+	var sessionIds []string
+	if manager.observesSessionIds() {
+		var err error
+		if sessionIds, err = manager.storageMedia.ListSessions(); err != nil {
+			manager.logger.Printf("wsm: could not list sessions before destroying them: %v", err)
+		}
+		sessionIds = manager.withoutTokens(sessionIds)
+	}
+	if err := manager.storageMedia.DestroyAllSessions(); err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		manager.recordStorageKeyAudit(AuditActorApplication, AuditActionDestroy, sessionId)
+		manager.emitSessionEvent(SessionDestroyed, sessionId)
+		if manager.metricsObserver != nil {
+			manager.metricsObserver.OnEnd()
+		}
+	}
+	return nil
+}
+
+// Warm is a method for SessionManager used on startup to validate the entire storage media,
+// retrieving every stored session so undecodable ones are detected and logged, and so any caching layer
+// in front of the storage media gets filled. Expired sessions are terminated first, as by the expiration
+// routine, so they're neither loaded nor cached.
+// It returns the number of sessions loaded and of sessions that failed to load, and an error if the
+// sessions could not be listed or the context is done before all sessions have been retrieved.
+func (manager *SessionManager) Warm(ctx context.Context) (loaded int, failed int, err error) {
+	manager.RLock()
+	manager.terminateExpiredSessions()
+	storageMedia := keyedStorageMedia(manager.storageMedia)
+	manager.RUnlock()
+	sessionIds, err := storageMedia.ListSessions()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, sessionId := range manager.withoutTokens(sessionIds) {
+		if err = ctx.Err(); err != nil {
+			return loaded, failed, err
+		}
+		_, err = storageMedia.RetrieveSession(sessionId)
+		switch {
+		case err == nil:
+			loaded += 1
+		case !errors.Is(err, abstract_definition.SessionNotExist):
+			manager.logger.Printf("wsm: could not load a session while warming: %v", err)
+			failed += 1
+		}
+	}
+	return loaded, failed, nil
 }
@@ -0,0 +1,604 @@
+package wsm_backup_test
+
+import (
+	"context"
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memory_storage"
+	"local/zyrx/backup/wsmtest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// requestWithSession starts a session with the manager and returns its ID, and a request carrying its cookie.
+func requestWithSession(t *testing.T, manager *wsm.SessionManager) (string, *http.Request) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	session, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session.GetSessionId(), requestWithCookies(response)
+}
+
+// requestWithCookies returns a request carrying the cookies set by the response.
+func requestWithCookies(response *httptest.ResponseRecorder) *http.Request {
+	request := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range response.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+// expiresCookie reports whether the response expires the session cookie.
+func expiresCookie(response *httptest.ResponseRecorder) bool {
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == wsmtest.CookieName && cookie.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEndSessionDestroysAnExistingSession(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId, request := requestWithSession(t, manager)
+	response := httptest.NewRecorder()
+	existed, err := manager.EndSession(response, request)
+	if err != nil || !existed {
+		t.Fatalf("got existed %v and error %v, want true and nil", existed, err)
+	}
+	if storage.HasSession(sessionId) {
+		t.Fatal("ended session kept by the storage media")
+	}
+	if !expiresCookie(response) {
+		t.Fatal("session cookie not expired")
+	}
+}
+
+func TestEndSessionOfAMissingSessionSucceeds(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, request := requestWithSession(t, manager)
+	if _, err = manager.EndSession(httptest.NewRecorder(), request); err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	existed, err := manager.EndSession(response, request)
+	if err != nil || existed {
+		t.Fatalf("got existed %v and error %v for a stale cookie, want false and nil", existed, err)
+	}
+	if !expiresCookie(response) {
+		t.Fatal("stale session cookie not expired")
+	}
+	existed, err = manager.EndSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil || existed {
+		t.Fatalf("got existed %v and error %v without a cookie, want false and nil", existed, err)
+	}
+}
+
+func TestEndSessionWithSnapshotReturnsTheEndedValues(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId, request := requestWithSession(t, manager)
+	session, err := manager.LookupSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]interface{}{"user-id": "42", "roles": "admin,editor"} {
+		if err = session.SetValue(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	response := httptest.NewRecorder()
+	snapshot, err := manager.EndSessionWithSnapshot(response, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[interface{}]interface{}{"user-id": "42", "roles": "admin,editor"}
+	if !reflect.DeepEqual(snapshot, want) {
+		t.Fatalf("got the snapshot %v, want %v", snapshot, want)
+	}
+	if storage.HasSession(sessionId) || !expiresCookie(response) {
+		t.Fatal("snapshotted session not ended")
+	}
+	if snapshot, err = manager.EndSessionWithSnapshot(httptest.NewRecorder(), request); err != nil || snapshot != nil {
+		t.Fatalf("got %v, %v for a stale cookie, want a nil snapshot", snapshot, err)
+	}
+	snapshot, err = manager.EndSessionWithSnapshot(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil || snapshot != nil {
+		t.Fatalf("got %v, %v without a cookie, want a nil snapshot", snapshot, err)
+	}
+}
+
+func TestEndSessionReturnsStorageErrors(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId, request := requestWithSession(t, manager)
+	outage := errors.New("storage outage")
+	storage.FailDestroyWith(outage)
+	existed, err := manager.EndSession(httptest.NewRecorder(), request)
+	if !errors.Is(err, outage) || existed {
+		t.Fatalf("got existed %v and error %v, want false and the storage error", existed, err)
+	}
+	if !storage.HasSession(sessionId) {
+		t.Fatal("session gone although the storage media failed to destroy it")
+	}
+}
+
+func TestRenewOnMissingStartsANewSessionForAStaleCookie(t *testing.T) {
+	for _, renew := range []bool{false, true} {
+		manager, storage, err := wsmtest.NewSessionManager(wsm.WithRenewOnMissing(renew))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionId, request := requestWithSession(t, manager)
+		if err = storage.DestroySession(sessionId); err != nil {
+			t.Fatal(err)
+		}
+		response := httptest.NewRecorder()
+		session, isNew, err := manager.StartSession(response, request)
+		cookies := response.Result().Cookies()
+		if !renew {
+			if !errors.Is(err, abstract_definition.SessionNotExist) || len(cookies) != 0 {
+				t.Fatalf("got %v and cookies %v without WithRenewOnMissing, want SessionNotExist and no cookie", err, cookies)
+			}
+			manager.Stop()
+			continue
+		}
+		if err != nil || !isNew || session.GetSessionId() == sessionId {
+			t.Fatalf("stale cookie not renewed: new %v, error %v", isNew, err)
+		}
+		if len(cookies) != 1 {
+			t.Fatalf("set cookies %v, want the cookie of the new session", cookies)
+		}
+		resumed, isNew, err := manager.StartSession(httptest.NewRecorder(), requestWithCookies(response))
+		if err != nil || isNew || resumed.GetSessionId() != session.GetSessionId() {
+			t.Fatalf("renewed session not resumed from its cookie: new %v, error %v", isNew, err)
+		}
+		manager.Stop()
+	}
+}
+
+func TestMaxLifetimeIsTheSameForTheCookieAndTheExpiration(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	response := httptest.NewRecorder()
+	session, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := response.Result().Cookies()[0]; cookie.MaxAge != 90 {
+		t.Fatalf("got a cookie MaxAge of %d, want 90", cookie.MaxAge)
+	}
+	storage.Advance(89 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(session.GetSessionId()) {
+		t.Fatal("session expired before its maximum lifetime")
+	}
+	storage.Advance(2 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if storage.HasSession(session.GetSessionId()) {
+		t.Fatal("session kept past its maximum lifetime")
+	}
+}
+
+func TestWithMaxLifetimeRejectsLessThanASecond(t *testing.T) {
+	for _, maxLifetime := range []time.Duration{0, -time.Minute, time.Millisecond} {
+		if _, _, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(maxLifetime)); err == nil {
+			t.Errorf("maximum lifetime of %v accepted", maxLifetime)
+		}
+	}
+}
+
+func TestConcurrentRequestsOfTheManager(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests sync.WaitGroup
+	for goroutine := 0; goroutine < 16; goroutine++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for request := 0; request < 20; request++ {
+				response := httptest.NewRecorder()
+				started, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				sessionId, sessionRequest := started.GetSessionId(), requestWithCookies(response)
+				session, isNew, err := manager.StartSession(httptest.NewRecorder(), sessionRequest)
+				if err != nil || isNew || session.GetSessionId() != sessionId {
+					t.Errorf("session %s not resumed: new %v, error %v", sessionId, isNew, err)
+					return
+				}
+				if err = session.SetValue("request", request); err != nil {
+					t.Error(err)
+					return
+				}
+				if existed, err := manager.EndSession(httptest.NewRecorder(), sessionRequest); err != nil || !existed {
+					t.Errorf("session %s not ended: existed %v, error %v", sessionId, existed, err)
+					return
+				}
+			}
+		}()
+	}
+	requests.Wait()
+	if count := storage.SessionCount(); count != 0 {
+		t.Fatalf("%d sessions left", count)
+	}
+}
+
+func TestStartSessionSetsNoCookieWhenTheSessionIsNotStored(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	storage.FailInitializeWith(errors.New("storage down"))
+	response := httptest.NewRecorder()
+	if _, _, err = manager.StartSession(response, httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Fatal("session started without being stored")
+	}
+	if cookies := response.Header().Values("Set-Cookie"); len(cookies) != 0 {
+		t.Fatalf("set cookies %q for a session that was not stored", cookies)
+	}
+	if count := storage.SessionCount(); count != 0 {
+		t.Fatalf("storage holds %d sessions, want none", count)
+	}
+}
+
+func TestConcurrentStartSessionsGetDistinctSessions(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	shared := httptest.NewRecorder()
+	sharedSession, _, err := manager.StartSession(shared, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const goroutines = 32
+	started := make(chan string, goroutines)
+	var requests sync.WaitGroup
+	for goroutine := 0; goroutine < goroutines; goroutine++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			response := httptest.NewRecorder()
+			session, isNew, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil))
+			if err != nil || !isNew {
+				t.Errorf("session not started: new %v, error %v", isNew, err)
+				return
+			}
+			if cookies := response.Result().Cookies(); len(cookies) != 1 {
+				t.Errorf("set cookies %v, want the one of the new session", cookies)
+			}
+			started <- session.GetSessionId()
+			resumed, isNew, err := manager.StartSession(httptest.NewRecorder(), requestWithCookies(shared))
+			if err != nil || isNew || resumed.GetSessionId() != sharedSession.GetSessionId() {
+				t.Errorf("shared session not resumed: new %v, error %v", isNew, err)
+			}
+		}()
+	}
+	requests.Wait()
+	close(started)
+	sessionIds := map[string]bool{sharedSession.GetSessionId(): true}
+	for sessionId := range started {
+		if sessionIds[sessionId] {
+			t.Fatalf("session %s started twice", sessionId)
+		}
+		sessionIds[sessionId] = true
+	}
+	if count := storage.SessionCount(); count != goroutines+1 {
+		t.Fatalf("storage holds %d sessions, want %d", count, goroutines+1)
+	}
+}
+
+// BenchmarkStartSessionParallel measures resuming sessions from parallel requests, each of its own session.
+func BenchmarkStartSessionParallel(b *testing.B) {
+	manager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.RunParallel(func(pb *testing.PB) {
+		response := httptest.NewRecorder()
+		if _, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil)); err != nil {
+			b.Error(err)
+			return
+		}
+		request := requestWithCookies(response)
+		for pb.Next() {
+			if _, _, err := manager.StartSession(httptest.NewRecorder(), request); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestWithClockDecidesTheExpirationOfSessions(t *testing.T) {
+	clock := wsmtest.NewManualClock(wsmtest.DefaultStartTime)
+	storage := &memory_storage.MemoryStorage{}
+	manager, err := wsm.NewSessionManagerWithStorage(storage, "session", wsm.WithClock(clock), wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	session, _, err := manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.CreatedAt().Equal(wsmtest.DefaultStartTime) || !session.LastAccessedAt().Equal(wsmtest.DefaultStartTime) {
+		t.Fatalf("session stamped %v and %v, want the time of the clock", session.CreatedAt(), session.LastAccessedAt())
+	}
+	clock.Advance(59 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if _, err = storage.RetrieveSession(session.GetSessionId()); err != nil {
+		t.Fatalf("session expired before its maximum lifetime on the clock: %v", err)
+	}
+	clock.Advance(2 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if _, err = storage.RetrieveSession(session.GetSessionId()); err == nil {
+		t.Fatal("session kept past its maximum lifetime on the clock")
+	}
+}
+
+func TestCreateSessionWithoutARequest(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !storage.HasSession(session.GetSessionId()) {
+		t.Fatal("created session not stored")
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: wsmtest.CookieName, Value: manager.SessionToken(session)})
+	resumed, isNew, err := manager.StartSession(httptest.NewRecorder(), request)
+	if err != nil || isNew || resumed.GetSessionId() != session.GetSessionId() {
+		t.Fatalf("created session not resumed from its token: new %v, error %v", isNew, err)
+	}
+}
+
+// countingObserver is a metrics observer counting the ended sessions.
+type countingObserver struct {
+	ended int64
+}
+
+func (observer *countingObserver) OnStart() {}
+
+func (observer *countingObserver) OnEnd() {
+	atomic.AddInt64(&observer.ended, 1)
+}
+
+func (observer *countingObserver) OnExpire(int) {}
+
+func TestDestroyAHeldSessionWithoutARequest(t *testing.T) {
+	observer := &countingObserver{}
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMetricsObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionId, request := requestWithSession(t, manager)
+	session, err := manager.LookupSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := manager.Subscribe()
+	defer unsubscribe()
+	if err = manager.Destroy(session); err != nil {
+		t.Fatal(err)
+	}
+	if storage.HasSession(sessionId) {
+		t.Fatal("destroyed session still stored")
+	}
+	if received := receivedEvents(events); len(received) != 1 || received[0].Kind != wsm.SessionDestroyed || received[0].SessionId != sessionId {
+		t.Fatalf("received %v, want the destruction of %s", received, sessionId)
+	}
+	if ended := atomic.LoadInt64(&observer.ended); ended != 1 {
+		t.Fatalf("observed %d ended sessions, want 1", ended)
+	}
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), request); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for the cookie of the destroyed session, want SessionNotExist", err)
+	}
+	if err = manager.Destroy(session); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v destroying the session again, want SessionNotExist", err)
+	}
+	if ended := atomic.LoadInt64(&observer.ended); ended != 1 {
+		t.Fatalf("observed %d ended sessions once destroyed again, want 1", ended)
+	}
+}
+
+func TestTouchMovesTheLastAccessTime(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionId, request := requestWithSession(t, manager)
+	storage.Advance(45 * time.Second)
+	if err = manager.Touch(request); err != nil {
+		t.Fatal(err)
+	}
+	data, err := storage.ExportSession(sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := wsmtest.DefaultStartTime.Add(45 * time.Second); !data.LastAccessTime.Equal(want) {
+		t.Fatalf("last access time is %v once touched, want %v", data.LastAccessTime, want)
+	}
+	storage.Advance(45 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(sessionId) {
+		t.Fatal("touched session expired before the maximum lifetime since touched")
+	}
+	if err = storage.DestroySession(sessionId); err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.Touch(request); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v touching a missing session, want SessionNotExist", err)
+	}
+	if err = manager.Touch(httptest.NewRequest("GET", "/", nil)); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v touching without a cookie, want SessionNotExist", err)
+	}
+}
+
+func TestRefreshSessionExtendsTheSessionAndItsCookie(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	sessionId, request := requestWithSession(t, manager)
+	storage.Advance(50 * time.Second)
+	response := httptest.NewRecorder()
+	session, err := manager.RefreshSession(response, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.GetSessionId() != sessionId || !session.LastAccessedAt().Equal(storage.Clock.Now()) {
+		t.Fatalf("got session %s last accessed at %v, want %s refreshed now", session.GetSessionId(), session.LastAccessedAt(), sessionId)
+	}
+	if cookies := response.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge != 60 {
+		t.Fatalf("got cookies %v, want the session cookie of MaxAge 60", cookies)
+	}
+	storage.Advance(50 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(sessionId) {
+		t.Fatal("refreshed session expired from its previous last access")
+	}
+	if _, err = manager.RefreshSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v without a session, want SessionNotExist", err)
+	}
+}
+
+func TestPingOfAFreshFileStorageMediaSucceeds(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "not", "created", "yet")
+	manager, err := wsm.NewSessionManagerWithStorage(&file_storage.FileStorage{Directory: directory}, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	if err = manager.Ping(context.Background()); err != nil {
+		t.Fatalf("fresh storage media not reached before its first session: %v", err)
+	}
+}
+
+func TestPingReachesTheStorageMediaThroughItsWrappers(t *testing.T) {
+	directory := t.TempDir()
+	manager, err := wsm.NewSessionManagerWithStorage(&file_storage.FileStorage{Directory: directory}, "session",
+		wsm.WithNamespace("tenant"), wsm.WithHashedStorageKeys(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.Ping(context.Background()); err != nil {
+		t.Fatalf("storage media not reached: %v", err)
+	}
+	if err = os.RemoveAll(directory); err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.Ping(context.Background()); err == nil {
+		t.Fatal("removed sessions directory reported as reachable")
+	}
+}
+
+func TestListSessionsEnumeratesTheStoredSessions(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	if sessionIds, err := manager.ListSessions(); err != nil || len(sessionIds) != 0 {
+		t.Fatalf("got %v, %v without any session, want no session", sessionIds, err)
+	}
+	started := startSessions(t, manager, 3)
+	if err = storage.DestroySession(started[2]); err != nil {
+		t.Fatal(err)
+	}
+	sessionIds, err := manager.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(sessionIds)
+	want := started[:2]
+	sort.Strings(want)
+	if !reflect.DeepEqual(sessionIds, want) {
+		t.Fatalf("listed %v, want the sessions still stored %v", sessionIds, want)
+	}
+}
+
+func TestStartSessionReportsWhetherTheSessionIsNew(t *testing.T) {
+	manager, _, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	response := httptest.NewRecorder()
+	session, isNew, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil))
+	if err != nil || !isNew {
+		t.Fatalf("got new %v and error %v without a cookie, want a new session", isNew, err)
+	}
+	resumed, isNew, err := manager.StartSession(httptest.NewRecorder(), requestWithCookies(response))
+	if err != nil || isNew || resumed.GetSessionId() != session.GetSessionId() {
+		t.Fatalf("got new %v and error %v with the cookie of the session, want it resumed", isNew, err)
+	}
+}
+
+func TestCreatedAtIsKeptWhileLastAccessedAtMoves(t *testing.T) {
+	clock := wsmtest.NewManualClock(wsmtest.DefaultStartTime)
+	manager, err := wsm.NewSessionManagerWithStorage(&file_storage.FileStorage{Directory: t.TempDir()}, "session",
+		wsm.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	response := httptest.NewRecorder()
+	session, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(5 * time.Minute)
+	resumed, _, err := manager.StartSession(httptest.NewRecorder(), requestWithCookies(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.CreatedAt().Equal(wsmtest.DefaultStartTime) {
+		t.Fatalf("resumed session created at %v, want %v", resumed.CreatedAt(), wsmtest.DefaultStartTime)
+	}
+	if want := wsmtest.DefaultStartTime.Add(5 * time.Minute); !resumed.LastAccessedAt().Equal(want) {
+		t.Fatalf("resumed session last accessed at %v, want %v", resumed.LastAccessedAt(), want)
+	}
+	if session.GetSessionId() != resumed.GetSessionId() {
+		t.Fatal("session not resumed from its cookie")
+	}
+}
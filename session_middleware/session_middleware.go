@@ -0,0 +1,60 @@
+// Package session_middleware provides a standard func(http.Handler) http.Handler middleware starting the session
+// of each request with a SessionManager, and carrying it in the request context, as mounted by routers such as
+// chi's Router.Use or gorilla/mux's Router.Use.
+package session_middleware
+
+import (
+	"context"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"net/http"
+)
+
+// contextKey is the type of the key the session is carried under in the request context,
+// unexported so no other package can collide with it.
+type contextKey struct{}
+
+// sessionContextKey is the key the session is carried under in the request context.
+var sessionContextKey = contextKey{}
+
+// WithSession is a function that returns a middleware starting the session of each request with the manager,
+// setting its cookie like SessionManager.StartSession, and passing the request on to the next handler
+// with the session in its context, to be retrieved with MustSession or SessionFromContext.
+// If the session could not be started, it responds with a 500 Internal Server Error
+// without calling the next handler.
+func WithSession(manager *wsm.SessionManager) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			session, _, err := manager.StartSession(response, request)
+			if err != nil {
+				http.Error(response, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(response, request.WithContext(NewContext(request.Context(), session)))
+		})
+	}
+}
+
+// NewContext is a function that returns a copy of the context carrying the session,
+// e.g. to call handlers mounted behind WithSession in tests.
+func NewContext(ctx context.Context, session abstract_definition.Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, session)
+}
+
+// SessionFromContext is a function that returns the session carried by the context,
+// and reports whether there's one.
+func SessionFromContext(ctx context.Context) (abstract_definition.Session, bool) {
+	session, found := ctx.Value(sessionContextKey).(abstract_definition.Session)
+	return session, found
+}
+
+// MustSession is a function that returns the session carried by the context of a request handled behind WithSession.
+// It panics if the request has no session, which only happens when the WithSession middleware isn't installed
+// in front of the handler, a programming error rather than a condition to handle at run time.
+func MustSession(request *http.Request) abstract_definition.Session {
+	session, found := SessionFromContext(request.Context())
+	if !found {
+		panic("wsm: no session in the request context, the session_middleware.WithSession middleware is not installed")
+	}
+	return session
+}
@@ -0,0 +1,78 @@
+package session_middleware_test
+
+import (
+	"errors"
+	"local/zyrx/backup/session_middleware"
+	"local/zyrx/backup/wsmtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestSessionIsAvailableBehindAChiRouter(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Use(session_middleware.WithSession(manager))
+	var sessionIds []string
+	router.Get("/users/{name}", func(response http.ResponseWriter, request *http.Request) {
+		session := session_middleware.MustSession(request)
+		if err := session.SetValue("name", chi.URLParam(request, "name")); err != nil {
+			t.Error(err)
+		}
+		sessionIds = append(sessionIds, session.GetSessionId())
+	})
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("GET", "/users/alice", nil))
+	if len(sessionIds) != 1 || !storage.HasSession(sessionIds[0]) {
+		t.Fatalf("final handler got sessions %v", sessionIds)
+	}
+	cookies := response.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != wsmtest.CookieName {
+		t.Fatalf("got cookies %v, want the session cookie", cookies)
+	}
+	request := httptest.NewRequest("GET", "/users/bob", nil)
+	request.AddCookie(cookies[0])
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	if len(sessionIds) != 2 || sessionIds[1] != sessionIds[0] {
+		t.Fatalf("second request not served the session of its cookie: %v", sessionIds)
+	}
+	session, err := manager.LookupSession(sessionIds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := session.GetValue("name"); name != "bob" {
+		t.Fatalf("got name %v, want bob", name)
+	}
+}
+
+func TestWithSessionRespondsWithAnErrorWhenTheSessionFails(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.FailInitializeWith(errors.New("storage outage"))
+	router := chi.NewRouter()
+	router.Use(session_middleware.WithSession(manager))
+	router.Get("/", func(http.ResponseWriter, *http.Request) {
+		t.Error("final handler called without a session")
+	})
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest("GET", "/", nil))
+	if response.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want 500", response.Code)
+	}
+}
+
+func TestMustSessionPanicsWithoutTheMiddleware(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("MustSession returned without the middleware installed")
+		}
+	}()
+	session_middleware.MustSession(httptest.NewRequest("GET", "/", nil))
+}
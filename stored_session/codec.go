@@ -0,0 +1,56 @@
+package stored_session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"time"
+)
+
+// Codec encodes and decodes the content of stored sessions, so storage media can keep values of richer types
+// than json allows. Unmarshal decodes the data into the value v points to, as Marshal encoded it.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the Codec encoding stored sessions as json, used by default.
+// Values are retrieved as decoded by encoding/json, meaning numbers become float64,
+// arrays []interface{}, and objects map[string]interface{}.
+type JSONCodec struct{}
+
+// Marshal is a method for JSONCodec that encodes v as json.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal is a method for JSONCodec that decodes json data into the value v points to.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec is the Codec encoding stored sessions with encoding/gob, so values keep their Go types,
+// e.g. structs, integers, and time.Time values, once retrieved.
+// Types stored as values, other than basic types, time.Time, map[string]interface{} and []interface{},
+// must be registered with gob.Register before being stored or retrieved.
+type GobCodec struct{}
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// Marshal is a method for GobCodec that encodes v with encoding/gob.
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Unmarshal is a method for GobCodec that decodes gob data into the value v points to.
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,86 @@
+package stored_session
+
+import (
+	"encoding/gob"
+	"local/zyrx/backup/abstract_definition"
+	"testing"
+	"time"
+)
+
+// point is a struct value type, kept as is by GobCodec once registered.
+type point struct {
+	X, Y int
+}
+
+func init() {
+	gob.Register(point{})
+}
+
+// sessionDataWithValues returns the content of a session holding values of several types.
+func sessionDataWithValues() abstract_definition.SessionData {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	return abstract_definition.SessionData{
+		Id:             "id",
+		CreatedAt:      now,
+		LastAccessTime: now,
+		Values: map[interface{}]interface{}{
+			"point":  point{1, 2},
+			"count":  3,
+			"time":   now,
+			"nested": map[string]interface{}{"key": "value"},
+		},
+		Expiry: time.Hour,
+		UserID: "user",
+	}
+}
+
+func TestGobCodecKeepsValueTypes(t *testing.T) {
+	data := sessionDataWithValues()
+	encodedData, err := MarshalSessionDataWith(GobCodec{}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalSessionDataWith(GobCodec{}, encodedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Values["point"] != (point{1, 2}) {
+		t.Errorf("got point %#v", decoded.Values["point"])
+	}
+	if decoded.Values["count"] != 3 {
+		t.Errorf("got count %#v, want the int 3", decoded.Values["count"])
+	}
+	if decodedTime, isTime := decoded.Values["time"].(time.Time); !isTime || !decodedTime.Equal(data.CreatedAt) {
+		t.Errorf("got time %#v", decoded.Values["time"])
+	}
+	if nested, isMap := decoded.Values["nested"].(map[string]interface{}); !isMap || nested["key"] != "value" {
+		t.Errorf("got nested %#v", decoded.Values["nested"])
+	}
+	if !decoded.CreatedAt.Equal(data.CreatedAt) || decoded.Expiry != data.Expiry || decoded.UserID != data.UserID {
+		t.Errorf("session fields not kept: %+v", decoded)
+	}
+}
+
+func TestJSONCodecDecodesValuesAsJSON(t *testing.T) {
+	encodedValues, err := MarshalSessionValuesWith(JSONCodec{}, map[interface{}]interface{}{"count": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := UnmarshalSessionValuesWith(JSONCodec{}, encodedValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["count"] != 3.0 {
+		t.Fatalf("got count %#v, want the float64 3", values["count"])
+	}
+}
+
+func TestCodecsDontReadEachOther(t *testing.T) {
+	encodedData, err := MarshalSessionDataWith(GobCodec{}, sessionDataWithValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnmarshalSessionDataWith(JSONCodec{}, encodedData); err == nil {
+		t.Fatal("gob encoded session decoded as json")
+	}
+}
@@ -0,0 +1,134 @@
+package stored_session
+
+import (
+	"local/zyrx/backup/abstract_definition"
+	"time"
+)
+
+// encodedSession is the json representation of the content of a stored session.
+type encodedSession struct {
+	Id             string                 `json:"id"`
+	CreatedAt      time.Time              `json:"created-at"`
+	LastAccessTime time.Time              `json:"last-access-time"`
+	Values         map[string]interface{} `json:"values"`
+	Pinned         bool                   `json:"pinned,omitempty"`
+	Expiry         time.Duration          `json:"expiry,omitempty"`
+	UserID         string                 `json:"user-id,omitempty"`
+	Version        int64                  `json:"version,omitempty"`
+}
+
+// MarshalSessionData is a function that encodes the content of a session as json,
+// for storage media persisting whole sessions.
+// It returns an abstract_definition.ErrInvalidKey error if a key is not a string,
+// or an error if a value could not be encoded.
+func MarshalSessionData(data abstract_definition.SessionData) ([]byte, error) {
+	return MarshalSessionDataWith(JSONCodec{}, data)
+}
+
+// MarshalSessionDataWith is a function that encodes the content of a session with the given codec,
+// for storage media persisting whole sessions.
+// It returns an abstract_definition.ErrInvalidKey error if a key is not a string,
+// or an error if a value could not be encoded.
+func MarshalSessionDataWith(codec Codec, data abstract_definition.SessionData) ([]byte, error) {
+	values, err := stringKeyedValues(data.Values)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(encodedSession{
+		Id:             data.Id,
+		CreatedAt:      data.CreatedAt,
+		LastAccessTime: data.LastAccessTime,
+		Values:         values,
+		Pinned:         data.Pinned,
+		Expiry:         data.Expiry,
+		UserID:         data.UserID,
+		Version:        data.Version,
+	})
+}
+
+// UnmarshalSessionData is a function that decodes the content of a session encoded by MarshalSessionData,
+// its values are retrieved as decoded by encoding/json.
+// It returns an error if the content could not be decoded.
+func UnmarshalSessionData(encodedData []byte) (abstract_definition.SessionData, error) {
+	return UnmarshalSessionDataWith(JSONCodec{}, encodedData)
+}
+
+// UnmarshalSessionDataWith is a function that decodes the content of a session encoded by MarshalSessionDataWith
+// with the same codec. It returns an error if the content could not be decoded.
+func UnmarshalSessionDataWith(codec Codec, encodedData []byte) (abstract_definition.SessionData, error) {
+	var storedSession encodedSession
+	if err := codec.Unmarshal(encodedData, &storedSession); err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	return abstract_definition.SessionData{
+		Id:             storedSession.Id,
+		CreatedAt:      storedSession.CreatedAt,
+		LastAccessTime: storedSession.LastAccessTime,
+		Values:         interfaceKeyedValues(storedSession.Values),
+		Pinned:         storedSession.Pinned,
+		Expiry:         storedSession.Expiry,
+		UserID:         storedSession.UserID,
+		Version:        storedSession.Version,
+	}, nil
+}
+
+// MarshalSessionValues is a function that encodes the values of a session as a json object,
+// for storage media persisting the values apart from the rest of the session, such as databases.
+// It returns an abstract_definition.ErrInvalidKey error if a key is not a string,
+// or an error if a value could not be encoded.
+func MarshalSessionValues(values map[interface{}]interface{}) ([]byte, error) {
+	return MarshalSessionValuesWith(JSONCodec{}, values)
+}
+
+// MarshalSessionValuesWith is a function that encodes the values of a session with the given codec,
+// for storage media persisting the values apart from the rest of the session, such as databases.
+// It returns an abstract_definition.ErrInvalidKey error if a key is not a string,
+// or an error if a value could not be encoded.
+func MarshalSessionValuesWith(codec Codec, values map[interface{}]interface{}) ([]byte, error) {
+	stringValues, err := stringKeyedValues(values)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(stringValues)
+}
+
+// UnmarshalSessionValues is a function that decodes the values of a session encoded by MarshalSessionValues,
+// as decoded by encoding/json.
+// It returns an error if the values could not be decoded.
+func UnmarshalSessionValues(encodedValues []byte) (map[interface{}]interface{}, error) {
+	return UnmarshalSessionValuesWith(JSONCodec{}, encodedValues)
+}
+
+// UnmarshalSessionValuesWith is a function that decodes the values of a session encoded by MarshalSessionValuesWith
+// with the same codec. It returns an error if the values could not be decoded.
+func UnmarshalSessionValuesWith(codec Codec, encodedValues []byte) (map[interface{}]interface{}, error) {
+	var values map[string]interface{}
+	if err := codec.Unmarshal(encodedValues, &values); err != nil {
+		return nil, err
+	}
+	return interfaceKeyedValues(values), nil
+}
+
+// stringKeyedValues is a function that converts the values of a session to a map with string keys,
+// so they can be encoded as a json object, it returns an abstract_definition.ErrInvalidKey error
+// if a key is not a string.
+func stringKeyedValues(values map[interface{}]interface{}) (map[string]interface{}, error) {
+	stringValues := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if err := abstract_definition.ValidateKey(key); err != nil {
+			return nil, err
+		}
+		stringValues[key.(string)] = value
+	}
+	return stringValues, nil
+}
+
+// interfaceKeyedValues is a function that converts values decoded from a json object back to
+// the values of a session.
+func interfaceKeyedValues(stringValues map[string]interface{}) map[interface{}]interface{} {
+	values := make(map[interface{}]interface{}, len(stringValues))
+	for key, value := range stringValues {
+		values[key] = value
+	}
+	return values
+}
@@ -0,0 +1,22 @@
+package stored_session
+
+import (
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+)
+
+// SizeChecker is implemented by persisters limiting the size of stored sessions.
+// CheckSessionSize returns an abstract_definition.ErrSessionTooLarge error if the content of a session
+// would exceed the limit once serialized the way the persister stores it.
+type SizeChecker interface {
+	CheckSessionSize(data abstract_definition.SessionData) error
+}
+
+// CheckSize is a function that returns an abstract_definition.ErrSessionTooLarge error if the serialized size
+// of a session exceeds the maximum size, a maximum of zero meaning no limit.
+func CheckSize(size int, maxBytes int64) error {
+	if maxBytes > 0 && int64(size) > maxBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d", abstract_definition.ErrSessionTooLarge, size, maxBytes)
+	}
+	return nil
+}
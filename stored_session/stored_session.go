@@ -0,0 +1,282 @@
+// Package stored_session provides a session for storage media persisting whole sessions, such as files.
+// Its changes are applied by the storage media to the freshly read stored session, then persisted,
+// so sessions retrieved by concurrent requests never overwrite each other's values.
+package stored_session
+
+import (
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// errUnchanged is returned by an update leaving the stored session unchanged, so nothing gets persisted.
+var errUnchanged = errors.New("wsm: stored session unchanged")
+
+// Persister is implemented by storage media to apply a change to a stored session.
+// UpdateSession reads the session belonging to the given ID, applies the update to it, persists it,
+// and returns its new content. It returns a wsm.SessionNotExists error if the session doesn't exist,
+// and the error of the update, without persisting anything, if the update fails.
+// Its clock stamps the last access time of the changes.
+type Persister interface {
+	abstract_definition.Clock
+	UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error)
+}
+
+// StoredSession is a session holding the content of a stored session as last read or written,
+// and the persister applying its changes.
+type StoredSession struct {
+	sync.RWMutex
+	data      abstract_definition.SessionData
+	persister Persister
+}
+
+// NewStoredSession is a function that initializes a StoredSession from the content of a stored session,
+// and the persister applying its changes. Without a persister, changes are only applied to the session itself.
+func NewStoredSession(data abstract_definition.SessionData, persister Persister) *StoredSession {
+	if data.Values == nil {
+		data.Values = make(map[interface{}]interface{})
+	}
+	return &StoredSession{data: data, persister: persister}
+}
+
+// update is a method for StoredSession used to apply a change through the persister, incrementing the version
+// of the stored session, and keep its new content.
+func (session *StoredSession) update(change func(data *abstract_definition.SessionData) error) error {
+	update := func(data *abstract_definition.SessionData) error {
+		if err := change(data); err != nil {
+			return err
+		}
+		data.Version++
+		return nil
+	}
+	session.Lock()
+	defer session.Unlock()
+	if session.persister == nil {
+		data := CopySessionData(session.data)
+		err := update(&data)
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		session.data = data
+		return nil
+	}
+	data, err := session.persister.UpdateSession(session.data.Id, update)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	session.data = data
+	return nil
+}
+
+// now is a method for StoredSession that returns the current time of the persister's clock,
+// or of the system without a persister.
+func (session *StoredSession) now() time.Time {
+	if session.persister == nil {
+		return time.Now()
+	}
+	return session.persister.Now()
+}
+
+// SetValue is a method for Session that takes key, value arguments both of type interface{}
+// to set the session's value, and then save this change to the storage media
+// as well as updating the session's last access time.
+// It returns an abstract_definition.ErrInvalidKey error if the key is not a string,
+// an abstract_definition.ErrSessionTooLarge error if the persister limits the size of sessions and the session
+// would exceed it, or the error of the storage media if the change could not be saved.
+func (session *StoredSession) SetValue(key, value interface{}) error {
+	if err := abstract_definition.ValidateKey(key); err != nil {
+		return err
+	}
+	return session.update(func(data *abstract_definition.SessionData) error {
+		data.Values[key] = value
+		data.LastAccessTime = session.now()
+		if sizeChecker, checksSize := session.persister.(SizeChecker); checksSize {
+			return sizeChecker.CheckSessionSize(*data)
+		}
+		return nil
+	})
+}
+
+// GetValue is a method for Session that takes a key argument of type interface{}
+// to retrieve the session's value as last read or written if it exists, otherwise it returns nil.
+func (session *StoredSession) GetValue(key interface{}) interface{} {
+	session.RLock()
+	defer session.RUnlock()
+	return session.data.Values[key]
+}
+
+// GetValueOr is a method for Session that takes key, fallback arguments both of type interface{}
+// to retrieve the session's value as last read or written if it exists, otherwise it returns the fallback.
+// A value explicitly set to nil exists, so it's returned instead of the fallback.
+func (session *StoredSession) GetValueOr(key, fallback interface{}) interface{} {
+	session.RLock()
+	defer session.RUnlock()
+	if value, valueExists := session.data.Values[key]; valueExists {
+		return value
+	}
+	return fallback
+}
+
+// GetValueOk is a method for Session that takes a key argument of type interface{}
+// to retrieve the session's value as last read or written and whether it exists,
+// so a value set to nil is told from a missing key.
+func (session *StoredSession) GetValueOk(key interface{}) (interface{}, bool) {
+	session.RLock()
+	defer session.RUnlock()
+	value, valueExists := session.data.Values[key]
+	return value, valueExists
+}
+
+// Values is a method for Session that returns a copy of all the session's values by key, as last read or written.
+func (session *StoredSession) Values() map[interface{}]interface{} {
+	session.RLock()
+	defer session.RUnlock()
+	return CopySessionData(session.data).Values
+}
+
+// DeleteValue is a method for Session that takes a key argument of type interface{}
+// and delete the session's value stored in the storage media as well as updating the
+// session's last access time.
+// It returns nil for error on a successful deletion, otherwise it returns that error.
+func (session *StoredSession) DeleteValue(key interface{}) error {
+	return session.update(func(data *abstract_definition.SessionData) error {
+		delete(data.Values, key)
+		data.LastAccessTime = session.now()
+		return nil
+	})
+}
+
+// DeleteValueIfExists is a method for Session that takes a key argument of type interface{}
+// and deletes the stored session's value like DeleteValue, reporting whether it existed.
+// Nothing is saved if the key has no value.
+// It returns the error of the storage media if the change could not be saved.
+func (session *StoredSession) DeleteValueIfExists(key interface{}) (bool, error) {
+	var valueExisted bool
+	err := session.update(func(data *abstract_definition.SessionData) error {
+		if _, valueExisted = data.Values[key]; !valueExisted {
+			return errUnchanged
+		}
+		delete(data.Values, key)
+		data.LastAccessTime = session.now()
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return valueExisted, nil
+}
+
+// GetSessionId is a method for Session that retrieves the current session ID
+// calling this method.
+func (session *StoredSession) GetSessionId() string {
+	session.RLock()
+	defer session.RUnlock()
+	return session.data.Id
+}
+
+// CreatedAt is a method for Session that returns when the stored session was created,
+// zero if it was stored before its creation time was recorded.
+func (session *StoredSession) CreatedAt() time.Time {
+	session.RLock()
+	defer session.RUnlock()
+	return session.data.CreatedAt
+}
+
+// LastAccessedAt is a method for Session that returns when the stored session was last accessed, as last read or written.
+func (session *StoredSession) LastAccessedAt() time.Time {
+	session.RLock()
+	defer session.RUnlock()
+	return session.data.LastAccessTime
+}
+
+// SetExpiry is a method for Session that overrides the maximum lifetime of this session only,
+// so it outlives (or expires before) the other sessions. A zero expiry restores the maximum lifetime.
+// It returns an error if the expiry is negative or the change could not be saved.
+func (session *StoredSession) SetExpiry(expiry time.Duration) error {
+	if expiry < 0 {
+		return fmt.Errorf("wsm: session expiry must not be negative, got %v", expiry)
+	}
+	return session.update(func(data *abstract_definition.SessionData) error {
+		data.Expiry = expiry
+		return nil
+	})
+}
+
+// GetAndDelete is a method for Session that takes a key argument of type interface{}
+// and deletes the stored session's value in a single update, returning the deleted value and whether it existed,
+// so across concurrent calls for the same key exactly one observes the value.
+// If the change could not be saved, the value is reported as not existing.
+func (session *StoredSession) GetAndDelete(key interface{}) (interface{}, bool) {
+	var value interface{}
+	var valueExists bool
+	err := session.update(func(data *abstract_definition.SessionData) error {
+		value, valueExists = data.Values[key]
+		if !valueExists {
+			return errUnchanged
+		}
+		delete(data.Values, key)
+		data.LastAccessTime = session.now()
+		return nil
+	})
+	if err != nil {
+		return nil, false
+	}
+	return value, valueExists
+}
+
+// Version is a method for Session that returns the version of the stored session as last read or written.
+func (session *StoredSession) Version() int64 {
+	session.RLock()
+	defer session.RUnlock()
+	return session.data.Version
+}
+
+// CompareAndSwapValue is a method for Session that takes key, old, new arguments all of type interface{}
+// and sets the session's value to new in a single update if the freshly read stored session still holds old
+// for the key, reporting whether it was swapped. Otherwise nothing is saved, and the session keeps the stored
+// content it was compared with, so the value can be read again before retrying.
+// It returns an abstract_definition.ErrInvalidKey error if the key is not a string,
+// an abstract_definition.ErrSessionTooLarge error if the persister limits the size of sessions and the session
+// would exceed it, or the error of the storage media if the change could not be saved.
+func (session *StoredSession) CompareAndSwapValue(key, old, new interface{}) (bool, error) {
+	if err := abstract_definition.ValidateKey(key); err != nil {
+		return false, err
+	}
+	var swapped bool
+	err := session.update(func(data *abstract_definition.SessionData) error {
+		if swapped = reflect.DeepEqual(data.Values[key], old); !swapped {
+			session.data = CopySessionData(*data)
+			return errUnchanged
+		}
+		data.Values[key] = new
+		data.LastAccessTime = session.now()
+		if sizeChecker, checksSize := session.persister.(SizeChecker); checksSize {
+			return sizeChecker.CheckSessionSize(*data)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+// CopySessionData is a function that returns a copy of the content of a session,
+// with its own values map, so changing one doesn't change the other.
+func CopySessionData(data abstract_definition.SessionData) abstract_definition.SessionData {
+	values := make(map[interface{}]interface{}, len(data.Values))
+	for key, value := range data.Values {
+		values[key] = value
+	}
+	data.Values = values
+	return data
+}
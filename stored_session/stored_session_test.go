@@ -0,0 +1,131 @@
+package stored_session
+
+import (
+	"errors"
+	"local/zyrx/backup/abstract_definition"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryPersister is a persister keeping a single stored session in memory, failing its updates with failErr if set.
+type memoryPersister struct {
+	sync.Mutex
+	data    abstract_definition.SessionData
+	failErr error
+}
+
+func (persister *memoryPersister) Now() time.Time {
+	return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+func (persister *memoryPersister) UpdateSession(sessionId string, update func(data *abstract_definition.SessionData) error) (abstract_definition.SessionData, error) {
+	persister.Lock()
+	defer persister.Unlock()
+	if sessionId != persister.data.Id {
+		return abstract_definition.SessionData{}, abstract_definition.SessionNotExist
+	}
+	data := CopySessionData(persister.data)
+	if err := update(&data); err != nil {
+		return abstract_definition.SessionData{}, err
+	}
+	if persister.failErr != nil {
+		return abstract_definition.SessionData{}, persister.failErr
+	}
+	persister.data = data
+	return CopySessionData(data), nil
+}
+
+// retrieve returns a new session of the stored session, as retrieved by a request.
+func (persister *memoryPersister) retrieve() *StoredSession {
+	persister.Lock()
+	defer persister.Unlock()
+	return NewStoredSession(CopySessionData(persister.data), persister)
+}
+
+func TestGetAndDeleteIsObservedOnce(t *testing.T) {
+	persister := &memoryPersister{data: abstract_definition.SessionData{
+		Id:     "id",
+		Values: map[interface{}]interface{}{"nonce": "once"},
+	}}
+	var observed int
+	var observations sync.Mutex
+	var requests sync.WaitGroup
+	for request := 0; request < 16; request++ {
+		session := persister.retrieve()
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			if value, existed := session.GetAndDelete("nonce"); existed {
+				if value != "once" {
+					t.Errorf("GetAndDelete returned %v, want the stored value", value)
+				}
+				observations.Lock()
+				observed++
+				observations.Unlock()
+			}
+		}()
+	}
+	requests.Wait()
+	if observed != 1 {
+		t.Fatalf("%d concurrent GetAndDelete observed the value, want exactly one", observed)
+	}
+}
+
+func TestGetAndDeleteOfAnUnsavedDeleteReportsNoValue(t *testing.T) {
+	persister := &memoryPersister{data: abstract_definition.SessionData{
+		Id:     "id",
+		Values: map[interface{}]interface{}{"nonce": "once"},
+	}}
+	session := persister.retrieve()
+	persister.failErr = errors.New("disk full")
+	if value, existed := session.GetAndDelete("nonce"); value != nil || existed {
+		t.Fatalf("GetAndDelete returned %v, %v for a delete that was not saved, want nil, false", value, existed)
+	}
+	persister.failErr = nil
+	if value, existed := persister.retrieve().GetAndDelete("nonce"); value != "once" || !existed {
+		t.Fatalf("GetAndDelete returned %v, %v once saves succeed again, want the value kept", value, existed)
+	}
+}
+
+func TestGetValueOrFallsBackForMissingKeysOnly(t *testing.T) {
+	persister := &memoryPersister{data: abstract_definition.SessionData{
+		Id:     "id",
+		Values: map[interface{}]interface{}{"theme": "dark", "cleared": nil},
+	}}
+	session := persister.retrieve()
+	if value := session.GetValueOr("theme", "light"); value != "dark" {
+		t.Fatalf("got %v for a stored value, want it", value)
+	}
+	if value := session.GetValueOr("cleared", "light"); value != nil {
+		t.Fatalf("got %v for a value set to nil, want nil", value)
+	}
+	if value := session.GetValueOr("missing", "light"); value != "light" {
+		t.Fatalf("got %v for a missing key, want the fallback", value)
+	}
+}
+
+func TestDeleteValueIfExistsReportsWhetherAValueWasDeleted(t *testing.T) {
+	persister := &memoryPersister{data: abstract_definition.SessionData{
+		Id:     "id",
+		Values: map[interface{}]interface{}{"cart": "items", "draft": "text"},
+	}}
+	session := persister.retrieve()
+	if existed, err := session.DeleteValueIfExists("cart"); err != nil || !existed {
+		t.Fatalf("got %v, %v deleting a stored value", existed, err)
+	}
+	if _, isSet := persister.retrieve().GetValueOk("cart"); isSet {
+		t.Fatal("deleted value still stored")
+	}
+	if existed, err := session.DeleteValueIfExists("cart"); err != nil || existed {
+		t.Fatalf("got %v, %v deleting a missing key", existed, err)
+	}
+	outage := errors.New("storage outage")
+	persister.failErr = outage
+	if existed, err := session.DeleteValueIfExists("draft"); !errors.Is(err, outage) || existed {
+		t.Fatalf("got %v, %v for a delete that could not be saved, want false and the storage error", existed, err)
+	}
+	if _, isSet := persister.retrieve().GetValueOk("draft"); !isSet {
+		t.Fatal("value gone although its delete could not be saved")
+	}
+}
@@ -0,0 +1,96 @@
+package wsm_backup
+
+import (
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+)
+
+// userIndex is a method for SessionManager that returns the user index of its storage media,
+// or an abstract_definition.ErrNotSupported error if the storage media can't associate sessions with users.
+func (manager *SessionManager) userIndex() (abstract_definition.UserIndex, error) {
+	userIndex, indexesUsers := manager.storageMedia.(abstract_definition.UserIndex)
+	if !indexesUsers {
+		return nil, fmt.Errorf("%w: sessions can't be associated with users", abstract_definition.ErrNotSupported)
+	}
+	return userIndex, nil
+}
+
+// SetUserID is a method for SessionManager used to associate a session with a user, e.g. on their login,
+// so a user can have several sessions, one per device, listed by SessionsForUser and destroyed together
+// by DestroySessionsForUser. An empty user ID removes the association.
+// It returns an abstract_definition.ErrNotSupported error if the storage media can't associate sessions with users,
+// or a wsm.SessionNotExists error if the session doesn't exist anymore.
+func (manager *SessionManager) SetUserID(session abstract_definition.Session, userID string) error {
+	manager.RLock()
+	defer manager.RUnlock()
+	userIndex, err := manager.userIndex()
+	if err != nil {
+		return err
+	}
+	return userIndex.SetSessionUserID(session.GetSessionId(), userID)
+}
+
+// SessionsForUser is a method for SessionManager used to retrieve all the sessions associated with a user.
+// Sessions removed while they're being retrieved are skipped.
+// It returns an abstract_definition.ErrNotSupported error if the storage media can't associate sessions with users,
+// or with the WithHashedStorageKeys option, or an error if the sessions could not be retrieved.
+func (manager *SessionManager) SessionsForUser(userID string) ([]abstract_definition.Session, error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	if err := manager.checkSessionIdsKnown("sessions of a user"); err != nil {
+		return nil, err
+	}
+	userIndex, err := manager.userIndex()
+	if err != nil {
+		return nil, err
+	}
+	sessionIds, err := userIndex.UserSessionIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]abstract_definition.Session, 0, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		session, err := keyedStorageMedia(manager.storageMedia).RetrieveSession(sessionId)
+		if errors.Is(err, abstract_definition.SessionNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// DestroySessionsForUser is a method for SessionManager used to destroy all the sessions associated with a user,
+// e.g. to log them out of every device. Sessions already removed are skipped.
+// It returns an abstract_definition.ErrNotSupported error if the storage media can't associate sessions with users,
+// or an error if a session could not be destroyed.
+func (manager *SessionManager) DestroySessionsForUser(userID string) error {
+	manager.RLock()
+	defer manager.RUnlock()
+	userIndex, err := manager.userIndex()
+	if err != nil {
+		return err
+	}
+	sessionIds, err := userIndex.UserSessionIDs(userID)
+	if err != nil {
+		return err
+	}
+	for _, sessionId := range sessionIds {
+		err = keyedStorageMedia(manager.storageMedia).DestroySession(sessionId)
+		if errors.Is(err, abstract_definition.SessionNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		manager.recordStorageKeyAudit(AuditActorApplication, AuditActionDestroy, sessionId)
+		manager.emitSessionEvent(SessionDestroyed, sessionId)
+		if manager.metricsObserver != nil {
+			manager.metricsObserver.OnEnd()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package wsm_backup_test
+
+import (
+	"local/zyrx/backup/wsmtest"
+	"sort"
+	"testing"
+)
+
+func TestSessionsOfAUser(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionIds := startSessions(t, manager, 3)
+	for _, sessionId := range sessionIds[:2] {
+		session, err := manager.LookupSession(sessionId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = manager.SetUserID(session, "user"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions, err := manager.SessionsForUser("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSessionIds := make([]string, len(sessions))
+	for index, session := range sessions {
+		userSessionIds[index] = session.GetSessionId()
+	}
+	sort.Strings(userSessionIds)
+	want := append([]string(nil), sessionIds[:2]...)
+	sort.Strings(want)
+	if len(userSessionIds) != 2 || userSessionIds[0] != want[0] || userSessionIds[1] != want[1] {
+		t.Fatalf("got sessions %v of the user, want %v", userSessionIds, want)
+	}
+	if err = manager.DestroySessionsForUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, err = manager.SessionsForUser("user"); err != nil || len(sessions) != 0 {
+		t.Fatalf("got %d sessions of the user after destroying them, error %v", len(sessions), err)
+	}
+	if count := storage.SessionCount(); count != 1 || !storage.HasSession(sessionIds[2]) {
+		t.Fatalf("%d sessions left, want only the session without a user", count)
+	}
+}
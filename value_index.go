@@ -0,0 +1,31 @@
+package wsm_backup
+
+import (
+	"context"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+)
+
+// FindSessionsByValue is a method for SessionManager used to retrieve the IDs of all the sessions holding a value
+// under a key, e.g. the sessions whose "role" is "admin" on an admin page. Values are compared as encoded
+// by encoding/json, so e.g. a struct matches the object of its exported fields. Opaque tokens of the WithOpaqueTokens
+// option are never listed.
+// It returns an abstract_definition.ErrNotSupported error if the storage media can't query sessions by their values,
+// only the "postgres" one being able to, or with the WithHashedStorageKeys option, or an error if the sessions
+// could not be queried.
+func (manager *SessionManager) FindSessionsByValue(ctx context.Context, key string, value interface{}) ([]string, error) {
+	manager.RLock()
+	defer manager.RUnlock()
+	if err := manager.checkSessionIdsKnown("sessions found by value"); err != nil {
+		return nil, err
+	}
+	valueIndex, indexesValues := manager.storageMedia.(abstract_definition.ValueIndex)
+	if !indexesValues {
+		return nil, fmt.Errorf("%w: sessions can't be queried by their values", abstract_definition.ErrNotSupported)
+	}
+	sessionIds, err := valueIndex.SessionIDsByValue(ctx, key, value)
+	if err != nil {
+		return nil, err
+	}
+	return manager.withoutTokens(sessionIds), nil
+}
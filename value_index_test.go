@@ -0,0 +1,98 @@
+package wsm_backup_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/memory_storage"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// valueIndexedStorage is a memory storage media querying sessions by their values by scanning them all.
+type valueIndexedStorage struct {
+	*memory_storage.MemoryStorage
+}
+
+func (storage valueIndexedStorage) SessionIDsByValue(_ context.Context, key string, value interface{}) ([]string, error) {
+	keys, err := storage.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+	var sessionIds []string
+	for _, sessionKey := range keys {
+		session, err := storage.RetrieveSession(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(session.GetValue(key), value) {
+			sessionIds = append(sessionIds, sessionKey)
+		}
+	}
+	return sessionIds, nil
+}
+
+func TestFindSessionsByValueListsTheSessionsOfTheManager(t *testing.T) {
+	storage := valueIndexedStorage{&memory_storage.MemoryStorage{}}
+	manager, err := wsm.NewSessionManagerWithStorage(storage, "session_values", wsm.WithNamespace("app"), wsm.WithOpaqueTokens(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	other, err := wsm.NewSessionManagerWithStorage(storage, "session_values_other", wsm.WithNamespace("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	var admins []string
+	for _, role := range []string{"admin", "editor", "admin"} {
+		session, _, err := manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = session.SetValue("role", role); err != nil {
+			t.Fatal(err)
+		}
+		// the value the opaque token of the session maps it with
+		if err = session.SetValue("session-id", session.GetSessionId()); err != nil {
+			t.Fatal(err)
+		}
+		if role == "admin" {
+			admins = append(admins, session.GetSessionId())
+		}
+	}
+	otherSession, _, err := other.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = otherSession.SetValue("role", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	found, err := manager.FindSessionsByValue(context.Background(), "role", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(admins)
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, admins) {
+		t.Fatalf("found %v, want the admin sessions of the namespace %v", found, admins)
+	}
+	found, err = manager.FindSessionsByValue(context.Background(), "session-id", admins[0])
+	if err != nil || fmt.Sprint(found) != fmt.Sprint(admins[:1]) {
+		t.Fatalf("found %v, error %v, want the session without its opaque token", found, err)
+	}
+}
+
+func TestFindSessionsByValueIsNotSupportedByOtherStorageMedia(t *testing.T) {
+	manager, err := newStoppedManager(t, "session_unindexed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.FindSessionsByValue(context.Background(), "role", "admin"); !errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Fatalf("got %v, want ErrNotSupported", err)
+	}
+}
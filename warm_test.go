@@ -0,0 +1,67 @@
+package wsm_backup_test
+
+import (
+	"context"
+	"errors"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/wsmtest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarmReportsCorruptSessionsAndDropsExpiredOnes(t *testing.T) {
+	directory := t.TempDir()
+	clock := wsmtest.NewManualClock(wsmtest.DefaultStartTime)
+	logger := &recordingLogger{}
+	manager, err := wsm.NewSessionManagerWithStorage(&file_storage.FileStorage{Directory: directory}, "session",
+		wsm.WithClock(clock), wsm.WithMaxLifetime(time.Minute), wsm.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	corrupt, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptFile := filepath.Join(directory, corrupt.GetSessionId()+".session")
+	if err = os.WriteFile(corruptFile, []byte("not a session"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := manager.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	valid := startSessions(t, manager, 2)
+	loaded, failed, err := manager.Warm(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 2 || failed != 1 {
+		t.Fatalf("loaded %d sessions and failed %d, want the 2 valid ones loaded and the corrupt one failed", loaded, failed)
+	}
+	if _, err = manager.LookupSession(expired.GetSessionId()); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Fatalf("got %v for the expired session, want it terminated", err)
+	}
+	for _, sessionId := range valid {
+		if _, err = manager.LookupSession(sessionId); err != nil {
+			t.Fatalf("valid session %s not kept: %v", sessionId, err)
+		}
+	}
+	if _, err = os.Stat(corruptFile); err != nil {
+		t.Fatalf("corrupt session file not kept for inspection: %v", err)
+	}
+	logger.Lock()
+	defer logger.Unlock()
+	for _, line := range logger.lines {
+		if strings.Contains(line, "could not load a session") {
+			return
+		}
+	}
+	t.Fatalf("logged %q, want the corrupt session", logger.lines)
+}
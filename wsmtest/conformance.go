@@ -0,0 +1,403 @@
+package wsmtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"local/zyrx/backup/abstract_definition"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// RunStorageMediaTests is a function that runs the contract of abstract_definition.StorageMedia as subtests
+// against the storage media built by the factory, so implementations of other storage media can check
+// they behave like the storage media of wsm, e.g. from a test of their own package:
+//
+//	func TestConformance(t *testing.T) {
+//		wsmtest.RunStorageMediaTests(t, func() abstract_definition.StorageMedia {
+//			return mystorage.New(...)
+//		})
+//	}
+//
+// The factory is called once per subtest and must return an empty storage media keeping sessions under
+// the IDs they're initialized with, closed once the subtest ends if it has a Close() error method.
+// Subtests of last access times and expiration need to control time, they're skipped unless the storage media
+// reads the current time from a clock, implementing abstract_definition.ClockSetter.
+func RunStorageMediaTests(t *testing.T, factory func() abstract_definition.StorageMedia) {
+	t.Helper()
+	subtests := []struct {
+		name string
+		test func(t *testing.T, storage abstract_definition.StorageMedia, clock *ManualClock)
+	}{
+		{"MissingSessions", testMissingSessions},
+		{"Values", testValues},
+		{"ValuesArePersisted", testValuesArePersisted},
+		{"InvalidKeys", testInvalidKeys},
+		{"LastAccess", testLastAccess},
+		{"Expiration", testExpiration},
+		{"ExpiryReport", testExpiryReport},
+		{"ConcurrentGetAndDelete", testConcurrentGetAndDelete},
+		{"Destroy", testDestroy},
+		{"ListAndScan", testListAndScan},
+		{"ExportImport", testExportImport},
+		{"Ping", testPing},
+	}
+	for _, subtest := range subtests {
+		subtest := subtest
+		t.Run(subtest.name, func(t *testing.T) {
+			storage := factory()
+			if closer, isCloser := storage.(interface{ Close() error }); isCloser {
+				t.Cleanup(func() { closer.Close() })
+			}
+			var clock *ManualClock
+			if clockSetter, isClockSetter := storage.(abstract_definition.ClockSetter); isClockSetter {
+				clock = NewManualClock(DefaultStartTime)
+				clockSetter.SetClock(clock)
+			}
+			subtest.test(t, storage, clock)
+		})
+	}
+}
+
+// requireClock skips the test if the storage media doesn't read the current time from a clock.
+func requireClock(t *testing.T, clock *ManualClock) {
+	t.Helper()
+	if clock == nil {
+		t.Skip("the storage media doesn't implement abstract_definition.ClockSetter")
+	}
+}
+
+// initialize initializes a session, failing the test otherwise.
+func initialize(t *testing.T, storage abstract_definition.StorageMedia, sessionId string) abstract_definition.Session {
+	t.Helper()
+	session, err := storage.InitializeSession(sessionId)
+	if err != nil {
+		t.Fatalf("could not initialize session %s: %v", sessionId, err)
+	}
+	if id := session.GetSessionId(); id != sessionId {
+		t.Fatalf("initialized session %s reports the ID %s", sessionId, id)
+	}
+	return session
+}
+
+// retrieve retrieves a session, failing the test otherwise.
+func retrieve(t *testing.T, storage abstract_definition.StorageMedia, sessionId string) abstract_definition.Session {
+	t.Helper()
+	session, err := storage.RetrieveSession(sessionId)
+	if err != nil {
+		t.Fatalf("could not retrieve session %s: %v", sessionId, err)
+	}
+	return session
+}
+
+func testMissingSessions(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	operations := map[string]func() error{
+		"RetrieveSession": func() error {
+			_, err := storage.RetrieveSession("missing")
+			return err
+		},
+		"RetrieveSessionAndTouch": func() error {
+			_, err := storage.RetrieveSessionAndTouch("missing")
+			return err
+		},
+		"ExportSession": func() error {
+			_, err := storage.ExportSession("missing")
+			return err
+		},
+		"UpdateSessionLastAccess": func() error { return storage.UpdateSessionLastAccess("missing") },
+		"DestroySession":          func() error { return storage.DestroySession("missing") },
+		"Pin":                     func() error { return storage.Pin("missing") },
+		"Unpin":                   func() error { return storage.Unpin("missing") },
+	}
+	for name, operation := range operations {
+		if err := operation(); !errors.Is(err, abstract_definition.SessionNotExist) {
+			t.Errorf("%s of a missing session returned %v, want abstract_definition.SessionNotExist", name, err)
+		}
+	}
+}
+
+func testValues(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	session := initialize(t, storage, "values")
+	if err := session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	if value := session.GetValue("username"); value != "zyrx" {
+		t.Errorf("GetValue returned %v, want the value set", value)
+	}
+	if value, isSet := session.GetValueOk("missing"); value != nil || isSet {
+		t.Errorf("GetValueOk of a missing key returned %v, %v", value, isSet)
+	}
+	if value := session.GetValueOr("missing", "fallback"); value != "fallback" {
+		t.Errorf("GetValueOr of a missing key returned %v, want the fallback", value)
+	}
+	if swapped, err := session.CompareAndSwapValue("username", "someone else", "swapped"); err != nil || swapped {
+		t.Errorf("CompareAndSwapValue of another value returned %v, %v, want no swap", swapped, err)
+	}
+	if swapped, err := session.CompareAndSwapValue("username", "zyrx", "swapped"); err != nil || !swapped {
+		t.Errorf("CompareAndSwapValue of the value held returned %v, %v, want a swap", swapped, err)
+	}
+	if value, existed := session.GetAndDelete("username"); value != "swapped" || !existed {
+		t.Errorf("GetAndDelete returned %v, %v, want the swapped value", value, existed)
+	}
+	if _, existed := session.GetAndDelete("username"); existed {
+		t.Error("GetAndDelete observed a deleted value")
+	}
+	if err := session.SetValue("theme", "dark"); err != nil {
+		t.Fatal(err)
+	}
+	if existed, err := session.DeleteValueIfExists("theme"); err != nil || !existed {
+		t.Errorf("DeleteValueIfExists of a value returned %v, %v", existed, err)
+	}
+	if existed, err := session.DeleteValueIfExists("theme"); err != nil || existed {
+		t.Errorf("DeleteValueIfExists of a deleted value returned %v, %v", existed, err)
+	}
+	if err := session.DeleteValue("missing"); err != nil {
+		t.Errorf("DeleteValue of a missing key returned %v", err)
+	}
+	if err := session.SetExpiry(-time.Second); err == nil {
+		t.Error("SetExpiry accepted a negative expiry")
+	}
+}
+
+func testValuesArePersisted(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	session := initialize(t, storage, "persisted")
+	if err := session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetValue("cleared", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetValue("deleted", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.DeleteValue("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	retrieved := retrieve(t, storage, "persisted")
+	if value := retrieved.GetValue("username"); value != "zyrx" {
+		t.Errorf("retrieved %v, want the value set", value)
+	}
+	if value, isSet := retrieved.GetValueOk("cleared"); value != nil || !isSet {
+		t.Errorf("retrieved %v, %v for a value set to nil", value, isSet)
+	}
+	if value, isSet := retrieved.GetValueOk("deleted"); isSet {
+		t.Errorf("retrieved the deleted value %v", value)
+	}
+	if values := retrieved.Values(); len(values) != 2 || values["username"] != "zyrx" {
+		t.Errorf("Values returned %v, want the values set and not deleted", values)
+	}
+	if retrieved.Version() == 0 {
+		t.Error("version of a changed session is still zero")
+	}
+}
+
+func testInvalidKeys(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	session := initialize(t, storage, "keys")
+	if err := session.SetValue(42, "value"); !errors.Is(err, abstract_definition.ErrInvalidKey) {
+		t.Errorf("SetValue of a non-string key returned %v, want abstract_definition.ErrInvalidKey", err)
+	}
+	if _, err := session.CompareAndSwapValue(42, nil, "value"); !errors.Is(err, abstract_definition.ErrInvalidKey) {
+		t.Errorf("CompareAndSwapValue of a non-string key returned %v, want abstract_definition.ErrInvalidKey", err)
+	}
+}
+
+func testLastAccess(t *testing.T, storage abstract_definition.StorageMedia, clock *ManualClock) {
+	requireClock(t, clock)
+	createdAt := clock.Now()
+	initialize(t, storage, "accessed")
+	clock.Advance(time.Minute)
+	if err := storage.UpdateSessionLastAccess("accessed"); err != nil {
+		t.Fatal(err)
+	}
+	session := retrieve(t, storage, "accessed")
+	if lastAccess := session.LastAccessedAt(); !lastAccess.Equal(clock.Now()) {
+		t.Errorf("last accessed at %v, want the time of UpdateSessionLastAccess %v", lastAccess, clock.Now())
+	}
+	if created := session.CreatedAt(); !created.Equal(createdAt) {
+		t.Errorf("created at %v, want %v", created, createdAt)
+	}
+	clock.Advance(time.Minute)
+	if _, err := storage.RetrieveSessionAndTouch("accessed"); err != nil {
+		t.Fatal(err)
+	}
+	if lastAccess := retrieve(t, storage, "accessed").LastAccessedAt(); !lastAccess.Equal(clock.Now()) {
+		t.Errorf("last accessed at %v, want the time of RetrieveSessionAndTouch %v", lastAccess, clock.Now())
+	}
+}
+
+func testExpiration(t *testing.T, storage abstract_definition.StorageMedia, clock *ManualClock) {
+	requireClock(t, clock)
+	if lifetimeSetter, isLifetimeSetter := storage.(abstract_definition.LifetimeSetter); isLifetimeSetter {
+		lifetimeSetter.SetMaxLifetime(time.Minute)
+	}
+	initialize(t, storage, "stale")
+	initialize(t, storage, "pinned")
+	if err := storage.Pin("pinned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := initialize(t, storage, "extended").SetExpiry(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	initialize(t, storage, "fresh")
+	terminated, err := storage.TerminateSessionOnExpiration(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terminated != 1 && terminated != 0 {
+		t.Errorf("terminated %d sessions, want the stale one, or zero for storage media expiring sessions by themselves", terminated)
+	}
+	if _, err = storage.RetrieveSession("stale"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Errorf("retrieving an expired session returned %v, want abstract_definition.SessionNotExist", err)
+	}
+	for _, sessionId := range []string{"pinned", "extended", "fresh"} {
+		if _, err = storage.RetrieveSession(sessionId); err != nil {
+			t.Errorf("session %s didn't survive the expiration: %v", sessionId, err)
+		}
+	}
+}
+
+func testExpiryReport(t *testing.T, storage abstract_definition.StorageMedia, clock *ManualClock) {
+	requireClock(t, clock)
+	reporter, isReporter := storage.(abstract_definition.ExpiryReporter)
+	if !isReporter {
+		t.Skip("the storage media doesn't implement abstract_definition.ExpiryReporter")
+	}
+	initialize(t, storage, "stale")
+	clock.Advance(2 * time.Minute)
+	initialize(t, storage, "fresh")
+	expiredIds, err := reporter.TerminateExpiredSessions(time.Minute)
+	if errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Skip("the storage media can't report expired sessions")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiredIds) != 1 || expiredIds[0] != "stale" {
+		t.Errorf("reported %v as expired, want [stale]", expiredIds)
+	}
+	retrieve(t, storage, "fresh")
+}
+
+func testConcurrentGetAndDelete(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	if err := initialize(t, storage, "nonce").SetValue("nonce", "once"); err != nil {
+		t.Fatal(err)
+	}
+	var observed int32
+	var requests sync.WaitGroup
+	for request := 0; request < 16; request++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			session, err := storage.RetrieveSession("nonce")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, existed := session.GetAndDelete("nonce"); existed {
+				atomic.AddInt32(&observed, 1)
+			}
+		}()
+	}
+	requests.Wait()
+	if observed != 1 {
+		t.Errorf("%d concurrent GetAndDelete observed the value, want exactly one", observed)
+	}
+}
+
+func testDestroy(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	initialize(t, storage, "destroyed")
+	initialize(t, storage, "kept")
+	if err := storage.DestroySession("destroyed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.RetrieveSession("destroyed"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Errorf("retrieving a destroyed session returned %v, want abstract_definition.SessionNotExist", err)
+	}
+	retrieve(t, storage, "kept")
+	if err := storage.DestroyAllSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.RetrieveSession("kept"); !errors.Is(err, abstract_definition.SessionNotExist) {
+		t.Errorf("retrieving a session after DestroyAllSessions returned %v, want abstract_definition.SessionNotExist", err)
+	}
+}
+
+func testListAndScan(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	var want []string
+	for index := 0; index < 5; index++ {
+		sessionId := fmt.Sprint("listed", index)
+		initialize(t, storage, sessionId)
+		want = append(want, sessionId)
+	}
+	listed, err := storage.ListSessions()
+	if errors.Is(err, abstract_definition.ErrNotSupported) {
+		t.Skip("the storage media can't list its sessions")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if fmt.Sprint(listed) != fmt.Sprint(want) {
+		t.Errorf("listed %v, want %v", listed, want)
+	}
+	var scanned []string
+	cursor := ""
+	for page := 0; page <= len(want); page++ {
+		ids, next, err := storage.ScanSessions(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) > 2 {
+			t.Fatalf("scanned %d sessions in a page limited to 2", len(ids))
+		}
+		scanned = append(scanned, ids...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprint(scanned) != fmt.Sprint(want) {
+		t.Errorf("scanned %v, want %v in ascending order", scanned, want)
+	}
+	if _, _, err = storage.ScanSessions("", 0); !errors.Is(err, abstract_definition.ErrInvalidScanLimit) {
+		t.Errorf("scanning with a zero limit returned %v, want abstract_definition.ErrInvalidScanLimit", err)
+	}
+}
+
+func testExportImport(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	session := initialize(t, storage, "exported")
+	if err := session.SetValue("username", "zyrx"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Pin("exported"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := storage.ExportSession("exported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Id != "exported" || data.Values["username"] != "zyrx" || !data.Pinned {
+		t.Fatalf("exported %+v, want the session as it was stored", data)
+	}
+	data.Id = "imported"
+	if err = storage.ImportSession(data); err != nil {
+		t.Fatal(err)
+	}
+	imported := retrieve(t, storage, "imported")
+	if value := imported.GetValue("username"); value != "zyrx" {
+		t.Errorf("imported session holds %v, want the exported value", value)
+	}
+	if _, err = storage.ExportSession("exported"); err != nil {
+		t.Errorf("exporting changed the exported session: %v", err)
+	}
+}
+
+func testPing(t *testing.T, storage abstract_definition.StorageMedia, _ *ManualClock) {
+	if err := storage.Ping(context.Background()); err != nil {
+		t.Errorf("Ping returned %v, want the storage media reachable", err)
+	}
+}
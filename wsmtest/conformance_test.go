@@ -0,0 +1,33 @@
+package wsmtest_test
+
+import (
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/bolt_storage"
+	"local/zyrx/backup/file_storage"
+	"local/zyrx/backup/memory_storage"
+	"local/zyrx/backup/wsmtest"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStorageConformance(t *testing.T) {
+	wsmtest.RunStorageMediaTests(t, func() abstract_definition.StorageMedia {
+		return &memory_storage.MemoryStorage{}
+	})
+}
+
+func TestFileStorageConformance(t *testing.T) {
+	wsmtest.RunStorageMediaTests(t, func() abstract_definition.StorageMedia {
+		return &file_storage.FileStorage{Directory: t.TempDir()}
+	})
+}
+
+func TestBoltStorageConformance(t *testing.T) {
+	wsmtest.RunStorageMediaTests(t, func() abstract_definition.StorageMedia {
+		storage, err := bolt_storage.NewBoltStorage(bolt_storage.BoltConfig{Path: filepath.Join(t.TempDir(), "sessions.db")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	})
+}
@@ -0,0 +1,42 @@
+package wsmtest
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultStartTime is the time a ManualClock created by NewFakeStorage starts at, fixed so tests are deterministic.
+var DefaultStartTime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ManualClock is an abstract_definition.Clock whose time only moves when it's advanced or set by hand,
+// so tests make sessions expire without waiting. It's safe for concurrent use.
+type ManualClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+// NewManualClock is a function that initializes a new ManualClock stopped at the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now is a method for ManualClock that returns its current time.
+func (clock *ManualClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+// Advance is a method for ManualClock that moves its current time forward by the given duration.
+func (clock *ManualClock) Advance(duration time.Duration) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// Set is a method for ManualClock that replaces its current time.
+func (clock *ManualClock) Set(now time.Time) {
+	clock.Lock()
+	defer clock.Unlock()
+	clock.now = now
+}
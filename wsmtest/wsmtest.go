@@ -0,0 +1,172 @@
+// Package wsmtest provides a deterministic storage media and clock to test handlers written against
+// a SessionManager, keeping sessions in memory, never touching disk, and failing on demand,
+// and the conformance tests of storage media implementations.
+package wsmtest
+
+import (
+	"context"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/abstract_definition"
+	"local/zyrx/backup/memory_storage"
+	"sync"
+	"time"
+)
+
+// CookieName is the name of the session cookie of the SessionManager created by NewSessionManager.
+const CookieName = "wsmtest_session"
+
+// FakeStorage is a storage media keeping sessions in memory like the memory storage media, on a ManualClock,
+// whose operations can be made to fail with a given error, e.g. to test how handlers deal with storage outages.
+// Failing operations fail until their error is cleared by setting it to nil.
+type FakeStorage struct {
+	*memory_storage.MemoryStorage
+	// Clock is the clock stamping the last access time of sessions and deciding their expiration.
+	Clock         *ManualClock
+	failures      sync.Mutex
+	retrieveErr   error
+	initializeErr error
+	destroyErr    error
+	touchErr      error
+	pingErr       error
+}
+
+// NewFakeStorage is a function that initializes a new empty FakeStorage, its clock stopped at DefaultStartTime.
+func NewFakeStorage() *FakeStorage {
+	storage := &FakeStorage{MemoryStorage: &memory_storage.MemoryStorage{}, Clock: NewManualClock(DefaultStartTime)}
+	storage.MemoryStorage.SetClock(storage.Clock)
+	return storage
+}
+
+// NewSessionManager is a function that initializes a new SessionManager around a new FakeStorage,
+// without registering it on disk, its cookie named CookieName and its clock being the clock of the storage,
+// and returns both. The options are applied after, e.g. to set another maximum lifetime.
+// It returns an error if an option is invalid.
+func NewSessionManager(options ...wsm.Option) (*wsm.SessionManager, *FakeStorage, error) {
+	storage := NewFakeStorage()
+	options = append([]wsm.Option{wsm.WithClock(storage.Clock)}, options...)
+	manager, err := wsm.NewSessionManagerWithStorage(storage, CookieName, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manager, storage, nil
+}
+
+// FailRetrieveWith is a method for FakeStorage that makes RetrieveSession and RetrieveSessionAndTouch
+// return the given error, a nil error making them succeed again.
+func (storage *FakeStorage) FailRetrieveWith(err error) {
+	storage.failures.Lock()
+	defer storage.failures.Unlock()
+	storage.retrieveErr = err
+}
+
+// FailInitializeWith is a method for FakeStorage that makes InitializeSession return the given error,
+// a nil error making it succeed again.
+func (storage *FakeStorage) FailInitializeWith(err error) {
+	storage.failures.Lock()
+	defer storage.failures.Unlock()
+	storage.initializeErr = err
+}
+
+// FailDestroyWith is a method for FakeStorage that makes DestroySession return the given error,
+// a nil error making it succeed again.
+func (storage *FakeStorage) FailDestroyWith(err error) {
+	storage.failures.Lock()
+	defer storage.failures.Unlock()
+	storage.destroyErr = err
+}
+
+// FailTouchWith is a method for FakeStorage that makes UpdateSessionLastAccess return the given error,
+// a nil error making it succeed again.
+func (storage *FakeStorage) FailTouchWith(err error) {
+	storage.failures.Lock()
+	defer storage.failures.Unlock()
+	storage.touchErr = err
+}
+
+// FailPingWith is a method for FakeStorage that makes Ping return the given error,
+// a nil error making it succeed again.
+func (storage *FakeStorage) FailPingWith(err error) {
+	storage.failures.Lock()
+	defer storage.failures.Unlock()
+	storage.pingErr = err
+}
+
+// failure is a method for FakeStorage that returns the current error of an operation.
+func (storage *FakeStorage) failure(err *error) error {
+	storage.failures.Lock()
+	defer storage.failures.Unlock()
+	return *err
+}
+
+// SetClock is a method for FakeStorage that ignores the clock set by SessionManager,
+// its sessions always being on its own ManualClock.
+func (storage *FakeStorage) SetClock(abstract_definition.Clock) {}
+
+// InitializeSession is a method for FakeStorage that creates a new session in memory,
+// or returns the error set by FailInitializeWith.
+func (storage *FakeStorage) InitializeSession(sessionId string) (abstract_definition.Session, error) {
+	if err := storage.failure(&storage.initializeErr); err != nil {
+		return nil, err
+	}
+	return storage.MemoryStorage.InitializeSession(sessionId)
+}
+
+// RetrieveSession is a method for FakeStorage that retrieves a session from memory,
+// or returns the error set by FailRetrieveWith.
+func (storage *FakeStorage) RetrieveSession(sessionId string) (abstract_definition.Session, error) {
+	if err := storage.failure(&storage.retrieveErr); err != nil {
+		return nil, err
+	}
+	return storage.MemoryStorage.RetrieveSession(sessionId)
+}
+
+// RetrieveSessionAndTouch is a method for FakeStorage that retrieves a session from memory and updates
+// its last access time, or returns the error set by FailRetrieveWith.
+func (storage *FakeStorage) RetrieveSessionAndTouch(sessionId string) (abstract_definition.Session, error) {
+	if err := storage.failure(&storage.retrieveErr); err != nil {
+		return nil, err
+	}
+	return storage.MemoryStorage.RetrieveSessionAndTouch(sessionId)
+}
+
+// UpdateSessionLastAccess is a method for FakeStorage that updates the last access time of a session,
+// or returns the error set by FailTouchWith.
+func (storage *FakeStorage) UpdateSessionLastAccess(sessionId string) error {
+	if err := storage.failure(&storage.touchErr); err != nil {
+		return err
+	}
+	return storage.MemoryStorage.UpdateSessionLastAccess(sessionId)
+}
+
+// DestroySession is a method for FakeStorage that deletes a session from memory,
+// or returns the error set by FailDestroyWith.
+func (storage *FakeStorage) DestroySession(sessionId string) error {
+	if err := storage.failure(&storage.destroyErr); err != nil {
+		return err
+	}
+	return storage.MemoryStorage.DestroySession(sessionId)
+}
+
+// Ping is a method for FakeStorage that returns nil, or the error set by FailPingWith.
+func (storage *FakeStorage) Ping(context.Context) error {
+	return storage.failure(&storage.pingErr)
+}
+
+// SessionCount is a method for FakeStorage that returns the number of sessions it holds, expired or not.
+func (storage *FakeStorage) SessionCount() int {
+	sessionIds, _ := storage.ListSessions()
+	return len(sessionIds)
+}
+
+// HasSession is a method for FakeStorage that reports whether it holds the session belonging to the given ID,
+// without updating its last access time.
+func (storage *FakeStorage) HasSession(sessionId string) bool {
+	_, err := storage.MemoryStorage.RetrieveSession(sessionId)
+	return err == nil
+}
+
+// Advance is a method for FakeStorage that moves its clock forward by the given duration,
+// e.g. past the maximum lifetime for sessions to expire on the next SessionsExpirationRoutine.
+func (storage *FakeStorage) Advance(duration time.Duration) {
+	storage.Clock.Advance(duration)
+}
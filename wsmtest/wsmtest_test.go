@@ -0,0 +1,136 @@
+package wsmtest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	wsm "local/zyrx/backup"
+	"local/zyrx/backup/wsmtest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var errOutage = errors.New("storage outage")
+
+// startSession starts a session with the manager and returns a request carrying its cookie.
+func startSession(t *testing.T, manager *wsm.SessionManager) *http.Request {
+	t.Helper()
+	response := httptest.NewRecorder()
+	if _, _, err := manager.StartSession(response, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range response.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	return request
+}
+
+func TestFailInitializeWith(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.FailInitializeWith(errOutage)
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v, want the injected error", err)
+	}
+	storage.FailInitializeWith(nil)
+	startSession(t, manager)
+	if count := storage.SessionCount(); count != 1 {
+		t.Fatalf("got %d sessions, want 1", count)
+	}
+}
+
+func TestFailRetrieveWith(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := startSession(t, manager)
+	storage.FailRetrieveWith(errOutage)
+	if _, _, err = manager.StartSession(httptest.NewRecorder(), request); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v from StartSession, want the injected error", err)
+	}
+	storage.FailRetrieveWith(nil)
+	if _, isNew, err := manager.StartSession(httptest.NewRecorder(), request); err != nil || isNew {
+		t.Fatalf("session not resumed once the failure is cleared: new %v, error %v", isNew, err)
+	}
+}
+
+func TestFailDestroyAndTouchWith(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := startSession(t, manager)
+	storage.FailTouchWith(errOutage)
+	if err = manager.Touch(request); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v from Touch, want the injected error", err)
+	}
+	storage.FailDestroyWith(errOutage)
+	if _, err = manager.EndSession(httptest.NewRecorder(), request); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v from EndSession, want the injected error", err)
+	}
+	if count := storage.SessionCount(); count != 1 {
+		t.Fatalf("got %d sessions after the failed destroy, want 1", count)
+	}
+}
+
+func TestAdvanceExpiresSessions(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager(wsm.WithMaxLifetime(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Stop()
+	session, _, err := manager.StartSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.LastAccessedAt().Equal(wsmtest.DefaultStartTime) {
+		t.Fatalf("session stamped %v, want the start time of the clock", session.LastAccessedAt())
+	}
+	storage.Advance(30 * time.Second)
+	manager.SessionsExpirationRoutine()
+	if !storage.HasSession(session.GetSessionId()) {
+		t.Fatal("session expired before its maximum lifetime")
+	}
+	storage.Advance(time.Minute)
+	manager.SessionsExpirationRoutine()
+	if storage.HasSession(session.GetSessionId()) {
+		t.Fatal("session kept past its maximum lifetime")
+	}
+}
+
+func ExampleFakeStorage_FailRetrieveWith() {
+	manager, storage, _ := wsmtest.NewSessionManager()
+	handler := http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if _, _, err := manager.StartSession(response, request); err != nil {
+			http.Error(response, "try again later", http.StatusServiceUnavailable)
+		}
+	})
+	storage.FailRetrieveWith(errOutage)
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: wsmtest.CookieName, Value: "session"})
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	fmt.Println(response.Code)
+	// Output: 503
+}
+
+func TestFailPingWith(t *testing.T) {
+	manager, storage, err := wsmtest.NewSessionManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.FailPingWith(errOutage)
+	if err = manager.Ping(context.Background()); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v, want the injected error", err)
+	}
+	storage.FailPingWith(nil)
+	if err = manager.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}